@@ -1,25 +1,49 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/adyen/adyen-go-api-library/v11/src/webhook"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
 	"github.com/oklog/ulid/v2"
 	"github.com/urfave/cli/v2"
 
 	"github.com/rotationalio/exchequer/pkg"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
 	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/events"
 	"github.com/rotationalio/exchequer/pkg/exchequer"
+	"github.com/rotationalio/exchequer/pkg/store"
 
 	confire "github.com/rotationalio/confire/usage"
 )
 
+var (
+	conf   config.Config
+	db     *store.Store
+	client api.Client
+)
+
+// The actor recorded in the audit log for changes made by the CLI.
+const cliActor = "exchequer-cli"
+
 func main() {
 	godotenv.Load()
 
@@ -67,11 +91,468 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:     "apikeys",
+			Usage:    "manage api keys for service-to-service access (server must be stopped)",
+			Category: "admin",
+			Before:   openDB,
+			After:    closeDB,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list all api keys including revoked keys",
+					Action: listAPIKeys,
+				},
+				{
+					Name:   "create",
+					Usage:  "create an api key and print its client id and secret",
+					Action: createAPIKey,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "description",
+							Aliases: []string{"d"},
+							Usage:   "a description of the service that uses the key",
+						},
+						&cli.StringSliceFlag{
+							Name:     "scope",
+							Aliases:  []string{"s"},
+							Usage:    "scopes to grant the key (can be specified multiple times)",
+							Required: true,
+						},
+					},
+				},
+				{
+					Name:      "revoke",
+					Usage:     "revoke an api key so it can no longer be used",
+					ArgsUsage: "id [id ...]",
+					Action:    revokeAPIKeys,
+				},
+			},
+		},
+		{
+			Name:     "audit",
+			Usage:    "export and verify the audit log (server must be stopped)",
+			Category: "admin",
+			Before:   openDB,
+			After:    closeDB,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "export",
+					Usage:  "export the audit log as json lines or csv",
+					Action: exportAuditLog,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "out",
+							Aliases: []string{"o"},
+							Usage:   "write the export to the specified path instead of stdout",
+						},
+						&cli.StringFlag{
+							Name:    "format",
+							Aliases: []string{"f"},
+							Usage:   "the format of the export (json or csv)",
+							Value:   "json",
+						},
+					},
+				},
+				{
+					Name:   "verify",
+					Usage:  "verify the hash chain of the audit log to detect tampering",
+					Action: verifyAuditLog,
+				},
+			},
+		},
+		{
+			Name:     "token",
+			Usage:    "issue an access token for the exchequer api signed by the configured keys",
+			Category: "admin",
+			Action:   issueToken,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "subject",
+					Aliases:  []string{"sub"},
+					Usage:    "the user or service the token is issued to",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:    "name",
+					Aliases: []string{"n"},
+					Usage:   "name of the token holder",
+				},
+				&cli.StringFlag{
+					Name:    "email",
+					Aliases: []string{"e"},
+					Usage:   "email address of the token holder",
+				},
+				&cli.StringSliceFlag{
+					Name:    "role",
+					Aliases: []string{"r"},
+					Usage:   "roles to assign the token holder: viewer, support, finance or admin",
+				},
+				&cli.StringSliceFlag{
+					Name:    "permission",
+					Aliases: []string{"p"},
+					Usage:   "permissions to grant the token holder (can be specified multiple times)",
+				},
+				&cli.DurationFlag{
+					Name:    "ttl",
+					Aliases: []string{"t"},
+					Usage:   "expire the token before the configured access duration",
+				},
+			},
+		},
+		{
+			Name:     "maintenance",
+			Usage:    "turn maintenance mode on or off on a running server (kept across restarts)",
+			Category: "admin",
+			Before:   initClient(auth.ScopeMaintenance),
+			Flags:    clientFlags,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "status",
+					Usage:  "show whether the server is in maintenance mode",
+					Action: maintenanceStatus,
+				},
+				{
+					Name:   "on",
+					Usage:  "put the server into maintenance mode",
+					Action: maintenanceOn,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "message",
+							Aliases: []string{"m"},
+							Usage:   "message to show users during maintenance",
+						},
+						&cli.StringFlag{
+							Name:    "eta",
+							Aliases: []string{"e"},
+							Usage:   "when maintenance is expected to end as a duration (e.g. 30m) or RFC3339 timestamp",
+						},
+					},
+				},
+				{
+					Name:   "off",
+					Usage:  "take the server out of maintenance mode",
+					Action: maintenanceOff,
+				},
+			},
+		},
+		// NOTE: there is no invoices command because exchequer does not store invoices
+		// or serve invoice endpoints yet; add it with the invoice API so that it can run
+		// against both the local store and a remote server like the commands below.
+		{
+			Name:     "customers",
+			Usage:    "inspect and fix the stored payment methods of customers",
+			Category: "billing",
+			Before:   openBackend(auth.ScopeCustomersRead, auth.ScopeCustomersWrite),
+			After:    closeDB,
+			Flags:    backendFlags,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "payment-methods",
+					Usage:     "list the stored payment methods of a customer",
+					ArgsUsage: "customer",
+					Action:    listPaymentMethods,
+				},
+				{
+					Name:      "set-default",
+					Usage:     "make a stored payment method the customer's default",
+					ArgsUsage: "customer method",
+					Action:    setDefaultPaymentMethod,
+				},
+				{
+					Name:      "disable-method",
+					Usage:     "delete a stored payment method from adyen so it can no longer be charged",
+					ArgsUsage: "customer method",
+					Action:    disablePaymentMethod,
+				},
+			},
+		},
+		{
+			Name:     "payments",
+			Usage:    "inspect payment events and cancel payments",
+			Category: "billing",
+			Before:   openBackend(auth.ScopePaymentsRead, auth.ScopePaymentsVoid),
+			After:    closeDB,
+			Flags:    backendFlags,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list payment events from the event log (requires --local)",
+					Action: listPayments,
+					Flags:  paymentEventFlags,
+				},
+				{
+					Name:      "cancel",
+					Usage:     "cancel an authorised payment that has not been captured",
+					ArgsUsage: "psp-reference",
+					Action:    cancelPayment,
+				},
+			},
+		},
+		{
+			Name:     "refunds",
+			Usage:    "inspect and issue refunds of captured payments",
+			Category: "billing",
+			Before:   openBackend(auth.ScopePaymentsRead, auth.ScopePaymentsRefund),
+			After:    closeDB,
+			Flags:    backendFlags,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list refund events from the event log (requires --local)",
+					Action: listRefunds,
+					Flags:  paymentEventFlags,
+				},
+				{
+					Name:      "create",
+					Usage:     "refund all or part of a captured payment",
+					ArgsUsage: "psp-reference",
+					Action:    createRefund,
+					Flags: []cli.Flag{
+						&cli.Int64Flag{
+							Name:     "amount",
+							Aliases:  []string{"a"},
+							Usage:    "amount to refund in minor units of the currency",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:     "currency",
+							Aliases:  []string{"c"},
+							Usage:    "three letter currency code of the payment",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:    "reason",
+							Aliases: []string{"r"},
+							Usage:   "reason for the refund",
+						},
+						&cli.StringFlag{
+							Name:    "reference",
+							Aliases: []string{"R"},
+							Usage:   "merchant reference of the refund",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:     "webhooks",
+			Usage:    "inspect and manage outbound webhooks and replay adyen notifications",
+			Category: "billing",
+			Before:   openBackend(auth.ScopeWebhooksRead, auth.ScopeWebhooksWrite, auth.ScopeNotificationsReplay),
+			After:    closeDB,
+			Flags:    backendFlags,
+			Subcommands: []*cli.Command{
+				{
+					Name:   "list",
+					Usage:  "list the registered webhook endpoints",
+					Action: listWebhookEndpoints,
+				},
+				{
+					Name:      "deliveries",
+					Usage:     "list the delivery log of a webhook endpoint",
+					ArgsUsage: "endpoint",
+					Action:    listWebhookDeliveries,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "status",
+							Aliases: []string{"s"},
+							Usage:   "only list deliveries with the status (pending, succeeded or failed)",
+						},
+					},
+				},
+				{
+					Name:      "redeliver",
+					Usage:     "immediately deliver the event of a delivery to its endpoint again",
+					ArgsUsage: "endpoint delivery",
+					Action:    redeliverWebhook,
+				},
+				{
+					Name:   "replay",
+					Usage:  "process stored adyen notifications again through the notification handlers",
+					Action: replayNotifications,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "event-id",
+							Aliases: []string{"e"},
+							Usage:   "replay the notification with the id or that published the billing event with the id",
+						},
+						&cli.StringFlag{
+							Name:    "psp",
+							Aliases: []string{"p"},
+							Usage:   "replay notifications for the payment or modification with the psp reference",
+						},
+						&cli.StringFlag{
+							Name:    "event-code",
+							Aliases: []string{"c"},
+							Usage:   "replay notifications with the adyen event code (e.g. AUTHORISATION)",
+						},
+						&cli.StringFlag{
+							Name:    "since",
+							Aliases: []string{"s"},
+							Usage:   "replay notifications received since a duration ago (e.g. 24h) or an RFC3339 timestamp",
+						},
+						&cli.StringFlag{
+							Name:  "until",
+							Usage: "replay notifications received before a duration ago (e.g. 1h) or an RFC3339 timestamp",
+						},
+						&cli.BoolFlag{
+							Name:    "dead-lettered",
+							Aliases: []string{"d"},
+							Usage:   "only replay notifications that could not be processed",
+						},
+						&cli.BoolFlag{
+							Name:  "republish",
+							Usage: "publish billing events again even if the notifications already published them",
+						},
+						&cli.BoolFlag{
+							Name:    "dry-run",
+							Aliases: []string{"n"},
+							Usage:   "report the state transitions that replaying would make without making them",
+						},
+					},
+				},
+				{
+					Name:      "simulate",
+					Usage:     "post a signed adyen notification to a local server for development",
+					ArgsUsage: "[currency]",
+					Action:    simulateWebhook,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "event",
+							Aliases: []string{"e"},
+							Usage:   "the adyen event code of the notification",
+							Value:   webhook.EventCodeAuthorisation,
+						},
+						&cli.StringFlag{
+							Name:    "psp",
+							Aliases: []string{"p"},
+							Usage:   "psp reference of the notification (random if not specified)",
+						},
+						&cli.StringFlag{
+							Name:    "amount",
+							Aliases: []string{"a"},
+							Usage:   "amount in minor units, optionally followed by the currency (e.g. \"1000 EUR\")",
+							Value:   "0",
+						},
+						&cli.StringFlag{
+							Name:    "currency",
+							Aliases: []string{"c"},
+							Usage:   "currency of the amount if not specified with the amount",
+							Value:   "EUR",
+						},
+						&cli.BoolFlag{
+							Name:  "success",
+							Usage: "whether the notification reports success (use --success=false for failures)",
+							Value: true,
+						},
+						&cli.StringFlag{
+							Name:    "original-reference",
+							Aliases: []string{"o"},
+							Usage:   "psp reference of the original payment of a modification",
+						},
+						&cli.StringFlag{
+							Name:    "merchant-reference",
+							Aliases: []string{"m"},
+							Usage:   "merchant reference of the payment",
+						},
+						&cli.StringFlag{
+							Name:    "payment-method",
+							Aliases: []string{"M"},
+							Usage:   "payment method of the payment",
+							Value:   "visa",
+						},
+						&cli.StringFlag{
+							Name:    "reason",
+							Aliases: []string{"r"},
+							Usage:   "reason of the notification (e.g. why a payment was refused)",
+						},
+						&cli.StringSliceFlag{
+							Name:    "data",
+							Aliases: []string{"D"},
+							Usage:   "additional data of the notification as key=value (can be specified multiple times)",
+						},
+						&cli.BoolFlag{
+							Name:  "live",
+							Usage: "mark the notification as a live notification",
+						},
+						&cli.BoolFlag{
+							Name:  "print",
+							Usage: "print the payload instead of posting it to the server",
+						},
+					},
+				},
+				{
+					Name:      "enable",
+					Usage:     "resume deliveries to a webhook endpoint",
+					ArgsUsage: "endpoint",
+					Action:    enableWebhookEndpoint,
+				},
+				{
+					Name:      "disable",
+					Usage:     "pause deliveries to a webhook endpoint",
+					ArgsUsage: "endpoint",
+					Action:    disableWebhookEndpoint,
+				},
+			},
+		},
 	}
 
 	app.Run(os.Args)
 }
 
+// Flags for commands that connect to a running server.
+var clientFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "endpoint",
+		Aliases: []string{"u"},
+		Usage:   "url of the running exchequer server",
+		Value:   "http://localhost:8204",
+		EnvVars: []string{"EXCHEQUER_ENDPOINT"},
+	},
+	&cli.StringFlag{
+		Name:    "token",
+		Aliases: []string{"t"},
+		Usage:   "access token with the permissions of the command (issued from the configured keys if not specified)",
+		EnvVars: []string{"EXCHEQUER_TOKEN"},
+	},
+}
+
+// Flags for commands that can either connect to a running server or use the database
+// directly when the server is stopped.
+var backendFlags = append([]cli.Flag{
+	&cli.BoolFlag{
+		Name:    "local",
+		Aliases: []string{"l"},
+		Usage:   "use the database directly instead of a running server (server must be stopped)",
+	},
+	&cli.StringFlag{
+		Name:    "format",
+		Aliases: []string{"f"},
+		Usage:   "the format of the output (table or json)",
+		Value:   "table",
+	},
+}, clientFlags...)
+
+// Flags for commands that list payment events from the event log.
+var paymentEventFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "psp",
+		Aliases: []string{"p"},
+		Usage:   "only list events for the payment or modification with the psp reference",
+	},
+	&cli.StringFlag{
+		Name:    "since",
+		Aliases: []string{"s"},
+		Usage:   "only list events created since a duration ago (e.g. 24h) or an RFC3339 timestamp",
+	},
+	&cli.IntFlag{
+		Name:    "limit",
+		Aliases: []string{"n"},
+		Usage:   "maximum number of events to list (0 for no limit)",
+	},
+}
+
 //===========================================================================
 // Server Commands
 //===========================================================================
@@ -145,27 +626,913 @@ func generateTokenKey(c *cli.Context) (err error) {
 	return nil
 }
 
+func issueToken(c *cli.Context) (err error) {
+	var conf config.Config
+	if conf, err = config.New(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var tokens *auth.TokenManager
+	if tokens, err = auth.NewTokenManager(conf.Auth); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	claims := &auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: c.String("subject")},
+		Name:             c.String("name"),
+		Email:            c.String("email"),
+		Roles:            c.StringSlice("role"),
+		Permissions:      c.StringSlice("permission"),
+	}
+
+	if err = auth.ValidateRoles(claims.Roles); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if len(claims.Permissions) > 0 {
+		if err = auth.ValidateScopes(claims.Permissions); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	if ttl := c.Duration("ttl"); ttl > 0 {
+		claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(ttl))
+	}
+
+	var tks string
+	if tks, err = tokens.CreateAccessToken(claims); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Println(tks)
+	return nil
+}
+
+func listAPIKeys(c *cli.Context) (err error) {
+	var keys []*store.APIKey
+	if keys, err = db.ListAPIKeys(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	tabs := tabwriter.NewWriter(os.Stdout, 1, 0, 4, ' ', 0)
+	fmt.Fprintln(tabs, "ID\tClient ID\tDescription\tScopes\tCreated\tRevoked")
+	for _, key := range keys {
+		revoked := ""
+		if key.IsRevoked() {
+			revoked = key.Revoked.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tabs, "%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.ClientID, key.Description, strings.Join(key.Scopes, ","), key.Created.Format(time.RFC3339), revoked)
+	}
+	return tabs.Flush()
+}
+
+func createAPIKey(c *cli.Context) (err error) {
+	var (
+		key    *store.APIKey
+		secret string
+	)
+
+	if key, secret, err = auth.NewAPIKey(c.String("description"), c.StringSlice("scope")); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err = db.CreateAPIKey(key); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Printf("api key %s created; the secret cannot be retrieved again\n", key.ID)
+	fmt.Printf("client id:     %s\n", key.ClientID)
+	fmt.Printf("client secret: %s\n", secret)
+	return nil
+}
+
+func revokeAPIKeys(c *cli.Context) (err error) {
+	if c.NArg() == 0 {
+		return cli.Exit("specify the id of at least one api key to revoke", 1)
+	}
+
+	for _, arg := range c.Args().Slice() {
+		var id ulid.ULID
+		if id, err = ulid.Parse(arg); err != nil {
+			return cli.Exit(fmt.Errorf("could not parse api key id %q: %w", arg, err), 1)
+		}
+
+		if _, err = db.RevokeAPIKey(id); err != nil {
+			return cli.Exit(fmt.Errorf("could not revoke api key %s: %w", id, err), 1)
+		}
+		fmt.Printf("api key %s revoked\n", id)
+	}
+	return nil
+}
+
+func exportAuditLog(c *cli.Context) (err error) {
+	var out io.Writer = os.Stdout
+	if path := c.String("out"); path != "" {
+		var f *os.File
+		if f, err = os.Create(path); err != nil {
+			return cli.Exit(err, 1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	var write func(*api.AuditEntry) error
+	switch format := strings.ToLower(c.String("format")); format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		write = func(entry *api.AuditEntry) error {
+			return encoder.Encode(entry)
+		}
+	case "csv":
+		writer := csv.NewWriter(out)
+		defer writer.Flush()
+
+		if err = writer.Write([]string{"id", "sequence", "timestamp", "actor", "actor_type", "action", "resource", "request_id", "client_ip", "before", "after", "prev_hash", "hash"}); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		write = func(entry *api.AuditEntry) error {
+			return writer.Write([]string{
+				entry.ID,
+				strconv.FormatUint(entry.Sequence, 10),
+				entry.Timestamp.Format(time.RFC3339Nano),
+				entry.Actor,
+				entry.ActorType,
+				entry.Action,
+				entry.Resource,
+				entry.RequestID,
+				entry.ClientIP,
+				string(entry.Before),
+				string(entry.After),
+				entry.PrevHash,
+				entry.Hash,
+			})
+		}
+	default:
+		return cli.Exit(fmt.Errorf("unknown export format %q", format), 1)
+	}
+
+	if err = db.EachAuditEntry(func(entry *store.AuditEntry) error {
+		return write(exchequer.AuditEntryToAPI(entry))
+	}); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return nil
+}
+
+func verifyAuditLog(c *cli.Context) (err error) {
+	var verified uint64
+	if verified, err = db.VerifyAuditLog(); err != nil {
+		return cli.Exit(fmt.Errorf("audit log verification failed after %d entries: %w", verified, err), 1)
+	}
+
+	fmt.Printf("audit log verified: %d entries\n", verified)
+	return nil
+}
+
+func maintenanceStatus(c *cli.Context) (err error) {
+	var mode *api.MaintenanceMode
+	if mode, err = client.MaintenanceMode(c.Context); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return printMaintenanceMode(mode)
+}
+
+func maintenanceOn(c *cli.Context) (err error) {
+	in := &api.MaintenanceMode{
+		Enabled: true,
+		Message: c.String("message"),
+	}
+
+	if eta := c.String("eta"); eta != "" {
+		var ts time.Time
+		if ts, err = parseETA(eta); err != nil {
+			return cli.Exit(err, 1)
+		}
+		in.ETA = &ts
+	}
+
+	var mode *api.MaintenanceMode
+	if mode, err = client.SetMaintenanceMode(c.Context, in); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return printMaintenanceMode(mode)
+}
+
+func maintenanceOff(c *cli.Context) (err error) {
+	var mode *api.MaintenanceMode
+	if mode, err = client.SetMaintenanceMode(c.Context, &api.MaintenanceMode{Enabled: false}); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return printMaintenanceMode(mode)
+}
+
+func printMaintenanceMode(mode *api.MaintenanceMode) error {
+	if !mode.Enabled {
+		fmt.Println("maintenance mode is off")
+		return nil
+	}
+
+	fmt.Println("maintenance mode is on")
+	if mode.Since != nil {
+		fmt.Printf("since:   %s\n", mode.Since.Format(time.RFC3339))
+	}
+	if mode.ETA != nil {
+		fmt.Printf("eta:     %s\n", mode.ETA.Format(time.RFC3339))
+	}
+	if mode.Message != "" {
+		fmt.Printf("message: %s\n", mode.Message)
+	}
+	return nil
+}
+
+// Parses an ETA as a duration from now or as an RFC3339 timestamp.
+func parseETA(eta string) (time.Time, error) {
+	if d, err := time.ParseDuration(eta); err == nil {
+		return time.Now().Add(d), nil
+	}
+
+	ts, err := time.Parse(time.RFC3339, eta)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse eta %q as a duration or RFC3339 timestamp", eta)
+	}
+	return ts, nil
+}
+
+//===========================================================================
+// Billing Commands
+//===========================================================================
+
+func listPaymentMethods(c *cli.Context) (err error) {
+	if c.NArg() != 1 {
+		return cli.Exit("specify the id of the customer", 1)
+	}
+
+	var methods []*api.PaymentMethod
+	if db != nil {
+		// Local records only include the payment methods that Exchequer has seen
+		var local []*store.PaymentMethod
+		if local, err = db.ListPaymentMethods(c.Args().First()); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		methods = make([]*api.PaymentMethod, 0, len(local))
+		for _, pm := range local {
+			methods = append(methods, exchequer.PaymentMethodToAPI(pm))
+		}
+	} else {
+		if methods, err = client.PaymentMethods(c.Context, c.Args().First(), nil).All(); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	return render(c, methods, "ID\tType\tBrand\tLast Four\tExpiry\tDefault\tDisabled", func(pm *api.PaymentMethod) []any {
+		var expiry string
+		if pm.ExpiryMonth != "" || pm.ExpiryYear != "" {
+			expiry = pm.ExpiryMonth + "/" + pm.ExpiryYear
+		}
+		return []any{pm.ID, pm.Type, pm.Brand, pm.LastFour, expiry, pm.Default, pm.Disabled}
+	})
+}
+
+func setDefaultPaymentMethod(c *cli.Context) (err error) {
+	if c.NArg() != 2 {
+		return cli.Exit("specify the id of the customer and of the payment method", 1)
+	}
+
+	customerID, methodID := c.Args().Get(0), c.Args().Get(1)
+
+	var out *api.PaymentMethod
+	if db != nil {
+		var before, after *store.PaymentMethod
+		if before, err = db.RetrievePaymentMethod(customerID, methodID); err != nil {
+			return cli.Exit(fmt.Errorf("could not retrieve payment method %s: %w", methodID, err), 1)
+		}
+
+		if after, err = db.SetDefaultPaymentMethod(customerID, methodID); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		if err = auditLocal(exchequer.AuditPaymentMethodDefault, "customers/"+customerID+"/payment-methods/"+methodID, before, after); err != nil {
+			return cli.Exit(err, 1)
+		}
+		out = exchequer.PaymentMethodToAPI(after)
+	} else {
+		if out, err = client.SetDefaultPaymentMethod(c.Context, customerID, methodID); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	return render(c, []*api.PaymentMethod{out}, "ID\tCustomer\tDefault", func(pm *api.PaymentMethod) []any {
+		return []any{pm.ID, pm.CustomerID, pm.Default}
+	})
+}
+
+func disablePaymentMethod(c *cli.Context) (err error) {
+	if c.NArg() != 2 {
+		return cli.Exit("specify the id of the customer and of the payment method", 1)
+	}
+
+	if err = requireServer("disabling a payment method"); err != nil {
+		return err
+	}
+
+	var out *api.PaymentMethod
+	if out, err = client.DisablePaymentMethod(c.Context, c.Args().Get(0), c.Args().Get(1)); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	return render(c, []*api.PaymentMethod{out}, "ID\tCustomer\tDisabled", func(pm *api.PaymentMethod) []any {
+		return []any{pm.ID, pm.CustomerID, pm.Disabled}
+	})
+}
+
+func listPayments(c *cli.Context) error {
+	return listPaymentEvents(c, "payment.*", "dispute.*")
+}
+
+func listRefunds(c *cli.Context) error {
+	return listPaymentEvents(c, events.PaymentRefunded, events.PaymentRefundFailed)
+}
+
+// Lists the events in the event log that match the event type filters and the flags of
+// the command. The payment events are only available from the local database.
+func listPaymentEvents(c *cli.Context, filters ...string) (err error) {
+	if err = requireLocal("listing payment events"); err != nil {
+		return err
+	}
+
+	var since time.Time
+	if flag := c.String("since"); flag != "" {
+		if since, err = parseSince(flag); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	type paymentEvent struct {
+		*api.Event
+		payment *api.PaymentEvent
+	}
+
+	psp, limit := c.String("psp"), c.Int("limit")
+	matches := make([]paymentEvent, 0)
+	err = db.EachEvent(ulid.ULID{}, func(event *store.Event) error {
+		if !events.Match(filters, event.Type) || event.Created.Before(since) {
+			return nil
+		}
+
+		payment := &api.PaymentEvent{}
+		if err := json.Unmarshal(event.Data, payment); err != nil {
+			return fmt.Errorf("could not parse data of event %s: %w", event.ID, err)
+		}
+
+		if psp != "" && payment.PSPReference != psp && payment.OriginalReference != psp {
+			return nil
+		}
+
+		matches = append(matches, paymentEvent{
+			Event:   &api.Event{ID: event.ID.String(), Type: event.Type, Created: event.Created, Data: event.Data},
+			payment: payment,
+		})
+
+		if limit > 0 && len(matches) >= limit {
+			return errStopIteration
+		}
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, errStopIteration) {
+		return cli.Exit(err, 1)
+	}
+
+	return render(c, matches, "Event ID\tType\tCreated\tPSP Reference\tOriginal Reference\tMerchant Reference\tAmount\tReason", func(event paymentEvent) []any {
+		return []any{
+			event.ID, event.Type, formatTime(event.Created),
+			event.payment.PSPReference, event.payment.OriginalReference, event.payment.MerchantReference,
+			formatAmount(event.payment.Amount, event.payment.Currency), event.payment.Reason,
+		}
+	})
+}
+
+func cancelPayment(c *cli.Context) (err error) {
+	if c.NArg() != 1 {
+		return cli.Exit("specify the psp reference of the payment", 1)
+	}
+
+	if err = requireServer("cancelling a payment"); err != nil {
+		return err
+	}
+
+	var out *api.Modification
+	if out, err = client.CancelPayment(c.Context, c.Args().First()); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return renderModification(c, out)
+}
+
+func createRefund(c *cli.Context) (err error) {
+	if c.NArg() != 1 {
+		return cli.Exit("specify the psp reference of the payment", 1)
+	}
+
+	if err = requireServer("refunding a payment"); err != nil {
+		return err
+	}
+
+	in := &api.RefundRequest{
+		Amount:    c.Int64("amount"),
+		Currency:  strings.ToUpper(c.String("currency")),
+		Reason:    c.String("reason"),
+		Reference: c.String("reference"),
+	}
+
+	var out *api.Modification
+	if out, err = client.RefundPayment(c.Context, c.Args().First(), in); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return renderModification(c, out)
+}
+
+func renderModification(c *cli.Context, mod *api.Modification) error {
+	return render(c, []*api.Modification{mod}, "PSP Reference\tPayment\tAmount\tReference\tStatus", func(mod *api.Modification) []any {
+		return []any{mod.PSPReference, mod.PaymentPSPReference, formatAmount(mod.Amount, mod.Currency), mod.Reference, mod.Status}
+	})
+}
+
+func listWebhookEndpoints(c *cli.Context) (err error) {
+	var endpoints []*api.WebhookEndpoint
+	if db != nil {
+		var local []*store.WebhookEndpoint
+		if local, err = db.ListWebhookEndpoints(); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		endpoints = make([]*api.WebhookEndpoint, 0, len(local))
+		for _, endpoint := range local {
+			endpoints = append(endpoints, exchequer.WebhookEndpointToAPI(endpoint, false))
+		}
+	} else {
+		if endpoints, err = client.WebhookEndpoints(c.Context, nil).All(); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	return renderWebhookEndpoints(c, endpoints...)
+}
+
+func listWebhookDeliveries(c *cli.Context) (err error) {
+	if c.NArg() != 1 {
+		return cli.Exit("specify the id of the webhook endpoint", 1)
+	}
+
+	status := c.String("status")
+
+	var deliveries []*api.WebhookDelivery
+	if db != nil {
+		var endpointID ulid.ULID
+		if endpointID, err = ulid.Parse(c.Args().First()); err != nil {
+			return cli.Exit(fmt.Errorf("could not parse webhook endpoint id: %w", err), 1)
+		}
+
+		deliveries = make([]*api.WebhookDelivery, 0)
+		if err = db.EachWebhookDelivery(endpointID, func(delivery *store.WebhookDelivery) error {
+			if status == "" || delivery.Status == status {
+				deliveries = append(deliveries, exchequer.WebhookDeliveryToAPI(delivery))
+			}
+			return nil
+		}); err != nil {
+			return cli.Exit(err, 1)
+		}
+	} else {
+		query := &api.PageQuery{ListFilter: api.ListFilter{Status: status}}
+		if deliveries, err = client.WebhookDeliveries(c.Context, c.Args().First(), query).All(); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	return renderWebhookDeliveries(c, deliveries...)
+}
+
+func redeliverWebhook(c *cli.Context) (err error) {
+	if c.NArg() != 2 {
+		return cli.Exit("specify the id of the webhook endpoint and of the delivery", 1)
+	}
+
+	if err = requireServer("redelivering a webhook"); err != nil {
+		return err
+	}
+
+	var delivery *api.WebhookDelivery
+	if delivery, err = client.ReplayWebhookDelivery(c.Context, c.Args().Get(0), c.Args().Get(1)); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return renderWebhookDeliveries(c, delivery)
+}
+
+func replayNotifications(c *cli.Context) (err error) {
+	if err = requireServer("replaying notifications"); err != nil {
+		return err
+	}
+
+	in := &api.NotificationReplayRequest{
+		EventID:      c.String("event-id"),
+		PSPReference: c.String("psp"),
+		EventCode:    strings.ToUpper(c.String("event-code")),
+		DeadLettered: c.Bool("dead-lettered"),
+		Republish:    c.Bool("republish"),
+		DryRun:       c.Bool("dry-run"),
+	}
+
+	if since := c.String("since"); since != "" {
+		if in.Since, err = parseSince(since); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	if until := c.String("until"); until != "" {
+		if in.Until, err = parseSince(until); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	var out *api.NotificationReplayReply
+	if out, err = client.ReplayNotifications(c.Context, in); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err = render(c, out.Results, "Notification ID\tEvent Code\tPSP Reference\tStatus\tTransitions\tError", func(result *api.NotificationReplayResult) []any {
+		transitions := make([]string, 0, len(result.Transitions))
+		for _, transition := range result.Transitions {
+			desc := transition.Action + " " + transition.Resource
+			if transition.Event != "" {
+				desc += " (" + transition.Event + ")"
+			}
+			transitions = append(transitions, desc)
+		}
+
+		n := result.Notification
+		return []any{n.ID, n.EventCode, n.PSPReference, n.Status, strings.Join(transitions, "; "), result.Error}
+	}); err != nil {
+		return err
+	}
+
+	if out.DryRun && strings.ToLower(c.String("format")) == "table" {
+		fmt.Printf("dry run: %d notifications would be replayed, no changes were made\n", len(out.Results))
+	}
+	return nil
+}
+
+// Posts a notification to the Adyen webhook of a server as Adyen would, signed with
+// the configured HMAC secret and with basic auth if it is configured, so that webhook
+// handling can be tested without routing notifications from Adyen to a local server.
+func simulateWebhook(c *cli.Context) (err error) {
+	if conf, err = config.New(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var (
+		amount   int64
+		currency = c.String("currency")
+	)
+
+	// The currency can be specified with the amount, e.g. --amount 1000 EUR
+	fields := strings.Fields(c.String("amount"))
+	switch {
+	case len(fields) == 2:
+		currency = fields[1]
+	case len(fields) == 1 && c.NArg() == 1:
+		currency = c.Args().First()
+	case len(fields) != 1 || c.NArg() > 1:
+		return cli.Exit("specify the amount in minor units followed by an optional currency", 1)
+	}
+
+	if amount, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return cli.Exit(fmt.Errorf("could not parse amount %q: %w", fields[0], err), 1)
+	}
+
+	now := time.Now()
+	notification := webhook.NotificationRequestItem{
+		Amount:              webhook.Amount{Value: amount, Currency: strings.ToUpper(currency)},
+		EventCode:           strings.ToUpper(c.String("event")),
+		EventDate:           &now,
+		MerchantAccountCode: conf.Adyen.MerchantAccount,
+		MerchantReference:   c.String("merchant-reference"),
+		OriginalReference:   c.String("original-reference"),
+		PaymentMethod:       c.String("payment-method"),
+		PspReference:        c.String("psp"),
+		Reason:              c.String("reason"),
+		Success:             strconv.FormatBool(c.Bool("success")),
+	}
+
+	// Adyen psp references are 16 alphanumeric characters
+	if notification.PspReference == "" {
+		notification.PspReference = ulid.Make().String()[10:]
+	}
+
+	if notification.MerchantReference == "" {
+		notification.MerchantReference = "simulated-" + notification.PspReference
+	}
+
+	additionalData := make(map[string]interface{})
+	for _, data := range c.StringSlice("data") {
+		key, value, ok := strings.Cut(data, "=")
+		if !ok || key == "" {
+			return cli.Exit(fmt.Errorf("could not parse additional data %q as key=value", data), 1)
+		}
+		additionalData[key] = value
+	}
+
+	if secret := conf.Adyen.Webhook.HMACSecret; secret != "" {
+		var signature string
+		if signature, err = exchequer.SignAdyenHMAC(&notification, secret); err != nil {
+			return cli.Exit(err, 1)
+		}
+		additionalData["hmacSignature"] = signature
+	}
+
+	if len(additionalData) > 0 {
+		notification.AdditionalData = &additionalData
+	}
+
+	payload := &webhook.Webhook{
+		Live:              strconv.FormatBool(c.Bool("live")),
+		NotificationItems: &[]webhook.NotificationItem{{NotificationRequestItem: notification}},
+	}
+
+	var body []byte
+	if body, err = json.MarshalIndent(payload, "", "  "); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if c.Bool("print") {
+		fmt.Println(string(body))
+		return nil
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(c.Context, http.MethodPost, strings.TrimSuffix(c.String("endpoint"), "/")+"/v1/adyen/payments", bytes.NewReader(body)); err != nil {
+		return cli.Exit(err, 1)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if conf.Adyen.Webhook.UseBasicAuth {
+		req.SetBasicAuth(conf.Adyen.Webhook.Username, conf.Adyen.Webhook.Password)
+	}
+
+	var rep *http.Response
+	if rep, err = http.DefaultClient.Do(req); err != nil {
+		return cli.Exit(err, 1)
+	}
+	defer rep.Body.Close()
+
+	reply, _ := io.ReadAll(rep.Body)
+	if rep.StatusCode < 200 || rep.StatusCode >= 300 {
+		return cli.Exit(fmt.Errorf("server rejected %s notification %s: %s %s", notification.EventCode, notification.PspReference, rep.Status, bytes.TrimSpace(reply)), 1)
+	}
+
+	fmt.Printf("%s notification %s accepted: %s\n", notification.EventCode, notification.PspReference, rep.Status)
+	return nil
+}
+
+func enableWebhookEndpoint(c *cli.Context) error {
+	return setWebhookEndpointActive(c, true)
+}
+
+func disableWebhookEndpoint(c *cli.Context) error {
+	return setWebhookEndpointActive(c, false)
+}
+
+func setWebhookEndpointActive(c *cli.Context, active bool) (err error) {
+	if c.NArg() != 1 {
+		return cli.Exit("specify the id of the webhook endpoint", 1)
+	}
+
+	var out *api.WebhookEndpoint
+	if db != nil {
+		var (
+			endpointID ulid.ULID
+			endpoint   *store.WebhookEndpoint
+		)
+
+		if endpointID, err = ulid.Parse(c.Args().First()); err != nil {
+			return cli.Exit(fmt.Errorf("could not parse webhook endpoint id: %w", err), 1)
+		}
+
+		if endpoint, err = db.RetrieveWebhookEndpoint(endpointID); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		before := exchequer.WebhookEndpointToAPI(endpoint, false)
+		endpoint.Active = active
+		if err = db.UpdateWebhookEndpoint(endpoint); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		out = exchequer.WebhookEndpointToAPI(endpoint, false)
+		if err = auditLocal(exchequer.AuditWebhookUpdate, "webhooks/"+endpoint.ID.String(), before, out); err != nil {
+			return cli.Exit(err, 1)
+		}
+	} else {
+		var endpoint *api.WebhookEndpoint
+		if endpoint, err = client.WebhookEndpointDetail(c.Context, c.Args().First()); err != nil {
+			return cli.Exit(err, 1)
+		}
+
+		endpoint.Active = active
+		if out, err = client.UpdateWebhookEndpoint(c.Context, endpoint); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	return renderWebhookEndpoints(c, out)
+}
+
+func renderWebhookEndpoints(c *cli.Context, endpoints ...*api.WebhookEndpoint) error {
+	return render(c, endpoints, "ID\tURL\tEvent Types\tActive\tDescription\tCreated", func(endpoint *api.WebhookEndpoint) []any {
+		return []any{endpoint.ID, endpoint.URL, strings.Join(endpoint.EventTypes, ","), endpoint.Active, endpoint.Description, formatTime(endpoint.Created)}
+	})
+}
+
+func renderWebhookDeliveries(c *cli.Context, deliveries ...*api.WebhookDelivery) error {
+	return render(c, deliveries, "ID\tEvent ID\tEvent Type\tStatus\tAttempts\tLast Error\tNext Attempt", func(delivery *api.WebhookDelivery) []any {
+		var lastError, nextAttempt string
+		if n := len(delivery.Attempts); n > 0 {
+			lastError = delivery.Attempts[n-1].Error
+		}
+		if delivery.NextAttempt != nil {
+			nextAttempt = formatTime(*delivery.NextAttempt)
+		}
+		return []any{delivery.ID, delivery.EventID, delivery.EventType, delivery.Status, len(delivery.Attempts), lastError, nextAttempt}
+	})
+}
+
 //===========================================================================
 // Helper Functions
 //===========================================================================
 
-// func openDB(c *cli.Context) (err error) {
-// 	if conf, err = config.New(); err != nil {
-// 		return cli.Exit(err, 1)
-// 	}
-
-// 	if db, err = store.Open(conf.DatabaseURL); err != nil {
-// 		return cli.Exit(err, 1)
-// 	}
-
-// 	return nil
-// }
-
-// func closeDB(c *cli.Context) error {
-// 	if db != nil {
-// 		if err := db.Close(); err != nil {
-// 			return cli.Exit(err, 1)
-// 		}
-// 	}
-// 	return nil
-// }
+func openDB(c *cli.Context) (err error) {
+	if conf, err = config.New(); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if db, err = store.Open(conf.DatabaseURL); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	return nil
+}
+
+// Returns a before func that creates an api client for a running server. If an access
+// token is not specified, a short-lived token with the permissions is issued from the
+// configured keys.
+func initClient(permissions ...string) cli.BeforeFunc {
+	return func(c *cli.Context) (err error) {
+		token := c.String("token")
+		if token == "" {
+			if conf, err = config.New(); err != nil {
+				return cli.Exit(err, 1)
+			}
+
+			var tokens *auth.TokenManager
+			if tokens, err = auth.NewTokenManager(conf.Auth); err != nil {
+				return cli.Exit(err, 1)
+			}
+
+			claims := &auth.Claims{
+				RegisteredClaims: jwt.RegisteredClaims{
+					Subject:   cliActor,
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+				},
+				Permissions: permissions,
+			}
+
+			if token, err = tokens.CreateAccessToken(claims); err != nil {
+				return cli.Exit(err, 1)
+			}
+		}
+
+		if client, err = api.New(c.String("endpoint"), api.WithAccessToken(token), api.WithRetries(api.DefaultRetryPolicy)); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return nil
+	}
+}
+
+// Returns a before func that opens the database if the local flag is specified and
+// otherwise creates an api client for a running server with the permissions.
+func openBackend(permissions ...string) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		if c.Bool("local") {
+			return openDB(c)
+		}
+		return initClient(permissions...)(c)
+	}
+}
+
+func closeDB(c *cli.Context) error {
+	if db != nil {
+		if err := db.Close(); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	return nil
+}
+
+var errStopIteration = errors.New("stop iteration")
+
+// Commands that use the local database only write to it directly when the server is
+// stopped; the changes are recorded in the audit log as the server would record them.
+func auditLocal(action, resource string, before, after any) (err error) {
+	entry := &store.AuditEntry{
+		Actor:     cliActor,
+		ActorType: exchequer.ActorSystem,
+		Action:    action,
+		Resource:  resource,
+	}
+
+	if entry.Before, err = json.Marshal(before); err != nil {
+		return err
+	}
+
+	if entry.After, err = json.Marshal(after); err != nil {
+		return err
+	}
+	return db.AppendAuditEntry(entry)
+}
+
+// Returns an error if the command is not running against the local database.
+func requireLocal(action string) error {
+	if db == nil {
+		return cli.Exit(action+" requires the database: stop the server and specify --local", 1)
+	}
+	return nil
+}
+
+// Returns an error if the command is not running against a server, e.g. because the
+// action requires Adyen.
+func requireServer(action string) error {
+	if client == nil {
+		return cli.Exit(action+" requires a running server: do not specify --local", 1)
+	}
+	return nil
+}
+
+// Prints the items as a table with a row for each item or as JSON if specified by the
+// format flag of the command.
+func render[T any](c *cli.Context, items []T, header string, row func(T) []any) error {
+	switch format := strings.ToLower(c.String("format")); format {
+	case "json":
+		if items == nil {
+			items = make([]T, 0)
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(items); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return nil
+	case "table":
+		tabs := tabwriter.NewWriter(os.Stdout, 1, 0, 4, ' ', 0)
+		fmt.Fprintln(tabs, header)
+		for _, item := range items {
+			cols := row(item)
+			cells := make([]string, 0, len(cols))
+			for _, col := range cols {
+				cells = append(cells, fmt.Sprint(col))
+			}
+			fmt.Fprintln(tabs, strings.Join(cells, "\t"))
+		}
+		return tabs.Flush()
+	default:
+		return cli.Exit(fmt.Errorf("unknown output format %q", format), 1)
+	}
+}
+
+func formatTime(ts time.Time) string {
+	if ts.IsZero() {
+		return ""
+	}
+	return ts.Format(time.RFC3339)
+}
+
+// Amounts are in minor units of the currency.
+func formatAmount(amount int64, currency string) string {
+	if currency == "" {
+		return ""
+	}
+	return fmt.Sprintf("%d %s", amount, currency)
+}
+
+// Parses a time in the past as a duration before now or as an RFC3339 timestamp.
+func parseSince(since string) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	ts, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse since %q as a duration or RFC3339 timestamp", since)
+	}
+	return ts, nil
+}
@@ -1,15 +1,65 @@
 package api
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
 
 //===========================================================================
 // Service Interface
 //===========================================================================
 
 // Client defines the service interface for interacting with the Exchequer service
-// internal API (e.g. the API that users can integrate with).
+// internal API (e.g. the API that users can integrate with). There is a method for every
+// endpoint of the v1 API except the Adyen webhooks, which are only called by Adyen.
+//
+// NOTE: the server does not yet have customer, product, invoice, subscription or usage
+// endpoints; customers are only identified by the shopper reference of their stored
+// payment methods. Methods for these resources are added along with their endpoints.
 type Client interface {
+	// Server status and administration
 	Status(context.Context) (*StatusReply, error)
+	MaintenanceMode(context.Context) (*MaintenanceMode, error)
+	SetMaintenanceMode(context.Context, *MaintenanceMode) (*MaintenanceMode, error)
+
+	// Customer stored payment methods
+	ListPaymentMethods(ctx context.Context, customerID string, query *PageQuery) (*PaymentMethodList, error)
+	PaymentMethods(ctx context.Context, customerID string, query *PageQuery) *Iterator[*PaymentMethod]
+	SetDefaultPaymentMethod(ctx context.Context, customerID, methodID string) (*PaymentMethod, error)
+	DisablePaymentMethod(ctx context.Context, customerID, methodID string) (*PaymentMethod, error)
+	CreateCheckoutLink(ctx context.Context, customerID string, in *CheckoutRequest) (*CheckoutLink, error)
+
+	// Payment modifications
+	RefundPayment(ctx context.Context, pspReference string, in *RefundRequest) (*Modification, error)
+	CancelPayment(ctx context.Context, pspReference string) (*Modification, error)
+
+	// Billing events and outbound webhooks
+	EventStream(context.Context, *EventStreamQuery) (*EventStream, error)
+	ListWebhookEndpoints(context.Context, *PageQuery) (*WebhookEndpointList, error)
+	WebhookEndpoints(context.Context, *PageQuery) *Iterator[*WebhookEndpoint]
+	CreateWebhookEndpoint(context.Context, *WebhookEndpoint) (*WebhookEndpoint, error)
+	WebhookEndpointDetail(ctx context.Context, id string) (*WebhookEndpoint, error)
+	UpdateWebhookEndpoint(context.Context, *WebhookEndpoint) (*WebhookEndpoint, error)
+	DeleteWebhookEndpoint(ctx context.Context, id string) error
+	ListWebhookDeliveries(ctx context.Context, endpointID string, query *PageQuery) (*WebhookDeliveryList, error)
+	WebhookDeliveries(ctx context.Context, endpointID string, query *PageQuery) *Iterator[*WebhookDelivery]
+	ReplayWebhookDelivery(ctx context.Context, endpointID, deliveryID string) (*WebhookDelivery, error)
+
+	// Adyen notifications
+	ReplayNotifications(context.Context, *NotificationReplayRequest) (*NotificationReplayReply, error)
+
+	// API keys
+	ListAPIKeys(context.Context, *PageQuery) (*APIKeyList, error)
+	APIKeys(context.Context, *PageQuery) *Iterator[*APIKey]
+	CreateAPIKey(context.Context, *APIKey) (*APIKey, error)
+	APIKeyDetail(ctx context.Context, id string) (*APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) (*APIKey, error)
+
+	// Audit log
+	ListAuditEntries(context.Context, *AuditQuery) (*AuditLog, error)
+	AuditEntries(context.Context, *AuditQuery) *Iterator[*AuditEntry]
+	VerifyAuditLog(context.Context) (*AuditVerification, error)
 }
 
 //===========================================================================
@@ -23,16 +73,366 @@ type Reply struct {
 	Version string `json:"version,omitempty"`
 }
 
-// Returned on status requests.
+// Returned on status requests. If the server is in maintenance mode the reply includes
+// the message and the estimated time that maintenance will end, if specified. Otherwise
+// the reply includes the results of the checks of the server's dependencies.
 type StatusReply struct {
-	Status  string `json:"status"`
-	Uptime  string `json:"uptime,omitempty"`
-	Version string `json:"version,omitempty"`
+	Status     string             `json:"status"`
+	Uptime     string             `json:"uptime,omitempty"`
+	Version    string             `json:"version,omitempty"`
+	Message    string             `json:"message,omitempty"`
+	ETA        *time.Time         `json:"eta,omitempty"`
+	Components []*ComponentStatus `json:"components,omitempty"`
+}
+
+// Component returns the status of the named component or nil if it was not checked.
+func (s *StatusReply) Component(name string) *ComponentStatus {
+	for _, component := range s.Components {
+		if component.Name == name {
+			return component
+		}
+	}
+	return nil
+}
+
+// ComponentStatus is the result of a health check of a dependency of the server. If a
+// critical component is unavailable the server is not ready to receive traffic, other
+// components only degrade the server. The error is only reported to authenticated
+// callers.
+type ComponentStatus struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Critical bool      `json:"critical"`
+	Error    string    `json:"error,omitempty"`
+	Latency  string    `json:"latency,omitempty"`
+	Checked  time.Time `json:"checked"`
 }
 
-// PageQuery manages paginated list requests.
+// MaintenanceMode describes whether the server is in maintenance mode. Operators set
+// the mode at runtime with an optional message and ETA that are shown to users; the
+// time maintenance started is set by the server and is ignored in requests.
+type MaintenanceMode struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	ETA     *time.Time `json:"eta,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// PageQuery manages paginated list requests. List replies include the tokens of the next
+// and previous pages if there are more results; use an Iterator to follow the tokens.
+// Page tokens are opaque and can only be used with the filters of the first page. The
+// server limits the page size; a page may have fewer results than requested.
 type PageQuery struct {
 	PageSize      int    `json:"page_size,omitempty" url:"page_size,omitempty" form:"page_size"`
 	NextPageToken string `json:"next_page_token" url:"next_page_token,omitempty" form:"next_page_token"`
 	PrevPageToken string `json:"prev_page_token" url:"prev_page_token,omitempty" form:"prev_page_token"`
+	ListFilter
+}
+
+// ListFilter narrows the results of a list request. The created range includes the
+// start and excludes the end. The statuses that can be filtered on depend on the type
+// of result and the customer filter only applies to customer resources; a filter that
+// does not apply to a list is rejected by the server.
+type ListFilter struct {
+	CreatedAfter  time.Time `json:"created_after,omitempty" url:"created_after,omitempty" form:"created_after" time_format:"2006-01-02T15:04:05Z07:00"`
+	CreatedBefore time.Time `json:"created_before,omitempty" url:"created_before,omitempty" form:"created_before" time_format:"2006-01-02T15:04:05Z07:00"`
+	Status        string    `json:"status,omitempty" url:"status,omitempty" form:"status"`
+	CustomerID    string    `json:"customer,omitempty" url:"customer,omitempty" form:"customer"`
+}
+
+//===========================================================================
+// Checkout
+//===========================================================================
+
+// CheckoutQuery starts a checkout session from the checkout page. Without a token the
+// session is a guest checkout; the token of a checkout link associates the session with
+// the customer it was created for, optionally storing the payment method with Adyen so
+// that it can be charged again later.
+type CheckoutQuery struct {
+	Token string `json:"token,omitempty" url:"token,omitempty" form:"token"`
+}
+
+// CheckoutRequest creates a checkout link for a customer; the customer ID is used as
+// the Adyen shopper reference of the checkout session.
+type CheckoutRequest struct {
+	StorePaymentMethod bool `json:"store_payment_method,omitempty"`
+}
+
+// CheckoutLink is a URL of the checkout page with a signed token that starts a checkout
+// session for the customer until the link expires.
+type CheckoutLink struct {
+	CustomerID         string    `json:"customer_id"`
+	URL                string    `json:"url"`
+	StorePaymentMethod bool      `json:"store_payment_method"`
+	Expires            time.Time `json:"expires"`
+}
+
+//===========================================================================
+// Payment Methods
+//===========================================================================
+
+// PaymentMethod is a payment method that Adyen has stored (tokenized) for a customer.
+type PaymentMethod struct {
+	ID          string `json:"id"`
+	CustomerID  string `json:"customer_id"`
+	Type        string `json:"type,omitempty"`
+	Brand       string `json:"brand,omitempty"`
+	Name        string `json:"name,omitempty"`
+	LastFour    string `json:"last_four,omitempty"`
+	ExpiryMonth string `json:"expiry_month,omitempty"`
+	ExpiryYear  string `json:"expiry_year,omitempty"`
+	HolderName  string `json:"holder_name,omitempty"`
+	Default     bool   `json:"default"`
+	Disabled    bool   `json:"disabled"`
+}
+
+type PaymentMethodList struct {
+	PaymentMethods []*PaymentMethod `json:"payment_methods"`
+	NextPageToken  string           `json:"next_page_token,omitempty"`
+	PrevPageToken  string           `json:"prev_page_token,omitempty"`
+}
+
+//===========================================================================
+// Billing Events and Outbound Webhooks
+//===========================================================================
+
+// Event is a billing event that is delivered to registered webhook endpoints. The type
+// of the event determines the structure of the data, e.g. payment events have data that
+// can be decoded into a PaymentEvent.
+type Event struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Created time.Time       `json:"created"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// EventStreamQuery filters the events that are streamed by event type and allows the
+// stream to resume after the specified event ID (the Last-Event-ID header may also be
+// used by clients that reconnect automatically, such as browser EventSources).
+type EventStreamQuery struct {
+	Types       []string `json:"types,omitempty" url:"types,omitempty" form:"types"`
+	LastEventID string   `json:"last_event_id,omitempty" url:"last_event_id,omitempty" form:"last_event_id"`
+}
+
+// PaymentEvent is the data of events that are published from Adyen notifications.
+type PaymentEvent struct {
+	PSPReference      string `json:"psp_reference"`
+	OriginalReference string `json:"original_reference,omitempty"`
+	MerchantReference string `json:"merchant_reference,omitempty"`
+	EventCode         string `json:"event_code"`
+	Success           bool   `json:"success"`
+	Amount            int64  `json:"amount"`
+	Currency          string `json:"currency"`
+	PaymentMethod     string `json:"payment_method,omitempty"`
+	Reason            string `json:"reason,omitempty"`
+	Live              bool   `json:"live"`
+}
+
+// RefundRequest refunds all or part of a captured payment. The amount is specified in
+// minor units of the currency and must not exceed the remaining captured amount.
+type RefundRequest struct {
+	Amount    int64  `json:"amount"`
+	Currency  string `json:"currency"`
+	Reason    string `json:"reason,omitempty"`
+	Reference string `json:"reference,omitempty"`
+}
+
+// Modification is returned when Adyen receives a refund or cancellation request for a
+// payment; the outcome is delivered asynchronously as a payment event.
+type Modification struct {
+	PSPReference        string `json:"psp_reference"`
+	PaymentPSPReference string `json:"payment_psp_reference"`
+	Reference           string `json:"reference,omitempty"`
+	Amount              int64  `json:"amount,omitempty"`
+	Currency            string `json:"currency,omitempty"`
+	Reason              string `json:"reason,omitempty"`
+	Status              string `json:"status"`
+}
+
+// WebhookEndpoint registers an internal service to receive billing events that match
+// the event types filter. The secret is only returned when the endpoint is created.
+type WebhookEndpoint struct {
+	ID          string    `json:"id,omitempty"`
+	URL         string    `json:"url"`
+	Description string    `json:"description,omitempty"`
+	EventTypes  []string  `json:"event_types"`
+	Secret      string    `json:"secret,omitempty"`
+	Active      bool      `json:"active"`
+	Created     time.Time `json:"created,omitempty"`
+	Modified    time.Time `json:"modified,omitempty"`
+}
+
+type WebhookEndpointList struct {
+	Endpoints     []*WebhookEndpoint `json:"endpoints"`
+	NextPageToken string             `json:"next_page_token,omitempty"`
+	PrevPageToken string             `json:"prev_page_token,omitempty"`
+}
+
+// WebhookDelivery is an entry in the delivery log of a webhook endpoint.
+type WebhookDelivery struct {
+	ID          string             `json:"id"`
+	EndpointID  string             `json:"endpoint_id"`
+	EventID     string             `json:"event_id"`
+	EventType   string             `json:"event_type"`
+	Status      string             `json:"status"`
+	Attempts    []*DeliveryAttempt `json:"attempts"`
+	NextAttempt *time.Time         `json:"next_attempt,omitempty"`
+	Created     time.Time          `json:"created"`
+	Modified    time.Time          `json:"modified"`
+}
+
+type DeliveryAttempt struct {
+	Attempted  time.Time `json:"attempted"`
+	Duration   string    `json:"duration"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Replay     bool      `json:"replay,omitempty"`
+}
+
+type WebhookDeliveryList struct {
+	Deliveries    []*WebhookDelivery `json:"deliveries"`
+	NextPageToken string             `json:"next_page_token,omitempty"`
+	PrevPageToken string             `json:"prev_page_token,omitempty"`
+}
+
+//===========================================================================
+// Adyen Notifications
+//===========================================================================
+
+// Notification is a notification that was received from Adyen along with the outcome of
+// processing it. Notifications that could not be processed are dead-lettered (failed)
+// until Adyen retries them or they are replayed.
+type Notification struct {
+	ID                string     `json:"id"`
+	EventCode         string     `json:"event_code"`
+	PSPReference      string     `json:"psp_reference"`
+	OriginalReference string     `json:"original_reference,omitempty"`
+	MerchantReference string     `json:"merchant_reference,omitempty"`
+	Success           bool       `json:"success"`
+	Live              bool       `json:"live"`
+	Status            string     `json:"status"`
+	Error             string     `json:"error,omitempty"`
+	Attempts          int        `json:"attempts"`
+	Replays           int        `json:"replays,omitempty"`
+	EventIDs          []string   `json:"event_ids,omitempty"`
+	Received          time.Time  `json:"received"`
+	Processed         *time.Time `json:"processed,omitempty"`
+}
+
+// NotificationReplayRequest selects the stored notifications to process again; at least
+// one selector is required and notifications must match all of the selectors. The event
+// ID matches the ID of the notification or of a billing event it published. The PSP
+// reference also matches the original reference of modifications. Billing events that
+// a notification has already published are not published again unless republish is
+// set. A dry run reports the transitions that processing the notifications would make
+// without making them.
+type NotificationReplayRequest struct {
+	EventID      string    `json:"event_id,omitempty"`
+	PSPReference string    `json:"psp_reference,omitempty"`
+	EventCode    string    `json:"event_code,omitempty"`
+	Since        time.Time `json:"since,omitempty"`
+	Until        time.Time `json:"until,omitempty"`
+	DeadLettered bool      `json:"dead_lettered,omitempty"`
+	Republish    bool      `json:"republish,omitempty"`
+	DryRun       bool      `json:"dry_run,omitempty"`
+}
+
+type NotificationReplayReply struct {
+	DryRun  bool                        `json:"dry_run"`
+	Results []*NotificationReplayResult `json:"results"`
+}
+
+// NotificationReplayResult is the outcome of replaying a notification. The notification
+// is returned with its status after the replay (unchanged by a dry run) and the error
+// is the error that occurred while processing the notification, if any.
+type NotificationReplayResult struct {
+	Notification *Notification `json:"notification"`
+	Transitions  []*Transition `json:"transitions"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// Transition is a change to the state of a resource made by processing a notification.
+// The action is the audit log action of the change; if a billing event is published,
+// the event is its type and the after state is its data.
+type Transition struct {
+	Resource string          `json:"resource"`
+	Action   string          `json:"action"`
+	Event    string          `json:"event,omitempty"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+}
+
+//===========================================================================
+// API Keys and Audit Log
+//===========================================================================
+
+// APIKey is a client ID and secret used by services to access the API. The client
+// secret is only returned when the key is created.
+type APIKey struct {
+	ID           string     `json:"id,omitempty"`
+	ClientID     string     `json:"client_id,omitempty"`
+	ClientSecret string     `json:"client_secret,omitempty"`
+	Description  string     `json:"description,omitempty"`
+	Scopes       []string   `json:"scopes"`
+	Revoked      *time.Time `json:"revoked,omitempty"`
+	Created      time.Time  `json:"created,omitempty"`
+	Modified     time.Time  `json:"modified,omitempty"`
+}
+
+type APIKeyList struct {
+	APIKeys       []*APIKey `json:"api_keys"`
+	NextPageToken string    `json:"next_page_token,omitempty"`
+	PrevPageToken string    `json:"prev_page_token,omitempty"`
+}
+
+// AuditEntry records who took an action on a resource, when and from where, along with
+// the state of the resource before and after the action. Entries are hash-chained.
+type AuditEntry struct {
+	ID        string          `json:"id"`
+	Sequence  uint64          `json:"sequence"`
+	Actor     string          `json:"actor"`
+	ActorType string          `json:"actor_type"`
+	Action    string          `json:"action"`
+	Resource  string          `json:"resource"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Changes   []*AuditChange  `json:"changes,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	ClientIP  string          `json:"client_ip,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	PrevHash  string          `json:"prev_hash,omitempty"`
+	Hash      string          `json:"hash"`
+}
+
+type AuditChange struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditQuery filters the audit log; resources are matched by prefix so that all of the
+// entries for a type of resource (e.g. payments/) can be queried. The customer filter
+// matches the entries of the customer's resources. Limit is an alias of the page size
+// that is retained for older clients.
+type AuditQuery struct {
+	Actor    string    `json:"actor,omitempty" url:"actor,omitempty" form:"actor"`
+	Action   string    `json:"action,omitempty" url:"action,omitempty" form:"action"`
+	Resource string    `json:"resource,omitempty" url:"resource,omitempty" form:"resource"`
+	Since    time.Time `json:"since,omitempty" url:"since,omitempty" form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until    time.Time `json:"until,omitempty" url:"until,omitempty" form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+	Limit    int       `json:"limit,omitempty" url:"limit,omitempty" form:"limit"`
+	PageQuery
+}
+
+type AuditLog struct {
+	Entries       []*AuditEntry `json:"entries"`
+	NextPageToken string        `json:"next_page_token,omitempty"`
+	PrevPageToken string        `json:"prev_page_token,omitempty"`
+}
+
+// AuditVerification reports whether the hash chain of the audit log is intact.
+type AuditVerification struct {
+	Verified bool   `json:"verified"`
+	Entries  uint64 `json:"entries"`
+	Error    string `json:"error,omitempty"`
 }
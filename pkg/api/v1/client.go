@@ -12,7 +12,9 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/google/go-querystring/query"
 	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/ulids"
 )
 
 // New creates a new APIv1 client that implements the Client interface.
@@ -50,6 +52,10 @@ func New(endpoint string, opts ...ClientOption) (_ Client, err error) {
 type APIv1 struct {
 	endpoint *url.URL     // the base url for all requests
 	client   *http.Client // used to make http requests to the server
+	token    string       // bearer token used to authenticate requests
+	clientID string       // api key client id used to authenticate requests
+	secret   string       // api key secret used to authenticate requests
+	retries  *RetryPolicy // if set, failed requests are retried with backoff
 }
 
 // Ensure the APIv1 implements the Client interface
@@ -88,6 +94,544 @@ func (s *APIv1) Status(ctx context.Context) (out *StatusReply, err error) {
 	return out, nil
 }
 
+const maintenanceEP = "/v1/admin/maintenance"
+
+// MaintenanceMode returns the current maintenance mode of the server.
+func (s *APIv1) MaintenanceMode(ctx context.Context) (out *MaintenanceMode, err error) {
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, maintenanceEP, nil, nil); err != nil {
+		return nil, err
+	}
+
+	out = &MaintenanceMode{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SetMaintenanceMode turns maintenance mode on or off, returning the updated mode.
+func (s *APIv1) SetMaintenanceMode(ctx context.Context, in *MaintenanceMode) (out *MaintenanceMode, err error) {
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPut, maintenanceEP, in, nil); err != nil {
+		return nil, err
+	}
+
+	out = &MaintenanceMode{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//===========================================================================
+// Customer Payment Methods
+//===========================================================================
+
+const customersEP = "/v1/customers"
+
+// ListPaymentMethods returns a page of the payment methods that Adyen has stored for the
+// customer.
+func (s *APIv1) ListPaymentMethods(ctx context.Context, customerID string, in *PageQuery) (out *PaymentMethodList, err error) {
+	if customerID == "" {
+		return nil, ErrMissingID
+	}
+
+	var params url.Values
+	if params, err = query.Values(in); err != nil {
+		return nil, fmt.Errorf("could not encode page query: %w", err)
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, customersEP+"/"+pathEscape(customerID)+"/payment-methods", nil, &params); err != nil {
+		return nil, err
+	}
+
+	out = &PaymentMethodList{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PaymentMethods iterates over all of the payment methods stored for the customer.
+func (s *APIv1) PaymentMethods(ctx context.Context, customerID string, in *PageQuery) *Iterator[*PaymentMethod] {
+	return NewIterator(ctx, in, func(ctx context.Context, in *PageQuery) ([]*PaymentMethod, string, error) {
+		page, err := s.ListPaymentMethods(ctx, customerID, in)
+		if err != nil {
+			return nil, "", err
+		}
+		return page.PaymentMethods, page.NextPageToken, nil
+	})
+}
+
+// SetDefaultPaymentMethod makes the stored payment method the customer's default.
+func (s *APIv1) SetDefaultPaymentMethod(ctx context.Context, customerID, methodID string) (out *PaymentMethod, err error) {
+	if customerID == "" || methodID == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPost, customersEP+"/"+pathEscape(customerID)+"/payment-methods/"+pathEscape(methodID)+"/default", nil, nil); err != nil {
+		return nil, err
+	}
+
+	out = &PaymentMethod{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DisablePaymentMethod deletes the stored payment method from Adyen.
+func (s *APIv1) DisablePaymentMethod(ctx context.Context, customerID, methodID string) (out *PaymentMethod, err error) {
+	if customerID == "" || methodID == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodDelete, customersEP+"/"+pathEscape(customerID)+"/payment-methods/"+pathEscape(methodID), nil, nil); err != nil {
+		return nil, err
+	}
+
+	out = &PaymentMethod{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CreateCheckoutLink creates a link to the checkout page that starts a checkout session
+// for the customer, e.g. to send to the customer to store a payment method.
+func (s *APIv1) CreateCheckoutLink(ctx context.Context, customerID string, in *CheckoutRequest) (out *CheckoutLink, err error) {
+	if customerID == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPost, customersEP+"/"+pathEscape(customerID)+"/checkout", in, nil); err != nil {
+		return nil, err
+	}
+
+	out = &CheckoutLink{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//===========================================================================
+// Payment Modifications
+//===========================================================================
+
+const paymentsEP = "/v1/payments"
+
+// RefundPayment requests that Adyen refunds all or part of a captured payment. The
+// outcome of the refund is delivered asynchronously as a payment event.
+func (s *APIv1) RefundPayment(ctx context.Context, pspReference string, in *RefundRequest) (out *Modification, err error) {
+	if pspReference == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPost, paymentsEP+"/"+pathEscape(pspReference)+"/refunds", in, nil); err != nil {
+		return nil, err
+	}
+
+	out = &Modification{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CancelPayment requests that Adyen voids an authorised payment that has not been
+// captured. The outcome of the cancellation is delivered as a payment event.
+func (s *APIv1) CancelPayment(ctx context.Context, pspReference string) (out *Modification, err error) {
+	if pspReference == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPost, paymentsEP+"/"+pathEscape(pspReference)+"/cancels", nil, nil); err != nil {
+		return nil, err
+	}
+
+	out = &Modification{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//===========================================================================
+// Billing Events and Outbound Webhooks
+//===========================================================================
+
+const eventStreamEP = "/v1/events/stream"
+
+// EventStream opens a stream of billing events from the server. Events are received by
+// calling Recv on the stream until the context is canceled or the stream is closed.
+func (s *APIv1) EventStream(ctx context.Context, in *EventStreamQuery) (_ *EventStream, err error) {
+	params := url.Values{}
+	if in != nil {
+		for _, eventType := range in.Types {
+			params.Add("types", eventType)
+		}
+
+		if in.LastEventID != "" {
+			params.Set("last_event_id", in.LastEventID)
+		}
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, eventStreamEP, nil, &params); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptStream)
+	req.Header.Del("Accept-Encoding")
+
+	// The stream is long-lived so the client's timeout must not apply to it.
+	client := &http.Client{
+		Transport:     s.client.Transport,
+		CheckRedirect: s.client.CheckRedirect,
+		Jar:           s.client.Jar,
+	}
+
+	var rep *http.Response
+	if rep, err = client.Do(req); err != nil {
+		return nil, fmt.Errorf("could not execute request: %s", err)
+	}
+
+	if rep.StatusCode != http.StatusOK {
+		defer rep.Body.Close()
+		serr := &StatusError{StatusCode: rep.StatusCode}
+		if err = json.NewDecoder(rep.Body).Decode(&serr.Reply); err != nil {
+			serr.Reply = Unsuccessful
+		}
+		return nil, serr
+	}
+
+	return newEventStream(rep.Body), nil
+}
+
+const webhooksEP = "/v1/webhooks"
+
+// ListWebhookEndpoints returns a page of the registered webhook endpoints.
+func (s *APIv1) ListWebhookEndpoints(ctx context.Context, in *PageQuery) (out *WebhookEndpointList, err error) {
+	var params url.Values
+	if params, err = query.Values(in); err != nil {
+		return nil, fmt.Errorf("could not encode page query: %w", err)
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, webhooksEP, nil, &params); err != nil {
+		return nil, err
+	}
+
+	out = &WebhookEndpointList{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WebhookEndpoints iterates over all of the registered webhook endpoints.
+func (s *APIv1) WebhookEndpoints(ctx context.Context, in *PageQuery) *Iterator[*WebhookEndpoint] {
+	return NewIterator(ctx, in, func(ctx context.Context, in *PageQuery) ([]*WebhookEndpoint, string, error) {
+		page, err := s.ListWebhookEndpoints(ctx, in)
+		if err != nil {
+			return nil, "", err
+		}
+		return page.Endpoints, page.NextPageToken, nil
+	})
+}
+
+// CreateWebhookEndpoint registers an endpoint to receive billing events. The signing
+// secret of the endpoint is only returned by this method.
+func (s *APIv1) CreateWebhookEndpoint(ctx context.Context, in *WebhookEndpoint) (out *WebhookEndpoint, err error) {
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPost, webhooksEP, in, nil); err != nil {
+		return nil, err
+	}
+
+	out = &WebhookEndpoint{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *APIv1) WebhookEndpointDetail(ctx context.Context, id string) (out *WebhookEndpoint, err error) {
+	if id == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, webhooksEP+"/"+pathEscape(id), nil, nil); err != nil {
+		return nil, err
+	}
+
+	out = &WebhookEndpoint{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdateWebhookEndpoint replaces the URL, description, event types and active status
+// of the endpoint identified by the ID of the input.
+func (s *APIv1) UpdateWebhookEndpoint(ctx context.Context, in *WebhookEndpoint) (out *WebhookEndpoint, err error) {
+	if in == nil || in.ID == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPut, webhooksEP+"/"+pathEscape(in.ID), in, nil); err != nil {
+		return nil, err
+	}
+
+	out = &WebhookEndpoint{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *APIv1) DeleteWebhookEndpoint(ctx context.Context, id string) (err error) {
+	if id == "" {
+		return ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodDelete, webhooksEP+"/"+pathEscape(id), nil, nil); err != nil {
+		return err
+	}
+
+	if _, err = s.Do(req, nil, true); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns a page of the delivery log of the webhook endpoint.
+func (s *APIv1) ListWebhookDeliveries(ctx context.Context, endpointID string, in *PageQuery) (out *WebhookDeliveryList, err error) {
+	if endpointID == "" {
+		return nil, ErrMissingID
+	}
+
+	var params url.Values
+	if params, err = query.Values(in); err != nil {
+		return nil, fmt.Errorf("could not encode page query: %w", err)
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, webhooksEP+"/"+pathEscape(endpointID)+"/deliveries", nil, &params); err != nil {
+		return nil, err
+	}
+
+	out = &WebhookDeliveryList{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WebhookDeliveries iterates over the delivery log of the webhook endpoint.
+func (s *APIv1) WebhookDeliveries(ctx context.Context, endpointID string, in *PageQuery) *Iterator[*WebhookDelivery] {
+	return NewIterator(ctx, in, func(ctx context.Context, in *PageQuery) ([]*WebhookDelivery, string, error) {
+		page, err := s.ListWebhookDeliveries(ctx, endpointID, in)
+		if err != nil {
+			return nil, "", err
+		}
+		return page.Deliveries, page.NextPageToken, nil
+	})
+}
+
+// ReplayWebhookDelivery immediately re-sends the event of the delivery to the endpoint
+// and returns the delivery with the outcome of the replay.
+func (s *APIv1) ReplayWebhookDelivery(ctx context.Context, endpointID, deliveryID string) (out *WebhookDelivery, err error) {
+	if endpointID == "" || deliveryID == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPost, webhooksEP+"/"+pathEscape(endpointID)+"/deliveries/"+pathEscape(deliveryID)+"/replay", nil, nil); err != nil {
+		return nil, err
+	}
+
+	out = &WebhookDelivery{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//===========================================================================
+// Adyen Notifications
+//===========================================================================
+
+const notificationsEP = "/v1/notifications"
+
+// ReplayNotifications processes the stored Adyen notifications that match the selectors
+// of the request again, returning the transitions that were (or would be) made.
+func (s *APIv1) ReplayNotifications(ctx context.Context, in *NotificationReplayRequest) (out *NotificationReplayReply, err error) {
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPost, notificationsEP+"/replay", in, nil); err != nil {
+		return nil, err
+	}
+
+	out = &NotificationReplayReply{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//===========================================================================
+// API Keys
+//===========================================================================
+
+const apikeysEP = "/v1/apikeys"
+
+// ListAPIKeys returns a page of the API keys, including revoked keys.
+func (s *APIv1) ListAPIKeys(ctx context.Context, in *PageQuery) (out *APIKeyList, err error) {
+	var params url.Values
+	if params, err = query.Values(in); err != nil {
+		return nil, fmt.Errorf("could not encode page query: %w", err)
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, apikeysEP, nil, &params); err != nil {
+		return nil, err
+	}
+
+	out = &APIKeyList{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// APIKeys iterates over all of the API keys.
+func (s *APIv1) APIKeys(ctx context.Context, in *PageQuery) *Iterator[*APIKey] {
+	return NewIterator(ctx, in, func(ctx context.Context, in *PageQuery) ([]*APIKey, string, error) {
+		page, err := s.ListAPIKeys(ctx, in)
+		if err != nil {
+			return nil, "", err
+		}
+		return page.APIKeys, page.NextPageToken, nil
+	})
+}
+
+// CreateAPIKey creates an API key with the description and scopes of the input. The
+// client secret of the key is only returned by this method.
+func (s *APIv1) CreateAPIKey(ctx context.Context, in *APIKey) (out *APIKey, err error) {
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodPost, apikeysEP, in, nil); err != nil {
+		return nil, err
+	}
+
+	out = &APIKey{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *APIv1) APIKeyDetail(ctx context.Context, id string) (out *APIKey, err error) {
+	if id == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, apikeysEP+"/"+pathEscape(id), nil, nil); err != nil {
+		return nil, err
+	}
+
+	out = &APIKey{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RevokeAPIKey prevents the API key from being used and returns the revoked key.
+func (s *APIv1) RevokeAPIKey(ctx context.Context, id string) (out *APIKey, err error) {
+	if id == "" {
+		return nil, ErrMissingID
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodDelete, apikeysEP+"/"+pathEscape(id), nil, nil); err != nil {
+		return nil, err
+	}
+
+	out = &APIKey{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+//===========================================================================
+// Audit Log
+//===========================================================================
+
+const auditEP = "/v1/audit"
+
+// ListAuditEntries returns the entries of the audit log that match the query.
+func (s *APIv1) ListAuditEntries(ctx context.Context, in *AuditQuery) (out *AuditLog, err error) {
+	var params url.Values
+	if params, err = query.Values(in); err != nil {
+		return nil, fmt.Errorf("could not encode audit query: %w", err)
+	}
+
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, auditEP, nil, &params); err != nil {
+		return nil, err
+	}
+
+	out = &AuditLog{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AuditEntries iterates over all of the entries of the audit log that match the query.
+func (s *APIv1) AuditEntries(ctx context.Context, in *AuditQuery) *Iterator[*AuditEntry] {
+	filter := AuditQuery{}
+	if in != nil {
+		filter = *in
+	}
+
+	return NewIterator(ctx, &filter.PageQuery, func(ctx context.Context, page *PageQuery) ([]*AuditEntry, string, error) {
+		query := filter
+		query.PageQuery = *page
+
+		log, err := s.ListAuditEntries(ctx, &query)
+		if err != nil {
+			return nil, "", err
+		}
+		return log.Entries, log.NextPageToken, nil
+	})
+}
+
+// VerifyAuditLog verifies the hash chain of the audit log on the server.
+func (s *APIv1) VerifyAuditLog(ctx context.Context) (out *AuditVerification, err error) {
+	var req *http.Request
+	if req, err = s.NewRequest(ctx, http.MethodGet, auditEP+"/verify", nil, nil); err != nil {
+		return nil, err
+	}
+
+	out = &AuditVerification{}
+	if _, err = s.Do(req, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 //===========================================================================
 // Helper Methods
 //===========================================================================
@@ -95,14 +639,36 @@ func (s *APIv1) Status(ctx context.Context) (out *StatusReply, err error) {
 const (
 	userAgent    = "Exchequer API Client/v1"
 	accept       = "application/json"
+	acceptStream = "text/event-stream"
 	acceptLang   = "en-US,en"
 	acceptEncode = "gzip, deflate, br"
 	contentType  = "application/json; charset=utf-8"
 )
 
+// Escapes a path parameter so that it is sent as a single path segment; dot segments are
+// also escaped so that they are not resolved against the rest of the path.
+func pathEscape(param string) string {
+	switch param {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	default:
+		return url.PathEscape(param)
+	}
+}
+
+// NewRequest creates a request to the path relative to the endpoint of the client. The
+// path must already be escaped so that parameters containing slashes or other reserved
+// characters are sent as a single path segment.
 func (s *APIv1) NewRequest(ctx context.Context, method, path string, data interface{}, params *url.Values) (req *http.Request, err error) {
-	// Resolve the URL reference from the path
-	url := s.endpoint.ResolveReference(&url.URL{Path: path})
+	// Resolve the URL reference from the escaped path
+	ref := &url.URL{RawPath: path}
+	if ref.Path, err = url.PathUnescape(path); err != nil {
+		return nil, fmt.Errorf("could not parse request path: %s", err)
+	}
+
+	url := s.endpoint.ResolveReference(ref)
 	if params != nil && len(*params) > 0 {
 		url.RawQuery = params.Encode()
 	}
@@ -135,7 +701,30 @@ func (s *APIv1) NewRequest(ctx context.Context, method, path string, data interf
 	if requestID, _ = RequestIDFromContext(ctx); requestID == "" {
 		requestID = ulid.Make().String()
 	}
-	req.Header.Add("X-Request-ID", requestID)
+	req.Header.Add(RequestIDHeader, requestID)
+
+	// Mutating requests are sent with an idempotency key so that they can be safely
+	// retried; the key is generated once per request so it is stable across retries.
+	if isMutating(method) {
+		var key string
+		if key, _ = IdempotencyKeyFromContext(ctx); key == "" {
+			key = ulids.New().String()
+		}
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+
+	// Propagate the trace context if there is one on the context
+	if traceparent, _ := TraceparentFromContext(ctx); traceparent != "" {
+		req.Header.Set(TraceparentHeader, traceparent)
+	}
+
+	// Authenticate the request if credentials are available
+	switch {
+	case s.token != "":
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	case s.clientID != "":
+		req.SetBasicAuth(s.clientID, s.secret)
+	}
 
 	// Add CSRF protection if its available
 	if s.client.Jar != nil {
@@ -153,8 +742,8 @@ func (s *APIv1) NewRequest(ctx context.Context, method, path string, data interf
 // Do executes an http request against the server, performs error checking, and
 // deserializes the response data into the specified struct.
 func (s *APIv1) Do(req *http.Request, data interface{}, checkStatus bool) (rep *http.Response, err error) {
-	if rep, err = s.client.Do(req); err != nil {
-		return rep, fmt.Errorf("could not execute request: %s", err)
+	if rep, err = s.send(req); err != nil {
+		return rep, fmt.Errorf("could not execute request: %w", err)
 	}
 	defer rep.Body.Close()
 
@@ -196,3 +785,12 @@ func (s *APIv1) Do(req *http.Request, data interface{}, checkStatus bool) (rep *
 
 	return rep, nil
 }
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,354 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	// The server pages through 7 api keys, returning the offset of the next page as the
+	// page token; the page token "fail" returns an error.
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		token := r.URL.Query().Get("next_page_token")
+		if token == "fail" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(api.Error("try again later"))
+			return
+		}
+
+		offset, _ := strconv.Atoi(token)
+		size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+
+		out := &api.APIKeyList{APIKeys: make([]*api.APIKey, 0, size)}
+		for i := offset; i < offset+size && i < 7; i++ {
+			out.APIKeys = append(out.APIKeys, &api.APIKey{ID: strconv.Itoa(i)})
+		}
+
+		if offset+size < 7 {
+			out.NextPageToken = strconv.Itoa(offset + size)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := api.New(srv.URL)
+	require.NoError(t, err)
+
+	keys, err := client.APIKeys(context.Background(), &api.PageQuery{PageSize: 3}).All()
+	require.NoError(t, err)
+	require.Len(t, keys, 7)
+	require.Equal(t, 3, requests)
+	for i, key := range keys {
+		require.Equal(t, strconv.Itoa(i), key.ID)
+	}
+
+	// The iterator resumes from the page token in the query
+	requests = 0
+	iter := client.APIKeys(context.Background(), &api.PageQuery{PageSize: 5, NextPageToken: "4"})
+	require.True(t, iter.Next())
+	require.Equal(t, "4", iter.Item().ID)
+	require.True(t, iter.Next())
+	require.True(t, iter.Next())
+	require.False(t, iter.Next())
+	require.NoError(t, iter.Err())
+	require.Equal(t, 1, requests)
+
+	// Errors stop the iteration
+	iter = client.APIKeys(context.Background(), &api.PageQuery{PageSize: 5, NextPageToken: "fail"})
+	require.False(t, iter.Next())
+	require.ErrorIs(t, iter.Err(), api.ErrUnavailable)
+	require.EqualError(t, iter.Err(), "[503] try again later")
+}
+
+func TestPathEscaping(t *testing.T) {
+	// The server records the escaped path of each request
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.EscapedPath())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := api.New(srv.URL)
+	require.NoError(t, err)
+
+	// Path parameters with reserved characters are sent as a single path segment
+	ctx := context.Background()
+	_, err = client.ListPaymentMethods(ctx, "cust/1", nil)
+	require.NoError(t, err)
+	_, err = client.SetDefaultPaymentMethod(ctx, "cust/1", "pm?visa")
+	require.NoError(t, err)
+	_, err = client.DisablePaymentMethod(ctx, "cust 1", "pm#visa")
+	require.NoError(t, err)
+	_, err = client.RefundPayment(ctx, "../apikeys", &api.RefundRequest{})
+	require.NoError(t, err)
+	_, err = client.CancelPayment(ctx, "psp%2F1")
+	require.NoError(t, err)
+	_, err = client.WebhookEndpointDetail(ctx, "..")
+	require.NoError(t, err)
+	_, err = client.UpdateWebhookEndpoint(ctx, &api.WebhookEndpoint{ID: "a/b"})
+	require.NoError(t, err)
+	require.NoError(t, client.DeleteWebhookEndpoint(ctx, "a/b"))
+	_, err = client.ListWebhookDeliveries(ctx, "a/b", nil)
+	require.NoError(t, err)
+	_, err = client.ReplayWebhookDelivery(ctx, "a/b", "c/d")
+	require.NoError(t, err)
+	_, err = client.APIKeyDetail(ctx, "key/1")
+	require.NoError(t, err)
+	_, err = client.RevokeAPIKey(ctx, "key/1")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"GET /v1/customers/cust%2F1/payment-methods",
+		"POST /v1/customers/cust%2F1/payment-methods/pm%3Fvisa/default",
+		"DELETE /v1/customers/cust%201/payment-methods/pm%23visa",
+		"POST /v1/payments/..%2Fapikeys/refunds",
+		"POST /v1/payments/psp%252F1/cancels",
+		"GET /v1/webhooks/%2E%2E",
+		"PUT /v1/webhooks/a%2Fb",
+		"DELETE /v1/webhooks/a%2Fb",
+		"GET /v1/webhooks/a%2Fb/deliveries",
+		"POST /v1/webhooks/a%2Fb/deliveries/c%2Fd/replay",
+		"GET /v1/apikeys/key%2F1",
+		"DELETE /v1/apikeys/key%2F1",
+	}, paths)
+}
+
+func TestStatusErrors(t *testing.T) {
+	testCases := []struct {
+		status int
+		target error
+	}{
+		{http.StatusBadRequest, api.ErrBadRequest},
+		{http.StatusUnauthorized, api.ErrUnauthenticated},
+		{http.StatusForbidden, api.ErrForbidden},
+		{http.StatusNotFound, api.ErrNotFound},
+		{http.StatusConflict, api.ErrConflict},
+		{http.StatusUnprocessableEntity, api.ErrUnprocessable},
+		{http.StatusTooManyRequests, api.ErrTooManyRequests},
+		{http.StatusInternalServerError, api.ErrServerError},
+		{http.StatusNotImplemented, api.ErrServerError},
+		{http.StatusBadGateway, api.ErrBadGateway},
+		{http.StatusServiceUnavailable, api.ErrUnavailable},
+		{http.StatusGatewayTimeout, api.ErrBadGateway},
+	}
+
+	for i, tc := range testCases {
+		err := error(&api.StatusError{StatusCode: tc.status, Reply: api.Error("oops")})
+		require.ErrorIs(t, err, tc.target, "test case %d failed", i)
+		require.Equal(t, tc.status, api.ErrorStatus(err), "test case %d failed", i)
+	}
+
+	// Status codes are recovered from wrapped errors
+	err := errors.Join(errors.New("could not list keys"), &api.StatusError{StatusCode: http.StatusNotFound})
+	require.ErrorIs(t, err, api.ErrNotFound)
+	require.Equal(t, http.StatusNotFound, api.ErrorStatus(err))
+	require.Equal(t, http.StatusInternalServerError, api.ErrorStatus(errors.New("connection refused")))
+
+	// An error message is provided if the server did not return one
+	require.EqualError(t, &api.StatusError{StatusCode: http.StatusNotFound}, "[404] Not Found")
+}
+
+func TestRetries(t *testing.T) {
+	// The server fails each request with the queued status codes before succeeding; a
+	// status code of 0 closes the connection without a response.
+	var (
+		mu       sync.Mutex
+		failures []int
+		keys     []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get(api.IdempotencyKeyHeader))
+
+		// The request body must be sent with every attempt
+		if r.Method == http.MethodPost {
+			in := &api.APIKey{}
+			if err := json.NewDecoder(r.Body).Decode(in); err != nil || in.Description != "monitoring" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		if len(failures) > 0 {
+			status := failures[0]
+			failures = failures[1:]
+
+			if status == 0 {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&api.APIKey{ID: "01J9ZJ4HQKX3GTEPJ6N0HFSW3M"})
+	}))
+	t.Cleanup(srv.Close)
+
+	reset := func(statuses ...int) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures, keys = statuses, nil
+	}
+
+	client, err := api.New(srv.URL, api.WithRetries(api.RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// Mutating requests are retried with the same idempotency key
+	reset(http.StatusServiceUnavailable, 0, http.StatusTooManyRequests)
+	_, err = client.CreateAPIKey(ctx, &api.APIKey{Description: "monitoring"})
+	require.NoError(t, err)
+	require.Len(t, keys, 4)
+	require.NotEmpty(t, keys[0])
+	for _, key := range keys[1:] {
+		require.Equal(t, keys[0], key, "expected idempotency key to be stable across retries")
+	}
+
+	// Each request has its own idempotency key unless one is set on the context
+	firstKey := keys[0]
+	reset()
+	_, err = client.CreateAPIKey(ctx, &api.APIKey{Description: "monitoring"})
+	require.NoError(t, err)
+	require.NotEqual(t, firstKey, keys[0])
+
+	reset()
+	_, err = client.CreateAPIKey(api.ContextWithIdempotencyKey(ctx, "nightly-sync-42"), &api.APIKey{Description: "monitoring"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"nightly-sync-42"}, keys)
+
+	// Read requests do not have an idempotency key
+	reset(http.StatusBadGateway, http.StatusGatewayTimeout)
+	_, err = client.APIKeyDetail(ctx, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+	require.NoError(t, err)
+	require.Equal(t, []string{"", "", ""}, keys)
+
+	// The last error is returned when the attempts are exhausted
+	reset(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	_, err = client.APIKeyDetail(ctx, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+	require.ErrorIs(t, err, api.ErrUnavailable)
+	require.Len(t, keys, 4)
+
+	// Conflicts from an in-flight attempt are only retried for idempotent requests
+	reset(http.StatusConflict)
+	_, err = client.CreateAPIKey(ctx, &api.APIKey{Description: "monitoring"})
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	reset(http.StatusConflict)
+	_, err = client.APIKeyDetail(ctx, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+	require.ErrorIs(t, err, api.ErrConflict)
+	require.Len(t, keys, 1)
+
+	// Other errors are not retried
+	reset(http.StatusInternalServerError)
+	_, err = client.APIKeyDetail(ctx, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+	require.ErrorIs(t, err, api.ErrServerError)
+	require.Len(t, keys, 1)
+
+	// Requests are not retried without the retry option
+	noretry, err := api.New(srv.URL)
+	require.NoError(t, err)
+
+	reset(http.StatusServiceUnavailable)
+	_, err = noretry.APIKeyDetail(ctx, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+	require.ErrorIs(t, err, api.ErrUnavailable)
+	require.Len(t, keys, 1)
+
+	// Invalid retry policies are rejected
+	_, err = api.New(srv.URL, api.WithRetries(api.RetryPolicy{MaxAttempts: -1}))
+	require.Error(t, err)
+}
+
+func TestRetryAfter(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		attempts []time.Time
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, time.Now())
+
+		switch r.URL.Query().Get("retry_after") {
+		case "date":
+			if len(attempts) == 1 {
+				w.Header().Set("Retry-After", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "seconds":
+			if len(attempts) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		case "hour":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&api.StatusReply{Status: "ok"})
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := api.New(srv.URL, api.WithRetries(api.RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	require.NoError(t, err)
+	v1 := client.(*api.APIv1)
+
+	get := func(ctx context.Context, retryAfter string) error {
+		mu.Lock()
+		attempts = nil
+		mu.Unlock()
+
+		req, err := v1.NewRequest(ctx, http.MethodGet, "/v1/status", nil, &url.Values{"retry_after": {retryAfter}})
+		require.NoError(t, err)
+		_, err = v1.Do(req, &api.StatusReply{}, true)
+		return err
+	}
+
+	// The server's Retry-After is used instead of the backoff
+	require.NoError(t, get(context.Background(), "seconds"))
+	require.Len(t, attempts, 2)
+	require.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), time.Second)
+
+	require.NoError(t, get(context.Background(), "date"))
+	require.Len(t, attempts, 2)
+
+	// The client gives up if the server asks it to wait too long
+	require.ErrorIs(t, get(context.Background(), "hour"), api.ErrUnavailable)
+	require.Len(t, attempts, 1)
+
+	// The client gives up if it cannot retry before the deadline of the request
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, get(ctx, "seconds"), api.ErrTooManyRequests)
+	require.Len(t, attempts, 1)
+}
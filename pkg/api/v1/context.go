@@ -2,14 +2,29 @@ package api
 
 import "context"
 
+// Headers used to correlate requests across services. The request ID is a ULID unless
+// another service sets it, and the traceparent is a W3C trace context header. The
+// idempotency key identifies a mutating request so that retries of it are not repeated;
+// the server sets the replayed header when it responds to a retry with a stored response.
+const (
+	RequestIDHeader          = "X-Request-ID"
+	TraceparentHeader        = "traceparent"
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
 // API-specific context keys for passing values to requests via the context. These keys
 // are unexported to reduce the size of the public interface an prevent incorrect handling.
+// NOTE: the server also uses these keys (via the logger package) so that the request ID
+// of an inbound request is propagated to outbound requests made with the same context.
 type contextKey uint8
 
 // Allocate context keys to simplify context key usage in helper functions.
 const (
 	contextKeyUnknown contextKey = iota
 	contextKeyRequestID
+	contextKeyTraceparent
+	contextKeyIdempotencyKey
 )
 
 // Adds a request ID to the context which is sent with the request in the X-Request-ID header.
@@ -23,7 +38,32 @@ func RequestIDFromContext(ctx context.Context) (string, bool) {
 	return requestID, ok
 }
 
-var contextKeyNames = []string{"unknown", "requestID"}
+// Adds a W3C traceparent to the context which is sent with the request in the
+// traceparent header.
+func ContextWithTraceparent(parent context.Context, traceparent string) context.Context {
+	return context.WithValue(parent, contextKeyTraceparent, traceparent)
+}
+
+// Extracts a W3C traceparent from the context.
+func TraceparentFromContext(ctx context.Context) (string, bool) {
+	traceparent, ok := ctx.Value(contextKeyTraceparent).(string)
+	return traceparent, ok
+}
+
+// Adds an idempotency key to the context which is sent with mutating requests in the
+// Idempotency-Key header instead of a generated key, e.g. so that a batch job that is
+// restarted does not repeat the requests it already made.
+func ContextWithIdempotencyKey(parent context.Context, key string) context.Context {
+	return context.WithValue(parent, contextKeyIdempotencyKey, key)
+}
+
+// Extracts an idempotency key from the context.
+func IdempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(contextKeyIdempotencyKey).(string)
+	return key, ok
+}
+
+var contextKeyNames = []string{"unknown", "requestID", "traceparent", "idempotencyKey"}
 
 // String returns a human readable representation of the context key for easier debugging.
 func (c contextKey) String() string {
@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -41,29 +42,81 @@ func Error(err interface{}) Reply {
 	return rep
 }
 
+// Client errors that are returned before a request is made.
+var (
+	ErrMissingID = errors.New("a resource id is required")
+)
+
 //===========================================================================
 // Status Errors
 //===========================================================================
 
-// StatusError decodes an error response from the TRISA API.
+// Errors that a StatusError wraps based on its status code so that callers can check
+// the kind of error with errors.Is rather than comparing status codes.
+var (
+	ErrBadRequest      = errors.New("bad request")
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("permission denied")
+	ErrNotFound        = errors.New("resource not found")
+	ErrConflict        = errors.New("request conflicts with the current state of the resource")
+	ErrUnprocessable   = errors.New("unprocessable request")
+	ErrTooManyRequests = errors.New("too many requests")
+	ErrServerError     = errors.New("internal server error")
+	ErrBadGateway      = errors.New("upstream request failed")
+	ErrUnavailable     = errors.New("service unavailable")
+)
+
+// StatusError decodes an error response from the Exchequer API.
 type StatusError struct {
 	StatusCode int
 	Reply      Reply
 }
 
 func (e *StatusError) Error() string {
+	if e.Reply.Error == "" {
+		return fmt.Sprintf("[%d] %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
 	return fmt.Sprintf("[%d] %s", e.StatusCode, e.Reply.Error)
 }
 
+// Unwrap returns the typed error for the status code, e.g. ErrNotFound for a 404.
+func (e *StatusError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return ErrBadRequest
+	case http.StatusUnauthorized:
+		return ErrUnauthenticated
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusUnprocessableEntity:
+		return ErrUnprocessable
+	case http.StatusTooManyRequests:
+		return ErrTooManyRequests
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return ErrBadGateway
+	case http.StatusServiceUnavailable:
+		return ErrUnavailable
+	}
+
+	if e.StatusCode >= 500 {
+		return ErrServerError
+	}
+	return nil
+}
+
 // ErrorStatus returns the HTTP status code from an error or 500 if the error is not a StatusError.
 func ErrorStatus(err error) int {
 	if err == nil {
 		return http.StatusOK
 	}
 
-	if e, ok := err.(*StatusError); !ok || e.StatusCode < 100 || e.StatusCode >= 600 {
+	var e *StatusError
+	if !errors.As(err, &e) || e.StatusCode < 100 || e.StatusCode >= 600 {
 		return http.StatusInternalServerError
-	} else {
-		return e.StatusCode
 	}
+	return e.StatusCode
 }
@@ -0,0 +1,80 @@
+package api
+
+import "context"
+
+// Iterator iterates over the items of a paginated list endpoint, fetching the next page
+// with the next page token of the previous page until there are no more pages.
+//
+//	iter := client.WebhookEndpoints(ctx, &api.PageQuery{PageSize: 50})
+//	for iter.Next() {
+//		endpoint := iter.Item()
+//	}
+//	if err := iter.Err(); err != nil {
+//		return err
+//	}
+type Iterator[T any] struct {
+	ctx   context.Context
+	query PageQuery
+	fetch PageFetcher[T]
+	page  []T
+	index int
+	item  T
+	err   error
+	done  bool
+}
+
+// PageFetcher requests a single page of a list, returning its items and the token of
+// the next page or an empty string if it is the last page.
+type PageFetcher[T any] func(ctx context.Context, query *PageQuery) (items []T, next string, err error)
+
+// NewIterator creates an iterator that fetches pages starting from the query.
+func NewIterator[T any](ctx context.Context, query *PageQuery, fetch PageFetcher[T]) *Iterator[T] {
+	iter := &Iterator[T]{ctx: ctx, fetch: fetch}
+	if query != nil {
+		iter.query = *query
+	}
+	return iter
+}
+
+// Next advances the iterator to the next item, fetching the next page if necessary.
+// It returns false when there are no more items or if an error occurred.
+func (i *Iterator[T]) Next() bool {
+	for i.index >= len(i.page) {
+		if i.done || i.err != nil {
+			return false
+		}
+
+		var next string
+		if i.page, next, i.err = i.fetch(i.ctx, &i.query); i.err != nil {
+			i.page = nil
+			return false
+		}
+
+		// Stop if the server does not advance the cursor to prevent an infinite loop
+		i.index = 0
+		i.done = next == "" || next == i.query.NextPageToken
+		i.query.NextPageToken = next
+	}
+
+	i.item = i.page[i.index]
+	i.index++
+	return true
+}
+
+// Item returns the current item of the iterator.
+func (i *Iterator[T]) Item() T {
+	return i.item
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (i *Iterator[T]) Err() error {
+	return i.err
+}
+
+// All consumes the iterator and returns all of the remaining items.
+func (i *Iterator[T]) All() (items []T, err error) {
+	for i.Next() {
+		items = append(items, i.Item())
+	}
+	return items, i.Err()
+}
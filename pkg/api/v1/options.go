@@ -11,3 +11,34 @@ func WithClient(client *http.Client) ClientOption {
 		return nil
 	}
 }
+
+// WithAccessToken sets the bearer token used to authenticate requests to the server.
+func WithAccessToken(token string) ClientOption {
+	return func(c *APIv1) error {
+		c.token = token
+		return nil
+	}
+}
+
+// WithAPIKey authenticates requests to the server using an API key client ID and secret.
+func WithAPIKey(clientID, secret string) ClientOption {
+	return func(c *APIv1) error {
+		c.clientID = clientID
+		c.secret = secret
+		return nil
+	}
+}
+
+// WithRetries retries requests that fail because of network errors or because the
+// server is temporarily unavailable using jittered exponential backoff, honoring the
+// Retry-After header sent by the server. Zero values in the policy are replaced with the
+// values of the DefaultRetryPolicy.
+func WithRetries(policy RetryPolicy) ClientOption {
+	return func(c *APIv1) (err error) {
+		if policy, err = policy.normalize(); err != nil {
+			return err
+		}
+		c.retries = &policy
+		return nil
+	}
+}
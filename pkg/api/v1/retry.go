@@ -0,0 +1,187 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy configures how the client retries requests that failed because of a
+// network error or because the server was temporarily unable to handle the request
+// (429, 502, 503 and 504 responses). The server responds 409 with a Retry-After header
+// to a retry that arrives while an earlier attempt with the same Idempotency-Key is still
+// in flight, so such responses to requests with an Idempotency-Key are also retried and
+// receive the stored response once the earlier attempt completes. Responses replayed
+// from an earlier attempt are not retried since the server will replay them again. Only
+// requests that are safe to repeat are retried: idempotent methods and requests with an
+// Idempotency-Key header, which the client adds to every mutating request.
+type RetryPolicy struct {
+	MaxAttempts    int           // the total number of attempts, including the first request
+	InitialBackoff time.Duration // the delay before the first retry, doubled for each retry
+	MaxBackoff     time.Duration // the maximum delay between attempts
+	MaxRetryAfter  time.Duration // the longest Retry-After the client will wait before giving up
+}
+
+// DefaultRetryPolicy rides out a rolling restart of the server without holding up the
+// caller for more than a few seconds.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	MaxRetryAfter:  time.Minute,
+}
+
+var errInvalidRetryPolicy = errors.New("invalid retry policy: max attempts must be at least 1 and initial backoff cannot exceed max backoff")
+
+// Fills in the zero values of the policy from the default policy and validates it.
+func (p RetryPolicy) normalize() (RetryPolicy, error) {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+
+	if p.InitialBackoff == 0 {
+		p.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = max(DefaultRetryPolicy.MaxBackoff, p.InitialBackoff)
+	}
+
+	if p.MaxRetryAfter == 0 {
+		p.MaxRetryAfter = DefaultRetryPolicy.MaxRetryAfter
+	}
+
+	if p.MaxAttempts < 1 || p.InitialBackoff < 0 || p.InitialBackoff > p.MaxBackoff {
+		return p, errInvalidRetryPolicy
+	}
+	return p, nil
+}
+
+// Computes the delay before the next attempt: the initial backoff is doubled for each
+// failed attempt up to the maximum backoff, then "equal jitter" is applied so that the
+// delay is randomly chosen between half and all of the computed backoff.
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempts && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + rand.N(half+1)
+}
+
+// Sends the request, retrying it according to the retry policy of the client. The
+// response or error of the last attempt is returned if the request cannot be retried.
+func (s *APIv1) send(req *http.Request) (rep *http.Response, err error) {
+	if s.retries == nil || !canRetry(req) {
+		return s.client.Do(req)
+	}
+
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		// The body is consumed by each attempt so it is rewound before retrying
+		if attempt > 1 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		rep, err = s.client.Do(req)
+		if attempt >= s.retries.MaxAttempts || !shouldRetry(req, rep, err) {
+			return rep, err
+		}
+
+		wait := s.retries.backoff(attempt)
+		if rep != nil {
+			if after, ok := retryAfter(rep.Header.Get("Retry-After")); ok {
+				if after > s.retries.MaxRetryAfter {
+					return rep, err
+				}
+				wait = after
+			}
+		}
+
+		// Give up early rather than waiting past the deadline of the request
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return rep, err
+		}
+
+		// Drain the body of the failed attempt so that the connection can be reused
+		if rep != nil {
+			io.Copy(io.Discard, io.LimitReader(rep.Body, 64*1024))
+			rep.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Requests can only be retried if repeating them has no additional side effects and if
+// their body can be sent again.
+func canRetry(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return req.Header.Get(IdempotencyKeyHeader) != ""
+	}
+}
+
+// Network errors and responses indicating that the server is overloaded, restarting, or
+// behind an unavailable proxy are retried unless the caller has given up on the request.
+// Conflicts are only retried if the server reported that an earlier attempt with the
+// same idempotency key is in flight by asking the client to retry after a delay.
+func shouldRetry(req *http.Request, rep *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+
+	if rep.Header.Get(IdempotentReplayedHeader) != "" {
+		return false
+	}
+
+	switch rep.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusConflict:
+		return req.Header.Get(IdempotencyKeyHeader) != "" && rep.Header.Get("Retry-After") != ""
+	default:
+		return false
+	}
+}
+
+// Parses the Retry-After header, which is either a number of seconds or an HTTP date.
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0), true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
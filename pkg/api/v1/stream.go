@@ -0,0 +1,76 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// EventStream reads billing events sent by the server as server-sent events.
+type EventStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	lastID string
+}
+
+func newEventStream(body io.ReadCloser) *EventStream {
+	return &EventStream{body: body, reader: bufio.NewReader(body)}
+}
+
+// Recv blocks until the next event is received from the server. Returns io.EOF when the
+// server closes the stream; callers can resume the stream by passing LastEventID to a
+// new EventStream request so that no events are missed.
+func (s *EventStream) Recv() (_ *Event, err error) {
+	var data strings.Builder
+	for {
+		var line string
+		if line, err = s.reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		// A blank line dispatches the event; comments (heartbeats) are ignored.
+		if line == "" {
+			if data.Len() == 0 {
+				continue
+			}
+
+			event := &Event{}
+			if err = json.Unmarshal([]byte(data.String()), event); err != nil {
+				return nil, fmt.Errorf("could not deserialize event: %w", err)
+			}
+
+			s.lastID = event.ID
+			return event, nil
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		case "id":
+			s.lastID = value
+		}
+	}
+}
+
+// LastEventID returns the ID of the last event received on the stream.
+func (s *EventStream) LastEventID() string {
+	return s.lastID
+}
+
+// Close the stream and release the underlying connection.
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
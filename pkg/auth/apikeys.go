@@ -0,0 +1,386 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/store"
+	"golang.org/x/crypto/argon2"
+)
+
+// Scopes that can be granted to API keys; scopes are also used as the permissions of
+// access tokens so that both credentials are authorized the same way.
+const (
+	ScopeCustomersRead       = "customers:read"
+	ScopeCustomersWrite      = "customers:write"
+	ScopeInvoicesRead        = "invoices:read"
+	ScopeInvoicesWrite       = "invoices:write"
+	ScopePaymentsRead        = "payments:read"
+	ScopePaymentsRefund      = "payments:refund"
+	ScopePaymentsVoid        = "payments:void"
+	ScopeCreditsWrite        = "credits:write"
+	ScopeEventsRead          = "events:read"
+	ScopeWebhooksRead        = "webhooks:read"
+	ScopeWebhooksWrite       = "webhooks:write"
+	ScopeAPIKeysManage       = "apikeys:manage"
+	ScopeAuditRead           = "audit:read"
+	ScopeMaintenance         = "maintenance:manage"
+	ScopeNotificationsReplay = "notifications:replay"
+)
+
+// Scopes is the set of all valid API key scopes.
+var Scopes = []string{
+	ScopeCustomersRead,
+	ScopeCustomersWrite,
+	ScopeInvoicesRead,
+	ScopeInvoicesWrite,
+	ScopePaymentsRead,
+	ScopePaymentsRefund,
+	ScopePaymentsVoid,
+	ScopeCreditsWrite,
+	ScopeEventsRead,
+	ScopeWebhooksRead,
+	ScopeWebhooksWrite,
+	ScopeAPIKeysManage,
+	ScopeAuditRead,
+	ScopeMaintenance,
+	ScopeNotificationsReplay,
+}
+
+// ValidateScopes returns an error if no scopes are specified or if any of the scopes
+// are not one of the known scopes.
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return ErrNoScopes
+	}
+
+scopes:
+	for _, scope := range scopes {
+		for _, valid := range Scopes {
+			if scope == valid {
+				continue scopes
+			}
+		}
+		return fmt.Errorf("%w %q", ErrUnknownScope, scope)
+	}
+	return nil
+}
+
+// APIKeyStore retrieves API keys by client ID to authenticate requests.
+type APIKeyStore interface {
+	RetrieveAPIKeyByClientID(clientID string) (*store.APIKey, error)
+}
+
+//===========================================================================
+// Key Generation
+//===========================================================================
+
+const (
+	clientIDLength = 24
+	secretLength   = 48
+	alphabet       = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// GenerateAPIKey creates a new random client ID and secret. The secret must be given to
+// the caller and then discarded; only its derived key should be stored.
+func GenerateAPIKey() (clientID, secret string, err error) {
+	if clientID, err = randomString(clientIDLength); err != nil {
+		return "", "", err
+	}
+
+	if secret, err = randomString(secretLength); err != nil {
+		return "", "", err
+	}
+	return clientID, secret, nil
+}
+
+// NewAPIKey generates credentials for a new API key with the specified scopes, returning
+// the key to save to the store and its plain text secret to give to the caller.
+func NewAPIKey(description string, scopes []string) (key *store.APIKey, secret string, err error) {
+	if err = ValidateScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	key = &store.APIKey{
+		Description: description,
+		Scopes:      scopes,
+	}
+
+	if key.ClientID, secret, err = GenerateAPIKey(); err != nil {
+		return nil, "", err
+	}
+
+	if key.Secret, err = CreateDerivedKey(secret); err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+func randomString(n int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+	out := make([]byte, n)
+	for i := range out {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		out[i] = alphabet[idx.Int64()]
+	}
+	return string(out), nil
+}
+
+//===========================================================================
+// Argon2 Derived Keys
+//===========================================================================
+
+// Argon2id parameters for hashing API key secrets (the OWASP recommended minimums).
+const (
+	argonTime    uint32 = 2
+	argonMemory  uint32 = 19 * 1024
+	argonThreads uint8  = 1
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+)
+
+var b64 = base64.RawStdEncoding
+
+// CreateDerivedKey hashes the secret with argon2id and a random salt, returning the
+// hash, salt and parameters in the PHC string format so that the parameters can be
+// changed without invalidating existing keys.
+func CreateDerivedKey(secret string) (_ string, err error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err = rand.Read(salt); err != nil {
+		return "", fmt.Errorf("could not generate salt: %w", err)
+	}
+
+	dk := argon2.IDKey([]byte(secret), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads, b64.EncodeToString(salt), b64.EncodeToString(dk)), nil
+}
+
+// VerifyDerivedKey returns true if the secret matches the derived key.
+func VerifyDerivedKey(derivedKey, secret string) (_ bool, err error) {
+	parts := strings.Split(derivedKey, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, ErrInvalidDerivedKey
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, ErrInvalidDerivedKey
+	}
+
+	var (
+		time, memory uint32
+		threads      uint8
+	)
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, ErrInvalidDerivedKey
+	}
+
+	var salt, dk []byte
+	if salt, err = b64.DecodeString(parts[4]); err != nil {
+		return false, ErrInvalidDerivedKey
+	}
+
+	if dk, err = b64.DecodeString(parts[5]); err != nil {
+		return false, ErrInvalidDerivedKey
+	}
+
+	vk := argon2.IDKey([]byte(secret), salt, time, memory, threads, uint32(len(dk)))
+	return subtle.ConstantTimeCompare(dk, vk) == 1, nil
+}
+
+//===========================================================================
+// API Key Verification
+//===========================================================================
+
+const (
+	// How long a successful verification is cached so that clients making many requests
+	// do not derive the key of their secret on every request.
+	verifiedKeyTTL = time.Minute
+
+	// The number of failed attempts allowed for a client ID from a source address in each
+	// window; further attempts are rejected without verifying the secret until the window
+	// ends.
+	maxFailedAttempts    = 5
+	failedAttemptsWindow = time.Minute
+)
+
+// APIKeyVerifier authenticates API key client IDs and secrets against the store. The
+// argon2 key derivation is deliberately expensive, so successful verifications are
+// cached briefly and failed attempts are limited per client ID and source address, so
+// that failed attempts from one address cannot lock the client out everywhere else.
+// Unknown client IDs are verified against a dummy key so that they take as long as a
+// wrong secret and cannot be used to find valid client IDs. A nil verifier does not
+// accept API keys.
+//
+// The cache is local to the process: a key that is revoked is only forgotten by the
+// verifier of the server that revoked it, other replicas accept it from their cache for
+// up to a minute (verifiedKeyTTL) after it was revoked.
+type APIKeyVerifier struct {
+	sync.Mutex
+	keys     APIKeyStore
+	verified map[string]*verifiedKey
+	failures map[string]*failedAttempts
+	swept    time.Time
+}
+
+type verifiedKey struct {
+	key     *store.APIKey
+	digest  [sha256.Size]byte
+	expires time.Time
+}
+
+type failedAttempts struct {
+	count int
+	reset time.Time
+}
+
+// NewAPIKeyVerifier returns a verifier that retrieves API keys from the store.
+func NewAPIKeyVerifier(keys APIKeyStore) *APIKeyVerifier {
+	return &APIKeyVerifier{
+		keys:     keys,
+		verified: make(map[string]*verifiedKey),
+		failures: make(map[string]*failedAttempts),
+	}
+}
+
+// Verify authenticates an API key client ID and secret, returning claims for the key.
+// The source is the address of the client, which scopes the limit on failed attempts.
+func (v *APIKeyVerifier) Verify(clientID, secret, source string) (_ *Claims, err error) {
+	if v == nil || v.keys == nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	// The secret has high entropy so a fast hash is enough to compare it to the cache
+	now := time.Now()
+	digest := sha256.Sum256([]byte(secret))
+
+	v.Lock()
+	if cached, ok := v.verified[clientID]; ok && now.Before(cached.expires) && subtle.ConstantTimeCompare(cached.digest[:], digest[:]) == 1 {
+		v.Unlock()
+		return apiKeyClaims(cached.key), nil
+	}
+
+	attempt := clientID + "\x00" + source
+	if failed, ok := v.failures[attempt]; ok && failed.count >= maxFailedAttempts && now.Before(failed.reset) {
+		v.Unlock()
+		return nil, ErrTooManyAttempts
+	}
+	v.Unlock()
+
+	var key *store.APIKey
+	if key, err = v.verify(clientID, secret); err != nil {
+		if errors.Is(err, ErrInvalidAPIKey) || errors.Is(err, ErrRevokedAPIKey) {
+			v.fail(attempt, now)
+		}
+		return nil, err
+	}
+
+	v.Lock()
+	delete(v.failures, attempt)
+	v.verified[clientID] = &verifiedKey{key: key, digest: digest, expires: now.Add(verifiedKeyTTL)}
+	v.sweep(now)
+	v.Unlock()
+
+	return apiKeyClaims(key), nil
+}
+
+// Forget removes the cached verification of the key, e.g. when the key is revoked. Only
+// the cache of this process is cleared; see APIKeyVerifier for other replicas.
+func (v *APIKeyVerifier) Forget(clientID string) {
+	if v == nil {
+		return
+	}
+
+	v.Lock()
+	delete(v.verified, clientID)
+	v.Unlock()
+}
+
+// Retrieves the key and verifies the secret; the secret is verified even if the key is
+// unknown or revoked so that every attempt takes the same time.
+func (v *APIKeyVerifier) verify(clientID, secret string) (key *store.APIKey, err error) {
+	if key, err = v.keys.RetrieveAPIKeyByClientID(clientID); err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			return nil, err
+		}
+
+		VerifyDerivedKey(dummyKey(), secret)
+		return nil, ErrInvalidAPIKey
+	}
+
+	var ok bool
+	if ok, err = VerifyDerivedKey(key.Secret, secret); err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if key.IsRevoked() {
+		return nil, ErrRevokedAPIKey
+	}
+	return key, nil
+}
+
+// Counts a failed attempt for the client ID and source in the current window.
+func (v *APIKeyVerifier) fail(attempt string, now time.Time) {
+	v.Lock()
+	defer v.Unlock()
+
+	failed, ok := v.failures[attempt]
+	if !ok || !now.Before(failed.reset) {
+		failed = &failedAttempts{reset: now.Add(failedAttemptsWindow)}
+		v.failures[attempt] = failed
+	}
+	failed.count++
+	v.sweep(now)
+}
+
+// Removes expired verifications and failed attempts so that attempts with many
+// different client IDs do not grow the maps without bound. Must hold the lock.
+func (v *APIKeyVerifier) sweep(now time.Time) {
+	if now.Sub(v.swept) < failedAttemptsWindow {
+		return
+	}
+	v.swept = now
+
+	for clientID, cached := range v.verified {
+		if !now.Before(cached.expires) {
+			delete(v.verified, clientID)
+		}
+	}
+
+	for attempt, failed := range v.failures {
+		if !now.Before(failed.reset) {
+			delete(v.failures, attempt)
+		}
+	}
+}
+
+// A derived key that unknown client IDs are verified against; its secret is discarded.
+var dummyKey = sync.OnceValue(func() string {
+	secret, _ := randomString(secretLength)
+	dk, _ := CreateDerivedKey(secret)
+	return dk
+})
+
+func apiKeyClaims(key *store.APIKey) *Claims {
+	claims := &Claims{
+		Name:        key.Description,
+		ClientID:    key.ClientID,
+		Permissions: key.Scopes,
+	}
+	claims.Subject = key.ID.String()
+	return claims
+}
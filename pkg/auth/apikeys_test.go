@@ -0,0 +1,149 @@
+package auth_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	clientID, secret, err := auth.GenerateAPIKey()
+	require.NoError(t, err)
+	require.Len(t, clientID, 24)
+	require.Len(t, secret, 48)
+
+	other, _, err := auth.GenerateAPIKey()
+	require.NoError(t, err)
+	require.NotEqual(t, clientID, other)
+}
+
+func TestDerivedKey(t *testing.T) {
+	dk, err := auth.CreateDerivedKey("supersecretsquirrel")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(dk, "$argon2id$v=19$m=19456,t=2,p=1$"))
+
+	// The salt is random so the same secret produces different derived keys
+	other, err := auth.CreateDerivedKey("supersecretsquirrel")
+	require.NoError(t, err)
+	require.NotEqual(t, dk, other)
+
+	ok, err := auth.VerifyDerivedKey(dk, "supersecretsquirrel")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = auth.VerifyDerivedKey(dk, "supersecretsquirre")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	testCases := []string{
+		"",
+		"$argon2i$v=19$m=19456,t=2,p=1$c2FsdA$a2V5",
+		"$argon2id$v=16$m=19456,t=2,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=foo$c2FsdA$a2V5",
+		"$argon2id$v=19$m=19456,t=2,p=1$!!$a2V5",
+		"$argon2id$v=19$m=19456,t=2,p=1$c2FsdA$!!",
+	}
+
+	for i, tc := range testCases {
+		_, err = auth.VerifyDerivedKey(tc, "supersecretsquirrel")
+		require.ErrorIs(t, err, auth.ErrInvalidDerivedKey, "test case %d failed", i)
+	}
+}
+
+func TestAPIKeyVerifier(t *testing.T) {
+	db, err := store.Open("memory://")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	const source = "192.0.2.1"
+	keys := &countingKeyStore{APIKeyStore: db}
+	verifier := auth.NewAPIKeyVerifier(keys)
+	clientID, secret := createAPIKey(t, db, "bob")
+
+	claims, err := verifier.Verify(clientID, secret, source)
+	require.NoError(t, err)
+	require.Equal(t, "bob", claims.Name)
+	require.Equal(t, clientID, claims.ClientID)
+	require.Equal(t, 1, keys.retrieved)
+
+	// Successful verifications are cached
+	claims, err = verifier.Verify(clientID, secret, source)
+	require.NoError(t, err)
+	require.Equal(t, "bob", claims.Name)
+	require.Equal(t, 1, keys.retrieved, "expected the verification to be cached")
+
+	// A wrong secret is not authenticated by the cached verification
+	_, err = verifier.Verify(clientID, "wrong", source)
+	require.ErrorIs(t, err, auth.ErrInvalidAPIKey)
+	require.Equal(t, 2, keys.retrieved)
+
+	// Unknown client IDs are rejected like a wrong secret
+	_, err = verifier.Verify("unknown", secret, source)
+	require.ErrorIs(t, err, auth.ErrInvalidAPIKey)
+
+	// Failed attempts are limited per client ID and source without verifying the secret
+	for i := 0; i < 4; i++ {
+		_, err = verifier.Verify(clientID, "wrong", source)
+		require.ErrorIs(t, err, auth.ErrInvalidAPIKey, "attempt %d failed", i)
+	}
+
+	retrieved := keys.retrieved
+	_, err = verifier.Verify(clientID, "wrong", source)
+	require.ErrorIs(t, err, auth.ErrTooManyAttempts)
+	require.Equal(t, retrieved, keys.retrieved)
+
+	// The cached verification is still used while the client ID is limited
+	_, err = verifier.Verify(clientID, secret, source)
+	require.NoError(t, err)
+
+	verifier.Forget(clientID)
+	_, err = verifier.Verify(clientID, secret, source)
+	require.ErrorIs(t, err, auth.ErrTooManyAttempts)
+
+	// Failed attempts from one source do not limit the client ID from other sources
+	_, err = verifier.Verify(clientID, secret, "192.0.2.2")
+	require.NoError(t, err)
+
+	_, err = verifier.Verify(clientID, "wrong", "192.0.2.3")
+	require.ErrorIs(t, err, auth.ErrInvalidAPIKey)
+
+	// Other client IDs are not limited
+	otherID, otherSecret := createAPIKey(t, db, "carol")
+	_, err = verifier.Verify(otherID, otherSecret, source)
+	require.NoError(t, err)
+
+	// Revoked keys are not authenticated once they are forgotten
+	key, err := db.RetrieveAPIKeyByClientID(otherID)
+	require.NoError(t, err)
+	_, err = db.RevokeAPIKey(key.ID)
+	require.NoError(t, err)
+
+	verifier.Forget(otherID)
+	_, err = verifier.Verify(otherID, otherSecret, source)
+	require.ErrorIs(t, err, auth.ErrRevokedAPIKey)
+
+	// A nil verifier does not accept API keys
+	var disabled *auth.APIKeyVerifier
+	_, err = disabled.Verify(clientID, secret, source)
+	require.ErrorIs(t, err, auth.ErrInvalidAPIKey)
+}
+
+func TestValidateScopes(t *testing.T) {
+	require.NoError(t, auth.ValidateScopes([]string{auth.ScopeInvoicesRead, auth.ScopePaymentsRefund}))
+	require.ErrorIs(t, auth.ValidateScopes(nil), auth.ErrNoScopes)
+	require.ErrorIs(t, auth.ValidateScopes([]string{auth.ScopeCustomersWrite, "invoices:delete"}), auth.ErrUnknownScope)
+}
+
+// Counts the API keys retrieved from the store to check that verifications are cached.
+type countingKeyStore struct {
+	auth.APIKeyStore
+	retrieved int
+}
+
+func (s *countingKeyStore) RetrieveAPIKeyByClientID(clientID string) (*store.APIKey, error) {
+	s.retrieved++
+	return s.APIKeyStore.RetrieveAPIKeyByClientID(clientID)
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the JWT claims of an Exchequer access token. The subject identifies the
+// user or service that the token was issued to. Requests authenticated with an API key
+// are also described by claims: the subject is the ID of the key, the client ID is set
+// and the permissions are the scopes of the key.
+type Claims struct {
+	jwt.RegisteredClaims
+	Name        string   `json:"name,omitempty"`
+	Email       string   `json:"email,omitempty"`
+	ClientID    string   `json:"client_id,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// HasPermission returns true if the permission was granted to the token holder, either
+// directly or by one of the roles assigned to the token holder.
+func (c *Claims) HasPermission(permission string) bool {
+	if slices.Contains(c.Permissions, permission) {
+		return true
+	}
+
+	for _, role := range c.Roles {
+		if slices.Contains(RolePermissions[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole returns true if the role was assigned to the token holder.
+func (c *Claims) HasRole(role string) bool {
+	return slices.Contains(c.Roles, role)
+}
+
+// LimitedRefunds returns true if the only grant of the refund permission comes from
+// the support role; support staff cannot issue refunds above the configured limit.
+func (c *Claims) LimitedRefunds() bool {
+	if !c.HasRole(RoleSupport) || slices.Contains(c.Permissions, ScopePaymentsRefund) {
+		return false
+	}
+
+	for _, role := range c.Roles {
+		if role != RoleSupport && slices.Contains(RolePermissions[role], ScopePaymentsRefund) {
+			return false
+		}
+	}
+	return true
+}
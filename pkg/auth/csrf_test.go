@@ -0,0 +1,79 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoubleCookies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		require.NoError(t, auth.SetCSRFCookies(c, "example.com", true))
+		c.Status(http.StatusOK)
+	})
+	router.GET("/resource", auth.DoubleCookies(), ok)
+	router.POST("/resource", auth.DoubleCookies(), ok)
+
+	// Loading a page sets the double-submit cookies
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	cookies := make(map[string]*http.Cookie)
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+
+	require.Contains(t, cookies, auth.CSRFCookie)
+	require.Contains(t, cookies, auth.CSRFReferenceCookie)
+	require.Equal(t, cookies[auth.CSRFCookie].Value, cookies[auth.CSRFReferenceCookie].Value)
+	require.False(t, cookies[auth.CSRFCookie].HttpOnly, "the front-end must be able to read the csrf token")
+	require.True(t, cookies[auth.CSRFReferenceCookie].HttpOnly)
+	require.True(t, cookies[auth.CSRFCookie].Secure)
+	require.Equal(t, http.SameSiteStrictMode, cookies[auth.CSRFCookie].SameSite)
+
+	token := cookies[auth.CSRFCookie].Value
+	other, err := auth.GenerateCSRFToken()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		method    string
+		reference string
+		header    string
+		authz     string
+		status    int
+	}{
+		{http.MethodGet, "", "", "", http.StatusOK},
+		{http.MethodPost, "", "", "", http.StatusForbidden},
+		{http.MethodPost, token, "", "", http.StatusForbidden},
+		{http.MethodPost, "", token, "", http.StatusForbidden},
+		{http.MethodPost, token, other, "", http.StatusForbidden},
+		{http.MethodPost, token, token, "", http.StatusOK},
+		{http.MethodPost, "", "", "Bearer token", http.StatusOK},
+	}
+
+	for i, tc := range testCases {
+		req := httptest.NewRequest(tc.method, "/resource", nil)
+		if tc.reference != "" {
+			req.AddCookie(&http.Cookie{Name: auth.CSRFReferenceCookie, Value: tc.reference})
+		}
+		if tc.header != "" {
+			req.Header.Set(auth.CSRFHeader, tc.header)
+		}
+		if tc.authz != "" {
+			req.Header.Set("Authorization", tc.authz)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, tc.status, w.Code, "test case %d failed", i)
+	}
+}
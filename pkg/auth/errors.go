@@ -0,0 +1,24 @@
+package auth
+
+import "errors"
+
+var (
+	ErrNoSigningKey      = errors.New("at least one token signing key is required")
+	ErrInvalidKeyID      = errors.New("token key id must be a valid ulid")
+	ErrMissingKeyID      = errors.New("token does not have a kid header")
+	ErrUnknownSigningKey = errors.New("token was not signed by a known key")
+	ErrMissingSubject    = errors.New("token claims must have a subject")
+	ErrInvalidToken      = errors.New("invalid access token")
+	ErrNoAuthorization   = errors.New("no authorization header in request")
+	ErrParseBearer       = errors.New("could not parse bearer token from authorization header")
+	ErrNoClaims          = errors.New("no claims found on the request context")
+	ErrNoScopes          = errors.New("at least one scope is required")
+	ErrUnknownScope      = errors.New("unknown scope")
+	ErrUnknownRole       = errors.New("unknown role")
+	ErrInvalidAPIKey     = errors.New("invalid api key client id or secret")
+	ErrRevokedAPIKey     = errors.New("api key has been revoked")
+	ErrTooManyAttempts   = errors.New("too many failed attempts to authenticate the api key")
+	ErrInvalidDerivedKey = errors.New("could not parse argon2 derived key")
+	ErrNoCSRFReference   = errors.New("no csrf reference cookie in request")
+	ErrCSRFVerification  = errors.New("csrf token header does not match reference cookie")
+)
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+)
+
+const (
+	authorization = "Authorization"
+	authenticate  = "WWW-Authenticate"
+	claimsKey     = "exchequer_claims"
+)
+
+var bearer = regexp.MustCompile(`^\s*[Bb]earer\s+([a-zA-Z0-9_\-\.]+)\s*$`)
+
+// Authenticate returns middleware that requires either a valid access token in the
+// Authorization header of the request or an API key client ID and secret using HTTP
+// basic authentication. The claims of the credentials are added to the gin context and
+// to the request context for downstream handlers; requests without valid credentials
+// are rejected with a 401 Unauthorized, or with a 429 Too Many Requests if there have
+// been too many failed attempts for the API key from the client IP address. If keys is nil, API keys are not
+// accepted.
+func Authenticate(tokens *TokenManager, keys *APIKeyVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var (
+			err    error
+			tks    string
+			claims *Claims
+		)
+
+		if clientID, secret, ok := c.Request.BasicAuth(); ok {
+			if claims, err = keys.Verify(clientID, secret, c.ClientIP()); err != nil {
+				c.Error(err)
+				if errors.Is(err, ErrTooManyAttempts) {
+					c.Header("Retry-After", strconv.Itoa(int(failedAttemptsWindow.Seconds())))
+					c.AbortWithStatusJSON(http.StatusTooManyRequests, api.Error("too many failed attempts, try again later"))
+					return
+				}
+
+				// NOTE: a Basic challenge is not sent so that browsers never prompt for
+				// and cache API key credentials, which would make them ambient.
+				c.Header(authenticate, `Bearer realm="exchequer", error="invalid_token"`)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, api.Error("invalid or revoked api key"))
+				return
+			}
+		} else {
+			if tks, err = GetBearerToken(c); err != nil {
+				c.Error(err)
+				c.Header(authenticate, `Bearer realm="exchequer"`)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, api.Error("this endpoint requires authentication"))
+				return
+			}
+
+			if claims, err = tokens.Verify(tks); err != nil {
+				c.Error(err)
+				c.Header(authenticate, `Bearer realm="exchequer", error="invalid_token"`)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, api.Error("invalid or expired access token"))
+				return
+			}
+		}
+
+		c.Set(claimsKey, claims)
+		c.Request = c.Request.WithContext(ContextWithClaims(c.Request.Context(), claims))
+		c.Next()
+	}
+}
+
+// Identify returns middleware that adds the claims of valid credentials to the gin
+// context and to the request context like Authenticate, but that does not reject
+// requests without valid credentials so that public endpoints can tell whether the
+// caller is authenticated with GetClaims.
+func Identify(tokens *TokenManager, keys *APIKeyVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var claims *Claims
+		if clientID, secret, ok := c.Request.BasicAuth(); ok {
+			claims, _ = keys.Verify(clientID, secret, c.ClientIP())
+		} else if tks, err := GetBearerToken(c); err == nil {
+			claims, _ = tokens.Verify(tks)
+		}
+
+		if claims != nil {
+			c.Set(claimsKey, claims)
+			c.Request = c.Request.WithContext(ContextWithClaims(c.Request.Context(), claims))
+		}
+		c.Next()
+	}
+}
+
+// GetBearerToken parses the access token from the Authorization header of the request.
+func GetBearerToken(c *gin.Context) (tks string, err error) {
+	header := c.GetHeader(authorization)
+	if header == "" {
+		return "", ErrNoAuthorization
+	}
+
+	match := bearer.FindStringSubmatch(header)
+	if len(match) != 2 {
+		return "", ErrParseBearer
+	}
+	return match[1], nil
+}
+
+// GetClaims returns the claims that were verified by the Authenticate middleware.
+func GetClaims(c *gin.Context) (*Claims, error) {
+	value, ok := c.Get(claimsKey)
+	if !ok {
+		return nil, ErrNoClaims
+	}
+
+	claims, ok := value.(*Claims)
+	if !ok {
+		return nil, ErrNoClaims
+	}
+	return claims, nil
+}
+
+//===========================================================================
+// Context Helpers
+//===========================================================================
+
+type contextKey uint8
+
+const contextKeyClaims contextKey = iota + 1
+
+// ContextWithClaims adds verified claims to the context.
+func ContextWithClaims(parent context.Context, claims *Claims) context.Context {
+	return context.WithValue(parent, contextKeyClaims, claims)
+}
+
+// ClaimsFromContext returns the verified claims from the context, if any.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKeyClaims).(*Claims)
+	return claims, ok
+}
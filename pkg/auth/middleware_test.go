@@ -0,0 +1,137 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens, err := auth.NewTokenManager(authConfig(t, 1))
+	require.NoError(t, err)
+
+	db, err := store.Open("memory://")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	clientID, secret := createAPIKey(t, db, "bob")
+	revokedID, revokedSecret := createAPIKey(t, db, "carol")
+	revoked, err := db.RetrieveAPIKeyByClientID(revokedID)
+	require.NoError(t, err)
+	_, err = db.RevokeAPIKey(revoked.ID)
+	require.NoError(t, err)
+
+	keys := auth.NewAPIKeyVerifier(db)
+	router := gin.New()
+	router.GET("/", auth.Authenticate(tokens, keys), func(c *gin.Context) {
+		claims, err := auth.GetClaims(c)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		if ctxClaims, ok := auth.ClaimsFromContext(c.Request.Context()); !ok || ctxClaims != claims {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.String(http.StatusOK, claims.Name)
+	})
+
+	// Identified requests are not rejected without valid credentials
+	router.GET("/identify", auth.Identify(tokens, keys), func(c *gin.Context) {
+		if claims, err := auth.GetClaims(c); err == nil {
+			c.String(http.StatusOK, claims.Name)
+			return
+		}
+		c.String(http.StatusOK, "anonymous")
+	})
+
+	tks, err := tokens.CreateAccessToken(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}, Name: "alice"})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		header string
+		status int
+		name   string
+	}{
+		{"", http.StatusUnauthorized, ""},
+		{basic("user", "pass"), http.StatusUnauthorized, ""},
+		{basic(clientID, "wrong"), http.StatusUnauthorized, ""},
+		{basic(revokedID, revokedSecret), http.StatusUnauthorized, ""},
+		{"Bearer", http.StatusUnauthorized, ""},
+		{"Bearer notatoken", http.StatusUnauthorized, ""},
+		{"Bearer " + tks + "x", http.StatusUnauthorized, ""},
+		{"Bearer " + tks, http.StatusOK, "alice"},
+		{"bearer  " + tks + " ", http.StatusOK, "alice"},
+		{basic(clientID, secret), http.StatusOK, "bob"},
+	}
+
+	for i, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, tc.status, w.Code, "test case %d failed", i)
+
+		if tc.status == http.StatusUnauthorized {
+			require.NotEmpty(t, w.Header().Get("WWW-Authenticate"), "test case %d failed", i)
+		} else {
+			require.Equal(t, tc.name, w.Body.String(), "test case %d failed", i)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/identify", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, "test case %d failed", i)
+		require.Empty(t, w.Header().Get("WWW-Authenticate"), "test case %d failed", i)
+
+		if tc.name == "" {
+			require.Equal(t, "anonymous", w.Body.String(), "test case %d failed", i)
+		} else {
+			require.Equal(t, tc.name, w.Body.String(), "test case %d failed", i)
+		}
+	}
+
+	// Too many failed attempts for an API key are rejected until the window ends
+	status := http.StatusUnauthorized
+	for i := 0; i <= 5 && status == http.StatusUnauthorized; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", basic(clientID, "wrong"))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		status = w.Code
+		if status == http.StatusTooManyRequests {
+			require.Equal(t, "60", w.Header().Get("Retry-After"))
+		}
+	}
+	require.Equal(t, http.StatusTooManyRequests, status)
+}
+
+// Creates an API key with the specified description, returning its client ID and secret.
+func createAPIKey(t *testing.T, db *store.Store, description string) (clientID, secret string) {
+	key, secret, err := auth.NewAPIKey(description, []string{auth.ScopeInvoicesRead})
+	require.NoError(t, err)
+	require.NoError(t, db.CreateAPIKey(key))
+	return key.ClientID, secret
+}
+
+func basic(username, password string) string {
+	req := &http.Request{Header: make(http.Header)}
+	req.SetBasicAuth(username, password)
+	return req.Header.Get("Authorization")
+}
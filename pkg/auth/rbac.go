@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/logger"
+)
+
+// Roles that can be assigned to operators in their access token claims.
+const (
+	RoleViewer  = "viewer"
+	RoleSupport = "support"
+	RoleFinance = "finance"
+	RoleAdmin   = "admin"
+)
+
+// RolePermissions maps each role to the permissions that it grants.
+var RolePermissions = map[string][]string{
+	RoleViewer: {
+		ScopeCustomersRead,
+		ScopeInvoicesRead,
+		ScopePaymentsRead,
+		ScopeEventsRead,
+		ScopeWebhooksRead,
+	},
+	RoleSupport: {
+		ScopeCustomersRead,
+		ScopeCustomersWrite,
+		ScopeInvoicesRead,
+		ScopePaymentsRead,
+		ScopePaymentsRefund,
+		ScopeEventsRead,
+		ScopeWebhooksRead,
+	},
+	RoleFinance: {
+		ScopeCustomersRead,
+		ScopeCustomersWrite,
+		ScopeInvoicesRead,
+		ScopeInvoicesWrite,
+		ScopePaymentsRead,
+		ScopePaymentsRefund,
+		ScopePaymentsVoid,
+		ScopeCreditsWrite,
+		ScopeEventsRead,
+		ScopeWebhooksRead,
+		ScopeAuditRead,
+	},
+	RoleAdmin: Scopes,
+}
+
+// ValidateRoles returns an error if any of the roles are unknown.
+func ValidateRoles(roles []string) error {
+	for _, role := range roles {
+		if _, ok := RolePermissions[role]; !ok {
+			return fmt.Errorf("%w %q", ErrUnknownRole, role)
+		}
+	}
+	return nil
+}
+
+// Authorize returns middleware that requires the claims added to the gin context by the
+// Authenticate middleware to have all of the specified permissions. Requests that are
+// not authorized are rejected with a 403 Forbidden. Every authorization decision is
+// logged with the request ID so that access to sensitive operations can be reviewed.
+func Authorize(permissions ...string) gin.HandlerFunc {
+	required := strings.Join(permissions, ",")
+	return func(c *gin.Context) {
+		log := logger.Tracing(c.Request.Context())
+
+		claims, err := GetClaims(c)
+		if err != nil {
+			c.Error(err)
+			log.Warn().Str("permissions", required).Str("path", c.FullPath()).Bool("authorized", false).Msg("authorization denied: no claims")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, api.Error("this endpoint requires authentication"))
+			return
+		}
+
+		for _, permission := range permissions {
+			if !claims.HasPermission(permission) {
+				log.Warn().
+					Str("subject", claims.Subject).
+					Strs("roles", claims.Roles).
+					Str("permissions", required).
+					Str("missing", permission).
+					Str("path", c.FullPath()).
+					Bool("authorized", false).
+					Msg("authorization denied")
+				c.AbortWithStatusJSON(http.StatusForbidden, api.Error("you do not have permission to perform this action"))
+				return
+			}
+		}
+
+		log.Info().
+			Str("subject", claims.Subject).
+			Strs("roles", claims.Roles).
+			Str("permissions", required).
+			Str("path", c.FullPath()).
+			Bool("authorized", true).
+			Msg("authorization granted")
+		c.Next()
+	}
+}
@@ -0,0 +1,113 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRolePermissions(t *testing.T) {
+	// Every role must only grant valid scopes
+	for role, permissions := range auth.RolePermissions {
+		require.NoError(t, auth.ValidateScopes(permissions), "role %s has invalid permissions", role)
+	}
+
+	require.NoError(t, auth.ValidateRoles([]string{auth.RoleViewer, auth.RoleAdmin}))
+	require.ErrorIs(t, auth.ValidateRoles([]string{"superuser"}), auth.ErrUnknownRole)
+
+	testCases := []struct {
+		claims     *auth.Claims
+		permission string
+		expected   bool
+	}{
+		{&auth.Claims{}, auth.ScopeCustomersRead, false},
+		{&auth.Claims{Roles: []string{auth.RoleViewer}}, auth.ScopeCustomersRead, true},
+		{&auth.Claims{Roles: []string{auth.RoleViewer}}, auth.ScopePaymentsRefund, false},
+		{&auth.Claims{Roles: []string{auth.RoleSupport}}, auth.ScopePaymentsRefund, true},
+		{&auth.Claims{Roles: []string{auth.RoleSupport}}, auth.ScopePaymentsVoid, false},
+		{&auth.Claims{Roles: []string{auth.RoleFinance}}, auth.ScopePaymentsVoid, true},
+		{&auth.Claims{Roles: []string{auth.RoleFinance}}, auth.ScopeAPIKeysManage, false},
+		{&auth.Claims{Roles: []string{auth.RoleAdmin}}, auth.ScopeAPIKeysManage, true},
+		{&auth.Claims{Roles: []string{auth.RoleFinance}}, auth.ScopeMaintenance, false},
+		{&auth.Claims{Roles: []string{auth.RoleAdmin}}, auth.ScopeMaintenance, true},
+		{&auth.Claims{Roles: []string{"superuser"}}, auth.ScopeAPIKeysManage, false},
+		{&auth.Claims{Permissions: []string{auth.ScopeInvoicesRead}}, auth.ScopeInvoicesRead, true},
+		{&auth.Claims{Permissions: []string{auth.ScopeInvoicesRead}, Roles: []string{auth.RoleViewer}}, auth.ScopeWebhooksRead, true},
+	}
+
+	for i, tc := range testCases {
+		require.Equal(t, tc.expected, tc.claims.HasPermission(tc.permission), "test case %d failed", i)
+	}
+}
+
+func TestLimitedRefunds(t *testing.T) {
+	testCases := []struct {
+		claims   *auth.Claims
+		expected bool
+	}{
+		{&auth.Claims{}, false},
+		{&auth.Claims{Roles: []string{auth.RoleViewer}}, false},
+		{&auth.Claims{Roles: []string{auth.RoleSupport}}, true},
+		{&auth.Claims{Roles: []string{auth.RoleSupport, auth.RoleViewer}}, true},
+		{&auth.Claims{Roles: []string{auth.RoleSupport, auth.RoleFinance}}, false},
+		{&auth.Claims{Roles: []string{auth.RoleAdmin, auth.RoleSupport}}, false},
+		{&auth.Claims{Roles: []string{auth.RoleSupport}, Permissions: []string{auth.ScopePaymentsRefund}}, false},
+		{&auth.Claims{Permissions: []string{auth.ScopePaymentsRefund}}, false},
+	}
+
+	for i, tc := range testCases {
+		require.Equal(t, tc.expected, tc.claims.LimitedRefunds(), "test case %d failed", i)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	logger.Discard()
+	t.Cleanup(logger.ResetLogger)
+	gin.SetMode(gin.TestMode)
+
+	tokens, err := auth.NewTokenManager(authConfig(t, 1))
+	require.NoError(t, err)
+
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router := gin.New()
+	router.GET("/unauthenticated", auth.Authorize(auth.ScopeCustomersRead), ok)
+	router.GET("/customers", auth.Authenticate(tokens, nil), auth.Authorize(auth.ScopeCustomersRead), ok)
+	router.POST("/refunds", auth.Authenticate(tokens, nil), auth.Authorize(auth.ScopePaymentsRead, auth.ScopePaymentsRefund), ok)
+
+	token := func(roles ...string) string {
+		tks, err := tokens.CreateAccessToken(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}, Roles: roles})
+		require.NoError(t, err)
+		return tks
+	}
+
+	testCases := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{http.MethodGet, "/unauthenticated", "", http.StatusUnauthorized},
+		{http.MethodGet, "/customers", token(), http.StatusForbidden},
+		{http.MethodGet, "/customers", token(auth.RoleViewer), http.StatusOK},
+		{http.MethodPost, "/refunds", token(auth.RoleViewer), http.StatusForbidden},
+		{http.MethodPost, "/refunds", token(auth.RoleSupport), http.StatusOK},
+		{http.MethodPost, "/refunds", token(auth.RoleAdmin), http.StatusOK},
+	}
+
+	for i, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, tc.status, w.Code, "test case %d failed", i)
+	}
+}
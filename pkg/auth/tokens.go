@@ -0,0 +1,255 @@
+/*
+Package auth issues and verifies the RS256 JWT access tokens that authenticate requests
+to the Exchequer v1 API. Tokens are signed with RSA keys generated by the tokenkey
+command; each key is identified by a ULID that is set as the kid header of the tokens it
+signs. Multiple keys may be configured to support key rotation: the most recently
+generated key (by ULID) signs new tokens and all configured keys verify tokens.
+*/
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+)
+
+// Tokens are only signed and verified with RS256.
+var signingMethod = jwt.SigningMethodRS256
+
+// TokenManager signs and verifies access tokens using the configured RSA keys.
+type TokenManager struct {
+	conf       config.AuthConfig
+	currentKID ulid.ULID
+	currentKey *rsa.PrivateKey
+	keys       map[ulid.ULID]*rsa.PublicKey
+	parser     *jwt.Parser
+	checkout   *jwt.Parser
+}
+
+// NewTokenManager loads the PEM encoded RSA keys specified by the configuration.
+func NewTokenManager(conf config.AuthConfig) (tm *TokenManager, err error) {
+	tm = &TokenManager{
+		conf: conf,
+		keys: make(map[ulid.ULID]*rsa.PublicKey, len(conf.Keys)),
+		parser: jwt.NewParser(
+			jwt.WithValidMethods([]string{signingMethod.Alg()}),
+			jwt.WithAudience(conf.Audience),
+			jwt.WithIssuer(conf.Issuer),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+		),
+		checkout: jwt.NewParser(
+			jwt.WithValidMethods([]string{signingMethod.Alg()}),
+			jwt.WithAudience(conf.Audience+checkoutAudience),
+			jwt.WithIssuer(conf.Issuer),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+		),
+	}
+
+	for kid, path := range conf.Keys {
+		var keyID ulid.ULID
+		if keyID, err = ulid.Parse(kid); err != nil {
+			return nil, fmt.Errorf("could not parse key id %q: %w", kid, err)
+		}
+
+		var key *rsa.PrivateKey
+		if key, err = LoadKey(path); err != nil {
+			return nil, err
+		}
+
+		if err = tm.AddKey(keyID, key); err != nil {
+			return nil, err
+		}
+	}
+
+	if ulids.IsZero(tm.currentKID) {
+		return nil, ErrNoSigningKey
+	}
+	return tm, nil
+}
+
+// AddKey adds a signing key to the token manager; if the key ID is more recent than the
+// current signing key, the new key is used to sign tokens from now on.
+func (tm *TokenManager) AddKey(keyID ulid.ULID, key *rsa.PrivateKey) error {
+	if ulids.IsZero(keyID) {
+		return ErrInvalidKeyID
+	}
+
+	if err := key.Validate(); err != nil {
+		return fmt.Errorf("invalid rsa key %s: %w", keyID, err)
+	}
+
+	tm.keys[keyID] = &key.PublicKey
+	if keyID.Compare(tm.currentKID) > 0 {
+		tm.currentKID = keyID
+		tm.currentKey = key
+	}
+	return nil
+}
+
+// CurrentKey returns the ID of the key that is used to sign new tokens.
+func (tm *TokenManager) CurrentKey() ulid.ULID {
+	return tm.currentKID
+}
+
+// CreateAccessToken signs a new access token for the claims. The registered claims are
+// populated by the token manager: a unique token ID, the configured issuer and
+// audience, and the issued at, not before and expiration times. Only the subject must
+// be specified by the caller, though an expiration before the configured access
+// duration may also be specified.
+func (tm *TokenManager) CreateAccessToken(claims *Claims) (_ string, err error) {
+	if claims.Subject == "" {
+		return "", ErrMissingSubject
+	}
+
+	now := time.Now()
+	expires := now.Add(tm.conf.AccessDuration)
+	if claims.ExpiresAt != nil && claims.ExpiresAt.Before(expires) {
+		expires = claims.ExpiresAt.Time
+	}
+
+	claims.ID = ulids.New().String()
+	claims.Issuer = tm.conf.Issuer
+	claims.Audience = jwt.ClaimStrings{tm.conf.Audience}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(expires)
+
+	token := jwt.NewWithClaims(signingMethod, claims)
+	token.Header["kid"] = tm.currentKID.String()
+	return token.SignedString(tm.currentKey)
+}
+
+// Verify the signature and the claims of an access token, returning the claims if the
+// token is valid. The key used to verify the token is selected by its kid header.
+func (tm *TokenManager) Verify(tks string) (claims *Claims, err error) {
+	claims = &Claims{}
+	if _, err = tm.parser.ParseWithClaims(tks, claims, tm.keyFunc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+//===========================================================================
+// Checkout Tokens
+//===========================================================================
+
+const (
+	// Checkout tokens are issued for a separate audience so that they cannot be used as
+	// access tokens and access tokens cannot be used to start a checkout.
+	checkoutAudience = "/checkout"
+
+	// How long a checkout link can be used to start a checkout session.
+	CheckoutTokenDuration = time.Hour
+)
+
+// CheckoutClaims are the claims of a checkout token; the subject is the customer that
+// the checkout session is started for and is used as the Adyen shopper reference.
+type CheckoutClaims struct {
+	jwt.RegisteredClaims
+	StorePaymentMethod bool `json:"store_payment_method,omitempty"`
+}
+
+// CreateCheckoutToken signs a token that allows the holder to start a checkout session
+// for the customer, optionally storing the payment method that is used.
+func (tm *TokenManager) CreateCheckoutToken(customerID string, storePaymentMethod bool) (_ string, expires time.Time, err error) {
+	if customerID == "" {
+		return "", time.Time{}, ErrMissingSubject
+	}
+
+	now := time.Now()
+	expires = now.Add(CheckoutTokenDuration)
+	claims := &CheckoutClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        ulids.New().String(),
+			Subject:   customerID,
+			Issuer:    tm.conf.Issuer,
+			Audience:  jwt.ClaimStrings{tm.conf.Audience + checkoutAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+		StorePaymentMethod: storePaymentMethod,
+	}
+
+	token := jwt.NewWithClaims(signingMethod, claims)
+	token.Header["kid"] = tm.currentKID.String()
+
+	var tks string
+	if tks, err = token.SignedString(tm.currentKey); err != nil {
+		return "", time.Time{}, err
+	}
+	return tks, expires.Truncate(time.Second), nil
+}
+
+// VerifyCheckoutToken verifies the signature and the claims of a checkout token.
+func (tm *TokenManager) VerifyCheckoutToken(tks string) (claims *CheckoutClaims, err error) {
+	claims = &CheckoutClaims{}
+	if _, err = tm.checkout.ParseWithClaims(tks, claims, tm.keyFunc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+
+	if claims.Subject == "" {
+		return nil, ErrMissingSubject
+	}
+	return claims, nil
+}
+
+func (tm *TokenManager) keyFunc(token *jwt.Token) (key any, err error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return nil, ErrMissingKeyID
+	}
+
+	var keyID ulid.ULID
+	if keyID, err = ulid.Parse(kid); err != nil {
+		return nil, ErrInvalidKeyID
+	}
+
+	if key, ok = tm.keys[keyID]; !ok {
+		return nil, ErrUnknownSigningKey
+	}
+	return key, nil
+}
+
+// LoadKey reads a PEM encoded RSA private key from disk in either PKCS1 format (as
+// generated by the tokenkey command) or PKCS8 format.
+func LoadKey(path string) (_ *rsa.PrivateKey, err error) {
+	var data []byte
+	if data, err = os.ReadFile(path); err != nil {
+		return nil, fmt.Errorf("could not read key from %s: %w", path, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("could not decode pem data from %s", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var key any
+		if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not an rsa key")
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("unhandled pem block type %q in %s", block.Type, path)
+	}
+}
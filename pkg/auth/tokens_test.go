@@ -0,0 +1,193 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenManager(t *testing.T) {
+	conf := authConfig(t, 1)
+	tokens, err := auth.NewTokenManager(conf)
+	require.NoError(t, err, "could not create token manager")
+
+	tks, err := tokens.CreateAccessToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"},
+		Email:            "alice@example.com",
+		Permissions:      []string{"invoices:read"},
+	})
+	require.NoError(t, err, "could not create access token")
+
+	claims, err := tokens.Verify(tks)
+	require.NoError(t, err, "could not verify access token")
+	require.Equal(t, "alice", claims.Subject)
+	require.Equal(t, "alice@example.com", claims.Email)
+	require.Equal(t, conf.Issuer, claims.Issuer)
+	require.Equal(t, jwt.ClaimStrings{conf.Audience}, claims.Audience)
+	require.True(t, claims.HasPermission("invoices:read"))
+	require.False(t, claims.HasPermission("payments:refund"))
+	require.WithinDuration(t, time.Now().Add(conf.AccessDuration), claims.ExpiresAt.Time, time.Second)
+
+	// The kid header identifies the signing key
+	token, _, err := jwt.NewParser().ParseUnverified(tks, &auth.Claims{})
+	require.NoError(t, err)
+	require.Equal(t, tokens.CurrentKey().String(), token.Header["kid"])
+
+	// A subject is required
+	_, err = tokens.CreateAccessToken(&auth.Claims{})
+	require.ErrorIs(t, err, auth.ErrMissingSubject)
+
+	// Expiration times cannot be extended past the access duration
+	tks, err = tokens.CreateAccessToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(48 * time.Hour))},
+	})
+	require.NoError(t, err)
+	claims, err = tokens.Verify(tks)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(conf.AccessDuration), claims.ExpiresAt.Time, time.Second)
+
+	// Tokens for a different audience or issuer are rejected
+	other := conf
+	other.Audience = "https://other.example.com"
+	others, err := auth.NewTokenManager(other)
+	require.NoError(t, err)
+
+	tks, err = others.CreateAccessToken(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}})
+	require.NoError(t, err)
+	_, err = tokens.Verify(tks)
+	require.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	other = conf
+	other.Issuer = "https://other.example.com"
+	others, err = auth.NewTokenManager(other)
+	require.NoError(t, err)
+
+	tks, err = others.CreateAccessToken(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}})
+	require.NoError(t, err)
+	_, err = tokens.Verify(tks)
+	require.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	// Expired tokens are rejected
+	tks, err = tokens.CreateAccessToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))},
+	})
+	require.NoError(t, err)
+	_, err = tokens.Verify(tks)
+	require.ErrorIs(t, err, jwt.ErrTokenExpired)
+
+	// Tokens signed with other algorithms are rejected
+	tks, err = jwt.NewWithClaims(jwt.SigningMethodHS256, &auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "alice",
+			Issuer:    conf.Issuer,
+			Audience:  jwt.ClaimStrings{conf.Audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}).SignedString([]byte("supersecret"))
+	require.NoError(t, err)
+	_, err = tokens.Verify(tks)
+	require.ErrorIs(t, err, auth.ErrInvalidToken)
+}
+
+func TestCheckoutTokens(t *testing.T) {
+	tokens, err := auth.NewTokenManager(authConfig(t, 1))
+	require.NoError(t, err, "could not create token manager")
+
+	tks, expires, err := tokens.CreateCheckoutToken("cust_1", true)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(auth.CheckoutTokenDuration), expires, time.Second)
+
+	claims, err := tokens.VerifyCheckoutToken(tks)
+	require.NoError(t, err)
+	require.Equal(t, "cust_1", claims.Subject)
+	require.True(t, claims.StorePaymentMethod)
+
+	_, _, err = tokens.CreateCheckoutToken("", false)
+	require.ErrorIs(t, err, auth.ErrMissingSubject)
+
+	// Checkout tokens and access tokens cannot be used in place of each other
+	_, err = tokens.Verify(tks)
+	require.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	access, err := tokens.CreateAccessToken(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "cust_1"}})
+	require.NoError(t, err)
+	_, err = tokens.VerifyCheckoutToken(access)
+	require.ErrorIs(t, err, auth.ErrInvalidToken)
+
+	_, err = tokens.VerifyCheckoutToken(tks + "x")
+	require.ErrorIs(t, err, auth.ErrInvalidToken)
+}
+
+func TestKeyRotation(t *testing.T) {
+	// Tokens signed by the old key are verified by a manager with both keys
+	conf := authConfig(t, 1)
+	old, err := auth.NewTokenManager(conf)
+	require.NoError(t, err)
+
+	oldTks, err := old.CreateAccessToken(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}})
+	require.NoError(t, err)
+
+	rotated := authConfig(t, 1)
+	for kid, path := range conf.Keys {
+		rotated.Keys[kid] = path
+	}
+
+	tokens, err := auth.NewTokenManager(rotated)
+	require.NoError(t, err)
+	require.NotEqual(t, old.CurrentKey(), tokens.CurrentKey(), "expected the newest key to sign tokens")
+
+	_, err = tokens.Verify(oldTks)
+	require.NoError(t, err, "expected token signed by the old key to be verified")
+
+	// Tokens signed by the new key are not verified by a manager that only has the old key
+	newTks, err := tokens.CreateAccessToken(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}})
+	require.NoError(t, err)
+
+	_, err = old.Verify(newTks)
+	require.ErrorIs(t, err, auth.ErrUnknownSigningKey)
+}
+
+func TestNewTokenManager(t *testing.T) {
+	_, err := auth.NewTokenManager(config.AuthConfig{})
+	require.ErrorIs(t, err, auth.ErrNoSigningKey)
+
+	_, err = auth.NewTokenManager(config.AuthConfig{Keys: map[string]string{"foo": "testdata/foo.pem"}})
+	require.Error(t, err, "expected invalid key id to be rejected")
+
+	_, err = auth.NewTokenManager(config.AuthConfig{Keys: map[string]string{ulid.Make().String(): "testdata/missing.pem"}})
+	require.Error(t, err, "expected missing key file to be rejected")
+}
+
+// Creates an auth configuration with the specified number of newly generated keys.
+func authConfig(t *testing.T, nkeys int) config.AuthConfig {
+	conf := config.AuthConfig{
+		Keys:           make(map[string]string, nkeys),
+		Audience:       "https://billing.example.com",
+		Issuer:         "https://auth.example.com",
+		AccessDuration: 15 * time.Minute,
+	}
+
+	dir := t.TempDir()
+	for i := 0; i < nkeys; i++ {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err, "could not generate rsa key")
+
+		kid := ulid.Make().String()
+		path := filepath.Join(dir, kid+".pem")
+		data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		require.NoError(t, os.WriteFile(path, data, 0600), "could not write rsa key")
+		conf.Keys[kid] = path
+	}
+	return conf
+}
@@ -0,0 +1,154 @@
+/*
+Package certs loads the certificates used by the server to terminate TLS and reloads
+them when they change on disk, e.g. when cert-manager renews a certificate mounted from
+a kubernetes secret, so that certificates can be rotated without restarting the server.
+*/
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNoClientCAs = errors.New("no pem encoded certificates found in client ca file")
+
+// Reloader serves the TLS configuration for each connection, checking the certificate,
+// key, and client CA files for changes at most once per reload interval. If the files
+// have changed but cannot be loaded (e.g. because the certificate has been written but
+// the key has not) the previous configuration is served until the files are valid.
+type Reloader struct {
+	sync.RWMutex
+	conf       config.TLSConfig
+	minVersion uint16
+	current    *tls.Config
+	modified   time.Time
+	checked    time.Time
+}
+
+// New loads the certificates specified by the configuration, returning an error if
+// they cannot be loaded so that the server does not start with an invalid config.
+func New(conf config.TLSConfig) (r *Reloader, err error) {
+	r = &Reloader{conf: conf}
+	if r.minVersion, err = conf.Version(); err != nil {
+		return nil, err
+	}
+
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Config returns the TLS configuration for an http.Server; the configuration of each
+// connection is returned by the reloader so that it always uses the latest certificate.
+func (r *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:         r.minVersion,
+		GetConfigForClient: r.GetConfigForClient,
+	}
+}
+
+// GetConfigForClient implements the tls.Config callback, reloading the certificates if
+// the files have been modified since they were last loaded.
+func (r *Reloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.RLock()
+	check := time.Since(r.checked) >= r.conf.ReloadInterval
+	r.RUnlock()
+
+	if check {
+		r.reloadIfModified()
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+	return r.current, nil
+}
+
+// Reload the certificate, key, and client CAs from disk.
+func (r *Reloader) Reload() (err error) {
+	var modified time.Time
+	if modified, err = r.lastModified(); err != nil {
+		return err
+	}
+
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile); err != nil {
+		return fmt.Errorf("could not load tls certificate: %w", err)
+	}
+
+	conf := &tls.Config{
+		MinVersion:   r.minVersion,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.conf.ClientCAFile != "" {
+		var data []byte
+		if data, err = os.ReadFile(r.conf.ClientCAFile); err != nil {
+			return fmt.Errorf("could not read client ca file: %w", err)
+		}
+
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(data) {
+			return ErrNoClientCAs
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.Lock()
+	r.current = conf
+	r.modified = modified
+	r.checked = time.Now()
+	r.Unlock()
+	return nil
+}
+
+func (r *Reloader) reloadIfModified() {
+	modified, err := r.lastModified()
+
+	r.Lock()
+	r.checked = time.Now()
+	unchanged := err == nil && !modified.After(r.modified)
+	r.Unlock()
+
+	if unchanged {
+		return
+	}
+
+	if err == nil {
+		err = r.Reload()
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Msg("could not reload tls certificates, continuing to serve previous certificates")
+		return
+	}
+	log.Info().Str("cert_file", r.conf.CertFile).Msg("tls certificates reloaded")
+}
+
+// Returns the most recent modification time of the certificate files.
+func (r *Reloader) lastModified() (modified time.Time, err error) {
+	for _, path := range []string{r.conf.CertFile, r.conf.KeyFile, r.conf.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+
+		var info os.FileInfo
+		if info, err = os.Stat(path); err != nil {
+			return modified, fmt.Errorf("could not stat %s: %w", path, err)
+		}
+
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
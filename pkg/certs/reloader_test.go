@@ -0,0 +1,240 @@
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/certs"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloader(t *testing.T) {
+	logger.Discard()
+	t.Cleanup(logger.ResetLogger)
+
+	dir := t.TempDir()
+	ca := newCA(t)
+	conf := config.TLSConfig{
+		CertFile:       filepath.Join(dir, "tls.crt"),
+		KeyFile:        filepath.Join(dir, "tls.key"),
+		MinVersion:     "1.2",
+		ReloadInterval: time.Millisecond,
+	}
+
+	// The certificates must be valid when the reloader is created
+	_, err := certs.New(conf)
+	require.Error(t, err, "expected error when certificate files do not exist")
+
+	ca.writeCert(t, conf.CertFile, conf.KeyFile, 1, false)
+	reloader, err := certs.New(conf)
+	require.NoError(t, err, "could not create reloader")
+
+	addr := serve(t, reloader.Config())
+	client := ca.client(nil, 0)
+
+	serial, err := get(client, addr)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), serial)
+
+	// Rotated certificates are served once they have been modified on disk
+	ca.writeCert(t, conf.CertFile, conf.KeyFile, 2, false)
+	touch(t, conf.CertFile, conf.KeyFile)
+
+	serial, err = get(client, addr)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), serial)
+
+	// Invalid certificates are not loaded and the previous certificate is served
+	require.NoError(t, os.WriteFile(conf.CertFile, []byte("not a certificate"), 0600))
+	touch(t, conf.CertFile)
+
+	serial, err = get(client, addr)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), serial)
+
+	ca.writeCert(t, conf.CertFile, conf.KeyFile, 3, false)
+	touch(t, conf.CertFile, conf.KeyFile)
+
+	serial, err = get(client, addr)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), serial)
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t)
+	conf := config.TLSConfig{
+		CertFile:       filepath.Join(dir, "tls.crt"),
+		KeyFile:        filepath.Join(dir, "tls.key"),
+		ClientCAFile:   filepath.Join(dir, "ca.crt"),
+		MinVersion:     "1.3",
+		ReloadInterval: time.Minute,
+	}
+
+	ca.writeCert(t, conf.CertFile, conf.KeyFile, 1, false)
+	require.NoError(t, os.WriteFile(conf.ClientCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+
+	reloader, err := certs.New(conf)
+	require.NoError(t, err, "could not create reloader")
+	addr := serve(t, reloader.Config())
+
+	// Clients must present a certificate signed by the client CA
+	_, err = get(ca.client(nil, 0), addr)
+	require.Error(t, err, "expected client without a certificate to be rejected")
+
+	clientCert := ca.issue(t, 10, true)
+	serial, err := get(ca.client(&clientCert, 0), addr)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), serial)
+
+	other := newCA(t).issue(t, 11, true)
+	_, err = get(ca.client(&other, 0), addr)
+	require.Error(t, err, "expected client certificate from another ca to be rejected")
+
+	// Clients must support the minimum TLS version
+	_, err = get(ca.client(&clientCert, tls.VersionTLS12), addr)
+	require.Error(t, err, "expected tls 1.2 client to be rejected")
+
+	// The client CA file must contain certificates
+	require.NoError(t, os.WriteFile(conf.ClientCAFile, []byte("no certificates here"), 0600))
+	_, err = certs.New(conf)
+	require.ErrorIs(t, err, certs.ErrNoClientCAs)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Exchequer Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// Issues a server (or client) certificate for localhost with the specified serial.
+func (ca *testCA) issue(t *testing.T, serial int64, client bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	usage := x509.ExtKeyUsageServerAuth
+	if client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) writeCert(t *testing.T, certPath, keyPath string, serial int64, client bool) {
+	cert := ca.issue(t, serial, client)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+// Creates a client that trusts the CA and does not reuse connections so that every
+// request performs a new handshake.
+func (ca *testCA) client(cert *tls.Certificate, maxVersion uint16) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	conf := &tls.Config{RootCAs: pool, MaxVersion: maxVersion}
+	if cert != nil {
+		conf.Certificates = []tls.Certificate{*cert}
+	}
+
+	return &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: conf, DisableKeepAlives: true},
+	}
+}
+
+// Serves https requests with the tls config, returning the address of the server.
+func serve(t *testing.T, conf *tls.Config) string {
+	sock, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}),
+		ReadHeaderTimeout: time.Second,
+	}
+
+	go srv.Serve(sock)
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + sock.Addr().String()
+}
+
+// Makes a request to the server and returns the serial number of its certificate.
+func get(client *http.Client, addr string) (int64, error) {
+	rep, err := client.Get(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer rep.Body.Close()
+	return rep.TLS.PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+// Updates the modification time of the files so that they are detected as changed
+// even if they were written within the resolution of the filesystem's timestamps.
+func touch(t *testing.T, paths ...string) {
+	modified := time.Now().Add(time.Duration(len(paths)) * time.Second)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		if info.ModTime().After(modified) {
+			modified = info.ModTime().Add(time.Second)
+		}
+	}
+
+	for _, path := range paths {
+		require.NoError(t, os.Chtimes(path, modified, modified))
+	}
+	time.Sleep(5 * time.Millisecond)
+}
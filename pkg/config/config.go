@@ -1,11 +1,15 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
 	"github.com/rs/zerolog"
 
 	"github.com/rotationalio/confire"
@@ -22,14 +26,50 @@ const Prefix = "exchequer"
 // values that are omitted. The Config should be validated in preparation for running
 // the server to ensure that all server operations work as expected.
 type Config struct {
-	Maintenance bool                `default:"false" desc:"if true, the node will start in maintenance mode"`
-	Mode        string              `default:"release" desc:"specify the mode of the server (release, debug, testing)"`
-	LogLevel    logger.LevelDecoder `split_words:"true" default:"info" desc:"specify the verbosity of logging (trace, debug, info, warn, error, fatal panic)"`
-	ConsoleLog  bool                `split_words:"true" default:"false" desc:"if true logs colorized human readable output instead of json"`
-	BindAddr    string              `split_words:"true" default:"8204" desc:"the ip address and port to bind the web service on"`
-	Origin      string              `default:"http://localhost:8204" desc:"origin (url) of the user interface for CORS access"`
-	Adyen       AdyenConfig
-	processed   bool
+	Maintenance    bool                `default:"false" desc:"if true, the node will start in maintenance mode; otherwise the mode stored in the database is kept"`
+	Mode           string              `default:"release" desc:"specify the mode of the server (release, debug, testing)"`
+	LogLevel       logger.LevelDecoder `split_words:"true" default:"info" desc:"specify the verbosity of logging (trace, debug, info, warn, error, fatal panic)"`
+	ConsoleLog     bool                `split_words:"true" default:"false" desc:"if true logs colorized human readable output instead of json"`
+	BindAddr       string              `split_words:"true" default:"8204" desc:"the ip address and port to bind the web service on"`
+	Origin         string              `default:"http://localhost:8204" desc:"origin (url) of the user interface for CORS access"`
+	TrustedProxies []string            `split_words:"true" desc:"ip addresses or cidr ranges of the proxies whose X-Forwarded-For headers are trusted for the client ip; if empty the remote address is used"`
+	DatabaseURL    string              `split_words:"true" default:"leveldb:///data/db" desc:"the url of the database to store billing records in (leveldb:///path or memory://)"`
+	TLS            TLSConfig
+	Auth           AuthConfig
+	Adyen          AdyenConfig
+	Webhooks       WebhooksConfig
+	Health         HealthConfig
+	Pagination     PaginationConfig
+	Tracing        TracingConfig
+	processed      bool
+}
+
+// TLSConfig enables TLS termination in the server for deployments that do not terminate
+// TLS at an ingress. TLS is enabled if a certificate and key are specified; the files
+// are checked for changes and reloaded so that certificates can be rotated on disk.
+type TLSConfig struct {
+	CertFile       string        `split_words:"true" desc:"path to the PEM encoded certificate (and intermediates) to serve; if empty, TLS is not terminated by the server"`
+	KeyFile        string        `split_words:"true" desc:"path to the PEM encoded private key of the certificate"`
+	ClientCAFile   string        `split_words:"true" desc:"path to PEM encoded ca certificates; if set clients must present a certificate signed by one of them (mTLS)"`
+	MinVersion     string        `split_words:"true" default:"1.2" desc:"the minimum TLS version accepted by the server (1.2 or 1.3)"`
+	ReloadInterval time.Duration `split_words:"true" default:"1m" desc:"how often to check the certificate files for changes"`
+}
+
+// AuthConfig manages the RSA keys used to sign and verify the JWT access tokens that
+// authenticate requests to the v1 API. Keys are generated with the tokenkey command.
+type AuthConfig struct {
+	Keys           map[string]string `required:"true" desc:"a map of ulid key ids to paths of PEM encoded rsa private keys (keyid:path,keyid:path)"`
+	Audience       string            `default:"exchequer" desc:"the audience claim of the access tokens issued and verified by the server"`
+	Issuer         string            `default:"exchequer" desc:"the issuer claim of the access tokens issued and verified by the server"`
+	AccessDuration time.Duration     `split_words:"true" default:"1h" desc:"the amount of time that issued access tokens are valid for"`
+	RefundLimits   map[string]int64  `split_words:"true" default:"EUR:10000,USD:10000,GBP:10000" desc:"the maximum refund in minor units that support staff can issue by currency (currency:limit,currency:limit); support staff cannot refund other currencies"`
+}
+
+// RefundLimit returns the maximum refund in minor units of the currency that support
+// staff can issue, or false if support staff cannot refund payments in the currency.
+func (c AuthConfig) RefundLimit(currency string) (int64, bool) {
+	limit, ok := c.RefundLimits[strings.ToUpper(currency)]
+	return limit, ok
 }
 
 type AdyenConfig struct {
@@ -39,6 +79,7 @@ type AdyenConfig struct {
 	Live            bool   `default:"false" desc:"set to true to enable live payments and access to the live environment"`
 	URLPrefix       string `split_words:"true" desc:"the live endpoint url prefix used to access the live environment"`
 	Webhook         AdyenWebhookConfig
+	Reports         AdyenReportsConfig
 }
 
 type AdyenWebhookConfig struct {
@@ -47,6 +88,74 @@ type AdyenWebhookConfig struct {
 	Password     string `default:"" desc:"if basic auth is enabled, provide the configured password in plaintext"`
 	VerifyHMAC   bool   `split_words:"true" default:"false" desc:"if true, verify the hmac in the additional details of the webhook"`
 	HMACSecret   string `split_words:"true" desc:"specify the configured hmac secret for message verification"`
+
+	// Adyen signs the management, report, balance platform and transfer webhooks with
+	// the hmac key of each webhook configuration; if a key is not specified the hmac
+	// secret of the standard webhook is used instead.
+	ManagementHMACSecret      string `split_words:"true" desc:"the hmac key of the management webhook configured in adyen"`
+	ReportHMACSecret          string `split_words:"true" desc:"the hmac key of the balance platform report webhook configured in adyen"`
+	BalancePlatformHMACSecret string `split_words:"true" desc:"the hmac key of the balance platform configuration webhook configured in adyen"`
+	TransferHMACSecret        string `split_words:"true" desc:"the hmac key of the balance platform transfer webhook configured in adyen"`
+}
+
+// AdyenReportsConfig manages the download of the settlement detail reports that Adyen
+// makes available after each settlement batch so that they can be reconciled against
+// the payment records of Exchequer. Reports are downloaded with the credentials of an
+// Adyen report user, either an API key or a username and password.
+type AdyenReportsConfig struct {
+	Reconcile bool          `default:"false" desc:"if true, settlement detail reports are downloaded and reconciled when adyen notifies that they are available"`
+	Username  string        `desc:"the username of the adyen report user (e.g. report@Company.YourCompany)"`
+	Password  string        `desc:"the password of the adyen report user"`
+	APIKey    string        `split_words:"true" desc:"the api key of the adyen report user; used instead of the username and password if specified"`
+	Timeout   time.Duration `default:"1m" desc:"the timeout for downloading a report"`
+
+	// Payments are settled in a later batch than the one in which they were captured if
+	// they were captured shortly before the batch closed or if their payment method has a
+	// longer settlement delay, so records are only missing from a report if they were
+	// created more than this delay before the latest line of the report.
+	SettlementDelay time.Duration `split_words:"true" default:"24h" desc:"how long after a payment is recorded it is expected to be in a settlement report"`
+}
+
+// WebhooksConfig manages the delivery of billing events to the webhook endpoints that
+// internal services register with Exchequer (as opposed to the Adyen webhooks).
+type WebhooksConfig struct {
+	Workers        int           `default:"4" desc:"the number of concurrent webhook deliveries"`
+	MaxAttempts    int           `split_words:"true" default:"8" desc:"the maximum number of attempts to deliver an event before it is marked failed"`
+	Timeout        time.Duration `default:"10s" desc:"the timeout for each webhook delivery request"`
+	InitialBackoff time.Duration `split_words:"true" default:"30s" desc:"the delay before the first retry of a failed delivery"`
+	MaxBackoff     time.Duration `split_words:"true" default:"1h" desc:"the maximum delay between retries of a failed delivery"`
+	PollInterval   time.Duration `split_words:"true" default:"5s" desc:"how often to check for deliveries that are ready to be retried"`
+}
+
+// HealthConfig manages the dependency checks that determine whether the server is ready
+// to receive traffic and that are reported by the status endpoint.
+type HealthConfig struct {
+	Timeout            time.Duration `default:"5s" desc:"the maximum time to wait for health checks to complete; if zero checks are not timed out"`
+	WebhookBacklog     int           `split_words:"true" default:"1000" desc:"the number of pending webhook deliveries above which the server is degraded; if zero the backlog is not checked"`
+	AdyenProbe         bool          `split_words:"true" default:"false" desc:"if true, the server is degraded if the adyen api does not accept the configured api key"`
+	AdyenProbeInterval time.Duration `split_words:"true" default:"5m" desc:"how long the result of the adyen probe is cached to limit requests to adyen"`
+}
+
+// PaginationConfig manages the page tokens and page sizes of list endpoints. Replicas of
+// the server must share the secret so that page tokens issued by one replica can be
+// used with another; if no secret is configured a random secret is generated when the
+// server starts and page tokens are invalidated when the server restarts.
+type PaginationConfig struct {
+	Secret          string `desc:"hex encoded key of at least 16 bytes used to sign page tokens"`
+	DefaultPageSize int    `split_words:"true" default:"50" desc:"the number of results in a page if the request does not specify a page size"`
+	MaxPageSize     int    `split_words:"true" default:"200" desc:"the maximum number of results in a page"`
+}
+
+// TracingConfig configures the OpenTelemetry spans that are exported for API requests,
+// Adyen webhook notifications, and calls to the Adyen API.
+type TracingConfig struct {
+	Enabled     bool    `default:"false" desc:"if true, spans are exported to the configured exporter"`
+	Exporter    string  `default:"otlp" desc:"the span exporter to use (otlp or memory for tests)"`
+	Endpoint    string  `desc:"the host:port of the otlp http collector; if empty the OTEL_EXPORTER_OTLP_* environment is used"`
+	Insecure    bool    `default:"false" desc:"if true, spans are exported to the collector without tls"`
+	SampleRatio float64 `split_words:"true" default:"1.0" desc:"the fraction of traces started by exchequer that are sampled; remote sampling decisions are respected"`
+	ServiceName string  `split_words:"true" default:"exchequer" desc:"the service name recorded on exported spans"`
+	GCPProject  string  `split_words:"true" desc:"the google cloud project id used to correlate log entries with traces"`
 }
 
 func New() (conf Config, err error) {
@@ -62,6 +171,16 @@ func New() (conf Config, err error) {
 	return conf, nil
 }
 
+// Mark a manually constructed config as processed as long as it is valid; used to
+// create configurations for tests without loading them from the environment.
+func (c Config) Mark() (_ Config, err error) {
+	if err = c.Validate(); err != nil {
+		return c, err
+	}
+	c.processed = true
+	return c, nil
+}
+
 // Returns true if the config has not been correctly processed from the environment.
 func (c Config) IsZero() bool {
 	return !c.processed
@@ -75,10 +194,34 @@ func (c Config) Validate() (err error) {
 		return fmt.Errorf("invalid configuration: %q is not a valid gin mode", c.Mode)
 	}
 
+	if err = c.TLS.Validate(); err != nil {
+		return err
+	}
+
+	if err = c.Auth.Validate(); err != nil {
+		return err
+	}
+
 	if err = c.Adyen.Validate(); err != nil {
 		return err
 	}
 
+	if err = c.Webhooks.Validate(); err != nil {
+		return err
+	}
+
+	if err = c.Health.Validate(); err != nil {
+		return err
+	}
+
+	if err = c.Pagination.Validate(); err != nil {
+		return err
+	}
+
+	if err = c.Tracing.Validate(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -86,6 +229,78 @@ func (c Config) GetLogLevel() zerolog.Level {
 	return zerolog.Level(c.LogLevel)
 }
 
+// Enabled returns true if the server should terminate TLS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// Version returns the minimum TLS version as a crypto/tls constant.
+func (c TLSConfig) Version() (uint16, error) {
+	switch c.MinVersion {
+	case "1.2", "":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid configuration: %q is not a supported tls version", c.MinVersion)
+	}
+}
+
+func (c TLSConfig) Validate() error {
+	if !c.Enabled() {
+		if c.ClientCAFile != "" {
+			return errors.New("invalid configuration: a tls certificate and key are required to verify client certificates")
+		}
+		return nil
+	}
+
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("invalid configuration: both a tls certificate and key are required")
+	}
+
+	if _, err := c.Version(); err != nil {
+		return err
+	}
+
+	if c.ReloadInterval <= 0 {
+		return errors.New("invalid configuration: tls reload interval must be positive")
+	}
+
+	return nil
+}
+
+func (c AuthConfig) Validate() error {
+	if len(c.Keys) == 0 {
+		return errors.New("invalid configuration: at least one token key is required")
+	}
+
+	for keyID := range c.Keys {
+		if _, err := ulid.Parse(keyID); err != nil {
+			return fmt.Errorf("invalid configuration: token key id %q is not a ulid", keyID)
+		}
+	}
+
+	if c.Audience == "" || c.Issuer == "" {
+		return errors.New("invalid configuration: token audience and issuer are required")
+	}
+
+	if c.AccessDuration <= 0 {
+		return errors.New("invalid configuration: access token duration must be positive")
+	}
+
+	for currency, limit := range c.RefundLimits {
+		if len(currency) != 3 || strings.ToUpper(currency) != currency {
+			return fmt.Errorf("invalid configuration: refund limit currency %q is not an uppercase ISO currency code", currency)
+		}
+
+		if limit < 0 {
+			return fmt.Errorf("invalid configuration: support refund limit for %s cannot be negative", currency)
+		}
+	}
+
+	return nil
+}
+
 func (c AdyenConfig) Validate() error {
 	if c.Live {
 		if c.URLPrefix == "" {
@@ -93,6 +308,10 @@ func (c AdyenConfig) Validate() error {
 		}
 	}
 
+	if err := c.Reports.Validate(); err != nil {
+		return err
+	}
+
 	if err := c.Webhook.Validate(); err != nil {
 		return err
 	}
@@ -115,6 +334,83 @@ func (c AdyenWebhookConfig) Validate() error {
 		if _, err := hex.DecodeString(c.HMACSecret); err != nil {
 			return errors.New("invalid configuration:  hmac secret must be a hex encoded string")
 		}
+
+		for _, secret := range []string{c.ManagementHMACSecret, c.ReportHMACSecret, c.BalancePlatformHMACSecret, c.TransferHMACSecret} {
+			if _, err := hex.DecodeString(secret); err != nil {
+				return errors.New("invalid configuration: webhook hmac keys must be hex encoded strings")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c AdyenReportsConfig) Validate() error {
+	if c.Reconcile && c.APIKey == "" && (c.Username == "" || c.Password == "") {
+		return errors.New("invalid configuration: an api key or username and password are required to download reports")
+	}
+
+	if c.SettlementDelay < 0 {
+		return errors.New("invalid configuration: settlement delay cannot be negative")
+	}
+	return nil
+}
+
+func (c WebhooksConfig) Validate() error {
+	if c.Workers < 1 {
+		return errors.New("invalid configuration: at least one webhook worker is required")
+	}
+
+	if c.MaxAttempts < 1 {
+		return errors.New("invalid configuration: webhook max attempts must be at least 1")
+	}
+
+	if c.InitialBackoff > c.MaxBackoff {
+		return errors.New("invalid configuration: webhook initial backoff cannot exceed max backoff")
+	}
+
+	return nil
+}
+
+func (c HealthConfig) Validate() error {
+	if c.Timeout < 0 {
+		return errors.New("invalid configuration: health check timeout cannot be negative")
+	}
+
+	if c.WebhookBacklog < 0 {
+		return errors.New("invalid configuration: webhook backlog threshold cannot be negative")
+	}
+
+	if c.AdyenProbe && c.AdyenProbeInterval <= 0 {
+		return errors.New("invalid configuration: adyen probe interval must be positive")
+	}
+
+	return nil
+}
+
+func (c PaginationConfig) Validate() error {
+	if c.Secret != "" {
+		if key, err := hex.DecodeString(c.Secret); err != nil || len(key) < 16 {
+			return errors.New("invalid configuration: pagination secret must be a hex encoded key of at least 16 bytes")
+		}
+	}
+
+	if c.DefaultPageSize < 1 || c.MaxPageSize < c.DefaultPageSize {
+		return errors.New("invalid configuration: default page size must be at least 1 and cannot exceed the max page size")
+	}
+
+	return nil
+}
+
+func (c TracingConfig) Validate() error {
+	if c.Enabled {
+		if c.Exporter != "otlp" && c.Exporter != "memory" {
+			return fmt.Errorf("invalid configuration: %q is not a valid span exporter", c.Exporter)
+		}
+
+		if c.SampleRatio < 0 || c.SampleRatio > 1 {
+			return errors.New("invalid configuration: trace sample ratio must be between 0 and 1")
+		}
 	}
 
 	return nil
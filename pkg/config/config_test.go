@@ -3,6 +3,7 @@ package config_test
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/rotationalio/exchequer/pkg/config"
 	"github.com/rs/zerolog"
@@ -10,22 +11,60 @@ import (
 )
 
 var testEnv = map[string]string{
-	"EXCHEQUER_MAINTENANCE":                  "true",
-	"EXCHEQUER_MODE":                         "test",
-	"EXCHEQUER_LOG_LEVEL":                    "debug",
-	"EXCHEQUER_CONSOLE_LOG":                  "true",
-	"EXCHEQUER_BIND_ADDR":                    ":9000",
-	"EXCHEQUER_ORIGIN":                       "http://localhost:9000",
-	"EXCHEQUER_ADYEN_MERCHANT_ACCOUNT":       "MyCompanyECOM",
-	"EXCHEQUER_ADYEN_API_KEY":                "my api key",
-	"EXCHEQUER_ADYEN_CLIENT_KEY":             "my client key",
-	"EXCHEQUER_ADYEN_LIVE":                   "true",
-	"EXCHEQUER_ADYEN_URL_PREFIX":             "1797a841fbb37ca7-AdyenDemo",
-	"EXCHEQUER_ADYEN_WEBHOOK_USE_BASIC_AUTH": "true",
-	"EXCHEQUER_ADYEN_WEBHOOK_USERNAME":       "admin",
-	"EXCHEQUER_ADYEN_WEBHOOK_PASSWORD":       "supersecretpassword",
-	"EXCHEQUER_ADYEN_WEBHOOK_VERIFY_HMAC":    "true",
-	"EXCHEQUER_ADYEN_WEBHOOK_HMAC_SECRET":    "44782DEF547AAA06C910C43932B1EB0C71FC68D9D0C057550C48EC2ACF6BA056",
+	"EXCHEQUER_MAINTENANCE":                          "true",
+	"EXCHEQUER_MODE":                                 "test",
+	"EXCHEQUER_LOG_LEVEL":                            "debug",
+	"EXCHEQUER_CONSOLE_LOG":                          "true",
+	"EXCHEQUER_BIND_ADDR":                            ":9000",
+	"EXCHEQUER_ORIGIN":                               "http://localhost:9000",
+	"EXCHEQUER_TRUSTED_PROXIES":                      "10.0.0.0/8,192.168.1.1",
+	"EXCHEQUER_DATABASE_URL":                         "leveldb:///tmp/exchequer/db",
+	"EXCHEQUER_TLS_CERT_FILE":                        "/etc/exchequer/tls/tls.crt",
+	"EXCHEQUER_TLS_KEY_FILE":                         "/etc/exchequer/tls/tls.key",
+	"EXCHEQUER_TLS_CLIENT_CA_FILE":                   "/etc/exchequer/tls/ca.crt",
+	"EXCHEQUER_TLS_MIN_VERSION":                      "1.3",
+	"EXCHEQUER_TLS_RELOAD_INTERVAL":                  "30s",
+	"EXCHEQUER_AUTH_KEYS":                            "01J9ZJ4HQKX3GTEPJ6N0HFSW3M:testdata/01J9ZJ4HQKX3GTEPJ6N0HFSW3M.pem",
+	"EXCHEQUER_AUTH_AUDIENCE":                        "https://billing.example.com",
+	"EXCHEQUER_AUTH_ISSUER":                          "https://auth.example.com",
+	"EXCHEQUER_AUTH_ACCESS_DURATION":                 "15m",
+	"EXCHEQUER_AUTH_REFUND_LIMITS":                   "EUR:25000,JPY:2500",
+	"EXCHEQUER_ADYEN_MERCHANT_ACCOUNT":               "MyCompanyECOM",
+	"EXCHEQUER_ADYEN_API_KEY":                        "my api key",
+	"EXCHEQUER_ADYEN_CLIENT_KEY":                     "my client key",
+	"EXCHEQUER_ADYEN_LIVE":                           "true",
+	"EXCHEQUER_ADYEN_URL_PREFIX":                     "1797a841fbb37ca7-AdyenDemo",
+	"EXCHEQUER_ADYEN_WEBHOOK_USE_BASIC_AUTH":         "true",
+	"EXCHEQUER_ADYEN_WEBHOOK_USERNAME":               "admin",
+	"EXCHEQUER_ADYEN_WEBHOOK_PASSWORD":               "supersecretpassword",
+	"EXCHEQUER_ADYEN_WEBHOOK_VERIFY_HMAC":            "true",
+	"EXCHEQUER_ADYEN_WEBHOOK_HMAC_SECRET":            "44782DEF547AAA06C910C43932B1EB0C71FC68D9D0C057550C48EC2ACF6BA056",
+	"EXCHEQUER_ADYEN_WEBHOOK_MANAGEMENT_HMAC_SECRET": "229382C61727723D66EF1A819B2A136F",
+	"EXCHEQUER_ADYEN_WEBHOOK_TRANSFER_HMAC_SECRET":   "5C2D0C6A3F1E4B7A9D8C7B6A5F4E3D2C",
+	"EXCHEQUER_ADYEN_REPORTS_RECONCILE":              "true",
+	"EXCHEQUER_ADYEN_REPORTS_API_KEY":                "my report api key",
+	"EXCHEQUER_ADYEN_REPORTS_TIMEOUT":                "30s",
+	"EXCHEQUER_ADYEN_REPORTS_SETTLEMENT_DELAY":       "72h",
+	"EXCHEQUER_WEBHOOKS_WORKERS":                     "2",
+	"EXCHEQUER_WEBHOOKS_MAX_ATTEMPTS":                "5",
+	"EXCHEQUER_WEBHOOKS_TIMEOUT":                     "3s",
+	"EXCHEQUER_WEBHOOKS_INITIAL_BACKOFF":             "10s",
+	"EXCHEQUER_WEBHOOKS_MAX_BACKOFF":                 "30m",
+	"EXCHEQUER_WEBHOOKS_POLL_INTERVAL":               "1s",
+	"EXCHEQUER_HEALTH_TIMEOUT":                       "2s",
+	"EXCHEQUER_HEALTH_WEBHOOK_BACKLOG":               "500",
+	"EXCHEQUER_HEALTH_ADYEN_PROBE":                   "true",
+	"EXCHEQUER_HEALTH_ADYEN_PROBE_INTERVAL":          "10m",
+	"EXCHEQUER_PAGINATION_SECRET":                    "5C2D0C6A3F1E4B7A9D8C7B6A5F4E3D2C",
+	"EXCHEQUER_PAGINATION_DEFAULT_PAGE_SIZE":         "25",
+	"EXCHEQUER_PAGINATION_MAX_PAGE_SIZE":             "100",
+	"EXCHEQUER_TRACING_ENABLED":                      "true",
+	"EXCHEQUER_TRACING_EXPORTER":                     "otlp",
+	"EXCHEQUER_TRACING_ENDPOINT":                     "otel-collector:4318",
+	"EXCHEQUER_TRACING_INSECURE":                     "true",
+	"EXCHEQUER_TRACING_SAMPLE_RATIO":                 "0.25",
+	"EXCHEQUER_TRACING_SERVICE_NAME":                 "billing",
+	"EXCHEQUER_TRACING_GCP_PROJECT":                  "rotational-billing",
 }
 
 func TestConfig(t *testing.T) {
@@ -44,6 +83,25 @@ func TestConfig(t *testing.T) {
 	require.True(t, conf.ConsoleLog)
 	require.Equal(t, testEnv["EXCHEQUER_BIND_ADDR"], conf.BindAddr)
 	require.Equal(t, testEnv["EXCHEQUER_ORIGIN"], conf.Origin)
+	require.Equal(t, []string{"10.0.0.0/8", "192.168.1.1"}, conf.TrustedProxies)
+	require.Equal(t, testEnv["EXCHEQUER_DATABASE_URL"], conf.DatabaseURL)
+	require.Equal(t, testEnv["EXCHEQUER_TLS_CERT_FILE"], conf.TLS.CertFile)
+	require.Equal(t, testEnv["EXCHEQUER_TLS_KEY_FILE"], conf.TLS.KeyFile)
+	require.Equal(t, testEnv["EXCHEQUER_TLS_CLIENT_CA_FILE"], conf.TLS.ClientCAFile)
+	require.Equal(t, testEnv["EXCHEQUER_TLS_MIN_VERSION"], conf.TLS.MinVersion)
+	require.Equal(t, 30*time.Second, conf.TLS.ReloadInterval)
+	require.Equal(t, map[string]string{"01J9ZJ4HQKX3GTEPJ6N0HFSW3M": "testdata/01J9ZJ4HQKX3GTEPJ6N0HFSW3M.pem"}, conf.Auth.Keys)
+	require.Equal(t, testEnv["EXCHEQUER_AUTH_AUDIENCE"], conf.Auth.Audience)
+	require.Equal(t, testEnv["EXCHEQUER_AUTH_ISSUER"], conf.Auth.Issuer)
+	require.Equal(t, 15*time.Minute, conf.Auth.AccessDuration)
+	require.Equal(t, map[string]int64{"EUR": 25000, "JPY": 2500}, conf.Auth.RefundLimits)
+
+	limit, ok := conf.Auth.RefundLimit("jpy")
+	require.True(t, ok)
+	require.Equal(t, int64(2500), limit)
+
+	_, ok = conf.Auth.RefundLimit("USD")
+	require.False(t, ok, "expected currencies without a limit not to be refundable by support")
 	require.Equal(t, testEnv["EXCHEQUER_ADYEN_MERCHANT_ACCOUNT"], conf.Adyen.MerchantAccount)
 	require.Equal(t, testEnv["EXCHEQUER_ADYEN_API_KEY"], conf.Adyen.APIKey)
 	require.Equal(t, testEnv["EXCHEQUER_ADYEN_CLIENT_KEY"], conf.Adyen.ClientKey)
@@ -54,6 +112,34 @@ func TestConfig(t *testing.T) {
 	require.Equal(t, testEnv["EXCHEQUER_ADYEN_WEBHOOK_PASSWORD"], conf.Adyen.Webhook.Password)
 	require.True(t, conf.Adyen.Webhook.VerifyHMAC)
 	require.Equal(t, testEnv["EXCHEQUER_ADYEN_WEBHOOK_HMAC_SECRET"], conf.Adyen.Webhook.HMACSecret)
+	require.Equal(t, testEnv["EXCHEQUER_ADYEN_WEBHOOK_MANAGEMENT_HMAC_SECRET"], conf.Adyen.Webhook.ManagementHMACSecret)
+	require.Empty(t, conf.Adyen.Webhook.ReportHMACSecret)
+	require.Empty(t, conf.Adyen.Webhook.BalancePlatformHMACSecret)
+	require.Equal(t, testEnv["EXCHEQUER_ADYEN_WEBHOOK_TRANSFER_HMAC_SECRET"], conf.Adyen.Webhook.TransferHMACSecret)
+	require.True(t, conf.Adyen.Reports.Reconcile)
+	require.Equal(t, testEnv["EXCHEQUER_ADYEN_REPORTS_API_KEY"], conf.Adyen.Reports.APIKey)
+	require.Equal(t, 30*time.Second, conf.Adyen.Reports.Timeout)
+	require.Equal(t, 72*time.Hour, conf.Adyen.Reports.SettlementDelay)
+	require.Equal(t, 2, conf.Webhooks.Workers)
+	require.Equal(t, 5, conf.Webhooks.MaxAttempts)
+	require.Equal(t, 3*time.Second, conf.Webhooks.Timeout)
+	require.Equal(t, 10*time.Second, conf.Webhooks.InitialBackoff)
+	require.Equal(t, 30*time.Minute, conf.Webhooks.MaxBackoff)
+	require.Equal(t, time.Second, conf.Webhooks.PollInterval)
+	require.Equal(t, 2*time.Second, conf.Health.Timeout)
+	require.Equal(t, 500, conf.Health.WebhookBacklog)
+	require.True(t, conf.Health.AdyenProbe)
+	require.Equal(t, 10*time.Minute, conf.Health.AdyenProbeInterval)
+	require.Equal(t, testEnv["EXCHEQUER_PAGINATION_SECRET"], conf.Pagination.Secret)
+	require.Equal(t, 25, conf.Pagination.DefaultPageSize)
+	require.Equal(t, 100, conf.Pagination.MaxPageSize)
+	require.True(t, conf.Tracing.Enabled)
+	require.Equal(t, testEnv["EXCHEQUER_TRACING_EXPORTER"], conf.Tracing.Exporter)
+	require.Equal(t, testEnv["EXCHEQUER_TRACING_ENDPOINT"], conf.Tracing.Endpoint)
+	require.True(t, conf.Tracing.Insecure)
+	require.Equal(t, 0.25, conf.Tracing.SampleRatio)
+	require.Equal(t, testEnv["EXCHEQUER_TRACING_SERVICE_NAME"], conf.Tracing.ServiceName)
+	require.Equal(t, testEnv["EXCHEQUER_TRACING_GCP_PROJECT"], conf.Tracing.GCPProject)
 }
 
 // Returns the current environment for the specified keys, or if no keys are specified
@@ -105,3 +191,83 @@ func cleanupEnv(keys ...string) func() {
 		}
 	}
 }
+
+func TestAuthConfigValidation(t *testing.T) {
+	valid := func(limits map[string]int64) config.AuthConfig {
+		return config.AuthConfig{
+			Keys:           map[string]string{"01J9ZJ4HQKX3GTEPJ6N0HFSW3M": "testdata/key.pem"},
+			Audience:       "exchequer",
+			Issuer:         "exchequer",
+			AccessDuration: time.Hour,
+			RefundLimits:   limits,
+		}
+	}
+
+	testCases := []struct {
+		conf config.AuthConfig
+		err  string
+	}{
+		{valid(nil), ""},
+		{valid(map[string]int64{"EUR": 10000, "JPY": 0}), ""},
+		{valid(map[string]int64{"eur": 10000}), "is not an uppercase ISO currency code"},
+		{valid(map[string]int64{"EURO": 10000}), "is not an uppercase ISO currency code"},
+		{valid(map[string]int64{"EUR": -1}), "support refund limit for EUR cannot be negative"},
+	}
+
+	for i, tc := range testCases {
+		err := tc.conf.Validate()
+		if tc.err == "" {
+			require.NoError(t, err, "test case %d failed", i)
+		} else {
+			require.ErrorContains(t, err, tc.err, "test case %d failed", i)
+		}
+	}
+}
+
+func TestAdyenReportsConfigValidation(t *testing.T) {
+	testCases := []struct {
+		conf config.AdyenReportsConfig
+		err  string
+	}{
+		{config.AdyenReportsConfig{}, ""},
+		{config.AdyenReportsConfig{Reconcile: true}, "an api key or username and password are required to download reports"},
+		{config.AdyenReportsConfig{Reconcile: true, Username: "report@Company.Example"}, "an api key or username and password are required to download reports"},
+		{config.AdyenReportsConfig{Reconcile: true, Username: "report@Company.Example", Password: "supersecret"}, ""},
+		{config.AdyenReportsConfig{Reconcile: true, APIKey: "my report api key"}, ""},
+		{config.AdyenReportsConfig{SettlementDelay: -time.Hour}, "settlement delay cannot be negative"},
+	}
+
+	for i, tc := range testCases {
+		err := tc.conf.Validate()
+		if tc.err == "" {
+			require.NoError(t, err, "test case %d failed", i)
+		} else {
+			require.ErrorContains(t, err, tc.err, "test case %d failed", i)
+		}
+	}
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	testCases := []struct {
+		conf config.TLSConfig
+		err  string
+	}{
+		{config.TLSConfig{}, ""},
+		{config.TLSConfig{ClientCAFile: "ca.crt"}, "a tls certificate and key are required to verify client certificates"},
+		{config.TLSConfig{CertFile: "tls.crt"}, "both a tls certificate and key are required"},
+		{config.TLSConfig{KeyFile: "tls.key"}, "both a tls certificate and key are required"},
+		{config.TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", MinVersion: "1.1", ReloadInterval: time.Minute}, "\"1.1\" is not a supported tls version"},
+		{config.TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", MinVersion: "1.2"}, "tls reload interval must be positive"},
+		{config.TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", MinVersion: "1.3", ReloadInterval: time.Minute}, ""},
+		{config.TLSConfig{CertFile: "tls.crt", KeyFile: "tls.key", ClientCAFile: "ca.crt", MinVersion: "1.2", ReloadInterval: time.Minute}, ""},
+	}
+
+	for i, tc := range testCases {
+		err := tc.conf.Validate()
+		if tc.err == "" {
+			require.NoError(t, err, "test case %d failed", i)
+		} else {
+			require.ErrorContains(t, err, tc.err, "test case %d failed", i)
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/metrics"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	userAgent       = "Exchequer Webhooks/v1"
+	contentType     = "application/json; charset=utf-8"
+	queueSize       = 1024
+	maxResponseRead = 64 * 1024
+)
+
+var (
+	ErrDispatcherRunning = errors.New("webhook dispatcher is already running")
+	ErrEndpointInactive  = errors.New("webhook endpoint is not active")
+)
+
+// Dispatcher publishes events to the event log and delivers them to the registered
+// webhook endpoints whose filters match the event type. Deliveries are made by a pool
+// of workers; failed deliveries are retried with jittered exponential backoff until the
+// maximum number of attempts is reached, at which point they are marked failed. Pending
+// deliveries are stored so they are resumed when the dispatcher is restarted.
+type Dispatcher struct {
+	sync.Mutex
+	conf    config.WebhooksConfig
+	store   *store.Store
+	client  *http.Client
+	queue   chan deliveryRef
+	pending map[deliveryRef]time.Time
+	queued  map[deliveryRef]struct{}
+	locks   map[deliveryRef]*deliveryLock
+	hub     *Hub
+	publish sync.Mutex
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	running bool
+	polled  time.Time
+}
+
+// Identifies a delivery in the store, which is keyed by endpoint and delivery ID.
+type deliveryRef struct {
+	endpointID ulid.ULID
+	deliveryID ulid.ULID
+}
+
+// Serializes the attempts of a delivery; refs counts the attempts holding or waiting
+// for the lock so that it can be removed once there are none.
+type deliveryLock struct {
+	sync.Mutex
+	refs int
+}
+
+// New creates a dispatcher that must be started with Run before deliveries are made.
+func New(conf config.WebhooksConfig, db *store.Store) *Dispatcher {
+	// Initialize prometheus collectors (safe to call multiple times)
+	metrics.Setup()
+
+	return &Dispatcher{
+		conf:    conf,
+		store:   db,
+		client:  &http.Client{Timeout: conf.Timeout},
+		queue:   make(chan deliveryRef, queueSize),
+		pending: make(map[deliveryRef]time.Time),
+		queued:  make(map[deliveryRef]struct{}),
+		locks:   make(map[deliveryRef]*deliveryLock),
+		hub:     NewHub(),
+	}
+}
+
+// Run loads any pending deliveries from the store and starts the delivery workers.
+func (d *Dispatcher) Run() (err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.running {
+		return ErrDispatcherRunning
+	}
+
+	err = d.store.EachWebhookDelivery(ulid.ULID{}, func(delivery *store.WebhookDelivery) error {
+		if delivery.Status == store.DeliveryPending {
+			d.pending[deliveryRef{delivery.EndpointID, delivery.ID}] = delivery.NextAttempt
+		}
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not load pending webhook deliveries: %w", err)
+	}
+	d.observeQueue()
+
+	d.stop = make(chan struct{})
+	for i := 0; i < d.conf.Workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+
+	d.wg.Add(1)
+	go d.poll()
+
+	d.running = true
+	d.polled = time.Now()
+	log.Debug().Int("pending", len(d.pending)).Int("workers", d.conf.Workers).Msg("webhook dispatcher started")
+	return nil
+}
+
+// Shutdown stops the workers after any in-flight deliveries have completed. Pending
+// deliveries remain in the store and are resumed the next time the dispatcher is run.
+func (d *Dispatcher) Shutdown() error {
+	d.Lock()
+	if !d.running {
+		d.Unlock()
+		return nil
+	}
+
+	close(d.stop)
+	d.running = false
+	d.Unlock()
+
+	d.wg.Wait()
+	log.Debug().Msg("webhook dispatcher stopped")
+	return nil
+}
+
+// Publish appends an event with the specified type and data to the event log, sends it
+// to live subscribers, then creates a delivery for every active endpoint that is
+// subscribed to the event type.
+func (d *Dispatcher) Publish(eventType string, data any) (event *store.Event, err error) {
+	event = &store.Event{Type: eventType}
+	if event.Data, err = json.Marshal(data); err != nil {
+		return nil, fmt.Errorf("could not marshal %s event data: %w", eventType, err)
+	}
+
+	// Events are broadcast in the order of the event log so that subscribers can skip
+	// the events that they have already read from the log by their ID.
+	d.publish.Lock()
+	if err = d.store.CreateEvent(event); err != nil {
+		d.publish.Unlock()
+		return nil, err
+	}
+	d.hub.Broadcast(event)
+	d.publish.Unlock()
+
+	var endpoints []*store.WebhookEndpoint
+	if endpoints, err = d.store.ListWebhookEndpoints(); err != nil {
+		return nil, err
+	}
+
+	for _, endpoint := range endpoints {
+		if !endpoint.Active || !Match(endpoint.EventTypes, eventType) {
+			continue
+		}
+
+		delivery := &store.WebhookDelivery{
+			EndpointID:  endpoint.ID,
+			EventID:     event.ID,
+			EventType:   event.Type,
+			Status:      store.DeliveryPending,
+			Attempts:    make([]*store.DeliveryAttempt, 0, 1),
+			NextAttempt: time.Now(),
+		}
+
+		if err = d.store.CreateWebhookDelivery(delivery); err != nil {
+			return nil, err
+		}
+		d.schedule(deliveryRef{delivery.EndpointID, delivery.ID}, delivery.NextAttempt)
+	}
+
+	return event, nil
+}
+
+// Subscribe to events as they are published. Subscribers should resume from the event
+// log if their subscription is closed because they could not keep up.
+func (d *Dispatcher) Subscribe() *Subscription {
+	return d.hub.Subscribe()
+}
+
+// Replay immediately re-delivers the event to the endpoint, regardless of the current
+// status of the delivery; the attempt is recorded in the delivery log as a replay. If
+// the replay succeeds any pending retries are cancelled.
+func (d *Dispatcher) Replay(ctx context.Context, endpointID, deliveryID ulid.ULID) (*store.WebhookDelivery, error) {
+	return d.deliver(ctx, deliveryRef{endpointID, deliveryID}, true)
+}
+
+// Backlog returns the number of deliveries that are scheduled for a future attempt
+// and the number that are queued waiting for a worker.
+func (d *Dispatcher) Backlog() (scheduled, queued int) {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.pending), len(d.queued)
+}
+
+// Heartbeat returns true if the dispatcher is running and the last time that it
+// checked for deliveries that are ready to be retried.
+func (d *Dispatcher) Heartbeat() (running bool, polled time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	return d.running, d.polled
+}
+
+//===========================================================================
+// Delivery Workers
+//===========================================================================
+
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case ref := <-d.queue:
+			if _, err := d.deliver(context.Background(), ref, false); err != nil {
+				log.Warn().Err(err).
+					Str("endpoint_id", ref.endpointID.String()).
+					Str("delivery_id", ref.deliveryID.String()).
+					Msg("could not process webhook delivery")
+			}
+
+			d.Lock()
+			delete(d.queued, ref)
+			d.observeQueue()
+			d.Unlock()
+		}
+	}
+}
+
+// Periodically moves pending deliveries that are due onto the delivery queue.
+func (d *Dispatcher) poll() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.conf.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.enqueueDue()
+
+			d.Lock()
+			d.polled = time.Now()
+			d.Unlock()
+		}
+	}
+}
+
+func (d *Dispatcher) schedule(ref deliveryRef, at time.Time) {
+	d.Lock()
+	d.pending[ref] = at
+	d.observeQueue()
+	d.Unlock()
+
+	if !at.After(time.Now()) {
+		d.enqueueDue()
+	}
+}
+
+func (d *Dispatcher) enqueueDue() {
+	d.Lock()
+	defer d.Unlock()
+	defer d.observeQueue()
+
+	now := time.Now()
+	for ref, at := range d.pending {
+		if at.After(now) {
+			continue
+		}
+
+		if _, ok := d.queued[ref]; ok {
+			continue
+		}
+
+		select {
+		case d.queue <- ref:
+			d.queued[ref] = struct{}{}
+			delete(d.pending, ref)
+		default:
+			// The queue is full, try again on the next poll
+			return
+		}
+	}
+}
+
+// Locks the delivery until the returned function is called.
+func (d *Dispatcher) lockDelivery(ref deliveryRef) (unlock func()) {
+	d.Lock()
+	lock, ok := d.locks[ref]
+	if !ok {
+		lock = &deliveryLock{}
+		d.locks[ref] = lock
+	}
+	lock.refs++
+	d.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		d.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(d.locks, ref)
+		}
+		d.Unlock()
+	}
+}
+
+// Updates the queue depth metrics; the dispatcher must be locked by the caller.
+func (d *Dispatcher) observeQueue() {
+	metrics.WebhookQueueDepth.WithLabelValues("scheduled").Set(float64(len(d.pending)))
+	metrics.WebhookQueueDepth.WithLabelValues("queued").Set(float64(len(d.queued)))
+}
+
+// Makes a single delivery attempt and updates the delivery log with the outcome.
+// Attempts of the same delivery (e.g. a replay while a worker retries it) are made one
+// at a time so that each attempt sees the outcome of the previous one.
+func (d *Dispatcher) deliver(ctx context.Context, ref deliveryRef, replay bool) (delivery *store.WebhookDelivery, err error) {
+	unlock := d.lockDelivery(ref)
+	defer unlock()
+
+	if delivery, err = d.store.RetrieveWebhookDelivery(ref.endpointID, ref.deliveryID); err != nil {
+		return nil, err
+	}
+
+	// Retries are skipped if the delivery was completed by a replay in the meantime.
+	if !replay && delivery.Status != store.DeliveryPending {
+		return delivery, nil
+	}
+
+	var endpoint *store.WebhookEndpoint
+	if endpoint, err = d.store.RetrieveWebhookEndpoint(ref.endpointID); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+
+	attempt := &store.DeliveryAttempt{Attempted: time.Now(), Replay: replay}
+	switch {
+	case endpoint == nil:
+		if replay {
+			return nil, store.ErrNotFound
+		}
+		attempt.Error = "webhook endpoint has been deleted"
+	case !endpoint.Active && !replay:
+		attempt.Error = ErrEndpointInactive.Error()
+	default:
+		d.send(ctx, endpoint, delivery, attempt)
+	}
+
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	success := attempt.StatusCode >= 200 && attempt.StatusCode < 300
+
+	switch {
+	case success:
+		delivery.Status = store.DeliverySucceeded
+		delivery.NextAttempt = time.Time{}
+		metrics.WebhookDeliveries.WithLabelValues(store.DeliverySucceeded).Inc()
+		d.Lock()
+		delete(d.pending, ref)
+		d.observeQueue()
+		d.Unlock()
+	case replay:
+		// A failed replay does not change the status or the retry schedule.
+	case endpoint == nil || !endpoint.Active || d.retries(delivery) >= d.conf.MaxAttempts:
+		delivery.Status = store.DeliveryFailed
+		delivery.NextAttempt = time.Time{}
+		metrics.WebhookDeliveries.WithLabelValues(store.DeliveryFailed).Inc()
+	default:
+		delivery.NextAttempt = time.Now().Add(d.backoff(d.retries(delivery)))
+		metrics.WebhookRetries.Inc()
+		d.schedule(ref, delivery.NextAttempt)
+	}
+
+	if err = d.store.UpdateWebhookDelivery(delivery); err != nil {
+		return nil, err
+	}
+
+	log.Debug().
+		Str("endpoint_id", ref.endpointID.String()).
+		Str("delivery_id", ref.deliveryID.String()).
+		Str("event_type", delivery.EventType).
+		Str("status", delivery.Status).
+		Int("status_code", attempt.StatusCode).
+		Bool("replay", replay).
+		Msg("webhook delivery attempted")
+	return delivery, nil
+}
+
+// Sends the signed event to the endpoint, recording the outcome on the attempt.
+func (d *Dispatcher) send(ctx context.Context, endpoint *store.WebhookEndpoint, delivery *store.WebhookDelivery, attempt *store.DeliveryAttempt) {
+	defer func() {
+		attempt.Duration = time.Since(attempt.Attempted)
+	}()
+
+	event, err := d.store.RetrieveEvent(delivery.EventID)
+	if err != nil {
+		attempt.Error = fmt.Sprintf("could not retrieve event: %s", err)
+		return
+	}
+
+	var payload []byte
+	if payload, err = json.Marshal(APIEvent(event)); err != nil {
+		attempt.Error = fmt.Sprintf("could not marshal event: %s", err)
+		return
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(payload)); err != nil {
+		attempt.Error = fmt.Sprintf("could not create request: %s", err)
+		return
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(HeaderEventID, event.ID.String())
+	req.Header.Set(HeaderEventType, event.Type)
+	req.Header.Set(HeaderDeliveryID, delivery.ID.String())
+	req.Header.Set(HeaderSignature, Sign(endpoint.Secret, time.Now(), payload))
+
+	var rep *http.Response
+	if rep, err = d.client.Do(req); err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+	defer rep.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(rep.Body, maxResponseRead))
+
+	attempt.StatusCode = rep.StatusCode
+	if rep.StatusCode < 200 || rep.StatusCode >= 300 {
+		attempt.Error = rep.Status
+	}
+}
+
+// Counts the automatic (non-replay) delivery attempts that have been made.
+func (d *Dispatcher) retries(delivery *store.WebhookDelivery) (n int) {
+	for _, attempt := range delivery.Attempts {
+		if !attempt.Replay {
+			n++
+		}
+	}
+	return n
+}
+
+// Computes the delay before the next attempt: the initial backoff is doubled for each
+// failed attempt up to the maximum backoff, then "equal jitter" is applied so that the
+// delay is randomly chosen between half and all of the computed backoff.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.conf.InitialBackoff
+	for i := 1; i < attempts && delay < d.conf.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > d.conf.MaxBackoff {
+		delay = d.conf.MaxBackoff
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + rand.N(half+1)
+}
+
+//===========================================================================
+// Helpers
+//===========================================================================
+
+// APIEvent converts an event from the event log into the payload that is delivered.
+func APIEvent(event *store.Event) *api.Event {
+	return &api.Event{
+		ID:      event.ID.String(),
+		Type:    event.Type,
+		Created: event.Created,
+		Data:    event.Data,
+	}
+}
@@ -0,0 +1,268 @@
+package events_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/events"
+	"github.com/rotationalio/exchequer/pkg/logger"
+	"github.com/rotationalio/exchequer/pkg/metrics"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+var testConf = config.WebhooksConfig{
+	Workers:        2,
+	MaxAttempts:    3,
+	Timeout:        time.Second,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     40 * time.Millisecond,
+	PollInterval:   5 * time.Millisecond,
+}
+
+func TestDispatcher(t *testing.T) {
+	logger.Discard()
+	t.Cleanup(logger.ResetLogger)
+
+	db, err := store.Open("memory://")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	// The receiver fails the first request then succeeds, verifying each signature.
+	var calls atomic.Int32
+	received := make(chan *api.Event, 4)
+	secret, _ := events.GenerateSecret()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := events.Verify(secret, r.Header.Get(events.HeaderSignature), body, events.DefaultTolerance); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		event := &api.Event{}
+		if err := json.Unmarshal(body, event); err != nil || event.ID != r.Header.Get(events.HeaderEventID) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received <- event
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	subscribed := &store.WebhookEndpoint{URL: srv.URL, EventTypes: []string{"payment.*"}, Secret: secret, Active: true}
+	require.NoError(t, db.CreateWebhookEndpoint(subscribed))
+
+	unsubscribed := &store.WebhookEndpoint{URL: srv.URL, EventTypes: []string{"dispute.*"}, Secret: secret, Active: true}
+	require.NoError(t, db.CreateWebhookEndpoint(unsubscribed))
+
+	dispatcher := events.New(testConf, db)
+	running, _ := dispatcher.Heartbeat()
+	require.False(t, running)
+
+	require.NoError(t, dispatcher.Run())
+	require.ErrorIs(t, dispatcher.Run(), events.ErrDispatcherRunning)
+	t.Cleanup(func() { dispatcher.Shutdown() })
+
+	// The scheduler should poll for due deliveries while the dispatcher is running
+	running, started := dispatcher.Heartbeat()
+	require.True(t, running)
+	require.Eventually(t, func() bool {
+		_, polled := dispatcher.Heartbeat()
+		return polled.After(started)
+	}, time.Second, testConf.PollInterval)
+
+	event, err := dispatcher.Publish(events.PaymentCaptured, &api.PaymentEvent{PSPReference: "7914073381342284", Amount: 1130, Currency: "EUR"})
+	require.NoError(t, err)
+
+	select {
+	case rep := <-received:
+		require.Equal(t, event.ID.String(), rep.ID)
+		require.Equal(t, events.PaymentCaptured, rep.Type)
+		require.JSONEq(t, `{"psp_reference":"7914073381342284","event_code":"","success":false,"amount":1130,"currency":"EUR","live":false}`, string(rep.Data))
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for webhook delivery")
+	}
+
+	// The delivery log should record both attempts for the subscribed endpoint
+	var deliveries []*store.WebhookDelivery
+	require.Eventually(t, func() bool {
+		deliveries, err = db.ListWebhookDeliveries(subscribed.ID)
+		return err == nil && len(deliveries) == 1 && deliveries[0].Status == store.DeliverySucceeded
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.Len(t, deliveries[0].Attempts, 2)
+	require.Equal(t, http.StatusServiceUnavailable, deliveries[0].Attempts[0].StatusCode)
+	require.Equal(t, http.StatusNoContent, deliveries[0].Attempts[1].StatusCode)
+
+	deliveries, err = db.ListWebhookDeliveries(unsubscribed.ID)
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+
+	require.Eventually(t, func() bool {
+		scheduled, queued := dispatcher.Backlog()
+		return scheduled+queued == 0
+	}, time.Second, 10*time.Millisecond, "expected no backlog after the delivery succeeded")
+
+	// Replay the delivery by hand
+	delivery, err := dispatcher.Replay(context.Background(), subscribed.ID, firstDelivery(t, db, subscribed).ID)
+	require.NoError(t, err)
+	require.Len(t, delivery.Attempts, 3)
+	require.True(t, delivery.Attempts[2].Replay)
+	require.Equal(t, store.DeliverySucceeded, delivery.Status)
+	<-received
+}
+
+func TestDispatcherFailed(t *testing.T) {
+	logger.Discard()
+	t.Cleanup(logger.ResetLogger)
+
+	db, err := store.Open("memory://")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	endpoint := &store.WebhookEndpoint{URL: srv.URL, EventTypes: []string{"*"}, Secret: "secret", Active: true}
+	require.NoError(t, db.CreateWebhookEndpoint(endpoint))
+
+	dispatcher := events.New(testConf, db)
+	require.NoError(t, dispatcher.Run())
+	t.Cleanup(func() { dispatcher.Shutdown() })
+
+	retries := testutil.ToFloat64(metrics.WebhookRetries)
+	failed := testutil.ToFloat64(metrics.WebhookDeliveries.WithLabelValues(store.DeliveryFailed))
+
+	_, err = dispatcher.Publish(events.DisputeOpened, map[string]string{"psp_reference": "foo"})
+	require.NoError(t, err)
+
+	// After the maximum number of attempts the delivery should be marked failed
+	require.Eventually(t, func() bool {
+		delivery := firstDelivery(t, db, endpoint)
+		return delivery != nil && delivery.Status == store.DeliveryFailed
+	}, 2*time.Second, 10*time.Millisecond)
+
+	delivery := firstDelivery(t, db, endpoint)
+	require.Len(t, delivery.Attempts, testConf.MaxAttempts)
+	require.True(t, delivery.NextAttempt.IsZero())
+	for _, attempt := range delivery.Attempts {
+		require.Equal(t, http.StatusInternalServerError, attempt.StatusCode)
+		require.NotEmpty(t, attempt.Error)
+	}
+
+	// Retries and the failed delivery are counted and the queue has been drained
+	require.Equal(t, float64(testConf.MaxAttempts-1), testutil.ToFloat64(metrics.WebhookRetries)-retries)
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.WebhookDeliveries.WithLabelValues(store.DeliveryFailed))-failed)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(metrics.WebhookQueueDepth.WithLabelValues("queued")) == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Zero(t, testutil.ToFloat64(metrics.WebhookQueueDepth.WithLabelValues("scheduled")))
+}
+
+func TestConcurrentReplays(t *testing.T) {
+	logger.Discard()
+	t.Cleanup(logger.ResetLogger)
+
+	db, err := store.Open("memory://")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	endpoint := &store.WebhookEndpoint{URL: srv.URL, EventTypes: []string{"*"}, Secret: "secret", Active: true}
+	require.NoError(t, db.CreateWebhookEndpoint(endpoint))
+
+	dispatcher := events.New(testConf, db)
+	require.NoError(t, dispatcher.Run())
+	t.Cleanup(func() { dispatcher.Shutdown() })
+
+	_, err = dispatcher.Publish(events.DisputeOpened, map[string]string{"psp_reference": "foo"})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		delivery := firstDelivery(t, db, endpoint)
+		return delivery != nil && delivery.Status == store.DeliverySucceeded
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Replays of the same delivery are serialized so that no attempts are lost
+	delivery := firstDelivery(t, db, endpoint)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dispatcher.Replay(context.Background(), endpoint.ID, delivery.ID)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	delivery = firstDelivery(t, db, endpoint)
+	require.Len(t, delivery.Attempts, 9)
+	require.Equal(t, store.DeliverySucceeded, delivery.Status)
+}
+
+func TestPublishOrder(t *testing.T) {
+	db, err := store.Open("memory://")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	dispatcher := events.New(testConf, db)
+	sub := dispatcher.Subscribe()
+	defer sub.Close()
+
+	// Events published concurrently are broadcast in the order of the event log
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 16; j++ {
+				_, err := dispatcher.Publish(events.PaymentAuthorised, map[string]int{"n": j})
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var last *store.Event
+	for i := 0; i < 8*16; i++ {
+		event := <-sub.C
+		if last != nil {
+			require.Greater(t, event.ID.String(), last.ID.String(), "event %d was broadcast out of order", i)
+		}
+		last = event
+	}
+}
+
+func firstDelivery(t *testing.T, db *store.Store, endpoint *store.WebhookEndpoint) *store.WebhookDelivery {
+	deliveries, err := db.ListWebhookDeliveries(endpoint.ID)
+	require.NoError(t, err)
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return deliveries[0]
+}
@@ -0,0 +1,109 @@
+/*
+Package events publishes billing events to the event log and delivers them to the
+webhook endpoints that internal services have registered with Exchequer. Deliveries are
+signed with the endpoint's secret, retried with exponential backoff, and recorded in a
+delivery log so that they can be inspected and replayed by hand.
+*/
+package events
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Billing event types that are published by Exchequer.
+const (
+	PaymentAuthorised     = "payment.authorised"
+	PaymentRefused        = "payment.refused"
+	PaymentCaptured       = "payment.captured"
+	PaymentCaptureFailed  = "payment.capture_failed"
+	PaymentCancelled      = "payment.cancelled"
+	PaymentRefunded       = "payment.refunded"
+	PaymentRefundFailed   = "payment.refund_failed"
+	DisputeOpened         = "dispute.opened"
+	DisputeLost           = "dispute.lost"
+	DisputeWon            = "dispute.won"
+	PaymentMethodStored   = "payment_method.stored"
+	PaymentMethodDisabled = "payment_method.disabled"
+)
+
+// Invoice and subscription event types. Exchequer does not manage invoices or
+// subscriptions yet so these events are not published; they are defined so that
+// endpoints can subscribe to them before they are.
+const (
+	InvoicePaid           = "invoice.paid"
+	InvoicePaymentFailed  = "invoice.payment_failed"
+	SubscriptionLapsed    = "subscription.lapsed"
+	SubscriptionCancelled = "subscription.cancelled"
+)
+
+// Filters may use the wildcard to match all events or a category wildcard (e.g.
+// "payment.*") to match all events in the category.
+const (
+	WildcardEventType = "*"
+	wildcardSuffix    = ".*"
+)
+
+// Types contains all of the event types that can be published.
+var Types = []string{
+	PaymentAuthorised,
+	PaymentRefused,
+	PaymentCaptured,
+	PaymentCaptureFailed,
+	PaymentCancelled,
+	PaymentRefunded,
+	PaymentRefundFailed,
+	DisputeOpened,
+	DisputeLost,
+	DisputeWon,
+	PaymentMethodStored,
+	PaymentMethodDisabled,
+	InvoicePaid,
+	InvoicePaymentFailed,
+	SubscriptionLapsed,
+	SubscriptionCancelled,
+}
+
+var ErrInvalidFilter = errors.New("invalid event type filter")
+
+// ValidateFilters ensures that each event type filter is either a known event type, a
+// category wildcard such as "payment.*", or the "*" wildcard that matches all events.
+func ValidateFilters(filters []string) error {
+	if len(filters) == 0 {
+		return fmt.Errorf("%w: at least one event type is required", ErrInvalidFilter)
+	}
+
+outer:
+	for _, filter := range filters {
+		if filter == WildcardEventType {
+			continue
+		}
+
+		for _, eventType := range Types {
+			if Match([]string{filter}, eventType) {
+				continue outer
+			}
+		}
+		return fmt.Errorf("%w: %q does not match any event types", ErrInvalidFilter, filter)
+	}
+	return nil
+}
+
+// Match returns true if the event type matches any of the filters.
+func Match(filters []string, eventType string) bool {
+	for _, filter := range filters {
+		switch {
+		case filter == WildcardEventType:
+			return true
+		case filter == eventType:
+			return true
+		case strings.HasSuffix(filter, wildcardSuffix):
+			category := strings.TrimSuffix(filter, wildcardSuffix)
+			if prefix, _, ok := strings.Cut(eventType, "."); ok && prefix == category {
+				return true
+			}
+		}
+	}
+	return false
+}
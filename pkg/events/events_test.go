@@ -0,0 +1,67 @@
+package events_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/events"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		filters   []string
+		eventType string
+		assert    require.BoolAssertionFunc
+	}{
+		{[]string{"*"}, events.PaymentCaptured, require.True},
+		{[]string{events.PaymentCaptured}, events.PaymentCaptured, require.True},
+		{[]string{events.PaymentRefunded, events.PaymentCaptured}, events.PaymentCaptured, require.True},
+		{[]string{"payment.*"}, events.PaymentCaptured, require.True},
+		{[]string{"payment.*"}, events.PaymentMethodStored, require.False},
+		{[]string{"payment_method.*"}, events.PaymentMethodStored, require.True},
+		{[]string{"dispute.*"}, events.PaymentCaptured, require.False},
+		{[]string{events.PaymentRefunded}, events.PaymentCaptured, require.False},
+		{[]string{}, events.PaymentCaptured, require.False},
+	}
+
+	for i, tc := range testCases {
+		tc.assert(t, events.Match(tc.filters, tc.eventType), "test case %d failed", i)
+	}
+}
+
+func TestValidateFilters(t *testing.T) {
+	require.NoError(t, events.ValidateFilters([]string{"*"}))
+	require.NoError(t, events.ValidateFilters([]string{"payment.*", events.DisputeOpened}))
+	require.ErrorIs(t, events.ValidateFilters(nil), events.ErrInvalidFilter)
+	require.NoError(t, events.ValidateFilters([]string{events.InvoicePaid, "subscription.*"}))
+	require.ErrorIs(t, events.ValidateFilters([]string{"invoice.voided"}), events.ErrInvalidFilter)
+	require.ErrorIs(t, events.ValidateFilters([]string{"foo.*"}), events.ErrInvalidFilter)
+}
+
+func TestSignature(t *testing.T) {
+	secret, err := events.GenerateSecret()
+	require.NoError(t, err)
+	require.Regexp(t, `^whsec_[A-Za-z0-9_-]{43}$`, secret)
+
+	payload := []byte(`{"id":"01J0000000000000000000000","type":"payment.captured"}`)
+	header := events.Sign(secret, time.Now(), payload)
+	require.Regexp(t, `^t=\d+,v1=[0-9a-f]{64}$`, header)
+
+	// A valid signature
+	require.NoError(t, events.Verify(secret, header, payload, events.DefaultTolerance))
+
+	// Modified payload or different secret
+	require.ErrorIs(t, events.Verify(secret, header, []byte(`{}`), events.DefaultTolerance), events.ErrInvalidSignature)
+	require.ErrorIs(t, events.Verify("whsec_other", header, payload, events.DefaultTolerance), events.ErrInvalidSignature)
+
+	// Expired signatures are only accepted without a tolerance
+	header = events.Sign(secret, time.Now().Add(-10*time.Minute), payload)
+	require.ErrorIs(t, events.Verify(secret, header, payload, events.DefaultTolerance), events.ErrExpiredSignature)
+	require.NoError(t, events.Verify(secret, header, payload, 0))
+
+	// Malformed headers
+	for _, header := range []string{"", "t=foo,v1=abc", "v1=abc", "t=1697000000", "garbage"} {
+		require.ErrorIs(t, events.Verify(secret, header, payload, 0), events.ErrMissingSignature, "expected %q to be malformed", header)
+	}
+}
@@ -0,0 +1,67 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/rotationalio/exchequer/pkg/store"
+)
+
+// The number of events buffered for each subscriber; if a subscriber falls this far
+// behind it is disconnected rather than blocking the publisher.
+const subscriberBuffer = 256
+
+// Hub fans out published events to live subscribers such as event streams. Subscribers
+// that cannot keep up are closed so that they can resume from the event log.
+type Hub struct {
+	sync.RWMutex
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives events published after it was created until it is closed.
+type Subscription struct {
+	C    <-chan *store.Event
+	c    chan *store.Event
+	hub  *Hub
+	once sync.Once
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe to all events that are broadcast by the hub.
+func (h *Hub) Subscribe() *Subscription {
+	c := make(chan *store.Event, subscriberBuffer)
+	sub := &Subscription{C: c, c: c, hub: h}
+
+	h.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.Unlock()
+	return sub
+}
+
+// Broadcast the event to all subscribers without blocking.
+func (h *Hub) Broadcast(event *store.Event) {
+	h.RLock()
+	defer h.RUnlock()
+
+	for sub := range h.subscribers {
+		select {
+		case sub.c <- event:
+		default:
+			// The subscriber is too slow; close it in a separate go routine since the
+			// close requires the write lock.
+			go sub.Close()
+		}
+	}
+}
+
+// Close the subscription; the channel is closed once no more events will be sent.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.Lock()
+		delete(s.hub.subscribers, s)
+		s.hub.Unlock()
+		close(s.c)
+	})
+}
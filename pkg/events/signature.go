@@ -0,0 +1,107 @@
+package events
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers that are set on every webhook delivery.
+const (
+	HeaderSignature  = "Exchequer-Signature"
+	HeaderEventID    = "Exchequer-Event-ID"
+	HeaderEventType  = "Exchequer-Event-Type"
+	HeaderDeliveryID = "Exchequer-Delivery-ID"
+)
+
+// DefaultTolerance is the maximum age of a signature accepted by Verify; receivers
+// should reject older deliveries to prevent replay attacks.
+const DefaultTolerance = 5 * time.Minute
+
+const (
+	secretPrefix  = "whsec_"
+	secretLength  = 32
+	schemeVersion = "v1"
+)
+
+var (
+	ErrMissingSignature = errors.New("webhook signature header is missing or malformed")
+	ErrInvalidSignature = errors.New("webhook signature does not match the payload")
+	ErrExpiredSignature = errors.New("webhook signature timestamp is outside of the tolerance")
+)
+
+// GenerateSecret creates a new random signing secret for a webhook endpoint.
+func GenerateSecret() (string, error) {
+	buf := make([]byte, secretLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return secretPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Sign computes the value of the Exchequer-Signature header for the payload, which is
+// in the form t=<unix timestamp>,v1=<hex signature>. The signature is the HMAC-SHA256 of
+// the timestamp and the raw request body joined by a period, keyed by the secret.
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	ts := timestamp.Unix()
+	return fmt.Sprintf("t=%d,%s=%s", ts, schemeVersion, computeSignature(secret, ts, payload))
+}
+
+// Verify the Exchequer-Signature header for the payload, ensuring that the signature
+// was created with the secret and that the timestamp is within the tolerance of now.
+// Internal services that receive webhooks can use this function to verify deliveries.
+func Verify(secret, header string, payload []byte, tolerance time.Duration) (err error) {
+	var (
+		ts         int64
+		signatures []string
+	)
+
+	for _, part := range strings.Split(header, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrMissingSignature
+		}
+
+		switch key {
+		case "t":
+			if ts, err = strconv.ParseInt(val, 10, 64); err != nil {
+				return ErrMissingSignature
+			}
+		case schemeVersion:
+			signatures = append(signatures, val)
+		}
+	}
+
+	if ts == 0 || len(signatures) == 0 {
+		return ErrMissingSignature
+	}
+
+	if tolerance > 0 {
+		if age := time.Since(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+			return ErrExpiredSignature
+		}
+	}
+
+	expected := computeSignature(secret, ts, payload)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func computeSignature(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
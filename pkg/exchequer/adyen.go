@@ -1,13 +1,17 @@
 package exchequer
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/adyen/adyen-go-api-library/v11/src/adyen"
 	"github.com/adyen/adyen-go-api-library/v11/src/common"
@@ -15,7 +19,12 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/rotationalio/exchequer/pkg/api/v1"
 	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/events"
+	"github.com/rotationalio/exchequer/pkg/logger"
+	"github.com/rotationalio/exchequer/pkg/metrics"
+	"github.com/rotationalio/exchequer/pkg/store"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 //===========================================================================
@@ -47,22 +56,25 @@ func (s *Server) AdyenPaymentsWebhook(c *gin.Context) {
 
 	// Bind JSON data from webhook
 	event = &webhook.Webhook{}
-	if err = c.BindJSON(event); err != nil {
+	if err = c.ShouldBindJSON(event); err != nil {
 		c.Error(err)
 		c.JSON(http.StatusBadRequest, api.Error("could not parse payments webhook request"))
+		return
 	}
 
-	notifications := event.GetNotificationItems()
+	notifications := NotificationItems(event)
 	for i, notification := range notifications {
 		// Verify HMAC Signature if required
 		if s.conf.Adyen.Webhook.VerifyHMAC {
 			if err = VerifyAdyenHMAC(notification, s.conf.Adyen.Webhook.HMACSecret); err != nil {
+				metrics.HMACFailures.Inc()
 				c.Error(err)
 				c.JSON(http.StatusUnauthorized, api.Error("HMAC signature cannot be verified"))
 				return
 			}
 		}
 
+		metrics.NotificationsReceived.WithLabelValues(notification.EventCode, notification.Success).Inc()
 		log.Info().
 			Str("live", event.Live).
 			Int("num_notification_items", len(notifications)).
@@ -80,15 +92,241 @@ func (s *Server) AdyenPaymentsWebhook(c *gin.Context) {
 			Str("reason", notification.Reason).
 			Str("success", notification.Success).
 			Msg("adyen payment webhook received")
+
+		// Process the notification; if processing fails Adyen will retry the webhook.
+		if err = s.HandleNotification(c.Request.Context(), notification, event.Live == "true"); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, api.Error("could not process notification"))
+			return
+		}
 	}
 
 	c.Status(http.StatusAccepted)
 }
 
+//===========================================================================
+// Adyen Notification Processing
+//===========================================================================
+
+// Event codes that are not defined as constants by the Adyen webhook library.
+const (
+	EventCodeRecurringContract = "RECURRING_CONTRACT"
+)
+
+// HandleNotification records and processes a single verified notification from a
+// standard webhook. The notification is processed by the handler registered for its
+// event code and the corresponding billing event is published to internal services.
+// Notifications that are published are recorded in the audit log; notifications for
+// event codes that Exchequer does not act on are only recorded.
+func (s *Server) HandleNotification(ctx context.Context, notification *webhook.NotificationRequestItem, live bool) (err error) {
+	var record *store.Notification
+	if record, err = s.recordNotification(notification, live); err != nil {
+		return fmt.Errorf("could not record notification: %w", err)
+	}
+
+	// Adyen redelivers notifications that it did not see accepted, e.g. on a timeout
+	if record.Status == store.NotificationProcessed {
+		log.Debug().
+			Str("notification_id", record.ID.String()).
+			Str("event_code", record.EventCode).
+			Str("psp_reference", record.PSPReference).
+			Int("attempts", record.Attempts).
+			Msg("notification has already been processed")
+		return nil
+	}
+
+	// Events published by a previous attempt that failed afterwards are not published again
+	var event *store.Event
+	_, event, err = s.processNotification(ctx, notification, live, len(record.EventIDs) == 0, false)
+	s.completeNotification(record, notification, event, err)
+	return err
+}
+
+// Records the payment amounts of successful notifications by currency and counts the
+// checkout sessions that have been completed; Adyen includes the checkout session ID in
+// the additional data of the AUTHORISATION notification for a session payment.
+func observeNotification(notification *webhook.NotificationRequestItem) {
+	if notification.Success != "true" {
+		return
+	}
+
+	var operation string
+	switch notification.EventCode {
+	case webhook.EventCodeAuthorisation:
+		operation = metrics.PaymentAuthorised
+		if AdditionalData(notification, "checkoutSessionId") != "" {
+			metrics.CheckoutSessionsCompleted.Inc()
+		}
+	case webhook.EventCodeCapture:
+		operation = metrics.PaymentCaptured
+	case webhook.EventCodeRefund:
+		operation = metrics.PaymentRefunded
+	default:
+		return
+	}
+
+	if notification.Amount.Currency != "" && notification.Amount.Value > 0 {
+		metrics.PaymentAmounts.WithLabelValues(operation, notification.Amount.Currency).Add(float64(notification.Amount.Value))
+	}
+}
+
+// Persists the token when Adyen notifies us that a payment method has been stored. The
+// pspReference of a RECURRING_CONTRACT notification is the stored payment method ID,
+// though newer API versions also include it in the additional data.
+func (s *Server) handleRecurringContract(ctx context.Context, notification *webhook.NotificationRequestItem, dryRun bool) (_ []*api.Transition, err error) {
+	if notification.Success != "true" {
+		log.Warn().
+			Str("psp_reference", notification.PspReference).
+			Str("reason", notification.Reason).
+			Msg("adyen could not store payment method")
+		return nil, nil
+	}
+
+	pm := &store.PaymentMethod{
+		ID:         AdditionalData(notification, "recurring.recurringDetailReference"),
+		CustomerID: AdditionalData(notification, "recurring.shopperReference"),
+		Type:       notification.PaymentMethod,
+		Summary:    AdditionalData(notification, "cardSummary"),
+		Expiry:     AdditionalData(notification, "expiryDate"),
+	}
+
+	if pm.ID == "" {
+		pm.ID = notification.PspReference
+	}
+
+	if pm.CustomerID == "" {
+		pm.CustomerID = AdditionalData(notification, "shopperReference")
+	}
+
+	// A payment method that cannot be stored locally must not fail the notification since
+	// Adyen would retry the entire batch that it was delivered in.
+	before, err := s.store.RetrievePaymentMethod(pm.CustomerID, pm.ID)
+	if errors.Is(err, store.ErrInvalidReference) {
+		log.Warn().
+			Str("psp_reference", notification.PspReference).
+			Str("customer_id", pm.CustomerID).
+			Str("payment_method_id", pm.ID).
+			Msg("cannot save stored payment method with an invalid shopper reference")
+		return nil, nil
+	}
+
+	resource := paymentMethodResource(pm.CustomerID, pm.ID)
+	if !dryRun {
+		if err = s.store.SavePaymentMethod(pm); err != nil {
+			return nil, fmt.Errorf("could not store payment method %q: %w", pm.ID, err)
+		}
+
+		if err = s.auditSystem(ctx, actorAdyen, AuditPaymentMethodStore, resource, before, pm); err != nil {
+			return nil, err
+		}
+
+		log.Info().
+			Str("customer_id", pm.CustomerID).
+			Str("payment_method_id", pm.ID).
+			Bool("default", pm.Default).
+			Msg("stored payment method saved")
+	}
+
+	var transition *api.Transition
+	if transition, err = newTransition(resource, AuditPaymentMethodStore, before, pm); err != nil {
+		return nil, err
+	}
+	return []*api.Transition{transition}, nil
+}
+
 //===========================================================================
 // Adyen Helper Methods
 //===========================================================================
 
+// NotificationItems returns the notification request items of a standard webhook. The
+// GetNotificationItems method of the Adyen library returns pointers to its loop variable
+// so every item that it returns is the last notification of the batch.
+func NotificationItems(event *webhook.Webhook) []*webhook.NotificationRequestItem {
+	if event.NotificationItems == nil {
+		return nil
+	}
+
+	items := make([]*webhook.NotificationRequestItem, 0, len(*event.NotificationItems))
+	for i := range *event.NotificationItems {
+		items = append(items, &(*event.NotificationItems)[i].NotificationRequestItem)
+	}
+	return items
+}
+
+// NotificationEventType maps the event code and success of an Adyen notification to the
+// billing event type published to internal services, returning an empty string if the
+// notification is not published as an event.
+func NotificationEventType(notification *webhook.NotificationRequestItem) string {
+	success := notification.Success == "true"
+	switch notification.EventCode {
+	case webhook.EventCodeAuthorisation:
+		if success {
+			return events.PaymentAuthorised
+		}
+		return events.PaymentRefused
+	case webhook.EventCodeCapture:
+		if success {
+			return events.PaymentCaptured
+		}
+		return events.PaymentCaptureFailed
+	case webhook.EventCodeCaptureFailed:
+		return events.PaymentCaptureFailed
+	case webhook.EventCodeCancellation:
+		if success {
+			return events.PaymentCancelled
+		}
+	case webhook.EventCodeRefund:
+		if success {
+			return events.PaymentRefunded
+		}
+		return events.PaymentRefundFailed
+	case webhook.EventCodeRefundFailed:
+		return events.PaymentRefundFailed
+	case webhook.EventCodeNotificationOfChargeback, webhook.EventCodeRequestForInformation:
+		return events.DisputeOpened
+	case webhook.EventCodeChargeback, webhook.EventCodeSecondChargeback, webhook.EventCodePrearbitrationLost:
+		return events.DisputeLost
+	case webhook.EventCodeChargebackReversed, webhook.EventCodePrearbitrationWon:
+		return events.DisputeWon
+	case EventCodeRecurringContract:
+		if success {
+			return events.PaymentMethodStored
+		}
+	}
+	return ""
+}
+
+// PaymentEvent creates the billing event data for an Adyen notification.
+func PaymentEvent(notification *webhook.NotificationRequestItem, live bool) *api.PaymentEvent {
+	return &api.PaymentEvent{
+		PSPReference:      notification.PspReference,
+		OriginalReference: notification.OriginalReference,
+		MerchantReference: notification.MerchantReference,
+		EventCode:         notification.EventCode,
+		Success:           notification.Success == "true",
+		Amount:            notification.Amount.Value,
+		Currency:          notification.Amount.Currency,
+		PaymentMethod:     notification.PaymentMethod,
+		Reason:            notification.Reason,
+		Live:              live,
+	}
+}
+
+// AdditionalData returns the string value for the key in the notification's additional
+// data or an empty string if the key is not present or is not a string.
+func AdditionalData(notification *webhook.NotificationRequestItem, key string) string {
+	if notification.AdditionalData == nil {
+		return ""
+	}
+
+	if val, ok := (*notification.AdditionalData)[key].(string); ok {
+		return val
+	}
+	return ""
+}
+
+// VerifyAdyenHMAC checks the HMAC signature in the additional data of the notification
+// against the signature computed with the hex encoded secret.
 func VerifyAdyenHMAC(payload *webhook.NotificationRequestItem, secret string) (err error) {
 	// Step 1: Extract the HMAC signature to verify from the additonal data.
 	if payload.AdditionalData == nil {
@@ -109,7 +347,24 @@ func VerifyAdyenHMAC(payload *webhook.NotificationRequestItem, secret string) (e
 		return ErrMissingHMACSignature
 	}
 
-	// Step 2: Construct the payload for verification
+	// Step 2: Compute the signature of the payload with the secret
+	var signature string
+	if signature, err = SignAdyenHMAC(payload, secret); err != nil {
+		return err
+	}
+
+	// Step 3: Verify the signature with the check signature
+	if !hmac.Equal([]byte(signature), []byte(checkSignature)) {
+		return ErrInvalidHMACSignature
+	}
+	return nil
+}
+
+// SignAdyenHMAC computes the base64 encoded HMAC signature of the notification with the
+// hex encoded secret in the same way as Adyen, e.g. to simulate signed notifications.
+// The signature is not added to the additional data of the notification.
+func SignAdyenHMAC(payload *webhook.NotificationRequestItem, secret string) (_ string, err error) {
+	// Construct the payload for signing from the fields of the notification
 	reference := strings.Join([]string{
 		payload.PspReference,
 		payload.OriginalReference,
@@ -123,32 +378,101 @@ func VerifyAdyenHMAC(payload *webhook.NotificationRequestItem, secret string) (e
 
 	var secretBytes []byte
 	if secretBytes, err = hex.DecodeString(secret); err != nil {
-		return ErrInvalidHMACSecret
+		return "", ErrInvalidHMACSecret
 	}
 
-	// Step 3: Compute the HMAC from the signature and the secret
-	hmac := hmac.New(sha256.New, secretBytes)
-	hmac.Write([]byte(reference))
-	signature := base64.StdEncoding.EncodeToString(hmac.Sum(nil))
+	mac := hmac.New(sha256.New, secretBytes)
+	mac.Write([]byte(reference))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyAdyenPayloadHMAC checks the HMAC signature from the HmacSignature header of a
+// management, report, balance platform or transfer webhook against the signature of
+// the raw request body computed with the hex encoded secret.
+func VerifyAdyenPayloadHMAC(body []byte, checkSignature, secret string) (err error) {
+	if checkSignature == "" {
+		return ErrMissingHMACSignature
+	}
+
+	var signature string
+	if signature, err = SignAdyenPayloadHMAC(body, secret); err != nil {
+		return err
+	}
 
-	// Step 4: Verify the signature with the check signature
-	if signature != checkSignature {
+	if !hmac.Equal([]byte(signature), []byte(checkSignature)) {
 		return ErrInvalidHMACSignature
 	}
 	return nil
 }
 
+// SignAdyenPayloadHMAC computes the base64 encoded HMAC signature of the raw body of a
+// webhook with the hex encoded secret in the same way as Adyen signs the webhooks that
+// are verified by the HmacSignature header.
+func SignAdyenPayloadHMAC(body []byte, secret string) (_ string, err error) {
+	var secretBytes []byte
+	if secretBytes, err = hex.DecodeString(secret); err != nil {
+		return "", ErrInvalidHMACSecret
+	}
+
+	mac := hmac.New(sha256.New, secretBytes)
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Adyen API operations used to label metrics.
+const (
+	adyenCreateSession       = "create_session"
+	adyenRefund              = "refund"
+	adyenCancel              = "cancel"
+	adyenListPaymentMethods  = "list_payment_methods"
+	adyenDeletePaymentMethod = "delete_payment_method"
+	adyenHealthProbe         = "health_probe"
+)
+
+// Records the latency of a call to the Adyen API and, if the call failed, the status
+// code of the response (or error if no response was received).
+func observeAdyen(operation string, started time.Time, rep *http.Response, err error) {
+	metrics.AdyenRequestDuration.WithLabelValues(operation).Observe(time.Since(started).Seconds())
+	if err != nil {
+		code := "error"
+		if rep != nil {
+			code = strconv.Itoa(rep.StatusCode)
+		}
+		metrics.AdyenErrors.WithLabelValues(operation, code).Inc()
+	}
+}
+
+// SetAdyenClient replaces the client that is used to call the Adyen API, e.g. so that a
+// mock of the Adyen API can be used in tests.
+func (s *Server) SetAdyenClient(client *adyen.APIClient) {
+	s.adyen = client
+}
+
 func CreateAdyenClient(conf config.AdyenConfig) *adyen.APIClient {
+	// Trace Adyen calls and propagate the request ID of the inbound request to them so
+	// that they can be correlated; this also prevents the Adyen client from using (and
+	// modifying) http.DefaultClient.
+	client := &http.Client{
+		Transport: otelhttp.NewTransport(
+			logger.TracingTransport(nil),
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				return "adyen " + r.Method
+			}),
+		),
+	}
+
 	if conf.Live {
 		return adyen.NewClient(&common.Config{
 			ApiKey:                conf.APIKey,
 			Environment:           common.LiveEnv,
 			LiveEndpointURLPrefix: conf.URLPrefix,
+			HTTPClient:            client,
 		})
 	}
 
 	return adyen.NewClient(&common.Config{
 		ApiKey:      conf.APIKey,
 		Environment: common.TestEnv,
+		HTTPClient:  client,
 	})
 }
@@ -1,10 +1,14 @@
 package exchequer_test
 
 import (
+	"context"
 	"testing"
 
 	"github.com/adyen/adyen-go-api-library/v11/src/webhook"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
 	"github.com/rotationalio/exchequer/pkg/exchequer"
+	"github.com/rotationalio/exchequer/pkg/metrics"
 	"github.com/stretchr/testify/require"
 )
 
@@ -56,4 +60,35 @@ func TestVerifyAdyenHMAC(t *testing.T) {
 		require.ErrorIs(t, err, exchequer.ErrInvalidHMACSignature, "expected error with invalid hmac secret")
 	})
 
+	t.Run("Sign", func(t *testing.T) {
+		notification := event.GetNotificationItems()[0]
+		signature, err := exchequer.SignAdyenHMAC(notification, exampleHMACSecret)
+		require.NoError(t, err, "could not sign notification")
+		require.Equal(t, (*notification.AdditionalData)["hmacSignature"], signature)
+
+		_, err = exchequer.SignAdyenHMAC(notification, "notahexsecret")
+		require.ErrorIs(t, err, exchequer.ErrInvalidHMACSecret)
+	})
+}
+
+func TestNotificationMetrics(t *testing.T) {
+	_, client := newServer(t)
+
+	received := metrics.NotificationsReceived.WithLabelValues("AUTHORISATION", "true")
+	authorised := metrics.PaymentAmounts.WithLabelValues(metrics.PaymentAuthorised, "EUR")
+	nReceived, nAuthorised := testutil.ToFloat64(received), testutil.ToFloat64(authorised)
+
+	postWebhook(t, client, exampleWebhookEvent)
+	postWebhook(t, client, exampleWebhookEvent)
+
+	// Redeliveries are received but the payment amount is only counted once
+	require.Equal(t, float64(2), testutil.ToFloat64(received)-nReceived)
+	require.Equal(t, float64(1130), testutil.ToFloat64(authorised)-nAuthorised)
+
+	// Replays of a processed notification are not counted again
+	out, err := client.ReplayNotifications(context.Background(), &api.NotificationReplayRequest{PSPReference: "7914073381342284", Republish: true})
+	require.NoError(t, err)
+	require.Len(t, out.Results, 1)
+	require.Empty(t, out.Results[0].Error)
+	require.Equal(t, float64(1130), testutil.ToFloat64(authorised)-nAuthorised)
 }
@@ -0,0 +1,209 @@
+package exchequer
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/pagination"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+)
+
+// ListAPIKeys returns all API keys, including revoked keys, without their secrets.
+func (s *Server) ListAPIKeys(c *gin.Context) {
+	var (
+		err   error
+		query *api.PageQuery
+		page  *pagination.Page[*api.APIKey]
+		keys  []*store.APIKey
+	)
+
+	query = &api.PageQuery{}
+	if err = c.ShouldBindQuery(query); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse page query"))
+		return
+	}
+
+	if page, err = newPage[*api.APIKey](s.pages, "apikeys", query, apiKeyFilters, query.ListFilter); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	if keys, err = s.store.ListAPIKeys(); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not list api keys"))
+		return
+	}
+
+	for _, key := range keys {
+		status := statusActive
+		if key.IsRevoked() {
+			status = statusRevoked
+		}
+
+		if !matchCreated(&query.ListFilter, key.Created) || !matchStatus(&query.ListFilter, status) {
+			continue
+		}
+
+		if !page.Add(apiKeyToAPI(key), pagination.Key{ID: key.ID}) {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, &api.APIKeyList{
+		APIKeys:       page.Items(),
+		NextPageToken: page.NextPageToken(),
+		PrevPageToken: page.PrevPageToken(),
+	})
+}
+
+// CreateAPIKey generates a new client ID and secret with the requested scopes. The
+// secret is only returned in this response; only its argon2 derived key is stored.
+func (s *Server) CreateAPIKey(c *gin.Context) {
+	var (
+		err    error
+		in     *api.APIKey
+		key    *store.APIKey
+		claims *auth.Claims
+		secret string
+	)
+
+	in = &api.APIKey{}
+	if err = c.ShouldBindJSON(in); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse api key request"))
+		return
+	}
+
+	if in.ID != "" || in.ClientID != "" || in.ClientSecret != "" {
+		c.JSON(http.StatusBadRequest, api.Error("api key credentials cannot be specified"))
+		return
+	}
+
+	if err = auth.ValidateScopes(in.Scopes); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	// Callers cannot grant scopes to an API key that they do not have themselves
+	if claims, err = auth.GetClaims(c); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusUnauthorized, api.Error("this endpoint requires authentication"))
+		return
+	}
+
+	for _, scope := range in.Scopes {
+		if !claims.HasPermission(scope) {
+			c.JSON(http.StatusForbidden, api.Error("cannot grant scopes that you do not have"))
+			return
+		}
+	}
+
+	if key, secret, err = auth.NewAPIKey(in.Description, in.Scopes); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not create api key"))
+		return
+	}
+
+	if err = s.store.CreateAPIKey(key); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not create api key"))
+		return
+	}
+
+	out := apiKeyToAPI(key)
+	s.audit(c, AuditAPIKeyCreate, apiKeyResource(key.ID), nil, out)
+
+	// The secret is not recorded in the audit log
+	out.ClientSecret = secret
+	c.JSON(http.StatusCreated, out)
+}
+
+// APIKeyDetail returns the API key without its secret.
+func (s *Server) APIKeyDetail(c *gin.Context) {
+	var (
+		err error
+		id  ulid.ULID
+		key *store.APIKey
+	)
+
+	if id, err = ulids.Parse(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, api.Error("api key not found"))
+		return
+	}
+
+	if key, err = s.store.RetrieveAPIKey(id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, api.Error("api key not found"))
+			return
+		}
+
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not retrieve api key"))
+		return
+	}
+
+	c.JSON(http.StatusOK, apiKeyToAPI(key))
+}
+
+// RevokeAPIKey prevents the API key from being used to authenticate any further
+// requests. Revoked keys are retained so that their use can be audited.
+func (s *Server) RevokeAPIKey(c *gin.Context) {
+	var (
+		err error
+		id  ulid.ULID
+		key *store.APIKey
+	)
+
+	if id, err = ulids.Parse(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, api.Error("api key not found"))
+		return
+	}
+
+	before, _ := s.store.RetrieveAPIKey(id)
+	if key, err = s.store.RevokeAPIKey(id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, api.Error("api key not found"))
+			return
+		}
+
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not revoke api key"))
+		return
+	}
+
+	// Revoked keys must not be authenticated from a cached verification; other replicas
+	// expire their cached verification of the key within a minute.
+	s.apikeys.Forget(key.ClientID)
+
+	out := apiKeyToAPI(key)
+	if before != nil {
+		s.audit(c, AuditAPIKeyRevoke, apiKeyResource(key.ID), apiKeyToAPI(before), out)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func apiKeyResource(id ulid.ULID) string {
+	return "apikeys/" + id.String()
+}
+
+func apiKeyToAPI(key *store.APIKey) *api.APIKey {
+	out := &api.APIKey{
+		ID:          key.ID.String(),
+		ClientID:    key.ClientID,
+		Description: key.Description,
+		Scopes:      key.Scopes,
+		Created:     key.Created,
+		Modified:    key.Modified,
+	}
+
+	if key.IsRevoked() {
+		out.Revoked = &key.Revoked
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package exchequer_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeys(t *testing.T) {
+	_, client := newServer(t)
+	ctx := context.Background()
+
+	// Invalid scopes are rejected
+	_, err := client.CreateAPIKey(ctx, &api.APIKey{Scopes: []string{"invoices:delete"}})
+	require.ErrorIs(t, err, api.ErrBadRequest)
+
+	// Create an API key; the secret is only returned on creation
+	key, err := client.CreateAPIKey(ctx, &api.APIKey{Description: "monitoring", Scopes: []string{"webhooks:read"}})
+	require.NoError(t, err, "could not create api key")
+	require.NotEmpty(t, key.ClientID)
+	require.NotEmpty(t, key.ClientSecret)
+	require.Nil(t, key.Revoked)
+
+	detail, err := client.APIKeyDetail(ctx, key.ID)
+	require.NoError(t, err)
+	require.Equal(t, key.ClientID, detail.ClientID)
+	require.Empty(t, detail.ClientSecret)
+
+	// The API key can be used to authenticate requests
+	service, err := api.New(endpoint(client), api.WithAPIKey(key.ClientID, key.ClientSecret))
+	require.NoError(t, err)
+
+	_, err = service.ListWebhookEndpoints(ctx, nil)
+	require.NoError(t, err, "could not authenticate with api key")
+
+	// API keys are limited to their scopes
+	_, err = service.ListAPIKeys(ctx, nil)
+	require.ErrorIs(t, err, api.ErrForbidden)
+
+	// An incorrect secret cannot be used to authenticate
+	imposter, err := api.New(endpoint(client), api.WithAPIKey(key.ClientID, "notthesecret"))
+	require.NoError(t, err)
+	_, err = imposter.ListWebhookEndpoints(ctx, nil)
+	require.ErrorIs(t, err, api.ErrUnauthenticated)
+
+	// Revoked keys cannot be used to authenticate
+	revoked, err := client.RevokeAPIKey(ctx, key.ID)
+	require.NoError(t, err, "could not revoke api key")
+	require.NotNil(t, revoked.Revoked)
+
+	_, err = service.ListWebhookEndpoints(ctx, nil)
+	require.ErrorIs(t, err, api.ErrUnauthenticated)
+
+	_, err = client.RevokeAPIKey(ctx, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+	require.ErrorIs(t, err, api.ErrNotFound)
+
+	_, err = client.RevokeAPIKey(ctx, "")
+	require.ErrorIs(t, err, api.ErrMissingID)
+}
+
+// Makes a raw request to the server for tests that need to inspect the response or
+// send requests that the typed client methods cannot express.
+func doRequest(ctx context.Context, client api.Client, method, path string, in, out any) (*http.Response, error) {
+	v1 := client.(*api.APIv1)
+	req, err := v1.NewRequest(ctx, method, path, in, nil)
+	if err != nil {
+		return nil, err
+	}
+	return v1.Do(req, out, true)
+}
+
+// Returns the base url of the test server that the client connects to.
+func endpoint(client api.Client) string {
+	req, _ := client.(*api.APIv1).NewRequest(context.Background(), http.MethodGet, "/", nil, nil)
+	return req.URL.Scheme + "://" + req.URL.Host
+}
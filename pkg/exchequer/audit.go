@@ -0,0 +1,268 @@
+package exchequer
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/logger"
+	"github.com/rotationalio/exchequer/pkg/metrics"
+	"github.com/rotationalio/exchequer/pkg/pagination"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rs/zerolog/log"
+)
+
+// Actor types recorded in the audit log.
+const (
+	ActorUser      = "user"
+	ActorAPIKey    = "apikey"
+	ActorSystem    = "system"
+	ActorAnonymous = "anonymous"
+)
+
+// The actor recorded for state changes driven by Adyen webhooks.
+const actorAdyen = "adyen"
+
+// Audit log actions.
+const (
+	AuditPaymentMethodDefault = "payment_method.set_default"
+	AuditPaymentMethodDisable = "payment_method.disable"
+	AuditPaymentMethodStore   = "payment_method.store"
+	AuditCheckoutLink         = "checkout.link"
+	AuditPaymentRefund        = "payment.refund"
+	AuditPaymentCancel        = "payment.cancel"
+	AuditWebhookCreate        = "webhook.create"
+	AuditWebhookUpdate        = "webhook.update"
+	AuditWebhookDelete        = "webhook.delete"
+	AuditWebhookReplay        = "webhook.replay"
+	AuditAPIKeyCreate         = "apikey.create"
+	AuditAPIKeyRevoke         = "apikey.revoke"
+	AuditAdyenNotification    = "adyen.notification"
+	AuditNotificationReplay   = "adyen.notification.replay"
+	AuditSettlementReconcile  = "settlement.reconcile"
+	AuditMaintenance          = "server.maintenance"
+)
+
+// ListAuditEntries returns a page of the entries of the audit log that match the query
+// in the order that they were recorded.
+func (s *Server) ListAuditEntries(c *gin.Context) {
+	var (
+		err   error
+		query *api.AuditQuery
+		page  *pagination.Page[*api.AuditEntry]
+	)
+
+	query = &api.AuditQuery{}
+	if err = c.ShouldBindQuery(query); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse audit query"))
+		return
+	}
+
+	if query.Limit < 0 {
+		c.JSON(http.StatusBadRequest, api.Error("limit cannot be negative"))
+		return
+	}
+
+	if query.PageSize == 0 {
+		query.PageSize = query.Limit
+	}
+
+	// Page tokens are bound to all of the filters of the query, not just the list filter
+	filter := *query
+	filter.Limit = 0
+	filter.PageSize, filter.NextPageToken, filter.PrevPageToken = 0, "", ""
+
+	if page, err = newPage[*api.AuditEntry](s.pages, "audit", &query.PageQuery, auditFilters, filter); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	err = s.store.EachAuditEntry(func(entry *store.AuditEntry) error {
+		if !MatchAuditEntry(query, entry) {
+			return nil
+		}
+
+		if !page.Add(AuditEntryToAPI(entry), auditEntryKey(entry)) {
+			return errStopIteration
+		}
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, errStopIteration) {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not list audit log entries"))
+		return
+	}
+
+	c.JSON(http.StatusOK, &api.AuditLog{
+		Entries:       page.Items(),
+		NextPageToken: page.NextPageToken(),
+		PrevPageToken: page.PrevPageToken(),
+	})
+}
+
+// VerifyAuditLog checks the hash chain of the audit log to detect tampering.
+func (s *Server) VerifyAuditLog(c *gin.Context) {
+	verified, err := s.store.VerifyAuditLog()
+	out := &api.AuditVerification{Verified: err == nil, Entries: verified}
+
+	if err != nil {
+		if !errors.Is(err, store.ErrAuditChainBroken) {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, api.Error("could not verify audit log"))
+			return
+		}
+		out.Error = err.Error()
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+var errStopIteration = errors.New("stop iteration")
+
+// Records an action taken by the authenticated caller of the request in the audit log.
+// The before and after states are serialized as JSON; either may be nil. The action has
+// already been taken when it is audited, so a failure to record it does not fail the
+// request; it is logged and counted by the audit failures metric so that it alerts.
+func (s *Server) audit(c *gin.Context, action, resource string, before, after any) {
+	entry := &store.AuditEntry{
+		Actor:     ActorAnonymous,
+		ActorType: ActorAnonymous,
+		Action:    action,
+		Resource:  resource,
+		ClientIP:  c.ClientIP(),
+	}
+
+	if claims, err := auth.GetClaims(c); err == nil {
+		entry.Actor = claims.Subject
+		entry.ActorType = ActorUser
+		if claims.ClientID != "" {
+			entry.ActorType = ActorAPIKey
+		}
+	}
+
+	if err := s.appendAudit(c.Request.Context(), entry, before, after); err != nil {
+		c.Error(err)
+	}
+}
+
+// Records an action taken by the system (e.g. in response to an Adyen webhook).
+func (s *Server) auditSystem(ctx context.Context, actor, action, resource string, before, after any) error {
+	entry := &store.AuditEntry{
+		Actor:     actor,
+		ActorType: ActorSystem,
+		Action:    action,
+		Resource:  resource,
+	}
+	return s.appendAudit(ctx, entry, before, after)
+}
+
+func (s *Server) appendAudit(ctx context.Context, entry *store.AuditEntry, before, after any) (err error) {
+	entry.RequestID, _ = logger.RequestID(ctx)
+
+	if entry.Before, err = marshalState(before); err != nil {
+		return err
+	}
+
+	if entry.After, err = marshalState(after); err != nil {
+		return err
+	}
+
+	if err = s.store.AppendAuditEntry(entry); err != nil {
+		metrics.AuditFailures.WithLabelValues(entry.Action).Inc()
+		log.Error().Err(err).
+			Str("actor", entry.Actor).
+			Str("action", entry.Action).
+			Str("resource", entry.Resource).
+			Str("request_id", entry.RequestID).
+			Msg("could not append entry to the audit log")
+		return err
+	}
+	return nil
+}
+
+// Serializes the state of a resource, returning nil if there is no state (including
+// typed nil pointers, which are serialized as null).
+func marshalState(state any) (data json.RawMessage, err error) {
+	if state == nil {
+		return nil, nil
+	}
+
+	if data, err = json.Marshal(state); err != nil {
+		return nil, err
+	}
+
+	if string(data) == "null" {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// MatchAuditEntry returns true if the entry matches the filters of the audit query.
+func MatchAuditEntry(query *api.AuditQuery, entry *store.AuditEntry) bool {
+	switch {
+	case query.Actor != "" && query.Actor != entry.Actor:
+		return false
+	case query.Action != "" && query.Action != entry.Action:
+		return false
+	case query.Resource != "" && !strings.HasPrefix(entry.Resource, query.Resource):
+		return false
+	case !query.Since.IsZero() && entry.Timestamp.Before(query.Since):
+		return false
+	case !query.Until.IsZero() && !entry.Timestamp.Before(query.Until):
+		return false
+	case query.CustomerID != "" && !strings.HasPrefix(entry.Resource, "customers/"+query.CustomerID+"/"):
+		return false
+	case !matchCreated(&query.ListFilter, entry.Timestamp):
+		return false
+	}
+	return true
+}
+
+// The audit log is ordered by sequence; the sequence is zero padded so that the sort
+// keys of the entries are ordered lexicographically.
+func auditEntryKey(entry *store.AuditEntry) pagination.Key {
+	return pagination.Key{ID: entry.ID, SortKey: fmt.Sprintf("%020d", entry.Sequence)}
+}
+
+// AuditEntryToAPI converts an audit log entry to its API representation.
+func AuditEntryToAPI(entry *store.AuditEntry) *api.AuditEntry {
+	out := &api.AuditEntry{
+		ID:        entry.ID.String(),
+		Sequence:  entry.Sequence,
+		Actor:     entry.Actor,
+		ActorType: entry.ActorType,
+		Action:    entry.Action,
+		Resource:  entry.Resource,
+		Before:    entry.Before,
+		After:     entry.After,
+		RequestID: entry.RequestID,
+		ClientIP:  entry.ClientIP,
+		Timestamp: entry.Timestamp,
+		Hash:      hex.EncodeToString(entry.Hash),
+	}
+
+	if len(entry.PrevHash) > 0 {
+		out.PrevHash = hex.EncodeToString(entry.PrevHash)
+	}
+
+	if len(entry.Changes) > 0 {
+		out.Changes = make([]*api.AuditChange, 0, len(entry.Changes))
+		for _, change := range entry.Changes {
+			out.Changes = append(out.Changes, &api.AuditChange{
+				Field:  change.Field,
+				Before: change.Before,
+				After:  change.After,
+			})
+		}
+	}
+	return out
+}
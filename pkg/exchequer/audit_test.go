@@ -0,0 +1,138 @@
+package exchequer_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/exchequer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	_, client, tokens := newServerWithTokens(t)
+	ctx := context.Background()
+
+	// Mutating API calls are recorded in the audit log
+	// The request ID sent by the client is recorded with the entry
+	webhook, err := client.CreateWebhookEndpoint(api.ContextWithRequestID(ctx, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M"), &api.WebhookEndpoint{URL: "https://example.com/hook", EventTypes: []string{"payment.*"}})
+	require.NoError(t, err, "could not create webhook endpoint")
+
+	webhook.Description = "billing events"
+	_, err = client.UpdateWebhookEndpoint(ctx, webhook)
+	require.NoError(t, err, "could not update webhook endpoint")
+
+	key, err := client.CreateAPIKey(ctx, &api.APIKey{Description: "monitoring", Scopes: []string{"webhooks:read"}})
+	require.NoError(t, err, "could not create api key")
+
+	// Webhook driven state changes are recorded in the audit log
+	postWebhook(t, client, exampleWebhookEvent)
+
+	log, err := client.ListAuditEntries(ctx, nil)
+	require.NoError(t, err, "could not list audit log")
+	require.Len(t, log.Entries, 4)
+
+	expected := []struct {
+		action    string
+		actor     string
+		actorType string
+		resource  string
+	}{
+		{exchequer.AuditWebhookCreate, "testing", exchequer.ActorUser, "webhooks/" + webhook.ID},
+		{exchequer.AuditWebhookUpdate, "testing", exchequer.ActorUser, "webhooks/" + webhook.ID},
+		{exchequer.AuditAPIKeyCreate, "testing", exchequer.ActorUser, "apikeys/" + key.ID},
+		{exchequer.AuditAdyenNotification, "adyen", exchequer.ActorSystem, "payments/7914073381342284"},
+	}
+
+	for i, tc := range expected {
+		entry := log.Entries[i]
+		require.Equal(t, tc.action, entry.Action, "test case %d failed", i)
+		require.Equal(t, tc.actor, entry.Actor, "test case %d failed", i)
+		require.Equal(t, tc.actorType, entry.ActorType, "test case %d failed", i)
+		require.Equal(t, tc.resource, entry.Resource, "test case %d failed", i)
+		require.Equal(t, uint64(i+1), entry.Sequence, "test case %d failed", i)
+		require.NotEmpty(t, entry.RequestID, "test case %d failed", i)
+		require.NotEmpty(t, entry.Hash, "test case %d failed", i)
+
+		if i > 0 {
+			require.Equal(t, log.Entries[i-1].Hash, entry.PrevHash, "test case %d failed", i)
+		}
+	}
+
+	require.Equal(t, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M", log.Entries[0].RequestID)
+
+	// Updates record the fields that were changed
+	require.NotEmpty(t, log.Entries[1].Changes)
+	var changed bool
+	for _, change := range log.Entries[1].Changes {
+		if change.Field == "description" {
+			changed = true
+		}
+	}
+	require.True(t, changed, "expected description change to be recorded")
+
+	// The api key secret is never recorded in the audit log
+	require.NotContains(t, string(log.Entries[2].After), key.ClientSecret)
+
+	// The audit log can be filtered
+	filtered, err := client.ListAuditEntries(ctx, &api.AuditQuery{Action: exchequer.AuditWebhookUpdate})
+	require.NoError(t, err)
+	require.Len(t, filtered.Entries, 1)
+
+	filtered, err = client.ListAuditEntries(ctx, &api.AuditQuery{Resource: "webhooks/", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, filtered.Entries, 1)
+	require.Equal(t, exchequer.AuditWebhookCreate, filtered.Entries[0].Action)
+
+	filtered, err = client.ListAuditEntries(ctx, &api.AuditQuery{Actor: "adyen"})
+	require.NoError(t, err)
+	require.Len(t, filtered.Entries, 1)
+
+	_, err = client.ListAuditEntries(ctx, &api.AuditQuery{Limit: -1})
+	require.ErrorIs(t, err, api.ErrBadRequest)
+
+	// The hash chain of the audit log can be verified
+	verification, err := client.VerifyAuditLog(ctx)
+	require.NoError(t, err)
+	require.True(t, verification.Verified)
+	require.Equal(t, uint64(4), verification.Entries)
+
+	// Viewers cannot read the audit log
+	viewer := newClientWithRoles(t, client, tokens, auth.RoleViewer)
+	_, err = viewer.ListAuditEntries(ctx, nil)
+	require.ErrorIs(t, err, api.ErrForbidden)
+}
+
+func TestAuditClientIP(t *testing.T) {
+	testCases := []struct {
+		proxies  []string
+		expected string
+	}{
+		{nil, "127.0.0.1"},
+		{[]string{"10.0.0.0/8"}, "127.0.0.1"},
+		{[]string{"127.0.0.1"}, "203.0.113.7"},
+	}
+
+	// Forwarded client IPs are only recorded from trusted proxies
+	for i, tc := range testCases {
+		_, client, _ := newServerWithTokens(t, func(conf *config.Config) {
+			conf.TrustedProxies = tc.proxies
+		})
+
+		v1 := client.(*api.APIv1)
+		req, err := v1.NewRequest(context.Background(), http.MethodPost, "/v1/webhooks", &api.WebhookEndpoint{URL: "https://example.com/hook", EventTypes: []string{"payment.*"}}, nil)
+		require.NoError(t, err, "test case %d failed", i)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+		_, err = v1.Do(req, &api.WebhookEndpoint{}, true)
+		require.NoError(t, err, "test case %d failed", i)
+
+		log, err := client.ListAuditEntries(context.Background(), &api.AuditQuery{Action: exchequer.AuditWebhookCreate})
+		require.NoError(t, err, "test case %d failed", i)
+		require.Len(t, log.Entries, 1, "test case %d failed", i)
+		require.Equal(t, tc.expected, log.Entries[0].ClientIP, "test case %d failed", i)
+	}
+}
@@ -1,18 +1,58 @@
 package exchequer
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/adyen/adyen-go-api-library/v11/src/checkout"
 	"github.com/adyen/adyen-go-api-library/v11/src/common"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/metrics"
 	"github.com/rotationalio/exchequer/pkg/ulids"
 )
 
+// Recurring processing models and shopper interactions used to store payment methods.
+const (
+	recurringCardOnFile = "CardOnFile"
+	shopperEcommerce    = "Ecommerce"
+)
+
+// Checkout starts an Adyen checkout session and renders the Drop-in. The checkout page is
+// public, so the customer that the session is associated with is only taken from the
+// signed token of a checkout link; without a token the session is a guest checkout that
+// cannot see or store the payment methods of any customer.
 func (s *Server) Checkout(c *gin.Context) {
+	var (
+		err    error
+		query  *api.CheckoutQuery
+		claims *auth.CheckoutClaims
+	)
+
+	query = &api.CheckoutQuery{}
+	if err = c.ShouldBindQuery(query); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse checkout query"))
+		return
+	}
+
+	if query.Token != "" {
+		if claims, err = s.tokens.VerifyCheckoutToken(query.Token); err != nil {
+			c.Error(err)
+			c.Negotiate(http.StatusForbidden, gin.Negotiate{
+				Offered:  []string{binding.MIMEJSON, binding.MIMEHTML},
+				Data:     api.Error("checkout link is invalid or has expired"),
+				HTMLName: "404.html",
+			})
+			return
+		}
+	}
+
 	origin, _ := url.Parse(s.conf.Origin)
 
 	// Create the checkout request object
@@ -31,10 +71,24 @@ func (s *Server) Checkout(c *gin.Context) {
 		ReturnUrl:       returnURL.String(),
 	}
 
+	// Associate the session with the customer and optionally store the payment method.
+	// Adyen sends a RECURRING_CONTRACT webhook with the token once it has been stored.
+	if claims != nil {
+		sessionRequest.ShopperReference = common.PtrString(claims.Subject)
+	}
+
+	if claims != nil && claims.StorePaymentMethod {
+		sessionRequest.StorePaymentMethod = common.PtrBool(true)
+		sessionRequest.RecurringProcessingModel = common.PtrString(recurringCardOnFile)
+		sessionRequest.ShopperInteraction = common.PtrString(shopperEcommerce)
+	}
+
 	// Send the request to Adyen
 	service := s.adyen.Checkout()
 	req := service.PaymentsApi.SessionsInput().IdempotencyKey(key.String()).CreateCheckoutSessionRequest(sessionRequest)
-	rep, _, err := service.PaymentsApi.Sessions(c.Request.Context(), req)
+	started := time.Now()
+	rep, hrep, err := service.PaymentsApi.Sessions(c.Request.Context(), req)
+	observeAdyen(adyenCreateSession, started, hrep, err)
 
 	if err != nil {
 		c.Error(err)
@@ -46,6 +100,7 @@ func (s *Server) Checkout(c *gin.Context) {
 		return
 	}
 
+	metrics.CheckoutSessionsCreated.Inc()
 	out := gin.H{
 		"ClientKey":   s.conf.Adyen.ClientKey,
 		"SessionID":   rep.Id,
@@ -58,3 +113,40 @@ func (s *Server) Checkout(c *gin.Context) {
 		HTMLName: "checkout.html",
 	})
 }
+
+// CreateCheckoutLink signs a checkout token for the customer and returns the link to the
+// checkout page that uses it. Anyone with the link can start a checkout session for the
+// customer until it expires, so links should only be sent to the customer.
+func (s *Server) CreateCheckoutLink(c *gin.Context) {
+	var (
+		err error
+		in  *api.CheckoutRequest
+		out *api.CheckoutLink
+		tks string
+	)
+
+	in = &api.CheckoutRequest{}
+	if err = c.ShouldBindJSON(in); err != nil && !errors.Is(err, io.EOF) {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse checkout request"))
+		return
+	}
+
+	out = &api.CheckoutLink{CustomerID: c.Param("id"), StorePaymentMethod: in.StorePaymentMethod}
+	if tks, out.Expires, err = s.tokens.CreateCheckoutToken(out.CustomerID, in.StorePaymentMethod); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not create checkout link"))
+		return
+	}
+
+	origin, _ := url.Parse(s.conf.Origin)
+	link := origin.JoinPath("/checkout")
+	link.RawQuery = url.Values{"token": []string{tks}}.Encode()
+	out.URL = link.String()
+
+	// The URL is not audited since anyone with it can start a checkout for the customer
+	audited := *out
+	audited.URL = ""
+	s.audit(c, AuditCheckoutLink, "customers/"+out.CustomerID+"/checkout", nil, &audited)
+	c.JSON(http.StatusCreated, out)
+}
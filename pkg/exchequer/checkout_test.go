@@ -0,0 +1,83 @@
+package exchequer_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckout(t *testing.T) {
+	svc, client, tokens := newServerWithTokens(t)
+	ctx := context.Background()
+
+	mock := &mockRecurringAPI{}
+	svc.SetAdyenClient(mock.Client())
+
+	// Guest checkouts are not associated with a customer even if one is requested
+	require.Equal(t, http.StatusOK, checkout(t, endpoint(client)+"/checkout?customer=cust_1&store_payment_method=true"))
+	require.Len(t, mock.Sessions(), 1)
+	require.NotContains(t, mock.Sessions()[0], "shopperReference")
+	require.NotContains(t, mock.Sessions()[0], "storePaymentMethod")
+
+	// Checkout links associate the session with the customer they were created for
+	link, err := client.CreateCheckoutLink(ctx, "cust_1", &api.CheckoutRequest{StorePaymentMethod: true})
+	require.NoError(t, err)
+	require.Equal(t, "cust_1", link.CustomerID)
+	require.True(t, link.StorePaymentMethod)
+	require.WithinDuration(t, time.Now().Add(auth.CheckoutTokenDuration), link.Expires, 2*time.Second)
+
+	u, err := url.Parse(link.URL)
+	require.NoError(t, err)
+	require.Equal(t, "/checkout", u.Path)
+
+	require.Equal(t, http.StatusOK, checkout(t, endpoint(client)+"/checkout?"+u.RawQuery))
+	require.Len(t, mock.Sessions(), 2)
+	require.Equal(t, "cust_1", mock.Sessions()[1]["shopperReference"])
+	require.Equal(t, true, mock.Sessions()[1]["storePaymentMethod"])
+
+	link, err = client.CreateCheckoutLink(ctx, "cust_2", nil)
+	require.NoError(t, err)
+	u, _ = url.Parse(link.URL)
+	require.Equal(t, http.StatusOK, checkout(t, endpoint(client)+"/checkout?"+u.RawQuery))
+	require.Equal(t, "cust_2", mock.Sessions()[2]["shopperReference"])
+	require.NotContains(t, mock.Sessions()[2], "storePaymentMethod")
+
+	// Forged tokens and access tokens cannot be used to start a checkout for a customer
+	accessToken, err := tokens.CreateAccessToken(&auth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "cust_1"}})
+	require.NoError(t, err)
+
+	for _, token := range []string{"notatoken", u.Query().Get("token") + "x", accessToken} {
+		require.Equal(t, http.StatusForbidden, checkout(t, endpoint(client)+"/checkout?token="+url.QueryEscape(token)))
+	}
+	require.Len(t, mock.Sessions(), 3)
+
+	// Creating checkout links requires permission to modify customers
+	viewer := newClientWithRoles(t, client, tokens, auth.RoleViewer)
+	_, err = viewer.CreateCheckoutLink(ctx, "cust_1", nil)
+	require.ErrorIs(t, err, api.ErrForbidden)
+
+	// The link is audited without its token
+	entries, err := client.ListAuditEntries(ctx, &api.AuditQuery{Resource: "customers/cust_1/checkout"})
+	require.NoError(t, err)
+	require.Len(t, entries.Entries, 1)
+	require.NotContains(t, string(entries.Entries[0].After), "token")
+}
+
+// Requests the checkout page as JSON, returning the status code of the response.
+func checkout(t *testing.T, url string) int {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+
+	rep, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	rep.Body.Close()
+	return rep.StatusCode
+}
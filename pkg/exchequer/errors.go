@@ -14,6 +14,8 @@ var (
 	ErrMissingHMACSignature = errors.New("HMAC id or signature is missing")
 	ErrInvalidHMACSignature = errors.New("invalid HMAC signature")
 	ErrInvalidHMACSecret    = errors.New("HMAC secret must be a hex encoded string")
+	ErrAdyenRequest         = errors.New("adyen api request failed")
+	ErrSchedulerStopped     = errors.New("webhook scheduler is not running")
 )
 
 func (s *Server) NotFound(c *gin.Context) {
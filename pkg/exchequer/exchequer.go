@@ -18,9 +18,17 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/certs"
 	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/events"
+	"github.com/rotationalio/exchequer/pkg/health"
 	"github.com/rotationalio/exchequer/pkg/logger"
 	"github.com/rotationalio/exchequer/pkg/metrics"
+	"github.com/rotationalio/exchequer/pkg/pagination"
+	"github.com/rotationalio/exchequer/pkg/settlement"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rotationalio/exchequer/pkg/tracing"
 )
 
 func init() {
@@ -60,20 +68,71 @@ func New(conf config.Config) (svc *Server, err error) {
 		return nil, err
 	}
 
+	// Configure tracing before the instrumented router and adyen client are created
+	if err = tracing.Setup(conf.Tracing); err != nil {
+		return nil, err
+	}
+
 	svc = &Server{
 		conf:  conf,
 		errc:  make(chan error, 1),
+		done:  make(chan struct{}),
 		adyen: CreateAdyenClient(conf.Adyen),
 	}
 
+	// Load the keys used to verify access tokens for the API
+	if svc.tokens, err = auth.NewTokenManager(conf.Auth); err != nil {
+		return nil, err
+	}
+
+	// Open the database for local billing records
+	if svc.store, err = store.Open(conf.DatabaseURL); err != nil {
+		return nil, err
+	}
+
+	// Verify API keys against the store, caching successful verifications
+	svc.apikeys = auth.NewAPIKeyVerifier(svc.store)
+
+	// Start in maintenance mode if configured; it can be turned off at runtime
+	if conf.Maintenance {
+		if _, _, err = svc.SetMaintenanceMode(true, "", nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sign the page tokens of list endpoints
+	if svc.pages, err = newPaginator(conf.Pagination); err != nil {
+		return nil, err
+	}
+
+	// Create the dispatcher for outbound webhooks to internal services
+	svc.events = events.New(conf.Webhooks, svc.store)
+
+	// Check the dependencies of the server to determine if it is ready for traffic
+	svc.setupHealthChecks()
+
+	// Download settlement detail reports to reconcile them when they are available
+	if conf.Adyen.Reports.Reconcile {
+		svc.reports = newReportDownloader(conf.Adyen.Reports)
+	}
+
+	// Register the handlers that process Adyen notifications
+	svc.setupNotificationHandlers()
+
 	// Configure the gin router if enabled
 	svc.router = gin.New()
 	svc.router.RedirectTrailingSlash = true
 	svc.router.RedirectFixedPath = false
 	svc.router.HandleMethodNotAllowed = true
 	svc.router.ForwardedByClientIP = true
-	svc.router.UseRawPath = false
+	svc.router.UseRawPath = true
 	svc.router.UnescapePathValues = true
+
+	// The client IP is recorded in the audit log and limits failed API key attempts so
+	// forwarded headers are only trusted from the configured proxies
+	if err = svc.router.SetTrustedProxies(conf.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
 	if err = svc.setupRoutes(); err != nil {
 		return nil, err
 	}
@@ -88,20 +147,40 @@ func New(conf config.Config) (svc *Server, err error) {
 		IdleTimeout:       120 * time.Second,
 	}
 
+	// Terminate TLS in the server if configured, reloading certificates as they change
+	if conf.TLS.Enabled() {
+		var reloader *certs.Reloader
+		if reloader, err = certs.New(conf.TLS); err != nil {
+			return nil, err
+		}
+		svc.srv.TLSConfig = reloader.Config()
+	}
+
 	return svc, nil
 }
 
 type Server struct {
 	sync.RWMutex
-	conf    config.Config
-	srv     *http.Server
-	router  *gin.Engine
-	adyen   *adyen.APIClient
-	url     *url.URL
-	started time.Time
-	healthy bool
-	ready   bool
-	errc    chan error
+	conf             config.Config
+	srv              *http.Server
+	router           *gin.Engine
+	adyen            *adyen.APIClient
+	tokens           *auth.TokenManager
+	apikeys          *auth.APIKeyVerifier
+	store            *store.Store
+	events           *events.Dispatcher
+	pages            *pagination.Paginator
+	handlers         map[string]NotificationHandler
+	platformHandlers map[string]PlatformWebhookHandler
+	reports          settlement.Downloader
+	health           *health.Registry
+	url              *url.URL
+	started          time.Time
+	healthy          bool
+	ready            bool
+	background       sync.WaitGroup
+	errc             chan error
+	done             chan struct{}
 }
 
 // Serve the compliance and administrative user interfaces in its own go routine.
@@ -124,6 +203,14 @@ func (s *Server) Serve() (err error) {
 		return fmt.Errorf("could not listen on bind addr %s: %s", s.srv.Addr, err)
 	}
 
+	// Start delivering billing events to registered webhook endpoints
+	if err = s.events.Run(); err != nil {
+		return err
+	}
+
+	// Remove idempotency records once retries of their requests are no longer replayed
+	go s.sweepIdempotencyRecords(s.done)
+
 	s.setURL(sock.Addr())
 	s.SetStatus(true, true)
 	s.started = time.Now()
@@ -163,10 +250,41 @@ func (s *Server) Shutdown() (err error) {
 		err = errors.Join(err, serr)
 	}
 
+	// Stop background work that was started by requests before the store is closed
+	close(s.done)
+	s.background.Wait()
+
+	if serr := s.events.Shutdown(); serr != nil {
+		err = errors.Join(err, serr)
+	}
+
+	if serr := s.store.Close(); serr != nil {
+		err = errors.Join(err, serr)
+	}
+
+	if serr := tracing.Shutdown(ctx); serr != nil {
+		err = errors.Join(err, serr)
+	}
+
 	log.Debug().Err(err).Msg("exchequer billing service has shut down")
 	return err
 }
 
+// Returns a context for work that continues in the background after the request that
+// started it has been answered. The context keeps the values of the request context
+// (e.g. the trace) and is canceled when the server shuts down instead of with the request.
+func (s *Server) detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 // SetStatus sets the health and ready status on the server, modifying the behavior of
 // the kubernetes probe responses.
 func (s *Server) SetStatus(health, ready bool) {
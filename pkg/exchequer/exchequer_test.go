@@ -0,0 +1,216 @@
+package exchequer_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/exchequer"
+	"github.com/rotationalio/exchequer/pkg/logger"
+	"github.com/rotationalio/exchequer/pkg/tracing"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Creates a test server with an in-memory database and returns a client to it that is
+// authenticated with an admin access token. The server is shut down when the test
+// completes.
+func newServer(t *testing.T) (*exchequer.Server, api.Client) {
+	srv, client, _ := newServerWithTokens(t)
+	return srv, client
+}
+
+// Creates a test server like newServer but also returns the token manager so that the
+// test can create clients that are authenticated with other claims. The options modify
+// the test configuration before the server is created.
+func newServerWithTokens(t *testing.T, opts ...func(*config.Config)) (*exchequer.Server, api.Client, *auth.TokenManager) {
+	logger.Discard()
+	t.Cleanup(logger.ResetLogger)
+
+	conf := config.Config{
+		Mode:        "test",
+		BindAddr:    "127.0.0.1:0",
+		Origin:      "http://localhost:8204",
+		DatabaseURL: "memory://",
+		Auth: config.AuthConfig{
+			Keys:           writeTokenKey(t),
+			Audience:       "exchequer",
+			Issuer:         "exchequer",
+			AccessDuration: time.Hour,
+			RefundLimits:   map[string]int64{"EUR": 10000, "JPY": 100},
+		},
+		Adyen: config.AdyenConfig{
+			MerchantAccount: "TestMerchant",
+			APIKey:          "testing",
+			ClientKey:       "testing",
+		},
+		Webhooks: config.WebhooksConfig{
+			Workers:        1,
+			MaxAttempts:    1,
+			Timeout:        time.Second,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+			PollInterval:   time.Second,
+		},
+		Health: config.HealthConfig{
+			Timeout:        time.Second,
+			WebhookBacklog: 100,
+		},
+		Pagination: config.PaginationConfig{
+			DefaultPageSize: 50,
+			MaxPageSize:     200,
+		},
+		Tracing: config.TracingConfig{
+			Enabled:     true,
+			Exporter:    "memory",
+			SampleRatio: 1,
+			ServiceName: "exchequer",
+		},
+	}
+
+	for _, opt := range opts {
+		opt(&conf)
+	}
+
+	conf, err := conf.Mark()
+	require.NoError(t, err, "could not create test configuration")
+
+	ts := httptest.NewUnstartedServer(nil)
+	srv, err := exchequer.Debug(conf, ts.Config)
+	require.NoError(t, err, "could not create debug server")
+
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	tokens, err := auth.NewTokenManager(conf.Auth)
+	require.NoError(t, err, "could not create token manager")
+
+	accessToken, err := tokens.CreateAccessToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "testing"},
+		Roles:            []string{auth.RoleAdmin},
+	})
+	require.NoError(t, err, "could not create access token")
+
+	client, err := api.New(ts.URL, api.WithAccessToken(accessToken))
+	require.NoError(t, err, "could not create api client")
+	return srv, client, tokens
+}
+
+// Creates a client for the test server that is authenticated with the specified roles.
+func newClientWithRoles(t *testing.T, client api.Client, tokens *auth.TokenManager, roles ...string) api.Client {
+	accessToken, err := tokens.CreateAccessToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "testing"},
+		Roles:            roles,
+	})
+	require.NoError(t, err, "could not create access token")
+
+	client, err = api.New(endpoint(client), api.WithAccessToken(accessToken))
+	require.NoError(t, err, "could not create api client")
+	return client
+}
+
+// Generates an RSA token signing key in a temporary directory, returning the key
+// configuration that references it.
+func writeTokenKey(t *testing.T) map[string]string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err, "could not generate rsa key")
+
+	kid := ulid.Make().String()
+	path := filepath.Join(t.TempDir(), kid+".pem")
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(path, data, 0600), "could not write rsa key")
+	return map[string]string{kid: path}
+}
+
+func TestCSRFProtection(t *testing.T) {
+	_, client := newServer(t)
+	ctx := context.Background()
+	v1 := client.(*api.APIv1)
+
+	// Page loads set the double-submit cookies
+	rep, err := http.Get(endpoint(client) + "/")
+	require.NoError(t, err)
+	rep.Body.Close()
+
+	var hasCookie bool
+	for _, cookie := range rep.Cookies() {
+		if cookie.Name == auth.CSRFCookie {
+			hasCookie = true
+		}
+	}
+	require.True(t, hasCookie, "expected csrf cookie to be set on page load")
+
+	// State changing browser requests without a csrf token are rejected
+	req, err := v1.NewRequest(ctx, http.MethodPost, "/v1/webhooks", &api.WebhookEndpoint{URL: "https://example.com/hook"}, nil)
+	require.NoError(t, err)
+	req.Header.Del("Authorization")
+
+	rep, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	rep.Body.Close()
+	require.Equal(t, http.StatusForbidden, rep.StatusCode)
+
+	// Adyen webhooks are exempt from csrf protection
+	req, err = v1.NewRequest(ctx, http.MethodPost, "/v1/adyen/payments", json.RawMessage(exampleWebhookEvent), nil)
+	require.NoError(t, err)
+	req.Header.Del("Authorization")
+
+	rep, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	rep.Body.Close()
+	require.Equal(t, http.StatusAccepted, rep.StatusCode)
+}
+
+func TestTracing(t *testing.T) {
+	_, client := newServer(t)
+	ctx := context.Background()
+
+	// Send a webhook as part of a trace started by another service
+	req, err := client.(*api.APIv1).NewRequest(ctx, http.MethodPost, "/v1/adyen/payments", json.RawMessage(exampleWebhookEvent), nil)
+	require.NoError(t, err)
+	req.Header.Del(api.RequestIDHeader)
+	req.Header.Set(api.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	rep, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	rep.Body.Close()
+	require.Equal(t, http.StatusAccepted, rep.StatusCode)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", rep.Header.Get(api.RequestIDHeader))
+
+	// The request and the notification are traced as part of the remote trace
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range tracing.Memory().GetSpans() {
+		spans[span.Name] = span
+	}
+
+	require.Contains(t, spans, "/v1/adyen/payments")
+	require.Contains(t, spans, "adyen.notification")
+
+	request, notification := spans["/v1/adyen/payments"], spans["adyen.notification"]
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", request.SpanContext.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", request.Parent.SpanID().String())
+	require.Equal(t, request.SpanContext.SpanID(), notification.Parent.SpanID())
+
+	var eventCode string
+	for _, attr := range notification.Attributes {
+		if attr.Key == "adyen.event_code" {
+			eventCode = attr.Value.AsString()
+		}
+	}
+	require.Equal(t, "AUTHORISATION", eventCode)
+}
@@ -0,0 +1,125 @@
+package exchequer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/checkout"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/health"
+	"github.com/rotationalio/exchequer/pkg/logger"
+)
+
+// Components of the server that are checked by the health registry.
+const (
+	ComponentStore          = "store"
+	ComponentScheduler      = "webhook_scheduler"
+	ComponentWebhookBacklog = "webhook_backlog"
+	ComponentAdyen          = "adyen"
+)
+
+// The number of poll intervals the webhook scheduler can miss before it is unhealthy.
+const missedPolls = 3
+
+// Registers the checks of the server's dependencies. The store is critical since
+// requests cannot be handled without it; the other checks only degrade the server since
+// Adyen webhooks are still accepted and queued. An Adyen outage must not take the server
+// out of rotation, otherwise the webhooks that Adyen retries would also be refused.
+func (s *Server) setupHealthChecks() {
+	s.health = health.NewRegistry(s.conf.Health.Timeout)
+	s.health.Register(ComponentStore, true, health.CheckFunc(s.checkStore))
+	s.health.Register(ComponentScheduler, false, health.CheckFunc(s.checkScheduler))
+
+	if s.conf.Health.WebhookBacklog > 0 {
+		s.health.Register(ComponentWebhookBacklog, false, health.CheckFunc(s.checkWebhookBacklog))
+	}
+
+	// The Adyen probe is cached so that readiness probes do not flood the Adyen API
+	if s.conf.Health.AdyenProbe {
+		s.health.Register(ComponentAdyen, false, health.Cached(health.CheckFunc(s.checkAdyen), s.conf.Health.AdyenProbeInterval))
+	}
+}
+
+// Health returns the registry of health checks so that checks can be added or replaced.
+func (s *Server) Health() *health.Registry {
+	return s.health
+}
+
+// Runs the health checks, logging any checks that fail.
+func (s *Server) checkHealth(ctx context.Context) *health.Report {
+	report := s.health.Check(ctx)
+	if report.Status != health.StatusOK {
+		log := logger.Tracing(ctx)
+		for _, result := range report.Components {
+			if result.Error != nil {
+				log.Warn().Err(result.Error).Str("component", result.Name).Str("status", result.Status).Msg("health check failed")
+			}
+		}
+	}
+	return report
+}
+
+func (s *Server) checkStore(context.Context) error {
+	if err := s.store.Ping(); err != nil {
+		return fmt.Errorf("could not read from the database: %w", err)
+	}
+	return nil
+}
+
+func (s *Server) checkScheduler(context.Context) error {
+	running, polled := s.events.Heartbeat()
+	if !running {
+		return ErrSchedulerStopped
+	}
+
+	if since := time.Since(polled); since > missedPolls*s.conf.Webhooks.PollInterval {
+		return fmt.Errorf("webhook scheduler has not run for %s", since.Truncate(time.Second))
+	}
+	return nil
+}
+
+func (s *Server) checkWebhookBacklog(context.Context) error {
+	scheduled, queued := s.events.Backlog()
+	if backlog := scheduled + queued; backlog > s.conf.Health.WebhookBacklog {
+		return fmt.Errorf("%d webhook deliveries are pending (threshold %d)", backlog, s.conf.Health.WebhookBacklog)
+	}
+	return nil
+}
+
+// Lists the payment methods of the merchant account to verify that Adyen is reachable
+// and that it accepts the configured API key.
+func (s *Server) checkAdyen(ctx context.Context) error {
+	service := s.adyen.Checkout()
+	req := service.PaymentsApi.PaymentMethodsInput().PaymentMethodsRequest(checkout.PaymentMethodsRequest{
+		MerchantAccount: s.conf.Adyen.MerchantAccount,
+	})
+
+	started := time.Now()
+	_, hrep, err := service.PaymentsApi.PaymentMethods(ctx, req)
+	if observeAdyen(adyenHealthProbe, started, hrep, err); err != nil {
+		return fmt.Errorf("%w: %w", ErrAdyenRequest, err)
+	}
+	return nil
+}
+
+// Converts a health report into the components of a status reply. The errors of the
+// checks describe the internals of the server so they are only included if requested.
+func componentsToAPI(report *health.Report, withErrors bool) []*api.ComponentStatus {
+	components := make([]*api.ComponentStatus, 0, len(report.Components))
+	for _, result := range report.Components {
+		component := &api.ComponentStatus{
+			Name:     result.Name,
+			Status:   result.Status,
+			Critical: result.Critical,
+			Latency:  result.Latency.String(),
+			Checked:  result.Checked,
+		}
+
+		if withErrors && result.Error != nil {
+			component.Error = result.Error.Error()
+		}
+		components = append(components, component)
+	}
+	return components
+}
@@ -0,0 +1,215 @@
+package exchequer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// How long the response to a request is replayed for retries with the same key.
+	idempotencyTTL = 24 * time.Hour
+
+	// How long a key is reserved for a request that is in flight; this is longer than
+	// the write timeout of the server so that a key is only released early if the
+	// server stopped before it could store the response.
+	idempotencyLockTimeout = time.Minute
+
+	// How long clients are told to wait before retrying a request whose key is in use.
+	idempotencyRetryAfter = "1"
+
+	// How often expired idempotency records are removed from the database.
+	idempotencySweepInterval = time.Hour
+
+	maxIdempotencyKeyLength = 255
+
+	// Context keys set by the middleware for handlers that call upstream APIs.
+	upstreamIdempotencyKey = "exchequer_upstream_idempotency_key"
+	keepIdempotencyRecord  = "exchequer_keep_idempotency_record"
+)
+
+// Idempotency replays the stored response to POST requests that are retried with the
+// same Idempotency-Key header so that retries do not repeat side effects such as
+// refunds. A key reused with a different request is rejected as unprocessable. A retry
+// made while the original request is still in flight is rejected as a conflict with a
+// Retry-After header so that clients back off and receive the stored response once the
+// original request has completed. Requests without the header are handled as normal.
+//
+// Transient failures release the key so that a retry is handled again, unless the
+// handler marked the outcome as unknown with keepIdempotencyKey because the failure
+// came after an upstream call that may have taken effect; the failure is then replayed.
+//
+// This middleware must follow authentication so that keys are scoped to the actor.
+func (s *Server) Idempotency() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idempotencyKey := c.GetHeader(api.IdempotencyKeyHeader)
+		if c.Request.Method != http.MethodPost || idempotencyKey == "" {
+			c.Next()
+			return
+		}
+
+		if !validIdempotencyKey(idempotencyKey) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, api.Error("invalid idempotency key"))
+			return
+		}
+
+		// Read the body to fingerprint the request, then replace it for the handler
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, api.Error("could not read request body"))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now()
+		record := &store.IdempotencyRecord{
+			Key:         idempotencyKey,
+			Actor:       ActorAnonymous,
+			Fingerprint: fingerprint(c.Request, body),
+			Created:     now,
+			Expires:     now.Add(idempotencyLockTimeout),
+		}
+
+		if claims, err := auth.GetClaims(c); err == nil {
+			record.Actor = claims.Subject
+		}
+
+		var existing *store.IdempotencyRecord
+		if existing, err = s.store.ReserveIdempotencyKey(record); err != nil {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, api.Error("could not process idempotency key"))
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != record.Fingerprint:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, api.Error("idempotency key has already been used for a different request"))
+			case !existing.Completed():
+				c.Header("Retry-After", idempotencyRetryAfter)
+				c.AbortWithStatusJSON(http.StatusConflict, api.Error("a request with this idempotency key is in progress"))
+			default:
+				c.Header(api.IdempotentReplayedHeader, "true")
+				c.Data(existing.Status, existing.ContentType, existing.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		// Handlers forward a key derived from the request to upstream APIs such as Adyen
+		c.Set(upstreamIdempotencyKey, upstreamKey(record))
+
+		// Record the response of the handler so that it can be replayed
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// Transient failures release the key so that the retry is handled again
+		if status := c.Writer.Status(); (status >= http.StatusInternalServerError || status == http.StatusTooManyRequests) && !c.GetBool(keepIdempotencyRecord) {
+			if err = s.store.DeleteIdempotencyRecord(record.Actor, record.Key); err != nil {
+				c.Error(err)
+			}
+			return
+		}
+
+		record.Status = c.Writer.Status()
+		record.ContentType = c.Writer.Header().Get("Content-Type")
+		record.Body = recorder.body.Bytes()
+		record.Expires = time.Now().Add(idempotencyTTL)
+
+		if err = s.store.SaveIdempotencyRecord(record); err != nil {
+			c.Error(err)
+		}
+	}
+}
+
+// Returns the idempotency key to send to upstream APIs for the request, or an empty
+// string if the request does not have an Idempotency-Key header.
+func idempotencyKey(c *gin.Context) string {
+	return c.GetString(upstreamIdempotencyKey)
+}
+
+// Marks the response of the request to be stored even if it is a transient failure, so
+// that a retry with the same key is not sent upstream again when the outcome of the
+// original upstream call is unknown.
+func keepIdempotencyKey(c *gin.Context) {
+	c.Set(keepIdempotencyRecord, true)
+}
+
+// Derives the upstream key from the actor, key, and fingerprint of the request so that
+// keys from different actors do not collide and a key reused for a different request
+// after its record expired is not rejected upstream. The hex digest is 64 characters,
+// which is the maximum length of an Adyen idempotency key.
+func upstreamKey(record *store.IdempotencyRecord) string {
+	sum := sha256.Sum256([]byte(record.Actor + "\x00" + record.Key + "\x00" + record.Fingerprint))
+	return hex.EncodeToString(sum[:])
+}
+
+// Removes expired idempotency records until the done channel is closed.
+func (s *Server) sweepIdempotencyRecords(done <-chan struct{}) {
+	ticker := time.NewTicker(idempotencySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if deleted, err := s.store.DeleteExpiredIdempotencyRecords(time.Now()); err != nil {
+			log.Warn().Err(err).Msg("could not delete expired idempotency records")
+		} else if deleted > 0 {
+			log.Debug().Int("deleted", deleted).Msg("deleted expired idempotency records")
+		}
+	}
+}
+
+// Keys must be printable ASCII so that they can be safely stored and logged.
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// The fingerprint identifies the request so that a key cannot be reused for another
+// request, including a request to a different endpoint.
+func fingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Captures the response body written by the handler while writing it to the client.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
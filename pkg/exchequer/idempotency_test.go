@@ -0,0 +1,130 @@
+package exchequer_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotency(t *testing.T) {
+	_, client := newServer(t)
+	ctx := api.ContextWithIdempotencyKey(context.Background(), "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+
+	// Retries of a request return the original response without executing it again
+	key := &api.APIKey{}
+	rep, err := doRequest(ctx, client, http.MethodPost, "/v1/apikeys", &api.APIKey{Description: "monitoring", Scopes: []string{"webhooks:write"}}, key)
+	require.NoError(t, err, "could not create api key")
+	require.Empty(t, rep.Header.Get(api.IdempotentReplayedHeader))
+
+	retry := &api.APIKey{}
+	rep, err = doRequest(ctx, client, http.MethodPost, "/v1/apikeys", &api.APIKey{Description: "monitoring", Scopes: []string{"webhooks:write"}}, retry)
+	require.NoError(t, err, "could not retry api key creation")
+	require.Equal(t, "true", rep.Header.Get(api.IdempotentReplayedHeader))
+	require.Equal(t, key, retry)
+
+	keys, err := client.ListAPIKeys(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, keys.APIKeys, 1, "expected the api key to be created only once")
+
+	// A key cannot be reused for a different request
+	_, err = client.CreateAPIKey(ctx, &api.APIKey{Description: "billing", Scopes: []string{"webhooks:write"}})
+	require.ErrorIs(t, err, api.ErrUnprocessable)
+
+	_, err = client.CreateWebhookEndpoint(ctx, &api.WebhookEndpoint{URL: "https://example.com/hook", EventTypes: []string{"payment.*"}})
+	require.ErrorIs(t, err, api.ErrUnprocessable)
+
+	// Keys are scoped to the actor that made the request
+	service, err := api.New(endpoint(client), api.WithAPIKey(key.ClientID, key.ClientSecret))
+	require.NoError(t, err)
+
+	_, err = service.CreateWebhookEndpoint(ctx, &api.WebhookEndpoint{URL: "https://example.com/hook", EventTypes: []string{"payment.*"}})
+	require.NoError(t, err)
+
+	// Requests without a key are not deduplicated
+	_, err = client.CreateAPIKey(context.Background(), &api.APIKey{Description: "monitoring", Scopes: []string{"webhooks:write"}})
+	require.NoError(t, err)
+
+	keys, err = client.ListAPIKeys(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, keys.APIKeys, 2)
+
+	// Invalid requests are replayed so that the retry fails the same way
+	invalid := api.ContextWithIdempotencyKey(context.Background(), "invalid-scopes")
+	_, err = client.CreateAPIKey(invalid, &api.APIKey{Scopes: []string{"invoices:delete"}})
+	require.ErrorIs(t, err, api.ErrBadRequest)
+
+	rep, err = doRequest(invalid, client, http.MethodPost, "/v1/apikeys", &api.APIKey{Scopes: []string{"invoices:delete"}}, nil)
+	require.ErrorIs(t, err, api.ErrBadRequest)
+	require.Equal(t, "true", rep.Header.Get(api.IdempotentReplayedHeader))
+
+	// Keys must be printable and not too long
+	_, err = client.CreateAPIKey(api.ContextWithIdempotencyKey(context.Background(), "bad\tkey"), &api.APIKey{Description: "monitoring", Scopes: []string{"webhooks:write"}})
+	require.ErrorIs(t, err, api.ErrBadRequest)
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	_, client, tokens := newServerWithTokens(t)
+	url := endpoint(client)
+
+	// The receiver blocks webhook deliveries until it is released
+	received, release := make(chan struct{}), make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(receiver.Close)
+
+	endpoint, err := client.CreateWebhookEndpoint(context.Background(), &api.WebhookEndpoint{URL: receiver.URL, EventTypes: []string{"payment.*"}})
+	require.NoError(t, err)
+
+	postWebhook(t, client, exampleWebhookEvent)
+	deliveries, err := client.ListWebhookDeliveries(context.Background(), endpoint.ID, nil)
+	require.NoError(t, err)
+	require.Len(t, deliveries.Deliveries, 1)
+	deliveryID := deliveries.Deliveries[0].ID
+
+	ctx := api.ContextWithIdempotencyKey(context.Background(), "replay-1")
+	var original *api.WebhookDelivery
+	replayed := make(chan error, 1)
+	go func() {
+		var err error
+		original, err = client.ReplayWebhookDelivery(ctx, endpoint.ID, deliveryID)
+		replayed <- err
+	}()
+
+	// A retry made while the original request is in flight is told to back off
+	<-received
+	rep, err := doRequest(ctx, client, http.MethodPost, "/v1/webhooks/"+endpoint.ID+"/deliveries/"+deliveryID+"/replay", nil, nil)
+	require.ErrorIs(t, err, api.ErrConflict)
+	require.Equal(t, "1", rep.Header.Get("Retry-After"))
+
+	// Clients with retries receive the original response once the request completes
+	accessToken, err := tokens.CreateAccessToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "testing"},
+		Roles:            []string{auth.RoleAdmin},
+	})
+	require.NoError(t, err)
+
+	retrying, err := api.New(url, api.WithAccessToken(accessToken), api.WithRetries(api.RetryPolicy{}))
+	require.NoError(t, err)
+
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	retried, err := retrying.ReplayWebhookDelivery(ctx, endpoint.ID, deliveryID)
+	require.NoError(t, err)
+	require.NoError(t, <-replayed)
+	require.Equal(t, original, retried)
+
+	// Once the request has completed its response is replayed without redelivering
+	delivery, err := client.ReplayWebhookDelivery(ctx, endpoint.ID, deliveryID)
+	require.NoError(t, err)
+	require.Equal(t, original, delivery)
+	require.Len(t, delivery.Attempts, 1)
+}
@@ -0,0 +1,351 @@
+package exchequer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/webhook"
+	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rotationalio/exchequer/pkg/tracing"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The maximum number of notifications that can be replayed by a single request.
+const maxReplayNotifications = 1000
+
+// NotificationHandler applies the state changes of a notification, returning the
+// transitions that it made. If dry run is true, the handler must not make any changes
+// and instead returns the transitions that it would have made.
+type NotificationHandler func(ctx context.Context, notification *webhook.NotificationRequestItem, dryRun bool) ([]*api.Transition, error)
+
+// RegisterNotificationHandler sets the handler for notifications with the event code,
+// replacing any handler that was previously registered for the event code. Handlers
+// must be registered before the server is started.
+func (s *Server) RegisterNotificationHandler(eventCode string, handler NotificationHandler) {
+	if s.handlers == nil {
+		s.handlers = make(map[string]NotificationHandler)
+	}
+	s.handlers[eventCode] = handler
+}
+
+// Registers the handlers for the event codes of notifications that change local state;
+// billing events are published for notifications whether or not they have a handler.
+func (s *Server) setupNotificationHandlers() {
+	s.RegisterNotificationHandler(EventCodeRecurringContract, s.handleRecurringContract)
+	s.RegisterNotificationHandler(webhook.EventCodeReportAvailable, s.handleReportAvailable)
+}
+
+// Processes the notification with the handler registered for its event code and then
+// publishes the billing event for the notification, if any, unless publish is false.
+// If dry run is true, no changes are made and the transitions that would have been
+// made are returned.
+func (s *Server) processNotification(ctx context.Context, notification *webhook.NotificationRequestItem, live, publish, dryRun bool) (transitions []*api.Transition, event *store.Event, err error) {
+	var span trace.Span
+	ctx, span = tracing.Tracer().Start(ctx, "adyen.notification", trace.WithAttributes(
+		attribute.String("adyen.event_code", notification.EventCode),
+		attribute.String("adyen.psp_reference", notification.PspReference),
+		attribute.String("adyen.merchant_reference", notification.MerchantReference),
+		attribute.String("adyen.success", notification.Success),
+		attribute.Bool("adyen.live", live),
+		attribute.Bool("dry_run", dryRun),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "could not process notification")
+		}
+		span.End()
+	}()
+
+	if handler, ok := s.handlers[notification.EventCode]; ok {
+		if transitions, err = handler(ctx, notification, dryRun); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if eventType := NotificationEventType(notification); publish && eventType != "" {
+		resource := paymentResource(notification.PspReference)
+		data := PaymentEvent(notification, live)
+
+		var transition *api.Transition
+		if transition, err = newTransition(resource, AuditAdyenNotification, nil, data); err != nil {
+			return nil, nil, err
+		}
+		transition.Event = eventType
+		transitions = append(transitions, transition)
+
+		if !dryRun {
+			if event, err = s.events.Publish(eventType, data); err != nil {
+				return nil, nil, fmt.Errorf("could not publish %s event: %w", eventType, err)
+			}
+
+			if err = s.auditSystem(ctx, actorAdyen, AuditAdyenNotification, resource, nil, data); err != nil {
+				return nil, event, err
+			}
+		}
+	}
+
+	return transitions, event, nil
+}
+
+// Stores the notification as it was received so that it can be replayed.
+func (s *Server) recordNotification(notification *webhook.NotificationRequestItem, live bool) (record *store.Notification, err error) {
+	record = &store.Notification{
+		EventCode:         notification.EventCode,
+		PSPReference:      notification.PspReference,
+		OriginalReference: notification.OriginalReference,
+		MerchantReference: notification.MerchantReference,
+		Success:           notification.Success == "true",
+		Live:              live,
+	}
+
+	if record.Item, err = json.Marshal(notification); err != nil {
+		return nil, err
+	}
+
+	if err = s.store.RecordNotification(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Stores the outcome of processing a notification; notifications that could not be
+// processed are dead-lettered until they are processed by a retry or a replay. The
+// payment metrics are only observed the first time that a notification is processed so
+// that redeliveries and replays are not counted again.
+func (s *Server) completeNotification(record *store.Notification, notification *webhook.NotificationRequestItem, event *store.Event, err error) {
+	if event != nil {
+		record.EventIDs = append(record.EventIDs, event.ID)
+	}
+
+	if err != nil {
+		record.Status = store.NotificationFailed
+		record.Error = err.Error()
+	} else {
+		if record.Processed.IsZero() {
+			observeNotification(notification)
+		}
+
+		record.Status = store.NotificationProcessed
+		record.Error = ""
+		record.Processed = time.Now()
+	}
+
+	if err = s.store.UpdateNotification(record); err != nil {
+		log.Warn().Err(err).
+			Str("notification_id", record.ID.String()).
+			Str("status", record.Status).
+			Msg("could not update status of notification")
+	}
+}
+
+//===========================================================================
+// Notification Replay
+//===========================================================================
+
+// ReplayNotifications processes the stored notifications that match the selectors of the
+// request again in the order that they were received, e.g. to re-run notifications after
+// a processing bug is fixed. Notifications are processed through the handler registry
+// as if they had been received from Adyen; billing events are only published again for
+// notifications that have already published them if the request asks to republish. A
+// dry run reports the transitions that would be made without making any changes.
+func (s *Server) ReplayNotifications(c *gin.Context) {
+	var (
+		err      error
+		in       *api.NotificationReplayRequest
+		selector *notificationSelector
+		records  []*store.Notification
+	)
+
+	in = &api.NotificationReplayRequest{}
+	if err = c.ShouldBindJSON(in); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse notification replay request"))
+		return
+	}
+
+	if selector, err = newNotificationSelector(in); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	err = s.store.EachNotification(func(record *store.Notification) error {
+		if !selector.Match(record) {
+			return nil
+		}
+
+		if len(records) == maxReplayNotifications {
+			return errTooManyNotifications
+		}
+
+		records = append(records, record)
+		return nil
+	})
+
+	if err != nil {
+		if errors.Is(err, errTooManyNotifications) {
+			c.JSON(http.StatusBadRequest, api.Error(err))
+			return
+		}
+
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not select notifications to replay"))
+		return
+	}
+
+	out := &api.NotificationReplayReply{DryRun: in.DryRun, Results: make([]*api.NotificationReplayResult, 0, len(records))}
+	for _, record := range records {
+		out.Results = append(out.Results, s.replayNotification(c, record, in.Republish, in.DryRun))
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// Replays a single stored notification; errors are reported in the result so that the
+// remaining notifications are still replayed.
+func (s *Server) replayNotification(c *gin.Context, record *store.Notification, republish, dryRun bool) (result *api.NotificationReplayResult) {
+	result = &api.NotificationReplayResult{Transitions: make([]*api.Transition, 0)}
+
+	notification := &webhook.NotificationRequestItem{}
+	if err := json.Unmarshal(record.Item, notification); err != nil {
+		c.Error(err)
+		result.Notification = NotificationToAPI(record)
+		result.Error = "could not parse stored notification"
+		return result
+	}
+
+	publish := republish || len(record.EventIDs) == 0
+	transitions, event, err := s.processNotification(c.Request.Context(), notification, record.Live, publish, dryRun)
+	if err != nil {
+		c.Error(err)
+		result.Error = err.Error()
+	}
+
+	if transitions != nil {
+		result.Transitions = transitions
+	}
+
+	if !dryRun {
+		before := NotificationToAPI(record)
+		record.Replays++
+		s.completeNotification(record, notification, event, err)
+		s.audit(c, AuditNotificationReplay, notificationResource(record.ID), before, NotificationToAPI(record))
+	}
+
+	result.Notification = NotificationToAPI(record)
+	return result
+}
+
+var errTooManyNotifications = fmt.Errorf("more than %d notifications match the selectors", maxReplayNotifications)
+
+// Matches stored notifications to the selectors of a replay request.
+type notificationSelector struct {
+	eventID      ulid.ULID
+	pspReference string
+	eventCode    string
+	since        time.Time
+	until        time.Time
+	deadLettered bool
+}
+
+func newNotificationSelector(in *api.NotificationReplayRequest) (_ *notificationSelector, err error) {
+	selector := &notificationSelector{
+		pspReference: in.PSPReference,
+		eventCode:    in.EventCode,
+		since:        in.Since,
+		until:        in.Until,
+		deadLettered: in.DeadLettered,
+	}
+
+	if in.EventID != "" {
+		if selector.eventID, err = ulids.Parse(in.EventID); err != nil {
+			return nil, errors.New("could not parse event id")
+		}
+	}
+
+	switch {
+	case in.EventID == "" && in.PSPReference == "" && in.EventCode == "" && in.Since.IsZero() && in.Until.IsZero() && !in.DeadLettered:
+		return nil, errors.New("at least one selector is required to replay notifications")
+	case !in.Since.IsZero() && !in.Until.IsZero() && !in.Since.Before(in.Until):
+		return nil, errors.New("since must be before until")
+	}
+	return selector, nil
+}
+
+func (s *notificationSelector) Match(record *store.Notification) bool {
+	switch {
+	case !ulids.IsZero(s.eventID) && record.ID.Compare(s.eventID) != 0 && !slices.Contains(record.EventIDs, s.eventID):
+		return false
+	case s.pspReference != "" && record.PSPReference != s.pspReference && record.OriginalReference != s.pspReference:
+		return false
+	case s.eventCode != "" && record.EventCode != s.eventCode:
+		return false
+	case !s.since.IsZero() && record.Received.Before(s.since):
+		return false
+	case !s.until.IsZero() && !record.Received.Before(s.until):
+		return false
+	case s.deadLettered && !record.DeadLettered():
+		return false
+	}
+	return true
+}
+
+//===========================================================================
+// Helpers
+//===========================================================================
+
+// Creates a transition from the before and after states of the resource.
+func newTransition(resource, action string, before, after any) (transition *api.Transition, err error) {
+	transition = &api.Transition{Resource: resource, Action: action}
+	if transition.Before, err = marshalState(before); err != nil {
+		return nil, err
+	}
+
+	if transition.After, err = marshalState(after); err != nil {
+		return nil, err
+	}
+	return transition, nil
+}
+
+func notificationResource(id ulid.ULID) string {
+	return "notifications/" + id.String()
+}
+
+// NotificationToAPI converts a stored notification to its API representation.
+func NotificationToAPI(record *store.Notification) *api.Notification {
+	out := &api.Notification{
+		ID:                record.ID.String(),
+		EventCode:         record.EventCode,
+		PSPReference:      record.PSPReference,
+		OriginalReference: record.OriginalReference,
+		MerchantReference: record.MerchantReference,
+		Success:           record.Success,
+		Live:              record.Live,
+		Status:            record.Status,
+		Error:             record.Error,
+		Attempts:          record.Attempts,
+		Replays:           record.Replays,
+		Received:          record.Received,
+	}
+
+	if !record.Processed.IsZero() {
+		out.Processed = &record.Processed
+	}
+
+	for _, id := range record.EventIDs {
+		out.EventIDs = append(out.EventIDs, id.String())
+	}
+	return out
+}
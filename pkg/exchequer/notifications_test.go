@@ -0,0 +1,191 @@
+package exchequer_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/webhook"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayNotifications(t *testing.T) {
+	svc, client, tokens := newServerWithTokens(t)
+	ctx := context.Background()
+
+	// Simulate a processing bug in the handler for captures that is fixed later
+	var fixed atomic.Bool
+	svc.RegisterNotificationHandler(webhook.EventCodeCapture, func(ctx context.Context, notification *webhook.NotificationRequestItem, dryRun bool) ([]*api.Transition, error) {
+		if !fixed.Load() {
+			return nil, errors.New("capture processing bug")
+		}
+		return []*api.Transition{{Resource: "payments/" + notification.PspReference, Action: "payment.capture"}}, nil
+	})
+
+	postWebhook(t, client, exampleWebhookEvent)
+
+	// Redeliveries of a processed notification are acknowledged without processing it
+	postWebhook(t, client, exampleWebhookEvent)
+
+	capture := strings.Replace(exampleWebhookEvent, `"AUTHORISATION"`, `"CAPTURE"`, 1)
+	req, err := client.(*api.APIv1).NewRequest(ctx, http.MethodPost, "/v1/adyen/payments", json.RawMessage(capture), nil)
+	require.NoError(t, err)
+	rep, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	rep.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, rep.StatusCode, "expected capture to fail")
+
+	// At least one valid selector is required
+	now := time.Now()
+	testCases := []*api.NotificationReplayRequest{
+		{},
+		{DryRun: true},
+		{EventID: "notanid"},
+		{PSPReference: "7914073381342284", Since: now, Until: now.Add(-time.Hour)},
+	}
+
+	for i, tc := range testCases {
+		_, err = client.ReplayNotifications(ctx, tc)
+		require.ErrorIs(t, err, api.ErrBadRequest, "test case %d failed", i)
+	}
+
+	// A dry run reports the transitions without making any changes
+	before, err := client.ListAuditEntries(ctx, &api.AuditQuery{})
+	require.NoError(t, err)
+
+	out, err := client.ReplayNotifications(ctx, &api.NotificationReplayRequest{PSPReference: "7914073381342284", DryRun: true})
+	require.NoError(t, err)
+	require.True(t, out.DryRun)
+	require.Len(t, out.Results, 2)
+
+	// The billing event of a processed notification is not published again by default
+	authorisation := out.Results[0]
+	require.Equal(t, "AUTHORISATION", authorisation.Notification.EventCode)
+	require.Equal(t, "processed", authorisation.Notification.Status)
+	require.Equal(t, 2, authorisation.Notification.Attempts)
+	require.Len(t, authorisation.Notification.EventIDs, 1)
+	require.Empty(t, authorisation.Transitions)
+
+	require.Equal(t, "CAPTURE", out.Results[1].Notification.EventCode)
+	require.Equal(t, "failed", out.Results[1].Notification.Status)
+	require.Equal(t, "capture processing bug", out.Results[1].Error)
+	require.Empty(t, out.Results[1].Transitions)
+
+	out, err = client.ReplayNotifications(ctx, &api.NotificationReplayRequest{PSPReference: "7914073381342284", EventCode: "AUTHORISATION", Republish: true, DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, out.Results, 1)
+	require.Len(t, out.Results[0].Transitions, 1)
+	require.Equal(t, "payments/7914073381342284", out.Results[0].Transitions[0].Resource)
+	require.Equal(t, "payment.authorised", out.Results[0].Transitions[0].Event)
+
+	after, err := client.ListAuditEntries(ctx, &api.AuditQuery{})
+	require.NoError(t, err)
+	require.Equal(t, before.Entries, after.Entries, "expected dry run not to change the audit log")
+
+	// Replay the dead-lettered notifications once the bug is fixed
+	captured := metrics.PaymentAmounts.WithLabelValues(metrics.PaymentCaptured, "EUR")
+	nCaptured := testutil.ToFloat64(captured)
+	fixed.Store(true)
+	out, err = client.ReplayNotifications(ctx, &api.NotificationReplayRequest{DeadLettered: true, DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, out.Results, 1)
+	require.Len(t, out.Results[0].Transitions, 2)
+	require.Equal(t, "payment.capture", out.Results[0].Transitions[0].Action)
+	require.Equal(t, "payment.captured", out.Results[0].Transitions[1].Event)
+
+	out, err = client.ReplayNotifications(ctx, &api.NotificationReplayRequest{DeadLettered: true})
+	require.NoError(t, err)
+	require.False(t, out.DryRun)
+	require.Len(t, out.Results, 1)
+	require.Empty(t, out.Results[0].Error)
+	require.Equal(t, "processed", out.Results[0].Notification.Status)
+	require.Equal(t, 1, out.Results[0].Notification.Replays)
+	require.Len(t, out.Results[0].Notification.EventIDs, 1)
+	require.Equal(t, float64(1130), testutil.ToFloat64(captured)-nCaptured, "expected the capture to be counted once processed")
+
+	_, err = client.ReplayNotifications(ctx, &api.NotificationReplayRequest{PSPReference: "7914073381342284", EventCode: "CAPTURE"})
+	require.NoError(t, err)
+	require.Equal(t, float64(1130), testutil.ToFloat64(captured)-nCaptured, "expected the replayed capture not to be counted again")
+
+	out, err = client.ReplayNotifications(ctx, &api.NotificationReplayRequest{DeadLettered: true})
+	require.NoError(t, err)
+	require.Empty(t, out.Results, "expected no dead-lettered notifications")
+
+	// Notifications can be selected by the billing event that they published
+	eventID := authorisation.Notification.EventIDs[0]
+	out, err = client.ReplayNotifications(ctx, &api.NotificationReplayRequest{EventID: eventID, EventCode: "AUTHORISATION"})
+	require.NoError(t, err)
+	require.Len(t, out.Results, 1)
+	require.Equal(t, authorisation.Notification.ID, out.Results[0].Notification.ID)
+	require.Len(t, out.Results[0].Notification.EventIDs, 1, "expected the event not to be published again")
+
+	out, err = client.ReplayNotifications(ctx, &api.NotificationReplayRequest{EventID: eventID, EventCode: "AUTHORISATION", Republish: true})
+	require.NoError(t, err)
+	require.Len(t, out.Results, 1)
+	require.Len(t, out.Results[0].Notification.EventIDs, 2, "expected the event to be published again")
+
+	entries, err := client.ListAuditEntries(ctx, &api.AuditQuery{Action: "adyen.notification.replay"})
+	require.NoError(t, err)
+	require.Len(t, entries.Entries, 4)
+
+	// Replaying notifications requires the replay permission
+	finance := newClientWithRoles(t, client, tokens, auth.RoleFinance)
+	_, err = finance.ReplayNotifications(ctx, &api.NotificationReplayRequest{DeadLettered: true})
+	require.ErrorIs(t, err, api.ErrForbidden)
+}
+
+func TestNotificationBatchRetry(t *testing.T) {
+	svc, client := newServer(t)
+	ctx := context.Background()
+
+	var fixed atomic.Bool
+	svc.RegisterNotificationHandler(webhook.EventCodeCapture, func(ctx context.Context, notification *webhook.NotificationRequestItem, dryRun bool) ([]*api.Transition, error) {
+		if !fixed.Load() {
+			return nil, errors.New("capture processing bug")
+		}
+		return nil, nil
+	})
+
+	now := time.Now()
+	items := []webhook.NotificationItem{
+		{NotificationRequestItem: webhook.NotificationRequestItem{EventCode: "AUTHORISATION", PspReference: "8515131751004933", Success: "true", EventDate: &now, Amount: webhook.Amount{Value: 2500, Currency: "EUR"}}},
+		{NotificationRequestItem: webhook.NotificationRequestItem{EventCode: "CAPTURE", PspReference: "8815131751004934", OriginalReference: "8515131751004933", Success: "true", EventDate: &now, Amount: webhook.Amount{Value: 2500, Currency: "EUR"}}},
+	}
+	batch, err := json.Marshal(&webhook.Webhook{Live: "false", NotificationItems: &items})
+	require.NoError(t, err)
+
+	// The capture fails so Adyen retries the entire batch
+	req, err := client.(*api.APIv1).NewRequest(ctx, http.MethodPost, "/v1/adyen/payments", json.RawMessage(batch), nil)
+	require.NoError(t, err)
+	rep, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	rep.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, rep.StatusCode)
+
+	// The authorisation was processed by the first attempt and is not published again
+	fixed.Store(true)
+	postWebhook(t, client, string(batch))
+
+	out, err := client.ReplayNotifications(ctx, &api.NotificationReplayRequest{PSPReference: "8515131751004933", DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, out.Results, 2)
+
+	for _, result := range out.Results {
+		require.Equal(t, "processed", result.Notification.Status)
+		require.Len(t, result.Notification.EventIDs, 1)
+	}
+	require.Equal(t, 2, out.Results[0].Notification.Attempts)
+
+	entries, err := client.ListAuditEntries(ctx, &api.AuditQuery{Resource: "payments/8515131751004933"})
+	require.NoError(t, err)
+	require.Len(t, entries.Entries, 1)
+}
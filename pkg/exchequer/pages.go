@@ -2,10 +2,30 @@ package exchequer
 
 import (
 	"net/http"
+	"net/url"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/auth"
 )
 
 func (s *Server) Index(c *gin.Context) {
 	c.HTML(http.StatusOK, "index.html", gin.H{})
 }
+
+// CSRFCookies sets the double-submit CSRF cookies on page loads so that the front-end
+// can make state changing requests to the API.
+func (s *Server) CSRFCookies() gin.HandlerFunc {
+	var domain string
+	secure := true
+	if origin, err := url.Parse(s.conf.Origin); err == nil {
+		domain = origin.Hostname()
+		secure = origin.Scheme == "https"
+	}
+
+	return func(c *gin.Context) {
+		if err := auth.SetCSRFCookies(c, domain, secure); err != nil {
+			c.Error(err)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,104 @@
+package exchequer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/pagination"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rs/zerolog/log"
+)
+
+// Creates the paginator that signs the page tokens of list endpoints, generating a
+// secret if one is not configured.
+func newPaginator(conf config.PaginationConfig) (_ *pagination.Paginator, err error) {
+	var secret []byte
+	if conf.Secret != "" {
+		if secret, err = hex.DecodeString(conf.Secret); err != nil {
+			return nil, fmt.Errorf("could not decode pagination secret: %w", err)
+		}
+	} else {
+		secret = make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("could not generate pagination secret: %w", err)
+		}
+		log.Warn().Msg("no pagination secret configured: page tokens will not be valid after a restart or on other replicas")
+	}
+	return pagination.New(secret, conf.DefaultPageSize, conf.MaxPageSize)
+}
+
+// Describes the filters that a list endpoint supports; other filters are rejected so
+// that clients do not mistake an unfiltered list for a filtered one.
+type listFilters struct {
+	created  bool
+	statuses []string
+	customer bool
+}
+
+// Filters supported by each of the list endpoints.
+var (
+	webhookEndpointFilters = listFilters{created: true, statuses: []string{statusActive, statusInactive}}
+	webhookDeliveryFilters = listFilters{created: true, statuses: []string{store.DeliveryPending, store.DeliverySucceeded, store.DeliveryFailed}}
+	apiKeyFilters          = listFilters{created: true, statuses: []string{statusActive, statusRevoked}}
+	paymentMethodFilters   = listFilters{}
+	auditFilters           = listFilters{created: true, customer: true}
+)
+
+// Statuses of resources that do not have a status field.
+const (
+	statusActive   = "active"
+	statusInactive = "inactive"
+	statusRevoked  = "revoked"
+)
+
+func (f listFilters) validate(filter *api.ListFilter) error {
+	created := !filter.CreatedAfter.IsZero() || !filter.CreatedBefore.IsZero()
+	switch {
+	case created && !f.created:
+		return errors.New("this list cannot be filtered by created time")
+	case !filter.CreatedAfter.IsZero() && !filter.CreatedBefore.IsZero() && !filter.CreatedAfter.Before(filter.CreatedBefore):
+		return errors.New("created after must be before created before")
+	case filter.Status != "" && len(f.statuses) == 0:
+		return errors.New("this list cannot be filtered by status")
+	case filter.Status != "" && !slices.Contains(f.statuses, filter.Status):
+		return fmt.Errorf("status must be one of %s", strings.Join(f.statuses, ", "))
+	case filter.CustomerID != "" && !f.customer:
+		return errors.New("this list cannot be filtered by customer")
+	}
+	return nil
+}
+
+// Creates the page for a list request after validating the filters of the query. The
+// list is the resource path of the list (e.g. "webhooks/{id}/deliveries") and the filter
+// describes all of the filters of the request (including filters that are not part of
+// the list filter) so that page tokens cannot be used with other lists or filters.
+func newPage[T any](paginator *pagination.Paginator, list string, query *api.PageQuery, supported listFilters, filter any) (*pagination.Page[T], error) {
+	if err := supported.validate(&query.ListFilter); err != nil {
+		return nil, err
+	}
+	return pagination.NewPage[T](paginator, list, query, filter)
+}
+
+// Returns true if the created timestamp is in the created range of the filter.
+func matchCreated(filter *api.ListFilter, created time.Time) bool {
+	if !filter.CreatedAfter.IsZero() && created.Before(filter.CreatedAfter) {
+		return false
+	}
+
+	if !filter.CreatedBefore.IsZero() && !created.Before(filter.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// Returns true if the status matches the status filter, if any.
+func matchStatus(filter *api.ListFilter, status string) bool {
+	return filter.Status == "" || filter.Status == status
+}
@@ -0,0 +1,115 @@
+package exchequer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPagination(t *testing.T) {
+	_, client := newServer(t)
+	ctx := context.Background()
+
+	created := make([]*api.APIKey, 0, 12)
+	for i := 0; i < 12; i++ {
+		key, err := client.CreateAPIKey(ctx, &api.APIKey{Description: "paging", Scopes: []string{"webhooks:read"}})
+		require.NoError(t, err, "could not create api key")
+		created = append(created, key)
+	}
+
+	_, err := client.RevokeAPIKey(ctx, created[3].ID)
+	require.NoError(t, err, "could not revoke api key")
+
+	// Page forward through the keys
+	first, err := client.ListAPIKeys(ctx, &api.PageQuery{PageSize: 5})
+	require.NoError(t, err)
+	require.Len(t, first.APIKeys, 5)
+	require.Equal(t, created[0].ID, first.APIKeys[0].ID)
+	require.Empty(t, first.PrevPageToken)
+	require.NotEmpty(t, first.NextPageToken)
+
+	second, err := client.ListAPIKeys(ctx, &api.PageQuery{PageSize: 5, NextPageToken: first.NextPageToken})
+	require.NoError(t, err)
+	require.Len(t, second.APIKeys, 5)
+	require.Equal(t, created[5].ID, second.APIKeys[0].ID)
+	require.NotEmpty(t, second.PrevPageToken)
+
+	last, err := client.ListAPIKeys(ctx, &api.PageQuery{PageSize: 5, NextPageToken: second.NextPageToken})
+	require.NoError(t, err)
+	require.Len(t, last.APIKeys, 2)
+	require.Empty(t, last.NextPageToken)
+
+	// Page backward to the first page
+	prev, err := client.ListAPIKeys(ctx, &api.PageQuery{PageSize: 5, PrevPageToken: second.PrevPageToken})
+	require.NoError(t, err)
+	require.Equal(t, first.APIKeys, prev.APIKeys)
+	require.Empty(t, prev.PrevPageToken)
+
+	// The iterator follows the page tokens
+	keys, err := client.APIKeys(ctx, &api.PageQuery{PageSize: 5}).All()
+	require.NoError(t, err)
+	require.Len(t, keys, 12)
+
+	// Filter by status and created range
+	revoked, err := client.ListAPIKeys(ctx, &api.PageQuery{ListFilter: api.ListFilter{Status: "revoked"}})
+	require.NoError(t, err)
+	require.Len(t, revoked.APIKeys, 1)
+	require.Equal(t, created[3].ID, revoked.APIKeys[0].ID)
+
+	active, err := client.APIKeys(ctx, &api.PageQuery{PageSize: 5, ListFilter: api.ListFilter{Status: "active"}}).All()
+	require.NoError(t, err)
+	require.Len(t, active, 11)
+
+	future, err := client.ListAPIKeys(ctx, &api.PageQuery{ListFilter: api.ListFilter{CreatedAfter: time.Now().Add(time.Hour)}})
+	require.NoError(t, err)
+	require.Empty(t, future.APIKeys)
+
+	// Page tokens cannot be used with different filters or be modified
+	_, err = client.ListAPIKeys(ctx, &api.PageQuery{NextPageToken: first.NextPageToken, ListFilter: api.ListFilter{Status: "active"}})
+	require.ErrorIs(t, err, api.ErrBadRequest)
+
+	_, err = client.ListAPIKeys(ctx, &api.PageQuery{NextPageToken: first.NextPageToken[1:]})
+	require.ErrorIs(t, err, api.ErrBadRequest)
+
+	// Page tokens can only be used with the list that issued them
+	_, err = client.ListWebhookEndpoints(ctx, &api.PageQuery{NextPageToken: first.NextPageToken})
+	require.ErrorIs(t, err, api.ErrBadRequest)
+
+	// Unsupported filters are rejected
+	testCases := []*api.PageQuery{
+		{PageSize: -1},
+		{ListFilter: api.ListFilter{Status: "pending"}},
+		{ListFilter: api.ListFilter{CustomerID: "cus_1234"}},
+		{ListFilter: api.ListFilter{CreatedAfter: time.Now(), CreatedBefore: time.Now().Add(-time.Hour)}},
+	}
+
+	for i, tc := range testCases {
+		_, err = client.ListAPIKeys(ctx, tc)
+		require.ErrorIs(t, err, api.ErrBadRequest, "test case %d failed", i)
+	}
+
+	// The audit log is paged in sequence order
+	entries, err := client.AuditEntries(ctx, &api.AuditQuery{Action: "apikey.create", PageQuery: api.PageQuery{PageSize: 5}}).All()
+	require.NoError(t, err)
+	require.Len(t, entries, 12)
+	for i := 1; i < len(entries); i++ {
+		require.Less(t, entries[i-1].Sequence, entries[i].Sequence)
+	}
+
+	// The limit is retained as an alias of the page size
+	log, err := client.ListAuditEntries(ctx, &api.AuditQuery{Limit: 4})
+	require.NoError(t, err)
+	require.Len(t, log.Entries, 4)
+	require.NotEmpty(t, log.NextPageToken)
+
+	// Audit page tokens cannot be used with different audit filters
+	_, err = client.ListAuditEntries(ctx, &api.AuditQuery{Action: "apikey.revoke", PageQuery: api.PageQuery{NextPageToken: log.NextPageToken}})
+	require.ErrorIs(t, err, api.ErrBadRequest)
+
+	log, err = client.ListAuditEntries(ctx, &api.AuditQuery{PageQuery: api.PageQuery{ListFilter: api.ListFilter{CustomerID: "cus_1234"}}})
+	require.NoError(t, err)
+	require.Empty(t, log.Entries)
+}
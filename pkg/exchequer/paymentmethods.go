@@ -0,0 +1,251 @@
+package exchequer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/checkout"
+	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/events"
+	"github.com/rotationalio/exchequer/pkg/pagination"
+	"github.com/rotationalio/exchequer/pkg/store"
+)
+
+// ListPaymentMethods returns a page of the payment methods that Adyen has stored for the
+// customer, ordered by ID. Adyen is the source of truth for which tokens exist; the local
+// records determine which of them is the customer's default payment method.
+func (s *Server) ListPaymentMethods(c *gin.Context) {
+	var (
+		err    error
+		query  *api.PageQuery
+		page   *pagination.Page[*api.PaymentMethod]
+		stored []checkout.StoredPaymentMethodResource
+		local  []*store.PaymentMethod
+	)
+
+	query = &api.PageQuery{}
+	if err = c.ShouldBindQuery(query); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse page query"))
+		return
+	}
+
+	customerID := c.Param("id")
+	if page, err = newPage[*api.PaymentMethod](s.pages, "customers/"+customerID+"/payment-methods", query, paymentMethodFilters, query.ListFilter); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	if stored, err = s.adyenPaymentMethods(c, customerID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadGateway, api.Error("could not retrieve stored payment methods from adyen"))
+		return
+	}
+
+	if local, err = s.store.ListPaymentMethods(customerID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not list payment methods"))
+		return
+	}
+
+	defaults := make(map[string]bool, len(local))
+	for _, pm := range local {
+		defaults[pm.ID] = pm.Default
+	}
+
+	// Adyen does not specify the order of stored payment methods
+	slices.SortFunc(stored, func(a, b checkout.StoredPaymentMethodResource) int {
+		return strings.Compare(a.GetId(), b.GetId())
+	})
+
+	for _, resource := range stored {
+		pm := paymentMethodFromAdyen(customerID, resource)
+		pm.Default = defaults[pm.ID]
+
+		if !page.Add(pm, pagination.Key{SortKey: pm.ID}) {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, &api.PaymentMethodList{
+		PaymentMethods: page.Items(),
+		NextPageToken:  page.NextPageToken(),
+		PrevPageToken:  page.PrevPageToken(),
+	})
+}
+
+// SetDefaultPaymentMethod makes the stored payment method the customer's default. If the
+// token was stored before Exchequer received its RECURRING_CONTRACT webhook, it is looked
+// up in Adyen and saved locally first.
+func (s *Server) SetDefaultPaymentMethod(c *gin.Context) {
+	var (
+		err error
+		pm  *store.PaymentMethod
+		out *api.PaymentMethod
+	)
+
+	customerID, methodID := c.Param("id"), c.Param("methodID")
+	if out, err = s.syncPaymentMethod(c, customerID, methodID); err != nil {
+		s.paymentMethodError(c, err)
+		return
+	}
+
+	before, _ := s.store.RetrievePaymentMethod(customerID, methodID)
+	if pm, err = s.store.SetDefaultPaymentMethod(customerID, methodID); err != nil {
+		s.paymentMethodError(c, err)
+		return
+	}
+
+	s.audit(c, AuditPaymentMethodDefault, paymentMethodResource(customerID, methodID), before, pm)
+
+	out.Default = pm.Default
+	c.JSON(http.StatusOK, out)
+}
+
+// DisablePaymentMethod deletes the token from Adyen so it can no longer be charged and
+// marks the local record as disabled.
+func (s *Server) DisablePaymentMethod(c *gin.Context) {
+	var (
+		err  error
+		pm   *store.PaymentMethod
+		out  *api.PaymentMethod
+		hrep *http.Response
+	)
+
+	customerID, methodID := c.Param("id"), c.Param("methodID")
+	if out, err = s.syncPaymentMethod(c, customerID, methodID); err != nil {
+		s.paymentMethodError(c, err)
+		return
+	}
+
+	service := s.adyen.Checkout()
+	req := service.RecurringApi.DeleteTokenForStoredPaymentDetailsInput(methodID).
+		ShopperReference(customerID).
+		MerchantAccount(s.conf.Adyen.MerchantAccount)
+
+	started := time.Now()
+	hrep, err = service.RecurringApi.DeleteTokenForStoredPaymentDetails(c.Request.Context(), req)
+	if observeAdyen(adyenDeletePaymentMethod, started, hrep, err); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadGateway, api.Error("could not disable stored payment method with adyen"))
+		return
+	}
+
+	before, _ := s.store.RetrievePaymentMethod(customerID, methodID)
+	if pm, err = s.store.DisablePaymentMethod(customerID, methodID); err != nil {
+		s.paymentMethodError(c, err)
+		return
+	}
+
+	s.audit(c, AuditPaymentMethodDisable, paymentMethodResource(customerID, methodID), before, pm)
+
+	out.Default = false
+	out.Disabled = true
+
+	if _, err = s.events.Publish(events.PaymentMethodDisabled, out); err != nil {
+		c.Error(err)
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// Fetches the specified payment method from Adyen and ensures that a local record exists
+// for it, returning ErrNotFound if Adyen has not stored the payment method.
+func (s *Server) syncPaymentMethod(c *gin.Context, customerID, methodID string) (_ *api.PaymentMethod, err error) {
+	var stored []checkout.StoredPaymentMethodResource
+	if stored, err = s.adyenPaymentMethods(c, customerID); err != nil {
+		return nil, err
+	}
+
+	for _, resource := range stored {
+		if resource.GetId() != methodID {
+			continue
+		}
+
+		out := paymentMethodFromAdyen(customerID, resource)
+		if _, err = s.store.RetrievePaymentMethod(customerID, methodID); errors.Is(err, store.ErrNotFound) {
+			err = s.store.SavePaymentMethod(&store.PaymentMethod{
+				ID:         methodID,
+				CustomerID: customerID,
+				Type:       out.Type,
+				Summary:    out.LastFour,
+				Expiry:     out.ExpiryMonth + "/" + out.ExpiryYear,
+			})
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+
+	return nil, store.ErrNotFound
+}
+
+func (s *Server) adyenPaymentMethods(c *gin.Context, customerID string) ([]checkout.StoredPaymentMethodResource, error) {
+	service := s.adyen.Checkout()
+	req := service.RecurringApi.GetTokensForStoredPaymentDetailsInput().
+		ShopperReference(customerID).
+		MerchantAccount(s.conf.Adyen.MerchantAccount)
+
+	started := time.Now()
+	rep, hrep, err := service.RecurringApi.GetTokensForStoredPaymentDetails(c.Request.Context(), req)
+	if observeAdyen(adyenListPaymentMethods, started, hrep, err); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAdyenRequest, err)
+	}
+	return rep.StoredPaymentMethods, nil
+}
+
+func (s *Server) paymentMethodError(c *gin.Context, err error) {
+	c.Error(err)
+
+	switch {
+	case errors.Is(err, ErrAdyenRequest):
+		c.JSON(http.StatusBadGateway, api.Error("could not retrieve stored payment methods from adyen"))
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, api.Error("stored payment method not found"))
+	case errors.Is(err, store.ErrInvalidReference):
+		c.JSON(http.StatusBadRequest, api.Error("invalid customer or payment method id"))
+	default:
+		c.JSON(http.StatusInternalServerError, api.Error("could not update stored payment method"))
+	}
+}
+
+func paymentMethodResource(customerID, methodID string) string {
+	return "customers/" + customerID + "/payment-methods/" + methodID
+}
+
+// PaymentMethodToAPI converts a local payment method record to its API representation;
+// local records only have the summary of the payment method that Adyen stored.
+func PaymentMethodToAPI(pm *store.PaymentMethod) *api.PaymentMethod {
+	out := &api.PaymentMethod{
+		ID:         pm.ID,
+		CustomerID: pm.CustomerID,
+		Type:       pm.Type,
+		LastFour:   pm.Summary,
+		Default:    pm.Default,
+		Disabled:   pm.Disabled,
+	}
+
+	out.ExpiryMonth, out.ExpiryYear, _ = strings.Cut(pm.Expiry, "/")
+	return out
+}
+
+func paymentMethodFromAdyen(customerID string, resource checkout.StoredPaymentMethodResource) *api.PaymentMethod {
+	return &api.PaymentMethod{
+		ID:          resource.GetId(),
+		CustomerID:  customerID,
+		Type:        resource.GetType(),
+		Brand:       resource.GetBrand(),
+		Name:        resource.GetName(),
+		LastFour:    resource.GetLastFour(),
+		ExpiryMonth: resource.GetExpiryMonth(),
+		ExpiryYear:  resource.GetExpiryYear(),
+		HolderName:  resource.GetHolderName(),
+	}
+}
@@ -0,0 +1,204 @@
+package exchequer_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/adyen"
+	"github.com/adyen/adyen-go-api-library/v11/src/common"
+	"github.com/adyen/adyen-go-api-library/v11/src/webhook"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentMethods(t *testing.T) {
+	svc, client, tokens := newServerWithTokens(t)
+	ctx := context.Background()
+
+	mock := &mockRecurringAPI{tokens: map[string][]map[string]string{
+		"cust_1": {
+			{"id": "pm_visa", "type": "scheme", "brand": "visa", "lastFour": "1111", "expiryMonth": "03", "expiryYear": "2030"},
+			{"id": "pm_mc", "type": "scheme", "brand": "mc", "lastFour": "4444", "expiryMonth": "10", "expiryYear": "2031"},
+		},
+	}}
+	svc.SetAdyenClient(mock.Client())
+
+	// The first payment method stored by Adyen becomes the default
+	postWebhook(t, client, recurringContractPayload(t, "pm_visa", "cust_1"))
+
+	// Shopper references that cannot be stored are skipped without failing the webhook
+	postWebhook(t, client, recurringContractPayload(t, "pm_amex", "cust::2"))
+	postWebhook(t, client, recurringContractPayload(t, "pm_amex", ""))
+
+	out, err := client.ListPaymentMethods(ctx, "cust_1", nil)
+	require.NoError(t, err)
+	require.Len(t, out.PaymentMethods, 2)
+	require.Equal(t, "pm_mc", out.PaymentMethods[0].ID, "expected payment methods to be sorted by id")
+	require.False(t, out.PaymentMethods[0].Default)
+	require.Equal(t, "pm_visa", out.PaymentMethods[1].ID)
+	require.Equal(t, "1111", out.PaymentMethods[1].LastFour)
+	require.True(t, out.PaymentMethods[1].Default)
+
+	out, err = client.ListPaymentMethods(ctx, "cust_3", nil)
+	require.NoError(t, err)
+	require.Empty(t, out.PaymentMethods)
+
+	// Escaped path parameters are routed as a single path segment
+	out, err = client.ListPaymentMethods(ctx, "cust/1", nil)
+	require.NoError(t, err)
+	require.Empty(t, out.PaymentMethods)
+
+	// Payment methods stored before their webhook was received are synced from Adyen
+	pm, err := client.SetDefaultPaymentMethod(ctx, "cust_1", "pm_mc")
+	require.NoError(t, err)
+	require.Equal(t, "pm_mc", pm.ID)
+	require.Equal(t, "mc", pm.Brand)
+	require.True(t, pm.Default)
+
+	out, err = client.ListPaymentMethods(ctx, "cust_1", nil)
+	require.NoError(t, err)
+	require.True(t, out.PaymentMethods[0].Default)
+	require.False(t, out.PaymentMethods[1].Default)
+
+	// Disabling a payment method deletes its token from Adyen
+	pm, err = client.DisablePaymentMethod(ctx, "cust_1", "pm_mc")
+	require.NoError(t, err)
+	require.True(t, pm.Disabled)
+	require.False(t, pm.Default)
+	require.Equal(t, []string{"cust_1/pm_mc"}, mock.Deleted())
+
+	_, err = client.SetDefaultPaymentMethod(ctx, "cust_1", "pm_mc")
+	require.ErrorIs(t, err, api.ErrNotFound, "expected deleted token not to be found in adyen")
+
+	entries, err := client.ListAuditEntries(ctx, &api.AuditQuery{Resource: "customers/cust_1/payment-methods/pm_mc"})
+	require.NoError(t, err)
+	require.Len(t, entries.Entries, 2)
+
+	testCases := []struct {
+		client   api.Client
+		customer string
+		method   string
+		target   error
+	}{
+		{client, "cust_1", "pm_unknown", api.ErrNotFound},
+		{client, "cust_3", "pm_visa", api.ErrNotFound},
+		{client, "broken", "pm_visa", api.ErrBadGateway},
+		{newClientWithRoles(t, client, tokens, auth.RoleViewer), "cust_1", "pm_visa", api.ErrForbidden},
+	}
+
+	for i, tc := range testCases {
+		_, err = tc.client.SetDefaultPaymentMethod(ctx, tc.customer, tc.method)
+		require.ErrorIs(t, err, tc.target, "test case %d failed", i)
+
+		_, err = tc.client.DisablePaymentMethod(ctx, tc.customer, tc.method)
+		require.ErrorIs(t, err, tc.target, "test case %d failed", i)
+	}
+
+	_, err = client.ListPaymentMethods(ctx, "broken", nil)
+	require.ErrorIs(t, err, api.ErrBadGateway)
+}
+
+// Serves the stored payment methods of the Adyen recurring API from memory; requests
+// for the "broken" shopper reference fail. Checkout sessions are recorded.
+type mockRecurringAPI struct {
+	sync.Mutex
+	tokens   map[string][]map[string]string
+	deleted  []string
+	sessions []map[string]any
+}
+
+// Client returns an Adyen client that calls the mock instead of the Adyen test API.
+func (m *mockRecurringAPI) Client() *adyen.APIClient {
+	return adyen.NewClient(&common.Config{
+		ApiKey:      "testing",
+		Environment: common.TestEnv,
+		HTTPClient:  &http.Client{Transport: m},
+	})
+}
+
+func (m *mockRecurringAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+func (m *mockRecurringAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/sessions") {
+		session := make(map[string]any)
+		json.NewDecoder(r.Body).Decode(&session)
+		m.sessions = append(m.sessions, session)
+
+		session["id"] = fmt.Sprintf("CS%d", len(m.sessions))
+		session["sessionData"] = "Ab02b4c0"
+		session["expiresAt"] = time.Now().Add(time.Hour).Format(time.RFC3339)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(session)
+		return
+	}
+
+	shopper := r.URL.Query().Get("shopperReference")
+	if shopper == "broken" {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, methodID, _ := strings.Cut(r.URL.Path, "/storedPaymentMethods/")
+	switch {
+	case r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"merchantAccount":      r.URL.Query().Get("merchantAccount"),
+			"shopperReference":     shopper,
+			"storedPaymentMethods": m.tokens[shopper],
+		})
+	case r.Method == http.MethodDelete && methodID != "":
+		for i, token := range m.tokens[shopper] {
+			if token["id"] == methodID {
+				m.tokens[shopper] = append(m.tokens[shopper][:i], m.tokens[shopper][i+1:]...)
+				m.deleted = append(m.deleted, shopper+"/"+methodID)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *mockRecurringAPI) Deleted() []string {
+	m.Lock()
+	defer m.Unlock()
+	return m.deleted
+}
+
+func (m *mockRecurringAPI) Sessions() []map[string]any {
+	m.Lock()
+	defer m.Unlock()
+	return m.sessions
+}
+
+// Creates a RECURRING_CONTRACT notification for a payment method stored for the shopper.
+func recurringContractPayload(t *testing.T, methodID, shopperReference string) string {
+	return notificationPayload(t, webhook.NotificationRequestItem{
+		EventCode:     "RECURRING_CONTRACT",
+		PspReference:  methodID,
+		PaymentMethod: "visa",
+		AdditionalData: &map[string]interface{}{
+			"recurring.recurringDetailReference": methodID,
+			"recurring.shopperReference":         shopperReference,
+		},
+	})
+}
@@ -0,0 +1,167 @@
+package exchequer
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/checkout"
+	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/logger"
+)
+
+// RefundPayment requests that Adyen refunds all or part of a captured payment. Support
+// staff cannot refund more than the configured refund limit. The outcome of the refund
+// is received in a REFUND webhook and published as a payment.refunded event.
+func (s *Server) RefundPayment(c *gin.Context) {
+	var (
+		err    error
+		in     *api.RefundRequest
+		claims *auth.Claims
+		rep    checkout.PaymentRefundResponse
+		hrep   *http.Response
+	)
+
+	in = &api.RefundRequest{}
+	if err = c.ShouldBindJSON(in); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse refund request"))
+		return
+	}
+
+	if in.Amount <= 0 {
+		c.JSON(http.StatusBadRequest, api.Error("refund amount must be greater than zero"))
+		return
+	}
+
+	if len(in.Currency) != 3 {
+		c.JSON(http.StatusBadRequest, api.Error("refund currency must be a three-character ISO currency code"))
+		return
+	}
+	in.Currency = strings.ToUpper(in.Currency)
+
+	if claims, err = auth.GetClaims(c); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusUnauthorized, api.Error("this endpoint requires authentication"))
+		return
+	}
+
+	// Limits are in minor units of a currency so refunds in currencies without a limit
+	// cannot be issued by support staff
+	if claims.LimitedRefunds() {
+		if limit, ok := s.conf.Auth.RefundLimit(in.Currency); !ok || in.Amount > limit {
+			log := logger.Tracing(c.Request.Context())
+			log.Warn().
+				Str("subject", claims.Subject).
+				Strs("roles", claims.Roles).
+				Int64("amount", in.Amount).
+				Str("currency", in.Currency).
+				Int64("limit", limit).
+				Bool("authorized", false).
+				Msg("authorization denied: refund exceeds support limit")
+
+			if !ok {
+				c.JSON(http.StatusForbidden, api.Error("support staff cannot refund payments in this currency"))
+				return
+			}
+			c.JSON(http.StatusForbidden, api.Error("refund exceeds the amount that support staff can refund"))
+			return
+		}
+	}
+
+	pspReference := c.Param("pspReference")
+	refund := checkout.NewPaymentRefundRequest(checkout.Amount{Value: in.Amount, Currency: in.Currency}, s.conf.Adyen.MerchantAccount)
+	if in.Reason != "" {
+		refund.SetMerchantRefundReason(in.Reason)
+	}
+	if in.Reference != "" {
+		refund.SetReference(in.Reference)
+	}
+
+	service := s.adyen.Checkout()
+	req := service.ModificationsApi.RefundCapturedPaymentInput(pspReference).PaymentRefundRequest(*refund)
+	if key := idempotencyKey(c); key != "" {
+		req = req.IdempotencyKey(key)
+	}
+
+	started := time.Now()
+	rep, hrep, err = service.ModificationsApi.RefundCapturedPayment(c.Request.Context(), req)
+	if observeAdyen(adyenRefund, started, hrep, err); err != nil {
+		c.Error(err)
+		if adyenOutcomeUnknown(hrep) {
+			keepIdempotencyKey(c)
+			c.JSON(http.StatusBadGateway, api.Error("the outcome of the refund is unknown; check the payment before refunding again"))
+			return
+		}
+		c.JSON(http.StatusBadGateway, api.Error("could not refund payment with adyen"))
+		return
+	}
+
+	out := &api.Modification{
+		PSPReference:        rep.PspReference,
+		PaymentPSPReference: rep.PaymentPspReference,
+		Reference:           rep.GetReference(),
+		Amount:              rep.Amount.Value,
+		Currency:            rep.Amount.Currency,
+		Reason:              rep.GetMerchantRefundReason(),
+		Status:              rep.Status,
+	}
+
+	s.audit(c, AuditPaymentRefund, paymentResource(pspReference), nil, out)
+	c.JSON(http.StatusAccepted, out)
+}
+
+// CancelPayment requests that Adyen voids an authorised payment that has not yet been
+// captured. The outcome is received in a CANCELLATION webhook.
+func (s *Server) CancelPayment(c *gin.Context) {
+	var (
+		err  error
+		rep  checkout.PaymentCancelResponse
+		hrep *http.Response
+	)
+
+	pspReference := c.Param("pspReference")
+	cancel := checkout.NewPaymentCancelRequest(s.conf.Adyen.MerchantAccount)
+
+	service := s.adyen.Checkout()
+	req := service.ModificationsApi.CancelAuthorisedPaymentByPspReferenceInput(pspReference).PaymentCancelRequest(*cancel)
+	if key := idempotencyKey(c); key != "" {
+		req = req.IdempotencyKey(key)
+	}
+
+	started := time.Now()
+	rep, hrep, err = service.ModificationsApi.CancelAuthorisedPaymentByPspReference(c.Request.Context(), req)
+	if observeAdyen(adyenCancel, started, hrep, err); err != nil {
+		c.Error(err)
+		if adyenOutcomeUnknown(hrep) {
+			keepIdempotencyKey(c)
+			c.JSON(http.StatusBadGateway, api.Error("the outcome of the cancellation is unknown; check the payment before cancelling again"))
+			return
+		}
+		c.JSON(http.StatusBadGateway, api.Error("could not cancel payment with adyen"))
+		return
+	}
+
+	out := &api.Modification{
+		PSPReference:        rep.PspReference,
+		PaymentPSPReference: rep.PaymentPspReference,
+		Reference:           rep.GetReference(),
+		Status:              rep.Status,
+	}
+
+	s.audit(c, AuditPaymentCancel, paymentResource(pspReference), nil, out)
+	c.JSON(http.StatusAccepted, out)
+}
+
+// Returns true if a failed Adyen call may still have taken effect, i.e. if no response
+// was received or Adyen failed with a server error, so the modification must not be
+// requested again with the same idempotency key.
+func adyenOutcomeUnknown(hrep *http.Response) bool {
+	return hrep == nil || hrep.StatusCode >= http.StatusInternalServerError
+}
+
+func paymentResource(pspReference string) string {
+	return "payments/" + pspReference
+}
@@ -0,0 +1,153 @@
+package exchequer_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/adyen"
+	"github.com/adyen/adyen-go-api-library/v11/src/common"
+
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefundPaymentAuthorization(t *testing.T) {
+	_, client, tokens := newServerWithTokens(t)
+	ctx := context.Background()
+
+	viewer := newClientWithRoles(t, client, tokens, auth.RoleViewer)
+	support := newClientWithRoles(t, client, tokens, auth.RoleSupport)
+	finance := newClientWithRoles(t, client, tokens, auth.RoleSupport, auth.RoleFinance)
+
+	// NOTE: only requests that are rejected before Adyen is called are tested here.
+	testCases := []struct {
+		client api.Client
+		in     *api.RefundRequest
+		target error
+	}{
+		{viewer, &api.RefundRequest{Amount: 500, Currency: "EUR"}, api.ErrForbidden},
+		{support, &api.RefundRequest{Amount: 10001, Currency: "EUR"}, api.ErrForbidden},
+		{support, &api.RefundRequest{Amount: 101, Currency: "jpy"}, api.ErrForbidden},
+		{support, &api.RefundRequest{Amount: 500, Currency: "USD"}, api.ErrForbidden},
+		{support, nil, api.ErrForbidden},
+		{support, &api.RefundRequest{Amount: 0, Currency: "EUR"}, api.ErrBadRequest},
+		{support, &api.RefundRequest{Amount: 500, Currency: "EURO"}, api.ErrBadRequest},
+		{finance, &api.RefundRequest{Amount: -1, Currency: "EUR"}, api.ErrBadRequest},
+	}
+
+	// Test cases without a refund request cancel the payment
+	for i, tc := range testCases {
+		var err error
+		if tc.in != nil {
+			_, err = tc.client.RefundPayment(ctx, "7914073381342284", tc.in)
+		} else {
+			_, err = tc.client.CancelPayment(ctx, "7914073381342284")
+		}
+		require.ErrorIs(t, err, tc.target, "test case %d failed", i)
+	}
+
+	_, err := finance.CancelPayment(ctx, "")
+	require.ErrorIs(t, err, api.ErrMissingID)
+}
+
+func TestRefundPaymentIdempotency(t *testing.T) {
+	svc, client := newServer(t)
+	mock := &mockModificationsAPI{status: http.StatusInternalServerError}
+	svc.SetAdyenClient(mock.Client())
+
+	// A refund whose outcome is unknown is replayed rather than sent to Adyen again
+	ctx := api.ContextWithIdempotencyKey(context.Background(), "refund-1")
+	_, err := client.RefundPayment(ctx, "7914073381342284", &api.RefundRequest{Amount: 500, Currency: "EUR"})
+	require.ErrorIs(t, err, api.ErrBadGateway)
+
+	keys := mock.Keys()
+	require.Len(t, keys, 1)
+	require.Len(t, keys[0], 64, "expected the idempotency key to be forwarded to adyen")
+
+	mock.SetStatus(http.StatusOK)
+	_, err = client.RefundPayment(ctx, "7914073381342284", &api.RefundRequest{Amount: 500, Currency: "EUR"})
+	require.ErrorIs(t, err, api.ErrBadGateway)
+	require.Len(t, mock.Keys(), 1, "expected the retry not to be sent to adyen")
+
+	// Refunds rejected by Adyen release the key so that they can be corrected and retried
+	mock.SetStatus(http.StatusUnprocessableEntity)
+	ctx = api.ContextWithIdempotencyKey(context.Background(), "refund-2")
+	_, err = client.RefundPayment(ctx, "7914073381342284", &api.RefundRequest{Amount: 500, Currency: "EUR"})
+	require.ErrorIs(t, err, api.ErrBadGateway)
+
+	mock.SetStatus(http.StatusOK)
+	out, err := client.RefundPayment(ctx, "7914073381342284", &api.RefundRequest{Amount: 500, Currency: "EUR"})
+	require.NoError(t, err)
+	require.Equal(t, "received", out.Status)
+
+	keys = mock.Keys()
+	require.Len(t, keys, 3)
+	require.Equal(t, keys[1], keys[2], "expected the retry to be sent to adyen with the same key")
+	require.NotEqual(t, keys[0], keys[1])
+
+	// Cancellations forward the key in the same way
+	ctx = api.ContextWithIdempotencyKey(context.Background(), "cancel-1")
+	_, err = client.CancelPayment(ctx, "7914073381342284")
+	require.NoError(t, err)
+
+	keys = mock.Keys()
+	require.Len(t, keys, 4)
+	require.Len(t, keys[3], 64)
+}
+
+// Responds to Adyen payment modification requests with the configured status and
+// records the Idempotency-Key header of each request.
+type mockModificationsAPI struct {
+	sync.Mutex
+	status int
+	keys   []string
+}
+
+// Client returns an Adyen client that calls the mock instead of the Adyen test API.
+func (m *mockModificationsAPI) Client() *adyen.APIClient {
+	return adyen.NewClient(&common.Config{
+		ApiKey:      "testing",
+		Environment: common.TestEnv,
+		HTTPClient:  &http.Client{Transport: m},
+	})
+}
+
+func (m *mockModificationsAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.keys = append(m.keys, req.Header.Get("Idempotency-Key"))
+	rec := httptest.NewRecorder()
+	if m.status != http.StatusOK {
+		rec.WriteHeader(m.status)
+		return rec.Result(), nil
+	}
+
+	rec.Header().Set("Content-Type", "application/json")
+	rec.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rec).Encode(map[string]any{
+		"merchantAccount":     "TestMerchant",
+		"paymentPspReference": "7914073381342284",
+		"pspReference":        "8825408195409505",
+		"status":              "received",
+		"amount":              map[string]any{"value": 500, "currency": "EUR"},
+	})
+	return rec.Result(), nil
+}
+
+func (m *mockModificationsAPI) SetStatus(status int) {
+	m.Lock()
+	defer m.Unlock()
+	m.status = status
+}
+
+func (m *mockModificationsAPI) Keys() []string {
+	m.Lock()
+	defer m.Unlock()
+	return append([]string(nil), m.keys...)
+}
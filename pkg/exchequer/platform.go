@@ -0,0 +1,276 @@
+package exchequer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/configurationwebhook"
+	"github.com/adyen/adyen-go-api-library/v11/src/managementwebhook"
+	"github.com/adyen/adyen-go-api-library/v11/src/reportwebhook"
+	"github.com/adyen/adyen-go-api-library/v11/src/transferwebhook"
+	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/metrics"
+	"github.com/rotationalio/exchequer/pkg/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Families of Adyen webhooks that are configured separately from the standard webhook.
+// Unlike standard notifications, these webhooks are signed with the HMAC signature of
+// the raw request body in the HmacSignature header.
+const (
+	WebhookManagement      = "management"
+	WebhookReport          = "report"
+	WebhookBalancePlatform = "balance_platform"
+	WebhookTransfer        = "transfer"
+)
+
+// HeaderHMACSignature contains the HMAC signature of the body of a platform webhook.
+const HeaderHMACSignature = "HmacSignature"
+
+// The maximum size of the body of a platform webhook; the body is read into memory to
+// verify its signature and Adyen webhooks are only a few kilobytes.
+const maxPlatformWebhookSize = 1 << 20
+
+// PlatformWebhook is a verified management, report, balance platform or transfer webhook
+// from Adyen. The payload is the request type from the Adyen library for the webhook
+// type, e.g. *reportwebhook.ReportNotificationRequest for balancePlatform.report.created,
+// or nil if the webhook type is not known; the body is the webhook as it was received.
+type PlatformWebhook struct {
+	Family      string
+	Type        string
+	Environment string
+	Payload     any
+	Body        json.RawMessage
+}
+
+// Live returns true if the webhook originated from the live environment.
+func (w *PlatformWebhook) Live() bool {
+	return w.Environment == "live"
+}
+
+// PlatformWebhookHandler processes a verified platform webhook; if the handler returns an
+// error the webhook is not accepted so that Adyen retries it.
+type PlatformWebhookHandler func(ctx context.Context, webhook *PlatformWebhook) error
+
+// RegisterPlatformWebhookHandler sets the handler for platform webhooks of the type,
+// replacing any handler that was previously registered for the type. Handlers must be
+// registered before the server is started.
+func (s *Server) RegisterPlatformWebhookHandler(webhookType string, handler PlatformWebhookHandler) {
+	if s.platformHandlers == nil {
+		s.platformHandlers = make(map[string]PlatformWebhookHandler)
+	}
+	s.platformHandlers[webhookType] = handler
+}
+
+//===========================================================================
+// Platform Webhook Handlers
+//===========================================================================
+
+// AdyenManagementWebhook receives the Management API webhooks, e.g. when a payment method
+// is enabled or a merchant account is updated.
+func (s *Server) AdyenManagementWebhook(c *gin.Context) {
+	s.adyenPlatformWebhook(c, WebhookManagement, s.conf.Adyen.Webhook.ManagementHMACSecret)
+}
+
+// AdyenReportWebhook receives the balance platform webhooks sent when a report is
+// available to download.
+func (s *Server) AdyenReportWebhook(c *gin.Context) {
+	s.adyenPlatformWebhook(c, WebhookReport, s.conf.Adyen.Webhook.ReportHMACSecret)
+}
+
+// AdyenBalancePlatformWebhook receives the balance platform configuration webhooks, e.g.
+// when an account holder or balance account is created or updated.
+func (s *Server) AdyenBalancePlatformWebhook(c *gin.Context) {
+	s.adyenPlatformWebhook(c, WebhookBalancePlatform, s.conf.Adyen.Webhook.BalancePlatformHMACSecret)
+}
+
+// AdyenTransferWebhook receives the balance platform webhooks sent when funds are
+// transferred into, out of or between balance accounts.
+func (s *Server) AdyenTransferWebhook(c *gin.Context) {
+	s.adyenPlatformWebhook(c, WebhookTransfer, s.conf.Adyen.Webhook.TransferHMACSecret)
+}
+
+// Verifies the signature of the raw body of a platform webhook before parsing it; if the
+// hmac key of the webhook family is not configured the standard webhook secret is used.
+// Platform webhooks are rejected unless they are authenticated by either hmac signatures
+// or basic authentication since handlers act on them, e.g. by downloading reports.
+func (s *Server) adyenPlatformWebhook(c *gin.Context, family, secret string) {
+	var (
+		err     error
+		body    []byte
+		webhook *PlatformWebhook
+	)
+
+	if !s.conf.Adyen.Webhook.VerifyHMAC && !s.conf.Adyen.Webhook.UseBasicAuth {
+		c.JSON(http.StatusForbidden, api.Error("platform webhooks require hmac verification or basic authentication"))
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxPlatformWebhookSize)
+	if body, err = c.GetRawData(); err != nil {
+		c.Error(err)
+
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, api.Error("webhook request is too large"))
+			return
+		}
+
+		c.JSON(http.StatusBadRequest, api.Error("could not read webhook request"))
+		return
+	}
+
+	if s.conf.Adyen.Webhook.VerifyHMAC {
+		if secret == "" {
+			secret = s.conf.Adyen.Webhook.HMACSecret
+		}
+
+		if err = VerifyAdyenPayloadHMAC(body, c.GetHeader(HeaderHMACSignature), secret); err != nil {
+			metrics.HMACFailures.Inc()
+			c.Error(err)
+			c.JSON(http.StatusUnauthorized, api.Error("HMAC signature cannot be verified"))
+			return
+		}
+	}
+
+	if webhook, err = ParsePlatformWebhook(family, body); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error(fmt.Sprintf("could not parse %s webhook request", family)))
+		return
+	}
+
+	metrics.PlatformWebhooksReceived.WithLabelValues(webhook.Family, webhook.Type).Inc()
+	msg := log.Info()
+	if webhook.Payload == nil {
+		msg = log.Warn()
+	}
+
+	msg.Str("family", webhook.Family).
+		Str("type", webhook.Type).
+		Str("environment", webhook.Environment).
+		Bool("known_type", webhook.Payload != nil).
+		Msg("adyen platform webhook received")
+
+	// Process the webhook; if processing fails Adyen will retry the webhook.
+	if err = s.HandlePlatformWebhook(c.Request.Context(), webhook); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not process webhook"))
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// HandlePlatformWebhook processes a verified platform webhook with the handler that is
+// registered for its type; webhooks without a handler are only acknowledged.
+func (s *Server) HandlePlatformWebhook(ctx context.Context, webhook *PlatformWebhook) (err error) {
+	handler, ok := s.platformHandlers[webhook.Type]
+	if !ok {
+		return nil
+	}
+
+	var span trace.Span
+	ctx, span = tracing.Tracer().Start(ctx, "adyen.platform_webhook", trace.WithAttributes(
+		attribute.String("adyen.webhook_family", webhook.Family),
+		attribute.String("adyen.webhook_type", webhook.Type),
+		attribute.Bool("adyen.live", webhook.Live()),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "could not process webhook")
+		}
+		span.End()
+	}()
+
+	return handler(ctx, webhook)
+}
+
+//===========================================================================
+// Platform Webhook Parsing
+//===========================================================================
+
+// The webhook types of each family mapped to a function that decodes the webhook into
+// the request type of the Adyen library.
+var platformWebhookTypes = map[string]map[string]func([]byte) (any, error){
+	WebhookManagement: {
+		"merchant.created":                         decodePayload[managementwebhook.MerchantCreatedNotificationRequest],
+		"merchant.updated":                         decodePayload[managementwebhook.MerchantUpdatedNotificationRequest],
+		"paymentMethod.created":                    decodePayload[managementwebhook.PaymentMethodCreatedNotificationRequest],
+		"paymentMethod.requestRemoved":             decodePayload[managementwebhook.PaymentMethodRequestRemovedNotificationRequest],
+		"paymentMethod.requestScheduledForRemoval": decodePayload[managementwebhook.PaymentMethodScheduledForRemovalNotificationRequest],
+		"terminalSettings.modified":                decodePayload[managementwebhook.TerminalSettingsNotificationRequest],
+	},
+	WebhookReport: {
+		"balancePlatform.report.created": decodePayload[reportwebhook.ReportNotificationRequest],
+	},
+	WebhookBalancePlatform: {
+		"balancePlatform.accountHolder.created":       decodePayload[configurationwebhook.AccountHolderNotificationRequest],
+		"balancePlatform.accountHolder.updated":       decodePayload[configurationwebhook.AccountHolderNotificationRequest],
+		"balancePlatform.balanceAccount.created":      decodePayload[configurationwebhook.BalanceAccountNotificationRequest],
+		"balancePlatform.balanceAccount.updated":      decodePayload[configurationwebhook.BalanceAccountNotificationRequest],
+		"balancePlatform.cardorder.created":           decodePayload[configurationwebhook.CardOrderNotificationRequest],
+		"balancePlatform.cardorder.updated":           decodePayload[configurationwebhook.CardOrderNotificationRequest],
+		"balancePlatform.paymentInstrument.created":   decodePayload[configurationwebhook.PaymentNotificationRequest],
+		"balancePlatform.paymentInstrument.updated":   decodePayload[configurationwebhook.PaymentNotificationRequest],
+		"balancePlatform.balanceAccountSweep.created": decodePayload[configurationwebhook.SweepConfigurationNotificationRequest],
+		"balancePlatform.balanceAccountSweep.updated": decodePayload[configurationwebhook.SweepConfigurationNotificationRequest],
+		"balancePlatform.balanceAccountSweep.deleted": decodePayload[configurationwebhook.SweepConfigurationNotificationRequest],
+	},
+	WebhookTransfer: {
+		"balancePlatform.transfer.created": decodePayload[transferwebhook.TransferNotificationRequest],
+		"balancePlatform.transfer.updated": decodePayload[transferwebhook.TransferNotificationRequest],
+	},
+}
+
+// ParsePlatformWebhook parses the raw body of a webhook of the family. Webhooks of types
+// that are not known are parsed without a payload since Adyen adds new webhook types to
+// each family, but every webhook must specify its type and environment.
+func ParsePlatformWebhook(family string, body []byte) (_ *PlatformWebhook, err error) {
+	types, ok := platformWebhookTypes[family]
+	if !ok {
+		return nil, fmt.Errorf("unknown adyen webhook family %q", family)
+	}
+
+	envelope := &struct {
+		Type        string `json:"type"`
+		Environment string `json:"environment"`
+	}{}
+
+	if err = json.Unmarshal(body, envelope); err != nil {
+		return nil, err
+	}
+
+	if envelope.Type == "" || envelope.Environment == "" {
+		return nil, errors.New("webhook type and environment are required")
+	}
+
+	webhook := &PlatformWebhook{
+		Family:      family,
+		Type:        envelope.Type,
+		Environment: envelope.Environment,
+		Body:        body,
+	}
+
+	if decode, ok := types[webhook.Type]; ok {
+		if webhook.Payload, err = decode(body); err != nil {
+			return nil, err
+		}
+	}
+	return webhook, nil
+}
+
+func decodePayload[T any](body []byte) (any, error) {
+	payload := new(T)
+	if err := json.Unmarshal(body, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
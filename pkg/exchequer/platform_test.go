@@ -0,0 +1,160 @@
+package exchequer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/reportwebhook"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/exchequer"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	exampleTransferHMACSecret = "229382C61727723D66EF1A819B2A136F"
+	exampleReportWebhook      = `{
+  "data": {
+    "balancePlatform": "YOUR_BALANCE_PLATFORM",
+    "creationDate": "2024-07-02T02:01:08+02:00",
+    "downloadUrl": "https://balanceplatform-api-test.adyen.com/balanceplatform/balanceAccounts/BA00000000000000000001/reports/download?filename=balanceplatform_payments_accounting_report_2024_07_01.csv",
+    "fileName": "balanceplatform_payments_accounting_report_2024_07_01.csv",
+    "reportType": "balanceplatform_payments_accounting_report"
+  },
+  "environment": "test",
+  "type": "balancePlatform.report.created"
+}`
+	exampleTransferWebhook = `{
+  "data": {
+    "id": "1W1UG35U8A9J5ZLG",
+    "amount": {"currency": "EUR", "value": 10000},
+    "category": "bank",
+    "direction": "outgoing",
+    "reference": "Your internal reference for the transfer",
+    "status": "authorised"
+  },
+  "environment": "test",
+  "type": "balancePlatform.transfer.created"
+}`
+)
+
+func TestVerifyAdyenPayloadHMAC(t *testing.T) {
+	body := []byte(exampleReportWebhook)
+	signature, err := exchequer.SignAdyenPayloadHMAC(body, exampleHMACSecret)
+	require.NoError(t, err, "could not sign webhook body")
+	require.NoError(t, exchequer.VerifyAdyenPayloadHMAC(body, signature, exampleHMACSecret))
+
+	err = exchequer.VerifyAdyenPayloadHMAC(body, "", exampleHMACSecret)
+	require.ErrorIs(t, err, exchequer.ErrMissingHMACSignature)
+
+	err = exchequer.VerifyAdyenPayloadHMAC(body, signature, exampleTransferHMACSecret)
+	require.ErrorIs(t, err, exchequer.ErrInvalidHMACSignature, "expected error with invalid hmac secret")
+
+	err = exchequer.VerifyAdyenPayloadHMAC(append(body, ' '), signature, exampleHMACSecret)
+	require.ErrorIs(t, err, exchequer.ErrInvalidHMACSignature, "expected error with modified body")
+
+	_, err = exchequer.SignAdyenPayloadHMAC(body, "notahexsecret")
+	require.ErrorIs(t, err, exchequer.ErrInvalidHMACSecret)
+}
+
+func TestPlatformWebhooks(t *testing.T) {
+	svc, client, _ := newServerWithTokens(t, func(conf *config.Config) {
+		conf.Adyen.Webhook.VerifyHMAC = true
+		conf.Adyen.Webhook.HMACSecret = exampleHMACSecret
+		conf.Adyen.Webhook.TransferHMACSecret = exampleTransferHMACSecret
+	})
+
+	var received []*exchequer.PlatformWebhook
+	svc.RegisterPlatformWebhookHandler("balancePlatform.report.created", func(ctx context.Context, webhook *exchequer.PlatformWebhook) error {
+		received = append(received, webhook)
+		return nil
+	})
+
+	svc.RegisterPlatformWebhookHandler("balancePlatform.transfer.updated", func(ctx context.Context, webhook *exchequer.PlatformWebhook) error {
+		return errors.New("could not process transfer")
+	})
+
+	// Reports are verified with the standard hmac secret since no report key is set
+	status := postPlatformWebhook(t, client, "/v1/adyen/reports", exampleReportWebhook, exampleHMACSecret)
+	require.Equal(t, http.StatusAccepted, status)
+	require.Len(t, received, 1)
+	require.Equal(t, exchequer.WebhookReport, received[0].Family)
+	require.False(t, received[0].Live())
+
+	report, ok := received[0].Payload.(*reportwebhook.ReportNotificationRequest)
+	require.True(t, ok, "expected report webhook payload")
+	require.Equal(t, "balanceplatform_payments_accounting_report_2024_07_01.csv", report.Data.FileName)
+
+	// Transfers are verified with the transfer hmac key
+	status = postPlatformWebhook(t, client, "/v1/adyen/transfers", exampleTransferWebhook, exampleTransferHMACSecret)
+	require.Equal(t, http.StatusAccepted, status)
+
+	testCases := []struct {
+		path     string
+		body     string
+		secret   string
+		expected int
+	}{
+		{"/v1/adyen/reports", exampleReportWebhook, "", http.StatusUnauthorized},
+		{"/v1/adyen/reports", exampleReportWebhook, exampleTransferHMACSecret, http.StatusUnauthorized},
+		{"/v1/adyen/transfers", exampleTransferWebhook, exampleHMACSecret, http.StatusUnauthorized},
+		{"/v1/adyen/management", `{"type": "merchant.created"}`, exampleHMACSecret, http.StatusBadRequest},
+		{"/v1/adyen/management", `{"type": "merchant.created", "environment": "test", "data": []}`, exampleHMACSecret, http.StatusBadRequest},
+		{"/v1/adyen/balance-platform", `not json`, exampleHMACSecret, http.StatusBadRequest},
+		{"/v1/adyen/management", `{"type": "merchant.created", "environment": "live", "createdAt": "2024-07-02T02:01:08+02:00", "data": {"merchantId": "MC00000000000000000001"}}`, exampleHMACSecret, http.StatusAccepted},
+		{"/v1/adyen/balance-platform", `{"type": "balancePlatform.unknown.created", "environment": "test", "data": {}}`, exampleHMACSecret, http.StatusAccepted},
+		{"/v1/adyen/transfers", `{"type": "balancePlatform.transfer.updated", "environment": "test", "data": {"status": "booked"}}`, exampleTransferHMACSecret, http.StatusInternalServerError},
+		{"/v1/adyen/management", `{"type": "merchant.created", "data": "` + strings.Repeat("a", 1<<20) + `"}`, exampleHMACSecret, http.StatusRequestEntityTooLarge},
+	}
+
+	for i, tc := range testCases {
+		status = postPlatformWebhook(t, client, tc.path, tc.body, tc.secret)
+		require.Equal(t, tc.expected, status, "test case %d failed", i)
+	}
+	require.Len(t, received, 1, "expected only the report handler to be called")
+
+	// Platform webhooks are rejected if they cannot be authenticated
+	_, insecure, _ := newServerWithTokens(t)
+	status = postPlatformWebhook(t, insecure, "/v1/adyen/reports", exampleReportWebhook, exampleHMACSecret)
+	require.Equal(t, http.StatusForbidden, status)
+
+	_, basic, _ := newServerWithTokens(t, func(conf *config.Config) {
+		conf.Adyen.Webhook.UseBasicAuth = true
+		conf.Adyen.Webhook.Username = "adyen"
+		conf.Adyen.Webhook.Password = "supersecret"
+	})
+	status = postPlatformWebhook(t, basic, "/v1/adyen/reports", exampleReportWebhook, "")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	req, err := http.NewRequest(http.MethodPost, endpoint(basic)+"/v1/adyen/reports", strings.NewReader(exampleReportWebhook))
+	require.NoError(t, err)
+	req.SetBasicAuth("adyen", "supersecret")
+
+	rep, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	rep.Body.Close()
+	require.Equal(t, http.StatusAccepted, rep.StatusCode)
+}
+
+// Posts a platform webhook signed with the secret in the HmacSignature header (unsigned
+// if the secret is empty) and returns the status code of the response.
+func postPlatformWebhook(t *testing.T, client api.Client, path, body, secret string) int {
+	req, err := http.NewRequest(http.MethodPost, endpoint(client)+path, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	if secret != "" {
+		signature, err := exchequer.SignAdyenPayloadHMAC([]byte(body), secret)
+		require.NoError(t, err)
+		req.Header.Set(exchequer.HeaderHMACSignature, signature)
+	}
+
+	rep, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer rep.Body.Close()
+	return rep.StatusCode
+}
@@ -7,8 +7,11 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
 	"github.com/rotationalio/exchequer/pkg/logger"
 	"github.com/rotationalio/exchequer/pkg/metrics"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 // Sets up the server's middleware and routes.
@@ -26,7 +29,8 @@ func (s *Server) setupRoutes() (err error) {
 	// Create CORS configuration
 	corsConf := cors.Config{
 		AllowMethods:     []string{"GET", "HEAD"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-CSRF-TOKEN"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-CSRF-TOKEN", api.RequestIDHeader, api.TraceparentHeader, api.IdempotencyKeyHeader},
+		ExposeHeaders:    []string{api.RequestIDHeader, api.IdempotentReplayedHeader},
 		AllowOrigins:     []string{s.conf.Origin},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
@@ -35,6 +39,9 @@ func (s *Server) setupRoutes() (err error) {
 	// Application Middleware
 	// NOTE: ordering is important to how middleware is handled
 	middlewares := []gin.HandlerFunc{
+		// Tracing wraps logging so that request logs include the trace of the request
+		otelgin.Middleware(s.conf.Tracing.ServiceName),
+
 		// Logging should be on the outside so we can record the correct latency of requests
 		// NOTE: logging panics will not recover
 		logger.GinLogger("web"),
@@ -45,7 +52,7 @@ func (s *Server) setupRoutes() (err error) {
 		// CORS configuration allows the front-end to make cross-origin requests
 		cors.New(corsConf),
 
-		// Maintenance mode middleware to return unavailable
+		// Maintenance mode middleware to return unavailable (except for webhooks)
 		s.Maintenance(),
 	}
 
@@ -73,20 +80,95 @@ func (s *Server) setupRoutes() (err error) {
 	staticFiles, _ := fs.Sub(content, "static")
 	s.router.StaticFS("/static", http.FS(staticFiles))
 
-	// Pages
-	s.router.GET("/", s.Index)
-	s.router.GET("/checkout", s.Checkout)
+	// Pages set the double-submit CSRF cookies for the front-end
+	csrfCookies := s.CSRFCookies()
+	s.router.GET("/", csrfCookies, s.Index)
+	s.router.GET("/checkout", csrfCookies, s.Checkout)
+
+	// CSRF protection for state changing requests from the browser, authentication
+	// middleware for API routes that require an access token or API key, and
+	// authorization middleware for the permissions required by each route.
+	// NOTE: the Adyen webhooks are exempt from CSRF protection.
+	// Retries of POST requests with an Idempotency-Key are replayed after authorization.
+	csrf := auth.DoubleCookies()
+	authenticate := auth.Authenticate(s.tokens, s.apikeys)
+	authorize := auth.Authorize
+	idempotent := s.Idempotency()
 
 	// API Routes (Including Content Negotiated Partials)
 	v1 := s.router.Group("/v1")
 	{
-		// Status/Heartbeat endpoint
-		v1.GET("/status", s.Status)
+		// Status/Heartbeat endpoint; authenticated callers also see health check errors
+		v1.GET("/status", auth.Identify(s.tokens, s.apikeys), s.Status)
+
+		// Customer stored payment methods
+		customers := v1.Group("/customers/:id", csrf, authenticate)
+		{
+			customers.GET("/payment-methods", authorize(auth.ScopeCustomersRead), s.ListPaymentMethods)
+			customers.POST("/payment-methods/:methodID/default", authorize(auth.ScopeCustomersWrite), idempotent, s.SetDefaultPaymentMethod)
+			customers.DELETE("/payment-methods/:methodID", authorize(auth.ScopeCustomersWrite), s.DisablePaymentMethod)
+			customers.POST("/checkout", authorize(auth.ScopeCustomersWrite), s.CreateCheckoutLink)
+		}
+
+		// Payment modifications by operators
+		payments := v1.Group("/payments/:pspReference", csrf, authenticate)
+		{
+			payments.POST("/refunds", authorize(auth.ScopePaymentsRefund), idempotent, s.RefundPayment)
+			payments.POST("/cancels", authorize(auth.ScopePaymentsVoid), idempotent, s.CancelPayment)
+		}
+
+		// Live stream of billing events
+		v1.GET("/events/stream", authenticate, authorize(auth.ScopeEventsRead), s.EventStream)
+
+		// Outbound webhooks for internal services
+		webhooks := v1.Group("/webhooks", csrf, authenticate)
+		{
+			webhooks.GET("", authorize(auth.ScopeWebhooksRead), s.ListWebhookEndpoints)
+			webhooks.POST("", authorize(auth.ScopeWebhooksWrite), idempotent, s.CreateWebhookEndpoint)
+			webhooks.GET("/:id", authorize(auth.ScopeWebhooksRead), s.WebhookEndpointDetail)
+			webhooks.PUT("/:id", authorize(auth.ScopeWebhooksWrite), s.UpdateWebhookEndpoint)
+			webhooks.DELETE("/:id", authorize(auth.ScopeWebhooksWrite), s.DeleteWebhookEndpoint)
+			webhooks.GET("/:id/deliveries", authorize(auth.ScopeWebhooksRead), s.ListWebhookDeliveries)
+			webhooks.POST("/:id/deliveries/:deliveryID/replay", authorize(auth.ScopeWebhooksWrite), idempotent, s.ReplayWebhookDelivery)
+		}
+
+		// API keys for service-to-service access
+		apikeys := v1.Group("/apikeys", csrf, authenticate, authorize(auth.ScopeAPIKeysManage))
+		{
+			apikeys.GET("", s.ListAPIKeys)
+			apikeys.POST("", idempotent, s.CreateAPIKey)
+			apikeys.GET("/:id", s.APIKeyDetail)
+			apikeys.DELETE("/:id", s.RevokeAPIKey)
+		}
+
+		// Audit log of operator and system actions
+		audit := v1.Group("/audit", csrf, authenticate, authorize(auth.ScopeAuditRead))
+		{
+			audit.GET("", s.ListAuditEntries)
+			audit.GET("/verify", s.VerifyAuditLog)
+		}
+
+		// Server administration (maintenance mode is exempt from the maintenance middleware)
+		admin := v1.Group("/admin", csrf, authenticate, authorize(auth.ScopeMaintenance))
+		{
+			admin.GET("/maintenance", s.MaintenanceDetail)
+			admin.PUT("/maintenance", s.UpdateMaintenance)
+		}
+
+		// Adyen notification replay
+		notifications := v1.Group("/notifications", csrf, authenticate, authorize(auth.ScopeNotificationsReplay))
+		{
+			notifications.POST("/replay", idempotent, s.ReplayNotifications)
+		}
 
-		// Adyen JSON webhooks and integration
+		// Adyen JSON webhooks and integration (authenticated by Adyen credentials)
 		adyen := v1.Group("/adyen", s.AdyenWebhookAuth())
 		{
 			adyen.POST("/payments", s.AdyenPaymentsWebhook)
+			adyen.POST("/management", s.AdyenManagementWebhook)
+			adyen.POST("/reports", s.AdyenReportWebhook)
+			adyen.POST("/balance-platform", s.AdyenBalancePlatformWebhook)
+			adyen.POST("/transfers", s.AdyenTransferWebhook)
 		}
 	}
 
@@ -0,0 +1,273 @@
+package exchequer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/webhook"
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/events"
+	"github.com/rotationalio/exchequer/pkg/logger"
+	"github.com/rotationalio/exchequer/pkg/metrics"
+	"github.com/rotationalio/exchequer/pkg/settlement"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rotationalio/exchequer/pkg/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SetReportDownloader replaces the downloader of the settlement detail reports that are
+// reconciled when Adyen notifies that a report is available, e.g. so that reports can be
+// reconciled from local files. Reports are only reconciled if a downloader is set,
+// either by this method or by enabling reconciliation in the configuration.
+func (s *Server) SetReportDownloader(downloader settlement.Downloader) {
+	s.reports = downloader
+}
+
+// Creates the downloader of Adyen reports with the credentials of the report user.
+func newReportDownloader(conf config.AdyenReportsConfig) *settlement.HTTPDownloader {
+	return &settlement.HTTPDownloader{
+		Client: &http.Client{
+			Timeout: conf.Timeout,
+			Transport: otelhttp.NewTransport(
+				logger.TracingTransport(nil),
+				otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+					return "adyen report " + r.Method
+				}),
+			),
+		},
+		APIKey:   conf.APIKey,
+		Username: conf.Username,
+		Password: conf.Password,
+	}
+}
+
+// Reconciles a settlement detail report when Adyen notifies that it is available. The
+// pspReference of a REPORT_AVAILABLE notification is the file name of the report and the
+// reason is the URL to download it from. Adyen expects notifications to be acknowledged
+// within seconds, so the report is downloaded and reconciled in the background unless
+// this is a dry run. Reconciliation does not change any payment records, the
+// discrepancies are recorded in the audit log for finance.
+func (s *Server) handleReportAvailable(ctx context.Context, notification *webhook.NotificationRequestItem, dryRun bool) (_ []*api.Transition, err error) {
+	if s.reports == nil || notification.Success != "true" || !settlement.IsSettlementDetailReport(notification.PspReference) {
+		return nil, nil
+	}
+
+	// The reason is not covered by the HMAC signature of the notification so the report
+	// is only downloaded from Adyen; retrying the notification would not change the URL.
+	if err = validateReportURL(notification.Reason); err != nil {
+		log.Warn().Err(err).Str("report", notification.PspReference).Msg("ignoring settlement report that is not available from adyen")
+		return nil, nil
+	}
+
+	var (
+		report         = notification.PspReference
+		reportURL      = notification.Reason
+		resource       = reportResource(report)
+		discrepancies  *settlement.Reconciliation
+		reconciliation *settlement.Reconciliation
+		transition     *api.Transition
+	)
+
+	if dryRun {
+		if reconciliation, err = s.reconcileReport(ctx, report, reportURL); err != nil {
+			return nil, err
+		}
+		discrepancies = reconciliation.Discrepancies()
+	} else {
+		s.background.Add(1)
+		go func(ctx context.Context) {
+			defer s.background.Done()
+			ctx, cancel := s.detach(ctx)
+			defer cancel()
+			s.recordReconciliation(ctx, report, reportURL)
+		}(ctx)
+	}
+
+	if transition, err = newTransition(resource, AuditSettlementReconcile, nil, discrepancies); err != nil {
+		return nil, err
+	}
+	return []*api.Transition{transition}, nil
+}
+
+// Reconciles the report and records the discrepancies in the audit log. Errors are
+// logged since the notification has already been acknowledged; the report can be
+// reconciled again by replaying its notification.
+func (s *Server) recordReconciliation(ctx context.Context, report, reportURL string) {
+	var (
+		err            error
+		span           trace.Span
+		reconciliation *settlement.Reconciliation
+	)
+
+	ctx, span = tracing.Tracer().Start(ctx, "settlement.reconcile", trace.WithAttributes(
+		attribute.String("settlement.report", report),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "could not reconcile settlement report")
+		}
+		span.End()
+	}()
+
+	if reconciliation, err = s.reconcileReport(ctx, report, reportURL); err != nil {
+		log.Error().Err(err).Str("report", report).Msg("could not reconcile settlement report")
+		return
+	}
+
+	// Only the discrepancies are recorded since finance only needs to act on them
+	if err = s.auditSystem(ctx, actorAdyen, AuditSettlementReconcile, reportResource(report), nil, reconciliation.Discrepancies()); err != nil {
+		log.Error().Err(err).Str("report", report).Msg("could not record settlement report reconciliation")
+		return
+	}
+
+	metrics.SettlementEntries.WithLabelValues(settlement.StatusMatched).Add(float64(reconciliation.Matched))
+	metrics.SettlementEntries.WithLabelValues(settlement.StatusMismatched).Add(float64(reconciliation.Mismatched))
+	metrics.SettlementEntries.WithLabelValues(settlement.StatusMissing).Add(float64(reconciliation.Missing))
+	metrics.SettlementEntries.WithLabelValues(settlement.StatusExtra).Add(float64(reconciliation.Extra))
+
+	msg := log.Info()
+	if !reconciliation.Balanced() {
+		msg = log.Warn()
+	}
+
+	msg.Str("report", reconciliation.Report).
+		Int("lines", len(reconciliation.Entries)).
+		Int("matched", reconciliation.Matched).
+		Int("mismatched", reconciliation.Mismatched).
+		Int("missing", reconciliation.Missing).
+		Int("extra", reconciliation.Extra).
+		Int("skipped", reconciliation.Skipped).
+		Msg("settlement report reconciled")
+}
+
+// Downloads the report and reconciles it against the payment records.
+func (s *Server) reconcileReport(ctx context.Context, report, reportURL string) (_ *settlement.Reconciliation, err error) {
+	var rc io.ReadCloser
+	if rc, err = s.reports.Download(ctx, reportURL); err != nil {
+		return nil, fmt.Errorf("could not download report %q: %w", report, err)
+	}
+	defer rc.Close()
+
+	var lines []*settlement.Line
+	if lines, err = settlement.Parse(rc); err != nil {
+		return nil, fmt.Errorf("could not parse report %q: %w", report, err)
+	}
+
+	var records []*settlement.Record
+	if records, err = s.settlementRecords(); err != nil {
+		return nil, fmt.Errorf("could not load payment records: %w", err)
+	}
+
+	reconciliation := settlement.Reconcile(lines, records, s.conf.Adyen.Reports.SettlementDelay)
+	reconciliation.Report = report
+	return reconciliation, nil
+}
+
+// Collects the payment records that are expected in settlement detail reports from the
+// billing events of the event log: captured payments (or authorised payments that are
+// captured automatically) are settled, refunds are refunded and lost disputes are
+// charged back. Events that are published again by a replayed notification are only
+// collected once. Payments are only made with the configured merchant account so it is
+// the merchant account of every record.
+func (s *Server) settlementRecords() (records []*settlement.Record, err error) {
+	var (
+		seen           = make(map[string]struct{})
+		modified       = make(map[string]struct{})
+		authorisations = make(map[*settlement.Record]struct{})
+	)
+
+	err = s.store.EachEvent(ulid.ULID{}, func(event *store.Event) error {
+		var recordType string
+		switch event.Type {
+		case events.PaymentAuthorised, events.PaymentCaptured:
+			recordType = settlement.TypeSettled
+		case events.PaymentRefunded:
+			recordType = settlement.TypeRefunded
+		case events.DisputeLost:
+			recordType = settlement.TypeChargeback
+		case events.PaymentCancelled:
+		default:
+			return nil
+		}
+
+		payment := &api.PaymentEvent{}
+		if err := json.Unmarshal(event.Data, payment); err != nil {
+			return fmt.Errorf("could not parse data of event %s: %w", event.ID, err)
+		}
+
+		// Authorised payments that are captured or cancelled are not settled themselves
+		if event.Type == events.PaymentCaptured || event.Type == events.PaymentCancelled {
+			modified[payment.OriginalReference] = struct{}{}
+		}
+
+		if recordType == "" {
+			return nil
+		}
+
+		key := event.Type + ":" + payment.PSPReference + ":" + payment.OriginalReference
+		if _, ok := seen[key]; ok {
+			return nil
+		}
+		seen[key] = struct{}{}
+
+		record := &settlement.Record{
+			ID:                event.ID.String(),
+			Type:              recordType,
+			MerchantAccount:   s.conf.Adyen.MerchantAccount,
+			PSPReference:      payment.PSPReference,
+			OriginalReference: payment.OriginalReference,
+			Amount:            payment.Amount,
+			Currency:          payment.Currency,
+			Created:           event.Created,
+		}
+
+		if event.Type == events.PaymentAuthorised {
+			authorisations[record] = struct{}{}
+		}
+
+		records = append(records, record)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	records = slices.DeleteFunc(records, func(record *settlement.Record) bool {
+		if _, ok := authorisations[record]; ok {
+			_, captured := modified[record.PSPReference]
+			return captured
+		}
+		return false
+	})
+	return records, nil
+}
+
+func validateReportURL(reportURL string) error {
+	if reportURL == "" {
+		return errors.New("report is available without a download url")
+	}
+
+	u, err := url.Parse(reportURL)
+	if err != nil {
+		return err
+	}
+	return settlement.ValidateReportURL(u)
+}
+
+func reportResource(name string) string {
+	return "reports/" + name
+}
@@ -0,0 +1,138 @@
+package exchequer_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/webhook"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/settlement"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettlementReconciliation(t *testing.T) {
+	svc, client, _ := newServerWithTokens(t, func(conf *config.Config) {
+		conf.Adyen.Reports.SettlementDelay = time.Minute
+	})
+	ctx := context.Background()
+
+	// Payments recorded by Exchequer from Adyen notifications
+	postWebhook(t, client, exampleWebhookEvent)
+	postWebhook(t, client, notificationPayload(t, webhook.NotificationRequestItem{EventCode: "AUTHORISATION", PspReference: "8515131751004933", Amount: webhook.Amount{Value: 2500, Currency: "EUR"}}))
+	postWebhook(t, client, notificationPayload(t, webhook.NotificationRequestItem{EventCode: "CAPTURE", PspReference: "8815131751004934", OriginalReference: "8515131751004933", Amount: webhook.Amount{Value: 2000, Currency: "EUR"}}))
+	postWebhook(t, client, notificationPayload(t, webhook.NotificationRequestItem{EventCode: "REFUND", PspReference: "8614073381342286", OriginalReference: "7914073381342284", Amount: webhook.Amount{Value: 500, Currency: "EUR"}}))
+	postWebhook(t, client, notificationPayload(t, webhook.NotificationRequestItem{EventCode: "AUTHORISATION", PspReference: "8915131751004950", Amount: webhook.Amount{Value: 990, Currency: "EUR"}}))
+
+	// Write the settlement detail report for the payments to a local directory
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	report := strings.Join([]string{
+		"Merchant Account,Psp Reference,Creation Date,TimeZone,Type,Modification Reference,Gross Currency,Gross Debit (GC),Gross Credit (GC),Net Currency,Net Debit (NC),Net Credit (NC),Batch Number",
+		fmt.Sprintf("TestMerchant,7914073381342284,%s,UTC,Settled,8814073381342285,EUR,,11.30,EUR,,11.18,7", now.Add(-time.Hour).Format(time.DateTime)),
+		fmt.Sprintf("TestMerchant,8515131751004933,%s,UTC,Settled,8815131751004934,EUR,,25.00,EUR,,24.70,7", now.Format(time.DateTime)),
+		fmt.Sprintf("TestMerchant,7914073381342284,%s,UTC,Refunded,8614073381342286,EUR,5.00,,EUR,5.00,,7", now.Format(time.DateTime)),
+		fmt.Sprintf("TestMerchant,9915131751004999,%s,UTC,Chargeback,9925131751004998,EUR,49.99,,EUR,49.99,,7", now.Add(time.Hour).Format(time.DateTime)),
+	}, "\n")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "settlement_detail_report_batch_7.csv"), []byte(report), 0600))
+	svc.SetReportDownloader(settlement.FileDownloader(dir))
+
+	available := webhook.NotificationRequestItem{
+		EventCode:    webhook.EventCodeReportAvailable,
+		PspReference: "settlement_detail_report_batch_7.csv",
+		Reason:       "https://ca-test.adyen.com/reports/download/MerchantAccount/TestMerchant/settlement_detail_report_batch_7.csv",
+	}
+	postWebhook(t, client, notificationPayload(t, available))
+
+	// The report is reconciled in the background and the discrepancies are recorded in
+	// the audit log
+	entries := reconciledReports(t, client, 1)
+	require.Equal(t, "reports/settlement_detail_report_batch_7.csv", entries.Entries[0].Resource)
+
+	reconciliation := &settlement.Reconciliation{}
+	require.NoError(t, json.Unmarshal(entries.Entries[0].After, reconciliation))
+	require.Equal(t, "settlement_detail_report_batch_7.csv", reconciliation.Report)
+	require.Equal(t, 2, reconciliation.Matched)
+	require.Equal(t, 1, reconciliation.Mismatched)
+	require.Equal(t, 1, reconciliation.Missing)
+	require.Equal(t, 1, reconciliation.Extra)
+	require.Len(t, reconciliation.Entries, 3)
+
+	require.Equal(t, settlement.StatusMismatched, reconciliation.Entries[0].Status)
+	require.Equal(t, "8815131751004934", reconciliation.Entries[0].Record.PSPReference)
+	require.Equal(t, settlement.StatusExtra, reconciliation.Entries[1].Status)
+	require.Equal(t, "9915131751004999", reconciliation.Entries[1].Line.PSPReference)
+	require.Equal(t, settlement.StatusMissing, reconciliation.Entries[2].Status)
+	require.Equal(t, "8915131751004950", reconciliation.Entries[2].Record.PSPReference)
+	require.Equal(t, "TestMerchant", reconciliation.Entries[2].Record.MerchantAccount)
+
+	// A dry run replay reconciles the report again without recording it
+	out, err := client.ReplayNotifications(ctx, &api.NotificationReplayRequest{EventCode: webhook.EventCodeReportAvailable, DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, out.Results, 1)
+	require.Len(t, out.Results[0].Transitions, 1)
+	require.Equal(t, "settlement.reconcile", out.Results[0].Transitions[0].Action)
+
+	entries, err = client.ListAuditEntries(ctx, &api.AuditQuery{Action: "settlement.reconcile"})
+	require.NoError(t, err)
+	require.Len(t, entries.Entries, 1)
+
+	// Reports that cannot be downloaded are acknowledged but not reconciled
+	available.PspReference = "settlement_detail_report_batch_8.csv"
+	available.Reason = "https://ca-test.adyen.com/reports/download/MerchantAccount/TestMerchant/settlement_detail_report_batch_8.csv"
+	postWebhook(t, client, notificationPayload(t, available))
+
+	// Reports are only downloaded from Adyen
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "settlement_detail_report_batch_9.csv"), []byte(report), 0600))
+	available.PspReference = "settlement_detail_report_batch_9.csv"
+	available.Reason = "https://example.com/reports/download/MerchantAccount/TestMerchant/settlement_detail_report_batch_9.csv"
+	postWebhook(t, client, notificationPayload(t, available))
+
+	// Other reports are not reconciled
+	available.PspReference = "payments_accounting_report_2026_10_12.csv"
+	available.Reason = "https://ca-test.adyen.com/reports/download/MerchantAccount/TestMerchant/payments_accounting_report_2026_10_12.csv"
+	postWebhook(t, client, notificationPayload(t, available))
+
+	// Replaying the notification of the report reconciles it again
+	_, err = client.ReplayNotifications(ctx, &api.NotificationReplayRequest{PSPReference: "settlement_detail_report_batch_7.csv"})
+	require.NoError(t, err)
+	entries = reconciledReports(t, client, 2)
+	for _, entry := range entries.Entries {
+		require.Equal(t, "reports/settlement_detail_report_batch_7.csv", entry.Resource)
+	}
+}
+
+// Waits for the expected number of settlement reports to be reconciled in the
+// background and returns their audit entries.
+func reconciledReports(t *testing.T, client api.Client, expected int) (entries *api.AuditLog) {
+	require.Eventually(t, func() bool {
+		var err error
+		entries, err = client.ListAuditEntries(context.Background(), &api.AuditQuery{Action: "settlement.reconcile"})
+		require.NoError(t, err)
+		return len(entries.Entries) >= expected
+	}, 5*time.Second, 10*time.Millisecond, "settlement report was not reconciled")
+
+	require.Len(t, entries.Entries, expected)
+	return entries
+}
+
+// Creates a webhook with a single successful notification from the specified fields.
+func notificationPayload(t *testing.T, item webhook.NotificationRequestItem) string {
+	now := time.Now()
+	item.EventDate = &now
+	item.MerchantAccountCode = "TestMerchant"
+	item.Success = "true"
+
+	payload, err := json.Marshal(&webhook.Webhook{
+		Live:              "false",
+		NotificationItems: &[]webhook.NotificationItem{{NotificationRequestItem: item}},
+	})
+	require.NoError(t, err, "could not marshal notification")
+	return string(payload)
+}
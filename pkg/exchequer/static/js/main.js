@@ -0,0 +1,12 @@
+// Returns the double-submit CSRF token set by the server when the page was loaded.
+function csrfToken() {
+  const cookie = document.cookie.split('; ').find((row) => row.startsWith('csrf_token='));
+  return cookie ? decodeURIComponent(cookie.split('=')[1]) : '';
+}
+
+// Wraps fetch to add the X-CSRF-TOKEN header required by state changing API requests.
+function apiFetch(url, options = {}) {
+  const headers = new Headers(options.headers || {});
+  headers.set('X-CSRF-TOKEN', csrfToken());
+  return fetch(url, { credentials: 'same-origin', ...options, headers });
+}
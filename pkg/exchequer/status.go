@@ -2,60 +2,232 @@ package exchequer
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/rotationalio/exchequer/pkg"
 	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/health"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rs/zerolog/log"
 )
 
 const (
 	serverStatusOK          = "ok"
+	serverStatusDegraded    = "degraded"
 	serverStatusNotReady    = "not ready"
 	serverStatusUnhealthy   = "unhealthy"
 	serverStatusMaintenance = "maintenance"
 )
 
-// Status reports the version and uptime of the server
+// Status reports the version and uptime of the server and the health of its
+// dependencies. The server is not ready if a critical dependency is unavailable and is
+// degraded if any other dependency is unhealthy. The status is public but the errors of
+// the health checks are only reported to authenticated callers.
 func (s *Server) Status(c *gin.Context) {
+	report := s.checkHealth(c.Request.Context())
+
 	var state string
 	s.RLock()
 	switch {
-	case s.healthy && s.ready:
-		state = serverStatusOK
-	case s.healthy && !s.ready:
-		state = serverStatusNotReady
 	case !s.healthy:
 		state = serverStatusUnhealthy
+	case !s.ready || !report.Ready():
+		state = serverStatusNotReady
+	case report.Status == health.StatusDegraded:
+		state = serverStatusDegraded
+	default:
+		state = serverStatusOK
 	}
 	s.RUnlock()
 
+	_, err := auth.GetClaims(c)
 	c.JSON(http.StatusOK, &api.StatusReply{
-		Status:  state,
-		Version: pkg.Version(),
-		Uptime:  time.Since(s.started).String(),
+		Status:     state,
+		Version:    pkg.Version(),
+		Uptime:     time.Since(s.started).String(),
+		Components: componentsToAPI(report, err == nil),
 	})
 }
 
 // If the server is in maintenance mode, aborts the current request and renders the
-// maintenance mode page instead. Returns nil if not in maintenance mode.
+// maintenance mode page instead. Maintenance mode is read from the database on every
+// request so that it can be toggled at runtime. Adyen webhooks are still accepted and queued so that
+// Adyen does not mark the endpoint as failing, and the maintenance endpoint is exempt
+// so that operators can turn maintenance mode off again.
 func (s *Server) Maintenance() gin.HandlerFunc {
-	if s.conf.Maintenance {
-		return func(c *gin.Context) {
-			c.Negotiate(http.StatusServiceUnavailable, gin.Negotiate{
-				Offered: []string{binding.MIMEJSON, binding.MIMEHTML},
-				Data: &api.StatusReply{
-					Status:  serverStatusMaintenance,
-					Version: pkg.Version(),
-					Uptime:  time.Since(s.started).String(),
-				},
-				HTMLName: "maintenance.html",
-			})
-			c.Abort()
+	return func(c *gin.Context) {
+		// Requests are served if the mode cannot be read rather than failing every request
+		mode, err := s.MaintenanceMode()
+		if err != nil {
+			c.Error(err)
+			c.Next()
+			return
+		}
+
+		if !mode.Enabled || maintenanceExempt(c.FullPath()) {
+			c.Next()
+			return
+		}
+
+		// Tell clients when to retry if the end of maintenance has been estimated
+		if mode.ETA != nil {
+			if wait := time.Until(*mode.ETA); wait > 0 {
+				c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			}
+		}
+
+		c.Negotiate(http.StatusServiceUnavailable, gin.Negotiate{
+			Offered: []string{binding.MIMEJSON, binding.MIMEHTML},
+			Data: &api.StatusReply{
+				Status:  serverStatusMaintenance,
+				Version: pkg.Version(),
+				Uptime:  time.Since(s.started).String(),
+				Message: mode.Message,
+				ETA:     mode.ETA,
+			},
+			HTMLName: "maintenance.html",
+		})
+		c.Abort()
+	}
+}
+
+// Routes that are served when the server is in maintenance mode.
+var maintenanceExemptRoutes = []string{
+	"/v1/adyen/",
+	"/v1/admin/maintenance",
+	"/static/",
+}
+
+func maintenanceExempt(route string) bool {
+	for _, prefix := range maintenanceExemptRoutes {
+		if strings.HasPrefix(route, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceDetail returns the current maintenance mode of the server.
+func (s *Server) MaintenanceDetail(c *gin.Context) {
+	mode, err := s.MaintenanceMode()
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not retrieve maintenance mode"))
+		return
+	}
+	c.JSON(http.StatusOK, mode)
+}
+
+// UpdateMaintenance turns maintenance mode on or off at runtime. The message and ETA
+// are shown to users on the maintenance page and in status replies. The mode is stored
+// in the database so that it is kept when the server restarts.
+func (s *Server) UpdateMaintenance(c *gin.Context) {
+	var (
+		err    error
+		in     *api.MaintenanceMode
+		before *api.MaintenanceMode
+		after  *api.MaintenanceMode
+	)
+
+	in = &api.MaintenanceMode{}
+	if err = c.ShouldBindJSON(in); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse maintenance mode request"))
+		return
+	}
+
+	if !in.Enabled && (in.Message != "" || in.ETA != nil) {
+		c.JSON(http.StatusBadRequest, api.Error("message and eta can only be set when enabling maintenance mode"))
+		return
+	}
+
+	if len(in.Message) > maxMaintenanceMessage {
+		c.JSON(http.StatusBadRequest, api.Error("maintenance message is too long"))
+		return
+	}
+
+	if in.ETA != nil && !in.ETA.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, api.Error("maintenance eta must be in the future"))
+		return
+	}
+
+	if before, after, err = s.SetMaintenanceMode(in.Enabled, in.Message, in.ETA); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not update maintenance mode"))
+		return
+	}
+
+	s.audit(c, AuditMaintenance, maintenanceResource, before, after)
+	c.JSON(http.StatusOK, after)
+}
+
+const (
+	// The maximum length of the message shown to users during maintenance.
+	maxMaintenanceMessage = 1024
+
+	// The resource recorded in the audit log when maintenance mode is changed.
+	maintenanceResource = "server/maintenance"
+)
+
+// MaintenanceMode returns the current maintenance mode of the server from the database.
+func (s *Server) MaintenanceMode() (*api.MaintenanceMode, error) {
+	mode, err := s.store.RetrieveMaintenanceMode()
+	if err != nil {
+		return nil, err
+	}
+	return maintenanceToAPI(mode), nil
+}
+
+// SetMaintenanceMode turns maintenance mode on or off, returning the previous and the
+// updated mode; the message and ETA are ignored if maintenance mode is turned off. If
+// maintenance mode is already on, the time it started is preserved so that the message
+// or ETA can be updated.
+func (s *Server) SetMaintenanceMode(enabled bool, message string, eta *time.Time) (before, after *api.MaintenanceMode, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var prev *store.MaintenanceMode
+	if prev, err = s.store.RetrieveMaintenanceMode(); err != nil {
+		return nil, nil, err
+	}
+
+	mode := &store.MaintenanceMode{}
+	if enabled {
+		mode.Enabled = true
+		mode.Message = message
+		if eta != nil {
+			utc := eta.UTC()
+			mode.ETA = &utc
 		}
+
+		if prev.Enabled && prev.Since != nil {
+			mode.Since = prev.Since
+		} else {
+			since := time.Now().UTC()
+			mode.Since = &since
+		}
+	}
+
+	if err = s.store.SaveMaintenanceMode(mode); err != nil {
+		return nil, nil, err
+	}
+
+	log.Info().Bool("maintenance", enabled).Str("message", message).Msg("maintenance mode set")
+	return maintenanceToAPI(prev), maintenanceToAPI(mode), nil
+}
+
+func maintenanceToAPI(mode *store.MaintenanceMode) *api.MaintenanceMode {
+	return &api.MaintenanceMode{
+		Enabled: mode.Enabled,
+		Message: mode.Message,
+		ETA:     mode.ETA,
+		Since:   mode.Since,
 	}
-	return nil
 }
 
 // Healthz is used to alert k8s to the health/liveness status of the server.
@@ -72,13 +244,14 @@ func (s *Server) Healthz(c *gin.Context) {
 	c.Data(http.StatusOK, "text/plain", []byte(serverStatusOK))
 }
 
-// Readyz is used to alert k8s to the readiness status of the server.
+// Readyz is used to alert k8s to the readiness status of the server. The server is not
+// ready until it has started serving or if a critical dependency is unavailable.
 func (s *Server) Readyz(c *gin.Context) {
 	s.RLock()
 	ready := s.ready
 	s.RUnlock()
 
-	if !ready {
+	if !ready || !s.checkHealth(c.Request.Context()).Ready() {
 		c.Data(http.StatusServiceUnavailable, "text/plain", []byte(serverStatusNotReady))
 		return
 	}
@@ -0,0 +1,227 @@
+package exchequer_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/exchequer"
+	"github.com/rotationalio/exchequer/pkg/health"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	_, client, tokens := newServerWithTokens(t)
+	ctx := context.Background()
+
+	mode, err := client.MaintenanceMode(ctx)
+	require.NoError(t, err)
+	require.False(t, mode.Enabled)
+
+	// Only admins can change maintenance mode
+	finance := newClientWithRoles(t, client, tokens, auth.RoleFinance)
+	_, err = finance.SetMaintenanceMode(ctx, &api.MaintenanceMode{Enabled: true})
+	require.Equal(t, http.StatusForbidden, api.ErrorStatus(err))
+
+	// Invalid maintenance modes are rejected
+	past := time.Now().Add(-time.Hour)
+	_, err = client.SetMaintenanceMode(ctx, &api.MaintenanceMode{Enabled: true, ETA: &past})
+	require.Equal(t, http.StatusBadRequest, api.ErrorStatus(err))
+
+	_, err = client.SetMaintenanceMode(ctx, &api.MaintenanceMode{Enabled: false, Message: "down"})
+	require.Equal(t, http.StatusBadRequest, api.ErrorStatus(err))
+
+	// Turn maintenance mode on at runtime
+	eta := time.Now().Add(30 * time.Minute).Truncate(time.Second)
+	mode, err = client.SetMaintenanceMode(ctx, &api.MaintenanceMode{Enabled: true, Message: "upgrading the database", ETA: &eta})
+	require.NoError(t, err)
+	require.True(t, mode.Enabled)
+	require.Equal(t, "upgrading the database", mode.Message)
+	require.True(t, eta.Equal(*mode.ETA))
+	require.NotNil(t, mode.Since)
+
+	status, err := client.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "maintenance", status.Status)
+	require.Equal(t, "upgrading the database", status.Message)
+	require.True(t, eta.Equal(*status.ETA))
+
+	// API requests are unavailable during maintenance
+	rep, err := doRequest(ctx, client, http.MethodGet, "/v1/webhooks", nil, nil)
+	require.Equal(t, http.StatusServiceUnavailable, api.ErrorStatus(err))
+	require.NotEmpty(t, rep.Header.Get("Retry-After"))
+
+	// Pages render the maintenance page with the message and ETA
+	req, err := http.NewRequest(http.MethodGet, endpoint(client)+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/html")
+
+	rep, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer rep.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, rep.StatusCode)
+
+	body, err := io.ReadAll(rep.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "Down for Maintenance")
+	require.Contains(t, string(body), "upgrading the database")
+	require.Contains(t, string(body), eta.UTC().Format(time.RFC3339))
+
+	// Adyen webhooks are still accepted during maintenance
+	postWebhook(t, client, exampleWebhookEvent)
+
+	// Updating the message preserves the time maintenance started
+	updated, err := client.SetMaintenanceMode(ctx, &api.MaintenanceMode{Enabled: true, Message: "almost done"})
+	require.NoError(t, err)
+	require.Equal(t, "almost done", updated.Message)
+	require.Nil(t, updated.ETA)
+	require.True(t, mode.Since.Equal(*updated.Since))
+
+	// Turn maintenance mode off
+	mode, err = client.SetMaintenanceMode(ctx, &api.MaintenanceMode{Enabled: false})
+	require.NoError(t, err)
+	require.False(t, mode.Enabled)
+
+	status, err = client.Status(ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, "maintenance", status.Status)
+	require.Empty(t, status.Message)
+
+	_, err = doRequest(ctx, client, http.MethodGet, "/v1/webhooks", nil, nil)
+	require.NoError(t, err)
+
+	// Changes to maintenance mode are audited
+	log, err := client.ListAuditEntries(ctx, &api.AuditQuery{Action: exchequer.AuditMaintenance})
+	require.NoError(t, err)
+	require.Len(t, log.Entries, 3)
+}
+
+func TestMaintenanceModeRestart(t *testing.T) {
+	ctx := context.Background()
+	dsn := "leveldb:///" + filepath.Join(t.TempDir(), "db")
+	database := func(conf *config.Config) {
+		conf.DatabaseURL = dsn
+	}
+
+	srv, client, _ := newServerWithTokens(t, database)
+	mode, err := client.SetMaintenanceMode(ctx, &api.MaintenanceMode{Enabled: true, Message: "upgrading the database"})
+	require.NoError(t, err)
+	require.NoError(t, srv.Shutdown())
+
+	// Maintenance mode set at runtime is kept when the server restarts
+	_, client, _ = newServerWithTokens(t, database)
+
+	restarted, err := client.MaintenanceMode(ctx)
+	require.NoError(t, err)
+	require.True(t, restarted.Enabled)
+	require.Equal(t, "upgrading the database", restarted.Message)
+	require.True(t, mode.Since.Equal(*restarted.Since))
+}
+
+func TestHealthChecks(t *testing.T) {
+	srv, client := newServer(t)
+	srv.SetStatus(true, true)
+	ctx := context.Background()
+
+	// The webhook scheduler is not run by the debug server so the server is degraded
+	status, err := client.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "degraded", status.Status)
+	require.Len(t, status.Components, 3)
+
+	store := status.Component(exchequer.ComponentStore)
+	require.NotNil(t, store)
+	require.Equal(t, health.StatusOK, store.Status)
+	require.True(t, store.Critical)
+	require.Empty(t, store.Error)
+	require.NotEmpty(t, store.Latency)
+
+	scheduler := status.Component(exchequer.ComponentScheduler)
+	require.NotNil(t, scheduler)
+	require.Equal(t, health.StatusDegraded, scheduler.Status)
+	require.False(t, scheduler.Critical)
+	require.Equal(t, exchequer.ErrSchedulerStopped.Error(), scheduler.Error)
+
+	backlog := status.Component(exchequer.ComponentWebhookBacklog)
+	require.NotNil(t, backlog)
+	require.Equal(t, health.StatusOK, backlog.Status)
+	require.Nil(t, status.Component(exchequer.ComponentAdyen), "the adyen probe is not enabled")
+
+	// A degraded server is still ready
+	require.Equal(t, http.StatusOK, readyz(t, client))
+
+	srv.Health().Register(exchequer.ComponentScheduler, false, health.CheckFunc(func(context.Context) error { return nil }))
+	status, err = client.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "ok", status.Status)
+
+	// The server is not ready if a critical dependency is unavailable
+	srv.Health().Register(exchequer.ComponentStore, true, health.CheckFunc(func(context.Context) error {
+		return errors.New("database is corrupted")
+	}))
+
+	status, err = client.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "not ready", status.Status)
+	require.Equal(t, health.StatusUnavailable, status.Component(exchequer.ComponentStore).Status)
+	require.Equal(t, "database is corrupted", status.Component(exchequer.ComponentStore).Error)
+	require.Equal(t, http.StatusServiceUnavailable, readyz(t, client))
+
+	// Errors are not reported to anonymous callers
+	rep, err := http.Get(endpoint(client) + "/v1/status")
+	require.NoError(t, err)
+	defer rep.Body.Close()
+
+	anonymous := &api.StatusReply{}
+	require.NoError(t, json.NewDecoder(rep.Body).Decode(anonymous))
+	require.Equal(t, "not ready", anonymous.Status)
+	require.Equal(t, health.StatusUnavailable, anonymous.Component(exchequer.ComponentStore).Status)
+	require.Empty(t, anonymous.Component(exchequer.ComponentStore).Error)
+
+	// The server is not ready until it is serving regardless of its dependencies
+	srv.Health().Register(exchequer.ComponentStore, true, health.CheckFunc(func(context.Context) error { return nil }))
+	require.Equal(t, http.StatusOK, readyz(t, client))
+
+	srv.SetStatus(true, false)
+	require.Equal(t, http.StatusServiceUnavailable, readyz(t, client))
+}
+
+func TestAdyenHealthCheck(t *testing.T) {
+	srv, client, _ := newServerWithTokens(t, func(conf *config.Config) {
+		conf.Health.AdyenProbe = true
+		conf.Health.AdyenProbeInterval = time.Minute
+	})
+	srv.SetStatus(true, true)
+	srv.Health().Register(exchequer.ComponentScheduler, false, health.CheckFunc(func(context.Context) error { return nil }))
+
+	// The mock does not serve the payment methods of the merchant account
+	srv.SetAdyenClient((&mockRecurringAPI{}).Client())
+
+	// An Adyen outage degrades the server but it is still ready for traffic
+	status, err := client.Status(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "degraded", status.Status)
+
+	adyen := status.Component(exchequer.ComponentAdyen)
+	require.NotNil(t, adyen)
+	require.Equal(t, health.StatusDegraded, adyen.Status)
+	require.False(t, adyen.Critical)
+	require.NotEmpty(t, adyen.Error)
+	require.Equal(t, http.StatusOK, readyz(t, client))
+}
+
+// Returns the status code of the kubernetes readiness probe.
+func readyz(t *testing.T, client api.Client) int {
+	rep, err := http.Get(endpoint(client) + "/readyz")
+	require.NoError(t, err)
+	rep.Body.Close()
+	return rep.StatusCode
+}
@@ -0,0 +1,143 @@
+package exchequer
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/events"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+)
+
+// How often a comment is sent on idle event streams to keep proxies from timing out.
+const streamHeartbeat = 15 * time.Second
+
+// The permission required to stream the events of each category in addition to
+// events:read; stored payment methods and subscriptions belong to customers.
+var eventCategoryScopes = map[string]string{
+	"payment":        auth.ScopePaymentsRead,
+	"dispute":        auth.ScopePaymentsRead,
+	"payment_method": auth.ScopeCustomersRead,
+	"invoice":        auth.ScopeInvoicesRead,
+	"subscription":   auth.ScopeCustomersRead,
+}
+
+// EventStream streams billing events to the caller as server-sent events. Events that
+// were published after the Last-Event-ID are first read from the event log so that
+// clients can resume a stream after a disconnect without missing any events, then new
+// events are streamed as they are published. Only the events of categories that the
+// caller is permitted to read are streamed.
+func (s *Server) EventStream(c *gin.Context) {
+	var (
+		err    error
+		claims *auth.Claims
+		query  *api.EventStreamQuery
+		lastID ulid.ULID
+	)
+
+	if claims, err = auth.GetClaims(c); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusUnauthorized, api.Error("this endpoint requires authentication"))
+		return
+	}
+
+	query = &api.EventStreamQuery{}
+	if err = c.ShouldBindQuery(query); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse event stream query"))
+		return
+	}
+
+	if len(query.Types) == 0 {
+		query.Types = []string{events.WildcardEventType}
+	}
+
+	if err = events.ValidateFilters(query.Types); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+		query.LastEventID = lastEventID
+	}
+
+	if lastID, err = ulids.Parse(query.LastEventID); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error("could not parse last event id"))
+		return
+	}
+
+	// Subscribe before reading the event log so that no events are missed; events that
+	// are received from both the log and the subscription are only sent once.
+	sub := s.events.Subscribe()
+	defer sub.Close()
+
+	// The stream is long-lived so the server's write timeout must not apply to it.
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	send := func(event *store.Event) {
+		if ulids.IsZero(lastID) || event.ID.Compare(lastID) > 0 {
+			lastID = event.ID
+			if events.Match(query.Types, event.Type) && canReadEvent(claims, event.Type) {
+				c.Render(-1, sse.Event{
+					Id:    event.ID.String(),
+					Event: event.Type,
+					Data:  events.APIEvent(event),
+				})
+			}
+		}
+	}
+
+	if !ulids.IsZero(lastID) {
+		err = s.store.EachEvent(lastID, func(event *store.Event) error {
+			send(event)
+			return nil
+		})
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-sub.C:
+			if !ok {
+				// The subscriber could not keep up; the client should reconnect and
+				// resume from the event log using the Last-Event-ID.
+				return
+			}
+			send(event)
+		case <-heartbeat.C:
+			io.WriteString(c.Writer, ": heartbeat\n\n")
+		}
+		c.Writer.Flush()
+	}
+}
+
+// Returns true if the claims grant the permission to read events of the category of
+// the event type; events of unknown categories are never streamed.
+func canReadEvent(claims *auth.Claims, eventType string) bool {
+	category, _, _ := strings.Cut(eventType, ".")
+	scope, ok := eventCategoryScopes[category]
+	return ok && claims.HasPermission(scope)
+}
@@ -0,0 +1,114 @@
+package exchequer_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/adyen/adyen-go-api-library/v11/src/webhook"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/rotationalio/exchequer/pkg/events"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventStream(t *testing.T) {
+	_, client := newServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.EventStream(ctx, &api.EventStreamQuery{Types: []string{"payment.*"}})
+	require.NoError(t, err, "could not open event stream")
+	defer stream.Close()
+
+	// Send the example AUTHORISATION webhook to publish a payment.authorised event
+	postWebhook(t, client, exampleWebhookEvent)
+
+	event, err := stream.Recv()
+	require.NoError(t, err, "could not receive event")
+	require.Equal(t, events.PaymentAuthorised, event.Type)
+	require.Equal(t, event.ID, stream.LastEventID())
+
+	data := &api.PaymentEvent{}
+	require.NoError(t, json.Unmarshal(event.Data, data))
+	require.Equal(t, "7914073381342284", data.PSPReference)
+	require.Equal(t, int64(1130), data.Amount)
+	require.True(t, data.Success)
+	stream.Close()
+
+	// Publish another event while disconnected then resume from the last event ID
+	postWebhook(t, client, notificationPayload(t, webhook.NotificationRequestItem{EventCode: "AUTHORISATION", PspReference: "8515131751004933", Amount: webhook.Amount{Value: 2500, Currency: "EUR"}}))
+
+	stream, err = client.EventStream(ctx, &api.EventStreamQuery{LastEventID: event.ID})
+	require.NoError(t, err, "could not resume event stream")
+	defer stream.Close()
+
+	resumed, err := stream.Recv()
+	require.NoError(t, err, "could not receive resumed event")
+	require.Equal(t, events.PaymentAuthorised, resumed.Type)
+	require.Greater(t, resumed.ID, event.ID)
+
+	// Invalid queries are rejected
+	_, err = client.EventStream(ctx, &api.EventStreamQuery{Types: []string{"invoice.voided"}})
+	require.Equal(t, http.StatusBadRequest, api.ErrorStatus(err))
+
+	_, err = client.EventStream(ctx, &api.EventStreamQuery{LastEventID: "foo"})
+	require.Equal(t, http.StatusBadRequest, api.ErrorStatus(err))
+
+	// Unauthenticated requests cannot stream events
+	req, err := client.(*api.APIv1).NewRequest(ctx, http.MethodGet, "/v1/events/stream", nil, nil)
+	require.NoError(t, err)
+	req.Header.Del("Authorization")
+
+	rep, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer rep.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, rep.StatusCode)
+	require.NotEmpty(t, rep.Header.Get("WWW-Authenticate"))
+}
+
+func TestEventStreamScopes(t *testing.T) {
+	_, client, tokens := newServerWithTokens(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The token can read customers but not payments
+	accessToken, err := tokens.CreateAccessToken(&auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "testing"},
+		Permissions:      []string{auth.ScopeEventsRead, auth.ScopeCustomersRead},
+	})
+	require.NoError(t, err, "could not create access token")
+
+	customers, err := api.New(endpoint(client), api.WithAccessToken(accessToken))
+	require.NoError(t, err, "could not create api client")
+
+	stream, err := customers.EventStream(ctx, &api.EventStreamQuery{})
+	require.NoError(t, err, "could not open event stream")
+	defer stream.Close()
+
+	postWebhook(t, client, exampleWebhookEvent)
+	postWebhook(t, client, notificationPayload(t, webhook.NotificationRequestItem{
+		EventCode:      "RECURRING_CONTRACT",
+		PspReference:   "8315131751004999",
+		PaymentMethod:  "visa",
+		AdditionalData: &map[string]interface{}{"shopperReference": "01JB7Q3ZKDP8S6VH4K9Y0M2C5N"},
+	}))
+
+	// Only the payment method event is streamed since payment events require payments:read
+	event, err := stream.Recv()
+	require.NoError(t, err, "could not receive event")
+	require.Equal(t, events.PaymentMethodStored, event.Type)
+}
+
+func postWebhook(t *testing.T, client api.Client, payload string) {
+	req, err := client.(*api.APIv1).NewRequest(context.Background(), http.MethodPost, "/v1/adyen/payments", json.RawMessage(payload), nil)
+	require.NoError(t, err)
+
+	rep, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer rep.Body.Close()
+	require.Equal(t, http.StatusAccepted, rep.StatusCode)
+}
@@ -0,0 +1,352 @@
+package exchequer
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/events"
+	"github.com/rotationalio/exchequer/pkg/pagination"
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+)
+
+// ListWebhookEndpoints returns a page of the webhook endpoints registered by internal
+// services, ordered by creation.
+func (s *Server) ListWebhookEndpoints(c *gin.Context) {
+	var (
+		err       error
+		query     *api.PageQuery
+		page      *pagination.Page[*api.WebhookEndpoint]
+		endpoints []*store.WebhookEndpoint
+	)
+
+	query = &api.PageQuery{}
+	if err = c.ShouldBindQuery(query); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse page query"))
+		return
+	}
+
+	if page, err = newPage[*api.WebhookEndpoint](s.pages, "webhooks", query, webhookEndpointFilters, query.ListFilter); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	if endpoints, err = s.store.ListWebhookEndpoints(); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not list webhook endpoints"))
+		return
+	}
+
+	for _, endpoint := range endpoints {
+		status := statusActive
+		if !endpoint.Active {
+			status = statusInactive
+		}
+
+		if !matchCreated(&query.ListFilter, endpoint.Created) || !matchStatus(&query.ListFilter, status) {
+			continue
+		}
+
+		if !page.Add(WebhookEndpointToAPI(endpoint, false), pagination.Key{ID: endpoint.ID}) {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, &api.WebhookEndpointList{
+		Endpoints:     page.Items(),
+		NextPageToken: page.NextPageToken(),
+		PrevPageToken: page.PrevPageToken(),
+	})
+}
+
+// CreateWebhookEndpoint registers a new endpoint to receive billing events. A signing
+// secret is generated for the endpoint and is only returned in this response.
+func (s *Server) CreateWebhookEndpoint(c *gin.Context) {
+	var (
+		err      error
+		in       *api.WebhookEndpoint
+		endpoint *store.WebhookEndpoint
+	)
+
+	in = &api.WebhookEndpoint{}
+	if err = c.ShouldBindJSON(in); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse webhook endpoint request"))
+		return
+	}
+
+	if err = validateWebhookEndpoint(in); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	endpoint = &store.WebhookEndpoint{
+		URL:         in.URL,
+		Description: in.Description,
+		EventTypes:  in.EventTypes,
+		Active:      true,
+	}
+
+	if endpoint.Secret, err = events.GenerateSecret(); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not create webhook endpoint"))
+		return
+	}
+
+	if err = s.store.CreateWebhookEndpoint(endpoint); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not create webhook endpoint"))
+		return
+	}
+
+	s.audit(c, AuditWebhookCreate, webhookResource(endpoint.ID), nil, WebhookEndpointToAPI(endpoint, false))
+
+	c.JSON(http.StatusCreated, WebhookEndpointToAPI(endpoint, true))
+}
+
+// WebhookEndpointDetail returns the webhook endpoint without its secret.
+func (s *Server) WebhookEndpointDetail(c *gin.Context) {
+	endpoint, err := s.webhookEndpoint(c)
+	if err != nil {
+		return
+	}
+	c.JSON(http.StatusOK, WebhookEndpointToAPI(endpoint, false))
+}
+
+// UpdateWebhookEndpoint changes the URL, description, event type filters or the active
+// status of the endpoint. Inactive endpoints do not receive new deliveries.
+func (s *Server) UpdateWebhookEndpoint(c *gin.Context) {
+	var (
+		err      error
+		in       *api.WebhookEndpoint
+		endpoint *store.WebhookEndpoint
+	)
+
+	if endpoint, err = s.webhookEndpoint(c); err != nil {
+		return
+	}
+
+	in = &api.WebhookEndpoint{}
+	if err = c.ShouldBindJSON(in); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse webhook endpoint request"))
+		return
+	}
+
+	if in.ID != "" && in.ID != endpoint.ID.String() {
+		c.JSON(http.StatusBadRequest, api.Error("webhook endpoint id does not match url"))
+		return
+	}
+
+	if err = validateWebhookEndpoint(in); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	before := WebhookEndpointToAPI(endpoint, false)
+	endpoint.URL = in.URL
+	endpoint.Description = in.Description
+	endpoint.EventTypes = in.EventTypes
+	endpoint.Active = in.Active
+
+	if err = s.store.UpdateWebhookEndpoint(endpoint); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not update webhook endpoint"))
+		return
+	}
+
+	out := WebhookEndpointToAPI(endpoint, false)
+	s.audit(c, AuditWebhookUpdate, webhookResource(endpoint.ID), before, out)
+	c.JSON(http.StatusOK, out)
+}
+
+// DeleteWebhookEndpoint removes the endpoint; its delivery log is kept for auditing.
+func (s *Server) DeleteWebhookEndpoint(c *gin.Context) {
+	endpoint, err := s.webhookEndpoint(c)
+	if err != nil {
+		return
+	}
+
+	if err = s.store.DeleteWebhookEndpoint(endpoint.ID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not delete webhook endpoint"))
+		return
+	}
+
+	s.audit(c, AuditWebhookDelete, webhookResource(endpoint.ID), WebhookEndpointToAPI(endpoint, false), nil)
+
+	c.JSON(http.StatusOK, api.Reply{Success: true})
+}
+
+// ListWebhookDeliveries returns a page of the delivery log for the webhook endpoint,
+// ordered by creation.
+func (s *Server) ListWebhookDeliveries(c *gin.Context) {
+	var (
+		err        error
+		endpointID ulid.ULID
+		query      *api.PageQuery
+		page       *pagination.Page[*api.WebhookDelivery]
+	)
+
+	if endpointID, err = ulids.Parse(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, api.Error("webhook endpoint not found"))
+		return
+	}
+
+	query = &api.PageQuery{}
+	if err = c.ShouldBindQuery(query); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusBadRequest, api.Error("could not parse page query"))
+		return
+	}
+
+	if page, err = newPage[*api.WebhookDelivery](s.pages, webhookResource(endpointID)+"/deliveries", query, webhookDeliveryFilters, query.ListFilter); err != nil {
+		c.JSON(http.StatusBadRequest, api.Error(err))
+		return
+	}
+
+	err = s.store.EachWebhookDelivery(endpointID, func(delivery *store.WebhookDelivery) error {
+		if !matchCreated(&query.ListFilter, delivery.Created) || !matchStatus(&query.ListFilter, delivery.Status) {
+			return nil
+		}
+
+		if !page.Add(WebhookDeliveryToAPI(delivery), pagination.Key{ID: delivery.ID}) {
+			return errStopIteration
+		}
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, errStopIteration) {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not list webhook deliveries"))
+		return
+	}
+
+	c.JSON(http.StatusOK, &api.WebhookDeliveryList{
+		Deliveries:    page.Items(),
+		NextPageToken: page.NextPageToken(),
+		PrevPageToken: page.PrevPageToken(),
+	})
+}
+
+// ReplayWebhookDelivery immediately re-sends the event to the endpoint and returns the
+// updated delivery, including the outcome of the replay attempt.
+func (s *Server) ReplayWebhookDelivery(c *gin.Context) {
+	var (
+		err                    error
+		endpointID, deliveryID ulid.ULID
+		delivery               *store.WebhookDelivery
+	)
+
+	if endpointID, err = ulids.Parse(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, api.Error("webhook endpoint not found"))
+		return
+	}
+
+	if deliveryID, err = ulids.Parse(c.Param("deliveryID")); err != nil {
+		c.JSON(http.StatusNotFound, api.Error("webhook delivery not found"))
+		return
+	}
+
+	if delivery, err = s.events.Replay(c.Request.Context(), endpointID, deliveryID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, api.Error("webhook delivery not found"))
+			return
+		}
+
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not replay webhook delivery"))
+		return
+	}
+
+	out := WebhookDeliveryToAPI(delivery)
+	s.audit(c, AuditWebhookReplay, webhookResource(endpointID)+"/deliveries/"+deliveryID.String(), nil, out)
+	c.JSON(http.StatusOK, out)
+}
+
+// Looks up the endpoint from the id url parameter, writing an error response if the
+// endpoint cannot be retrieved.
+func (s *Server) webhookEndpoint(c *gin.Context) (endpoint *store.WebhookEndpoint, err error) {
+	var id ulid.ULID
+	if id, err = ulids.Parse(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, api.Error("webhook endpoint not found"))
+		return nil, err
+	}
+
+	if endpoint, err = s.store.RetrieveWebhookEndpoint(id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, api.Error("webhook endpoint not found"))
+			return nil, err
+		}
+
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, api.Error("could not retrieve webhook endpoint"))
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func webhookResource(id ulid.ULID) string {
+	return "webhooks/" + id.String()
+}
+
+func validateWebhookEndpoint(in *api.WebhookEndpoint) error {
+	u, err := url.Parse(in.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook endpoint url must be an absolute http(s) url")
+	}
+	return events.ValidateFilters(in.EventTypes)
+}
+
+// WebhookEndpointToAPI converts a webhook endpoint to its API representation, only
+// including the secret if specified.
+func WebhookEndpointToAPI(endpoint *store.WebhookEndpoint, secret bool) *api.WebhookEndpoint {
+	out := &api.WebhookEndpoint{
+		ID:          endpoint.ID.String(),
+		URL:         endpoint.URL,
+		Description: endpoint.Description,
+		EventTypes:  endpoint.EventTypes,
+		Active:      endpoint.Active,
+		Created:     endpoint.Created,
+		Modified:    endpoint.Modified,
+	}
+
+	if secret {
+		out.Secret = endpoint.Secret
+	}
+	return out
+}
+
+// WebhookDeliveryToAPI converts an entry of the delivery log to its API representation.
+func WebhookDeliveryToAPI(delivery *store.WebhookDelivery) *api.WebhookDelivery {
+	out := &api.WebhookDelivery{
+		ID:         delivery.ID.String(),
+		EndpointID: delivery.EndpointID.String(),
+		EventID:    delivery.EventID.String(),
+		EventType:  delivery.EventType,
+		Status:     delivery.Status,
+		Attempts:   make([]*api.DeliveryAttempt, 0, len(delivery.Attempts)),
+		Created:    delivery.Created,
+		Modified:   delivery.Modified,
+	}
+
+	if !delivery.NextAttempt.IsZero() {
+		out.NextAttempt = &delivery.NextAttempt
+	}
+
+	for _, attempt := range delivery.Attempts {
+		out.Attempts = append(out.Attempts, &api.DeliveryAttempt{
+			Attempted:  attempt.Attempted,
+			Duration:   attempt.Duration.String(),
+			StatusCode: attempt.StatusCode,
+			Error:      attempt.Error,
+			Replay:     attempt.Replay,
+		})
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package exchequer_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookEndpoints(t *testing.T) {
+	_, client, tokens := newServerWithTokens(t)
+	ctx := context.Background()
+
+	// Invalid endpoints are rejected
+	_, err := client.CreateWebhookEndpoint(ctx, &api.WebhookEndpoint{URL: "https://example.com/hook"})
+	require.ErrorIs(t, err, api.ErrBadRequest)
+
+	// The signing secret is only returned when the endpoint is created
+	created, err := client.CreateWebhookEndpoint(ctx, &api.WebhookEndpoint{URL: "https://example.com/hook", EventTypes: []string{"payment.*"}})
+	require.NoError(t, err, "could not create webhook endpoint")
+	require.NotEmpty(t, created.ID)
+	require.NotEmpty(t, created.Secret)
+	require.True(t, created.Active)
+
+	_, err = client.CreateWebhookEndpoint(ctx, &api.WebhookEndpoint{URL: "https://example.com/refunds", EventTypes: []string{"payment.refunded"}})
+	require.NoError(t, err, "could not create webhook endpoint")
+
+	detail, err := client.WebhookEndpointDetail(ctx, created.ID)
+	require.NoError(t, err)
+	require.Equal(t, created.URL, detail.URL)
+	require.Empty(t, detail.Secret)
+
+	list, err := client.ListWebhookEndpoints(ctx, &api.PageQuery{PageSize: 10})
+	require.NoError(t, err)
+	require.Len(t, list.Endpoints, 2)
+
+	endpoints, err := client.WebhookEndpoints(ctx, nil).All()
+	require.NoError(t, err)
+	require.Len(t, endpoints, 2)
+
+	detail.Description = "billing events"
+	updated, err := client.UpdateWebhookEndpoint(ctx, detail)
+	require.NoError(t, err, "could not update webhook endpoint")
+	require.Equal(t, "billing events", updated.Description)
+
+	// No events have been delivered to the endpoint
+	deliveries, err := client.WebhookDeliveries(ctx, created.ID, nil).All()
+	require.NoError(t, err)
+	require.Empty(t, deliveries)
+
+	_, err = client.ReplayWebhookDelivery(ctx, created.ID, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+	require.ErrorIs(t, err, api.ErrNotFound)
+
+	// Viewers can list but cannot manage webhook endpoints
+	viewer := newClientWithRoles(t, client, tokens, auth.RoleViewer)
+	_, err = viewer.ListWebhookEndpoints(ctx, nil)
+	require.NoError(t, err)
+
+	err = viewer.DeleteWebhookEndpoint(ctx, created.ID)
+	require.ErrorIs(t, err, api.ErrForbidden)
+
+	// Deleted endpoints are no longer found
+	require.NoError(t, client.DeleteWebhookEndpoint(ctx, created.ID))
+	_, err = client.WebhookEndpointDetail(ctx, created.ID)
+	require.ErrorIs(t, err, api.ErrNotFound)
+
+	// Requests without an ID are not sent to the server
+	_, err = client.UpdateWebhookEndpoint(ctx, &api.WebhookEndpoint{URL: "https://example.com/hook"})
+	require.ErrorIs(t, err, api.ErrMissingID)
+
+	_, err = client.ListWebhookDeliveries(ctx, "", nil)
+	require.ErrorIs(t, err, api.ErrMissingID)
+}
@@ -0,0 +1,196 @@
+/*
+Package health provides a registry of checks of the dependencies of the server (e.g.
+the database, the webhook queue, and the Adyen API) that are aggregated to determine if
+the server is ready to receive traffic. Critical checks make the server unavailable if
+they fail; non-critical checks only degrade it so that it keeps receiving traffic.
+*/
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Status of a component or of the server as a whole.
+const (
+	StatusOK          = "ok"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+)
+
+var ErrTimeout = errors.New("health check timed out")
+
+// Checker checks the health of a component, returning an error if it is unhealthy.
+// Checks should respect the deadline of the context.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckFunc allows a function to be used as a Checker.
+type CheckFunc func(ctx context.Context) error
+
+func (f CheckFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Registry runs the registered checks concurrently and aggregates their results.
+type Registry struct {
+	sync.RWMutex
+	timeout time.Duration
+	checks  []*check
+}
+
+type check struct {
+	name     string
+	critical bool
+	checker  Checker
+}
+
+// Result of a single health check.
+type Result struct {
+	Name     string
+	Status   string
+	Critical bool
+	Error    error
+	Latency  time.Duration
+	Checked  time.Time
+}
+
+// Report aggregates the results of all of the registered checks in the order that
+// they were registered.
+type Report struct {
+	Status     string
+	Components []*Result
+}
+
+// NewRegistry creates an empty registry; if the timeout is positive every run of the
+// checks must complete within it or the checks that have not completed fail.
+func NewRegistry(timeout time.Duration) *Registry {
+	return &Registry{timeout: timeout, checks: make([]*check, 0, 4)}
+}
+
+// Register a check of the named component, replacing any check already registered with
+// the same name. If a critical check fails the server is unavailable, otherwise it is
+// only degraded.
+func (r *Registry) Register(name string, critical bool, checker Checker) {
+	r.Lock()
+	defer r.Unlock()
+
+	c := &check{name: name, critical: critical, checker: checker}
+	for i, existing := range r.checks {
+		if existing.name == name {
+			r.checks[i] = c
+			return
+		}
+	}
+	r.checks = append(r.checks, c)
+}
+
+// Check runs all of the registered checks concurrently and reports their results.
+func (r *Registry) Check(ctx context.Context) *Report {
+	r.RLock()
+	checks := make([]*check, len(r.checks))
+	copy(checks, r.checks)
+	r.RUnlock()
+
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	report := &Report{Status: StatusOK, Components: make([]*Result, len(checks))}
+
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			report.Components[i] = c.run(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, result := range report.Components {
+		switch {
+		case result.Status == StatusOK:
+		case result.Critical:
+			report.Status = StatusUnavailable
+		case report.Status == StatusOK:
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+// Ready returns true unless a critical check failed.
+func (r *Report) Ready() bool {
+	return r.Status != StatusUnavailable
+}
+
+// Runs the check, returning early if the context is done before the check returns so
+// that a check that does not respect the deadline cannot block the report.
+func (c *check) run(ctx context.Context) *Result {
+	result := &Result{Name: c.name, Critical: c.critical, Checked: time.Now()}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.checker.Check(ctx)
+	}()
+
+	select {
+	case result.Error = <-errc:
+	case <-ctx.Done():
+		result.Error = ErrTimeout
+	}
+
+	result.Latency = time.Since(result.Checked)
+	switch {
+	case result.Error == nil:
+		result.Status = StatusOK
+	case c.critical:
+		result.Status = StatusUnavailable
+	default:
+		result.Status = StatusDegraded
+	}
+	return result
+}
+
+//===========================================================================
+// Cached Checks
+//===========================================================================
+
+// Cached wraps a check that is expensive or rate limited (e.g. a request to an external
+// API) so that its result is reused until the ttl expires. Failures caused by the
+// caller's context being done are not cached.
+func Cached(checker Checker, ttl time.Duration) Checker {
+	return &cached{checker: checker, ttl: ttl}
+}
+
+type cached struct {
+	sync.Mutex
+	checker Checker
+	ttl     time.Duration
+	err     error
+	expires time.Time
+}
+
+func (c *cached) Check(ctx context.Context) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if time.Now().Before(c.expires) {
+		return c.err
+	}
+
+	err := c.checker.Check(ctx)
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+
+	c.err = err
+	c.expires = time.Now().Add(c.ttl)
+	return err
+}
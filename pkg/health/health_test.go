@@ -0,0 +1,84 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/health"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	ok      = health.CheckFunc(func(context.Context) error { return nil })
+	failing = health.CheckFunc(func(context.Context) error { return errors.New("unreachable") })
+	hanging = health.CheckFunc(func(context.Context) error { select {} })
+)
+
+func TestRegistry(t *testing.T) {
+	registry := health.NewRegistry(50 * time.Millisecond)
+	report := registry.Check(context.Background())
+	require.Equal(t, health.StatusOK, report.Status, "an empty registry should be ok")
+	require.Empty(t, report.Components)
+
+	registry.Register("store", true, ok)
+	registry.Register("backlog", false, ok)
+
+	report = registry.Check(context.Background())
+	require.Equal(t, health.StatusOK, report.Status)
+	require.True(t, report.Ready())
+	require.Len(t, report.Components, 2)
+	require.Equal(t, "store", report.Components[0].Name)
+	require.Equal(t, "backlog", report.Components[1].Name)
+
+	// A failing non-critical check degrades the server but it is still ready
+	registry.Register("backlog", false, failing)
+	report = registry.Check(context.Background())
+	require.Equal(t, health.StatusDegraded, report.Status)
+	require.True(t, report.Ready())
+	require.Len(t, report.Components, 2, "registering a check with the same name should replace it")
+	require.Equal(t, health.StatusOK, report.Components[0].Status)
+	require.Equal(t, health.StatusDegraded, report.Components[1].Status)
+	require.EqualError(t, report.Components[1].Error, "unreachable")
+
+	// A failing critical check makes the server unavailable
+	registry.Register("store", true, hanging)
+	report = registry.Check(context.Background())
+	require.Equal(t, health.StatusUnavailable, report.Status)
+	require.False(t, report.Ready())
+	require.Equal(t, health.StatusUnavailable, report.Components[0].Status)
+	require.ErrorIs(t, report.Components[0].Error, health.ErrTimeout)
+}
+
+func TestCached(t *testing.T) {
+	var calls atomic.Int32
+	var fail atomic.Bool
+	checker := health.Cached(health.CheckFunc(func(ctx context.Context) error {
+		calls.Add(1)
+		if fail.Load() {
+			return errors.New("api key revoked")
+		}
+		return ctx.Err()
+	}), 50*time.Millisecond)
+
+	require.NoError(t, checker.Check(context.Background()))
+	fail.Store(true)
+	require.NoError(t, checker.Check(context.Background()), "expected cached result")
+	require.Equal(t, int32(1), calls.Load())
+
+	time.Sleep(60 * time.Millisecond)
+	require.Error(t, checker.Check(context.Background()))
+	fail.Store(false)
+	require.Error(t, checker.Check(context.Background()), "expected cached failure")
+	require.Equal(t, int32(2), calls.Load())
+
+	// Failures caused by the caller's context are not cached
+	time.Sleep(60 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, checker.Check(ctx))
+	require.NoError(t, checker.Check(context.Background()))
+	require.Equal(t, int32(4), calls.Load())
+}
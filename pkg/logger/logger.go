@@ -12,9 +12,12 @@ const (
 	GCPInfoLevel     severityGCP = "INFO"
 	GCPDebugLevel    severityGCP = "DEBUG"
 
-	GCPFieldKeySeverity = "severity"
-	GCPFieldKeyMsg      = "message"
-	GCPFieldKeyTime     = "time"
+	GCPFieldKeySeverity     = "severity"
+	GCPFieldKeyMsg          = "message"
+	GCPFieldKeyTime         = "time"
+	GCPFieldKeyTrace        = "logging.googleapis.com/trace"
+	GCPFieldKeySpanID       = "logging.googleapis.com/spanId"
+	GCPFieldKeyTraceSampled = "logging.googleapis.com/trace_sampled"
 )
 
 var (
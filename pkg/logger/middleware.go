@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/rotationalio/exchequer/pkg"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
 	"github.com/rotationalio/exchequer/pkg/metrics"
 	"github.com/rotationalio/exchequer/pkg/ulids"
 
@@ -33,17 +34,35 @@ func GinLogger(server string) gin.HandlerFunc {
 			path = path + "?" + c.Request.URL.RawQuery
 		}
 
-		// Create a request ID for tracing purposes and add to context
+		// Use the request ID or trace context of the inbound request so that requests
+		// can be correlated across services, otherwise create a new request ID for
+		// tracing purposes. The request ID is added to the context and echoed back.
 		// HACK: this creates a shallow copy of the request, which might cause issues?
-		requestID := ulid.MustNew(ulid.Now(), entropy).String()
-		c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), requestID))
+		ctx := c.Request.Context()
+		traceparent := c.GetHeader(api.TraceparentHeader)
+		traceID, traced := ParseTraceparent(traceparent)
+		if traced {
+			ctx = api.ContextWithTraceparent(ctx, traceparent)
+		}
+
+		requestID := c.GetHeader(api.RequestIDHeader)
+		switch {
+		case ValidRequestID(requestID):
+		case traced:
+			requestID = traceID
+		default:
+			requestID = ulid.MustNew(ulid.Now(), entropy).String()
+		}
+
+		c.Request = c.Request.WithContext(WithRequestID(ctx, requestID))
+		c.Header(api.RequestIDHeader, requestID)
 
 		// Handle the request
 		c.Next()
 
 		// After request
 		status := c.Writer.Status()
-		logctx := log.With().
+		logctx := WithTrace(c.Request.Context(), log.With().
 			Str("path", path).
 			Str("ser_name", server).
 			Str("version", version).
@@ -52,7 +71,7 @@ func GinLogger(server string) gin.HandlerFunc {
 			Int("resp_bytes", c.Writer.Size()).
 			Int("status", status).
 			Str("client_ip", c.ClientIP()).
-			Str("request_id", requestID).
+			Str("request_id", requestID)).
 			Logger()
 
 		// Log any errors that were added to the context
@@ -85,8 +104,27 @@ func GinLogger(server string) gin.HandlerFunc {
 		}
 
 		// prometheus metrics - log request duration and type
+		// NOTE: the route template is used rather than the request path to bound the
+		// cardinality of the metrics; requests that do not match a route are grouped.
+		route := c.FullPath()
+		if route == "" {
+			route = metrics.UnmatchedRoute
+		}
+
+		method := methodLabel(c.Request.Method)
 		duration := time.Since(started)
-		metrics.RequestDuration.WithLabelValues(server, http.StatusText(status), path).Observe(duration.Seconds())
-		metrics.RequestsHandled.WithLabelValues(server, http.StatusText(status), path).Inc()
+		metrics.RequestDuration.WithLabelValues(server, method, http.StatusText(status), route).Observe(duration.Seconds())
+		metrics.RequestsHandled.WithLabelValues(server, method, http.StatusText(status), route).Inc()
+	}
+}
+
+// Returns the method label of the request metrics; non-standard methods are grouped.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return metrics.OtherMethod
 	}
 }
@@ -0,0 +1,59 @@
+package logger_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rotationalio/exchequer/pkg/logger"
+	"github.com/rotationalio/exchequer/pkg/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGinLoggerMetrics(t *testing.T) {
+	logger.Discard()
+	t.Cleanup(logger.ResetLogger)
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(logger.GinLogger("metrics"))
+	router.GET("/items/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.DELETE("/items/:id", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	// Requests are labeled by the route template rather than the path and query
+	for _, path := range []string{"/items/1", "/items/2?expand=true", "/items/foo"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/items/1", nil))
+
+	// Requests that do not match a route are grouped together
+	for _, path := range []string{"/wp-admin.php", "/.env", "/items/1/foo"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// Requests with non-standard methods are grouped together
+	for _, method := range []string{"PROPFIND", "FOO", "get"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/items/1", nil))
+	}
+
+	testCases := []struct {
+		method   string
+		code     int
+		path     string
+		expected float64
+	}{
+		{http.MethodGet, http.StatusOK, "/items/:id", 3},
+		{http.MethodDelete, http.StatusNoContent, "/items/:id", 1},
+		{http.MethodGet, http.StatusNotFound, metrics.UnmatchedRoute, 3},
+		{http.MethodGet, http.StatusOK, "/items/1", 0},
+		{metrics.OtherMethod, http.StatusNotFound, metrics.UnmatchedRoute, 3},
+		{"PROPFIND", http.StatusNotFound, metrics.UnmatchedRoute, 0},
+	}
+
+	for i, tc := range testCases {
+		handled := metrics.RequestsHandled.WithLabelValues("metrics", tc.method, http.StatusText(tc.code), tc.path)
+		require.Equal(t, tc.expected, testutil.ToFloat64(handled), "test case %d failed", i)
+	}
+}
@@ -2,37 +2,151 @@ package logger
 
 import (
 	"context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync/atomic"
 
+	"github.com/rotationalio/exchequer/pkg/api/v1"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type contextKey uint8
+// The maximum length of a request ID accepted from an inbound request.
+const maxRequestIDLength = 128
 
-const (
-	KeyUnknown contextKey = iota
-	KeyRequestID
-)
+// The google cloud project used to format trace IDs so that logs can be correlated
+// with traces in cloud logging.
+var gcpProject atomic.Value
+
+// SetGCPProject sets the google cloud project of the traces that are logged.
+func SetGCPProject(project string) {
+	gcpProject.Store(project)
+}
 
 func Tracing(ctx context.Context) zerolog.Logger {
 	requestID, _ := RequestID(ctx)
-	return log.With().Str("request_id", requestID).Logger()
+	return WithTrace(ctx, log.With().Str("request_id", requestID)).Logger()
+}
+
+// WithTrace adds the trace and span IDs of the span in the context to the logging
+// context in the GCP structured logging format so that log entries can be correlated
+// with traces. The logging context is unmodified if there is no valid span.
+func WithTrace(ctx context.Context, logctx zerolog.Context) zerolog.Context {
+	span := trace.SpanContextFromContext(ctx)
+	if !span.IsValid() {
+		return logctx
+	}
+
+	traceID := span.TraceID().String()
+	if project, _ := gcpProject.Load().(string); project != "" {
+		traceID = "projects/" + project + "/traces/" + traceID
+	}
+
+	return logctx.
+		Str(GCPFieldKeyTrace, traceID).
+		Str(GCPFieldKeySpanID, span.SpanID().String()).
+		Bool(GCPFieldKeyTraceSampled, span.IsSampled())
 }
 
+// WithRequestID adds the request ID to the context. The API context key is used so that
+// requests made by the API client with the context carry the same request ID.
 func WithRequestID(parent context.Context, requestID string) context.Context {
-	return context.WithValue(parent, KeyRequestID, requestID)
+	return api.ContextWithRequestID(parent, requestID)
 }
 
 func RequestID(ctx context.Context) (string, bool) {
-	requestID, ok := ctx.Value(KeyRequestID).(string)
-	return requestID, ok
+	return api.RequestIDFromContext(ctx)
+}
+
+// ValidRequestID returns true if a request ID received from another service can be
+// used to trace the request. Request IDs are limited to 128 characters of letters,
+// digits, and the punctuation used by common ID formats so that they can be safely
+// logged and echoed in response headers.
+func ValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range requestID {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTraceparent parses a W3C trace context traceparent header, returning the hex
+// encoded trace ID if the header is valid. The all zeros trace and parent IDs are
+// invalid, as is version ff. Future versions may append fields to the header so only
+// the length of version 00 headers is strictly checked.
+func ParseTraceparent(traceparent string) (traceID string, ok bool) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 {
+		return "", false
+	}
+
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return "", false
+	}
+
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return "", false
+	}
+
+	if !isLowerHex(parentID, 16) || parentID == strings.Repeat("0", 16) {
+		return "", false
+	}
+
+	if !isLowerHex(flags, 2) {
+		return "", false
+	}
+	return traceID, true
+}
+
+func isLowerHex(s string, length int) bool {
+	if len(s) != length || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
 }
 
-var contextKeyNames = []string{"unknown", "requestID"}
+// TracingTransport wraps an http.RoundTripper to propagate the request ID and trace
+// context of the inbound request to outbound requests made with its context, e.g. so
+// that calls to Adyen can be correlated with the request that caused them.
+func TracingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &tracingTransport{base: base}
+}
+
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	requestID, _ := RequestID(req.Context())
+	traceparent, _ := api.TraceparentFromContext(req.Context())
+	if requestID == "" && traceparent == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the original request
+	req = req.Clone(req.Context())
+	if requestID != "" {
+		req.Header.Set(api.RequestIDHeader, requestID)
+	}
 
-func (c contextKey) String() string {
-	if int(c) < len(contextKeyNames) {
-		return contextKeyNames[c]
+	// Do not replace trace context that was injected by an instrumented client
+	if traceparent != "" && req.Header.Get(api.TraceparentHeader) == "" {
+		req.Header.Set(api.TraceparentHeader, traceparent)
 	}
-	return contextKeyNames[0]
+	return t.base.RoundTrip(req)
 }
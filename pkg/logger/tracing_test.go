@@ -1,13 +1,23 @@
 package logger_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/rotationalio/exchequer/pkg/api/v1"
 	"github.com/rotationalio/exchequer/pkg/logger"
 	"github.com/rotationalio/exchequer/pkg/ulids"
 
+	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestRequestIDContext(t *testing.T) {
@@ -22,3 +32,196 @@ func TestRequestIDContext(t *testing.T) {
 	cancel()
 	require.ErrorIs(t, ctx.Err(), context.Canceled)
 }
+
+func TestRequestIDInteroperability(t *testing.T) {
+	// The request ID set by the logger is sent by the API client and vice versa
+	ctx := logger.WithRequestID(context.Background(), "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+	requestID, ok := api.RequestIDFromContext(ctx)
+	require.True(t, ok)
+	require.Equal(t, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M", requestID)
+
+	ctx = api.ContextWithRequestID(context.Background(), "01J9ZJ5A7WQ3G5M5QZ7E1V4B2N")
+	requestID, ok = logger.RequestID(ctx)
+	require.True(t, ok)
+	require.Equal(t, "01J9ZJ5A7WQ3G5M5QZ7E1V4B2N", requestID)
+}
+
+func TestValidRequestID(t *testing.T) {
+	testCases := []struct {
+		requestID string
+		valid     bool
+	}{
+		{"", false},
+		{"01J9ZJ4HQKX3GTEPJ6N0HFSW3M", true},
+		{"7a1d6a3c-2f0b-4e57-9d41-25d7b0a7e8c1", true},
+		{"frontend:request_42.1", true},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+		{"request id", false},
+		{"request\nid", false},
+		{"request<id>", false},
+	}
+
+	for i, tc := range testCases {
+		require.Equal(t, tc.valid, logger.ValidRequestID(tc.requestID), "test case %d failed", i)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	testCases := []struct {
+		traceparent string
+		traceID     string
+		valid       bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz", "", false},
+	}
+
+	for i, tc := range testCases {
+		traceID, ok := logger.ParseTraceparent(tc.traceparent)
+		require.Equal(t, tc.valid, ok, "test case %d failed", i)
+		require.Equal(t, tc.traceID, traceID, "test case %d failed", i)
+	}
+}
+
+func TestGinLoggerRequestID(t *testing.T) {
+	logger.Discard()
+	t.Cleanup(logger.ResetLogger)
+	gin.SetMode(gin.TestMode)
+
+	var (
+		requestID   string
+		traceparent string
+	)
+
+	router := gin.New()
+	router.Use(logger.GinLogger("test"))
+	router.GET("/", func(c *gin.Context) {
+		requestID, _ = logger.RequestID(c.Request.Context())
+		traceparent, _ = api.TraceparentFromContext(c.Request.Context())
+		c.Status(http.StatusNoContent)
+	})
+
+	testCases := []struct {
+		requestID   string
+		traceparent string
+		expected    string
+		traced      bool
+	}{
+		{"", "", "", false},
+		{"01J9ZJ4HQKX3GTEPJ6N0HFSW3M", "", "01J9ZJ4HQKX3GTEPJ6N0HFSW3M", false},
+		{"not a valid id", "", "", false},
+		{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"01J9ZJ4HQKX3GTEPJ6N0HFSW3M", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "01J9ZJ4HQKX3GTEPJ6N0HFSW3M", true},
+		{"", "00-invalid-traceparent-01", "", false},
+	}
+
+	for i, tc := range testCases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.requestID != "" {
+			req.Header.Set(api.RequestIDHeader, tc.requestID)
+		}
+		if tc.traceparent != "" {
+			req.Header.Set(api.TraceparentHeader, tc.traceparent)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, requestID, w.Header().Get(api.RequestIDHeader), "test case %d failed", i)
+
+		if tc.expected != "" {
+			require.Equal(t, tc.expected, requestID, "test case %d failed", i)
+		} else {
+			// A new ULID request ID is generated
+			_, err := ulid.Parse(requestID)
+			require.NoError(t, err, "test case %d failed", i)
+		}
+
+		if tc.traced {
+			require.Equal(t, tc.traceparent, traceparent, "test case %d failed", i)
+		} else {
+			require.Empty(t, traceparent, "test case %d failed", i)
+		}
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	var headers http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: logger.TracingTransport(nil)}
+
+	// Requests without a request ID on the context are unchanged
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+
+	rep, err := client.Do(req)
+	require.NoError(t, err)
+	rep.Body.Close()
+	require.Empty(t, headers.Get(api.RequestIDHeader))
+	require.Empty(t, headers.Get(api.TraceparentHeader))
+
+	// The request ID and trace context are propagated from the context
+	ctx := logger.WithRequestID(context.Background(), "01J9ZJ4HQKX3GTEPJ6N0HFSW3M")
+	ctx = api.ContextWithTraceparent(ctx, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+
+	rep, err = client.Do(req)
+	require.NoError(t, err)
+	rep.Body.Close()
+	require.Equal(t, "01J9ZJ4HQKX3GTEPJ6N0HFSW3M", headers.Get(api.RequestIDHeader))
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", headers.Get(api.TraceparentHeader))
+	require.Empty(t, req.Header.Get(api.RequestIDHeader), "original request should not be modified")
+}
+
+func TestWithTrace(t *testing.T) {
+	t.Cleanup(func() { logger.SetGCPProject("") })
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	var buf bytes.Buffer
+	record := func(ctx context.Context) map[string]interface{} {
+		buf.Reset()
+		log := logger.WithTrace(ctx, zerolog.New(&buf).With()).Logger()
+		log.Info().Msg("testing")
+
+		fields := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+		return fields
+	}
+
+	// No trace fields are logged without a span
+	fields := record(context.Background())
+	require.NotContains(t, fields, logger.GCPFieldKeyTrace)
+
+	fields = record(ctx)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", fields[logger.GCPFieldKeyTrace])
+	require.Equal(t, "00f067aa0ba902b7", fields[logger.GCPFieldKeySpanID])
+	require.Equal(t, true, fields[logger.GCPFieldKeyTraceSampled])
+
+	// The trace is formatted with the google cloud project if configured
+	logger.SetGCPProject("rotational-billing")
+	fields = record(ctx)
+	require.Equal(t, "projects/rotational-billing/traces/4bf92f3577b34da6a3ce929d0e0e4736", fields[logger.GCPFieldKeyTrace])
+}
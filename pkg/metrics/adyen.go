@@ -0,0 +1,73 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// Adyen webhook notifications received, by event code and success
+	NotificationsReceived *prometheus.CounterVec
+
+	// Adyen management, report, balance platform and transfer webhooks received, by
+	// webhook family and type
+	PlatformWebhooksReceived *prometheus.CounterVec
+
+	// Adyen webhook notifications rejected because the HMAC signature could not be verified
+	HMACFailures prometheus.Counter
+
+	// Lines of settlement detail reports and payment records reconciled, by status
+	SettlementEntries *prometheus.CounterVec
+
+	// Adyen API request duration (latency) by operation
+	AdyenRequestDuration *prometheus.HistogramVec
+
+	// Adyen API requests that failed, by operation and http status code
+	AdyenErrors *prometheus.CounterVec
+)
+
+func initAdyenCollectors() (collectors []prometheus.Collector, err error) {
+	collectors = make([]prometheus.Collector, 0, 6)
+
+	NotificationsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NamespaceAdyenMetrics,
+		Name:      "notifications_received",
+		Help:      "total verified webhook notifications received from adyen, disaggregated by event code and success",
+	}, []string{"event_code", "success"})
+	collectors = append(collectors, NotificationsReceived)
+
+	PlatformWebhooksReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NamespaceAdyenMetrics,
+		Name:      "platform_webhooks_received",
+		Help:      "total verified management, report, balance platform and transfer webhooks received from adyen, disaggregated by family and type",
+	}, []string{"family", "type"})
+	collectors = append(collectors, PlatformWebhooksReceived)
+
+	HMACFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NamespaceAdyenMetrics,
+		Name:      "hmac_failures",
+		Help:      "total webhook notifications rejected because their hmac signature could not be verified",
+	})
+	collectors = append(collectors, HMACFailures)
+
+	SettlementEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NamespaceAdyenMetrics,
+		Name:      "settlement_entries",
+		Help:      "total settlement report lines and payment records reconciled, disaggregated by status (matched, mismatched, missing or extra)",
+	}, []string{"status"})
+	collectors = append(collectors, SettlementEntries)
+
+	AdyenRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NamespaceAdyenMetrics,
+		Name:      "request_duration",
+		Help:      "duration of requests to the adyen api in seconds, disaggregated by operation",
+		Buckets:   LatencyBuckets,
+	}, []string{"operation"})
+	collectors = append(collectors, AdyenRequestDuration)
+
+	AdyenErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NamespaceAdyenMetrics,
+		Name:      "request_errors",
+		Help:      "total failed requests to the adyen api, disaggregated by operation and http status code (or error if there was no response)",
+	}, []string{"operation", "code"})
+	collectors = append(collectors, AdyenErrors)
+
+	return collectors, nil
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Payment operations used to label payment amounts.
+const (
+	PaymentAuthorised = "authorised"
+	PaymentCaptured   = "captured"
+	PaymentRefunded   = "refunded"
+)
+
+var (
+	// Checkout sessions created with adyen
+	CheckoutSessionsCreated prometheus.Counter
+
+	// Checkout sessions completed with a successful authorisation
+	CheckoutSessionsCompleted prometheus.Counter
+
+	// Payment amounts in minor units by payment operation and currency
+	PaymentAmounts *prometheus.CounterVec
+
+	// Actions that could not be recorded in the audit log by action
+	AuditFailures *prometheus.CounterVec
+)
+
+func initBillingCollectors() (collectors []prometheus.Collector, err error) {
+	collectors = make([]prometheus.Collector, 0, 4)
+
+	CheckoutSessionsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NamespaceBillingMetrics,
+		Name:      "checkout_sessions_created",
+		Help:      "total checkout sessions created with adyen",
+	})
+	collectors = append(collectors, CheckoutSessionsCreated)
+
+	CheckoutSessionsCompleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NamespaceBillingMetrics,
+		Name:      "checkout_sessions_completed",
+		Help:      "total checkout sessions completed with a successful authorisation",
+	})
+	collectors = append(collectors, CheckoutSessionsCompleted)
+
+	PaymentAmounts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NamespaceBillingMetrics,
+		Name:      "payment_amount",
+		Help:      "total payment amounts in minor units of the currency, disaggregated by operation (authorised, captured, refunded) and currency",
+	}, []string{"operation", "currency"})
+	collectors = append(collectors, PaymentAmounts)
+
+	AuditFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NamespaceBillingMetrics,
+		Name:      "audit_failures",
+		Help:      "total actions that could not be recorded in the audit log, disaggregated by action",
+	}, []string{"action"})
+	collectors = append(collectors, AuditFailures)
+
+	return collectors, nil
+}
@@ -2,6 +2,20 @@ package metrics
 
 import "github.com/prometheus/client_golang/prometheus"
 
+// The path label of requests that do not match a route, e.g. 404s from bots scanning
+// for vulnerabilities, so that they do not create a new time series for every path.
+const UnmatchedRoute = "unmatched"
+
+// The method label of requests with a non-standard HTTP method so that arbitrary method
+// tokens sent by clients do not create a new time series for every method.
+const OtherMethod = "OTHER"
+
+// Latency buckets in seconds for HTTP requests and Adyen API calls. Most requests (and
+// webhooks from Adyen, which must be acknowledged quickly) are handled in milliseconds,
+// while requests that call the Adyen API such as checkout sessions and refunds take
+// hundreds of milliseconds to seconds, up to the server's 20 second write timeout.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2.5, 5, 10, 20}
+
 var (
 	// Total HTTP requests handled by the server
 	RequestsHandled *prometheus.CounterVec
@@ -16,15 +30,16 @@ func initHTTPCollectors() (collectors []prometheus.Collector, err error) {
 	RequestsHandled = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: NamespaceHTTPMetrics,
 		Name:      "requests_handled",
-		Help:      "total requests handled, disaggregated by service, http status code, and path",
-	}, []string{"service", "code", "path"})
+		Help:      "total requests handled, disaggregated by service, http method, http status code, and route",
+	}, []string{"service", "method", "code", "path"})
 	collectors = append(collectors, RequestsHandled)
 
 	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: NamespaceHTTPMetrics,
 		Name:      "request_duration",
-		Help:      "duration of requests, disaggregated by service, http status code, and path",
-	}, []string{"service", "code", "path"})
+		Help:      "duration of requests in seconds, disaggregated by service, http method, http status code, and route",
+		Buckets:   LatencyBuckets,
+	}, []string{"service", "method", "code", "path"})
 	collectors = append(collectors, RequestDuration)
 
 	return collectors, nil
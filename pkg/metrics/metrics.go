@@ -11,8 +11,10 @@ import (
 )
 
 const (
-	NamespaceHTTPMetrics = "http_stats"
-	NamespaceGRPCMetrics = "grpc_stats"
+	NamespaceHTTPMetrics    = "http_stats"
+	NamespaceAdyenMetrics   = "adyen_stats"
+	NamespaceBillingMetrics = "billing_stats"
+	NamespaceWebhookMetrics = "webhook_stats"
 )
 
 var (
@@ -35,7 +37,7 @@ func Routes(router *gin.Engine) {
 func initCollectors() (err error) {
 	// Track all collectors to register at the end of the function.
 	// When adding new collectors make sure to increase the capacity.
-	collectors := make([]prometheus.Collector, 0, 8)
+	collectors := make([]prometheus.Collector, 0, 12)
 
 	var httpCollectors []prometheus.Collector
 	if httpCollectors, err = initHTTPCollectors(); err != nil {
@@ -43,6 +45,24 @@ func initCollectors() (err error) {
 	}
 	collectors = append(collectors, httpCollectors...)
 
+	var adyenCollectors []prometheus.Collector
+	if adyenCollectors, err = initAdyenCollectors(); err != nil {
+		return err
+	}
+	collectors = append(collectors, adyenCollectors...)
+
+	var billingCollectors []prometheus.Collector
+	if billingCollectors, err = initBillingCollectors(); err != nil {
+		return err
+	}
+	collectors = append(collectors, billingCollectors...)
+
+	var webhookCollectors []prometheus.Collector
+	if webhookCollectors, err = initWebhookCollectors(); err != nil {
+		return err
+	}
+	collectors = append(collectors, webhookCollectors...)
+
 	// Register the collectors
 	registerCollectors(collectors)
 	return nil
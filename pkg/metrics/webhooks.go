@@ -0,0 +1,41 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	// Webhook deliveries to internal services waiting to be attempted, by state
+	WebhookQueueDepth *prometheus.GaugeVec
+
+	// Webhook delivery retries scheduled after a failed attempt
+	WebhookRetries prometheus.Counter
+
+	// Webhook deliveries that have completed, by outcome
+	WebhookDeliveries *prometheus.CounterVec
+)
+
+func initWebhookCollectors() (collectors []prometheus.Collector, err error) {
+	collectors = make([]prometheus.Collector, 0, 3)
+
+	WebhookQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: NamespaceWebhookMetrics,
+		Name:      "queue_depth",
+		Help:      "number of webhook deliveries waiting to be attempted, disaggregated by state (scheduled or queued)",
+	}, []string{"state"})
+	collectors = append(collectors, WebhookQueueDepth)
+
+	WebhookRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NamespaceWebhookMetrics,
+		Name:      "retries",
+		Help:      "total webhook delivery retries scheduled after a failed delivery attempt",
+	})
+	collectors = append(collectors, WebhookRetries)
+
+	WebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NamespaceWebhookMetrics,
+		Name:      "deliveries",
+		Help:      "total webhook deliveries that have completed, disaggregated by outcome (succeeded or failed)",
+	}, []string{"outcome"})
+	collectors = append(collectors, WebhookDeliveries)
+
+	return collectors, nil
+}
@@ -0,0 +1,283 @@
+/*
+Package pagination pages through the results of list endpoints using opaque cursors.
+A cursor records the position of the first or last item of a page by its sort key and
+ULID, along with the list that issued it and a hash of the filters of the query, so that
+a page token can only be used to page through the list it was issued for. Cursors are
+signed so that they cannot be forged or modified by clients and are encoded as page
+tokens. Because the
+position is recorded rather than an offset, pages are stable when records are inserted
+or deleted while a client is paging through a list.
+*/
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+)
+
+var (
+	ErrInvalidToken    = errors.New("invalid page token")
+	ErrListMismatch    = errors.New("page token was issued for a different list")
+	ErrFilterMismatch  = errors.New("page token cannot be used with different filters")
+	ErrMultipleTokens  = errors.New("specify either a next or a previous page token, not both")
+	ErrInvalidPageSize = errors.New("page size cannot be negative")
+	ErrNoSecret        = errors.New("a secret is required to sign page tokens")
+)
+
+// Length of the signature appended to page tokens.
+const sigLength = 16
+
+// Paginator signs and verifies page tokens and limits the size of pages.
+type Paginator struct {
+	secret      []byte
+	defaultSize int
+	maxSize     int
+}
+
+// New creates a paginator that signs page tokens with the secret. Queries that do not
+// specify a page size get the default page size; larger page sizes are reduced to max.
+func New(secret []byte, defaultSize, maxSize int) (*Paginator, error) {
+	if len(secret) == 0 {
+		return nil, ErrNoSecret
+	}
+
+	if defaultSize < 1 || maxSize < defaultSize {
+		return nil, errors.New("invalid page sizes: the default page size must be at least 1 and cannot exceed the max page size")
+	}
+	return &Paginator{secret: secret, defaultSize: defaultSize, maxSize: maxSize}, nil
+}
+
+// PageSize returns the size of the page for the requested page size.
+func (p *Paginator) PageSize(requested int) (int, error) {
+	switch {
+	case requested < 0:
+		return 0, ErrInvalidPageSize
+	case requested == 0:
+		return p.defaultSize, nil
+	case requested > p.maxSize:
+		return p.maxSize, nil
+	default:
+		return requested, nil
+	}
+}
+
+//===========================================================================
+// Cursors
+//===========================================================================
+
+// Key is the position of an item in a list. Lists are ordered by sort key and then by
+// ID; lists that are ordered by ID (e.g. by creation) can leave the sort key empty and
+// lists of items without a ULID can leave the ID zero if their sort keys are unique.
+type Key struct {
+	ID      ulid.ULID
+	SortKey string
+}
+
+// Compare returns -1 if the key is before the other key, 0 if they are the same
+// position, and +1 if the key is after the other key.
+func (k Key) Compare(o Key) int {
+	if c := strings.Compare(k.SortKey, o.SortKey); c != 0 {
+		return c
+	}
+	return k.ID.Compare(o.ID)
+}
+
+// Cursor is the decoded contents of a page token. Next page cursors point to the last
+// item of the previous page and previous page cursors point to the first item of the
+// next page; the page is made up of the items strictly after or before the cursor. The
+// list identifies the list that issued the cursor (see NewPage).
+type Cursor struct {
+	Key
+	List   string
+	Filter string
+	Prev   bool
+}
+
+type cursor struct {
+	ID      ulid.ULID `json:"i"`
+	SortKey string    `json:"k,omitempty"`
+	List    string    `json:"l,omitempty"`
+	Filter  string    `json:"f,omitempty"`
+	Prev    bool      `json:"p,omitempty"`
+}
+
+// Encode the cursor as a signed, url safe page token.
+func (p *Paginator) Encode(c *Cursor) string {
+	data, _ := json.Marshal(cursor{ID: c.ID, SortKey: c.SortKey, List: c.List, Filter: c.Filter, Prev: c.Prev})
+	return base64.RawURLEncoding.EncodeToString(append(data, p.sign(data)...))
+}
+
+// Decode a page token, verifying its signature.
+func (p *Paginator) Decode(token string) (_ *Cursor, err error) {
+	var data []byte
+	if data, err = base64.RawURLEncoding.DecodeString(token); err != nil || len(data) <= sigLength {
+		return nil, ErrInvalidToken
+	}
+
+	data, sig := data[:len(data)-sigLength], data[len(data)-sigLength:]
+	if !hmac.Equal(sig, p.sign(data)) {
+		return nil, ErrInvalidToken
+	}
+
+	c := cursor{}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, ErrInvalidToken
+	}
+	return &Cursor{Key: Key{ID: c.ID, SortKey: c.SortKey}, List: c.List, Filter: c.Filter, Prev: c.Prev}, nil
+}
+
+func (p *Paginator) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(data)
+	return mac.Sum(nil)[:sigLength]
+}
+
+// FilterHash returns a short hash of the filters of a query so that page tokens can only
+// be used with the filters that they were created with. The filter must be serializable
+// as JSON; a nil filter has an empty hash.
+func FilterHash(filter any) string {
+	if filter == nil {
+		return ""
+	}
+
+	data, err := json.Marshal(filter)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+//===========================================================================
+// Pages
+//===========================================================================
+
+// Page collects the items of a single page of a list. Items are added in list order
+// until Add returns false; the page then provides the tokens of the adjacent pages.
+type Page[T any] struct {
+	paginator *Paginator
+	size      int
+	list      string
+	filter    string
+	cursor    *Cursor
+	items     []T
+	keys      []Key
+	before    bool
+	after     bool
+}
+
+// NewPage creates the page described by the query. The list identifies the list that is
+// being paged through, including the resource that it belongs to if it is nested (e.g.
+// "webhooks/{id}/deliveries"), so that page tokens of one list cannot be used with
+// another. The filter describes the filters of the query (see FilterHash) and must be
+// the same for every page of a list.
+func NewPage[T any](p *Paginator, list string, query *api.PageQuery, filter any) (page *Page[T], err error) {
+	page = &Page[T]{paginator: p, list: list, filter: FilterHash(filter)}
+	if query == nil {
+		query = &api.PageQuery{}
+	}
+
+	if page.size, err = p.PageSize(query.PageSize); err != nil {
+		return nil, err
+	}
+
+	var token string
+	switch {
+	case query.NextPageToken != "" && query.PrevPageToken != "":
+		return nil, ErrMultipleTokens
+	case query.NextPageToken != "":
+		token = query.NextPageToken
+	case query.PrevPageToken != "":
+		token = query.PrevPageToken
+	}
+
+	if token != "" {
+		if page.cursor, err = p.Decode(token); err != nil {
+			return nil, err
+		}
+
+		if page.cursor.Prev != (query.PrevPageToken != "") {
+			return nil, ErrInvalidToken
+		}
+
+		if page.cursor.List != page.list {
+			return nil, ErrListMismatch
+		}
+
+		if page.cursor.Filter != page.filter {
+			return nil, ErrFilterMismatch
+		}
+	}
+
+	page.items = make([]T, 0, page.size)
+	page.keys = make([]Key, 0, page.size)
+	return page, nil
+}
+
+// Add offers the next item of the list to the page. Items must be added in list order
+// and only if they match the filters of the query. Returns false when the page is
+// complete and no more items need to be added.
+func (p *Page[T]) Add(item T, key Key) bool {
+	// Previous pages are the items before the cursor; keep a sliding window of them
+	if p.cursor != nil && p.cursor.Prev {
+		if key.Compare(p.cursor.Key) >= 0 {
+			p.after = true
+			return false
+		}
+
+		if len(p.items) == p.size {
+			p.items, p.keys = p.items[1:], p.keys[1:]
+			p.before = true
+		}
+
+		p.items = append(p.items, item)
+		p.keys = append(p.keys, key)
+		return true
+	}
+
+	// Next pages are the items after the cursor
+	if p.cursor != nil && key.Compare(p.cursor.Key) <= 0 {
+		p.before = true
+		return true
+	}
+
+	if len(p.items) == p.size {
+		p.after = true
+		return false
+	}
+
+	p.items = append(p.items, item)
+	p.keys = append(p.keys, key)
+	return true
+}
+
+// Items returns the items of the page.
+func (p *Page[T]) Items() []T {
+	return p.items
+}
+
+// NextPageToken returns the token of the next page or an empty string if this is the
+// last page of the list.
+func (p *Page[T]) NextPageToken() string {
+	if !p.after || len(p.keys) == 0 {
+		return ""
+	}
+	return p.paginator.Encode(&Cursor{Key: p.keys[len(p.keys)-1], List: p.list, Filter: p.filter})
+}
+
+// PrevPageToken returns the token of the previous page or an empty string if this is
+// the first page of the list.
+func (p *Page[T]) PrevPageToken() string {
+	if !p.before || len(p.keys) == 0 {
+		return ""
+	}
+	return p.paginator.Encode(&Cursor{Key: p.keys[0], List: p.list, Filter: p.filter, Prev: true})
+}
@@ -0,0 +1,175 @@
+package pagination_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/api/v1"
+	"github.com/rotationalio/exchequer/pkg/pagination"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+	"github.com/stretchr/testify/require"
+)
+
+var secret = []byte("supersecretsquirrel")
+
+func TestNew(t *testing.T) {
+	_, err := pagination.New(nil, 10, 100)
+	require.ErrorIs(t, err, pagination.ErrNoSecret)
+
+	_, err = pagination.New(secret, 0, 100)
+	require.Error(t, err)
+
+	_, err = pagination.New(secret, 100, 10)
+	require.Error(t, err)
+
+	paginator, err := pagination.New(secret, 10, 100)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		requested int
+		expected  int
+		err       error
+	}{
+		{0, 10, nil},
+		{1, 1, nil},
+		{50, 50, nil},
+		{100, 100, nil},
+		{1000, 100, nil},
+		{-1, 0, pagination.ErrInvalidPageSize},
+	}
+
+	for i, tc := range testCases {
+		size, err := paginator.PageSize(tc.requested)
+		require.ErrorIs(t, err, tc.err, "test case %d failed", i)
+		require.Equal(t, tc.expected, size, "test case %d failed", i)
+	}
+}
+
+func TestCursors(t *testing.T) {
+	paginator, err := pagination.New(secret, 10, 100)
+	require.NoError(t, err)
+
+	cursor := &pagination.Cursor{
+		Key:    pagination.Key{ID: ulids.New(), SortKey: "00000000000000000042"},
+		List:   "webhooks",
+		Filter: pagination.FilterHash(&api.ListFilter{Status: "active"}),
+		Prev:   true,
+	}
+
+	token := paginator.Encode(cursor)
+	decoded, err := paginator.Decode(token)
+	require.NoError(t, err)
+	require.Equal(t, cursor, decoded)
+
+	// Tokens that have been modified cannot be decoded
+	tampered := []byte(token)
+	tampered[4] ^= 0x01
+	_, err = paginator.Decode(string(tampered))
+	require.ErrorIs(t, err, pagination.ErrInvalidToken)
+
+	// Tokens signed with another secret cannot be decoded
+	other, err := pagination.New([]byte("anothersecret"), 10, 100)
+	require.NoError(t, err)
+	_, err = other.Decode(token)
+	require.ErrorIs(t, err, pagination.ErrInvalidToken)
+
+	for i, token := range []string{"", "foo", "!!!!", token[:12]} {
+		_, err = paginator.Decode(token)
+		require.ErrorIs(t, err, pagination.ErrInvalidToken, "test case %d failed", i)
+	}
+}
+
+func TestFilterHash(t *testing.T) {
+	require.Empty(t, pagination.FilterHash(nil))
+	require.Equal(t, pagination.FilterHash(api.ListFilter{}), pagination.FilterHash(api.ListFilter{}))
+	require.NotEqual(t, pagination.FilterHash(api.ListFilter{}), pagination.FilterHash(api.ListFilter{Status: "active"}))
+}
+
+func TestPages(t *testing.T) {
+	paginator, err := pagination.New(secret, 10, 100)
+	require.NoError(t, err)
+
+	items := make([]ulid.ULID, 25)
+	for i := range items {
+		items[i] = ulids.New()
+	}
+
+	// Page forward through the list
+	pages := collect(t, paginator, items, &api.PageQuery{PageSize: 10}, nil)
+	require.Len(t, pages, 3)
+	require.Equal(t, items[:10], pages[0].Items())
+	require.Equal(t, items[10:20], pages[1].Items())
+	require.Equal(t, items[20:], pages[2].Items())
+
+	require.Empty(t, pages[0].PrevPageToken())
+	require.NotEmpty(t, pages[0].NextPageToken())
+	require.NotEmpty(t, pages[1].PrevPageToken())
+	require.NotEmpty(t, pages[1].NextPageToken())
+	require.NotEmpty(t, pages[2].PrevPageToken())
+	require.Empty(t, pages[2].NextPageToken())
+
+	// Page backward from the last page
+	prev := page(t, paginator, items, &api.PageQuery{PageSize: 10, PrevPageToken: pages[2].PrevPageToken()}, nil)
+	require.Equal(t, items[10:20], prev.Items())
+	require.Equal(t, pages[1].NextPageToken(), prev.NextPageToken())
+
+	prev = page(t, paginator, items, &api.PageQuery{PageSize: 10, PrevPageToken: prev.PrevPageToken()}, nil)
+	require.Equal(t, items[:10], prev.Items())
+	require.Empty(t, prev.PrevPageToken())
+	require.NotEmpty(t, prev.NextPageToken())
+
+	// Pages are stable when items are inserted before the cursor
+	inserted := slices.Concat([]ulid.ULID{{}}, items)
+	next := page(t, paginator, inserted, &api.PageQuery{PageSize: 10, NextPageToken: pages[0].NextPageToken()}, nil)
+	require.Equal(t, items[10:20], next.Items())
+
+	// Page tokens cannot be used with other filters
+	_, err = pagination.NewPage[ulid.ULID](paginator, "items", &api.PageQuery{NextPageToken: pages[0].NextPageToken()}, &api.ListFilter{Status: "active"})
+	require.ErrorIs(t, err, pagination.ErrFilterMismatch)
+
+	// Page tokens cannot be used with other lists
+	_, err = pagination.NewPage[ulid.ULID](paginator, "others", &api.PageQuery{NextPageToken: pages[0].NextPageToken()}, nil)
+	require.ErrorIs(t, err, pagination.ErrListMismatch)
+
+	// Next page tokens cannot be used as previous page tokens
+	_, err = pagination.NewPage[ulid.ULID](paginator, "items", &api.PageQuery{PrevPageToken: pages[0].NextPageToken()}, nil)
+	require.ErrorIs(t, err, pagination.ErrInvalidToken)
+
+	_, err = pagination.NewPage[ulid.ULID](paginator, "items", &api.PageQuery{NextPageToken: pages[0].NextPageToken(), PrevPageToken: pages[1].PrevPageToken()}, nil)
+	require.ErrorIs(t, err, pagination.ErrMultipleTokens)
+
+	// The page size is limited to the max page size
+	all := page(t, paginator, slices.Concat(items, items, items, items, items), &api.PageQuery{PageSize: 1000}, nil)
+	require.Len(t, all.Items(), 100)
+
+	// An empty list has a single empty page
+	empty := page(t, paginator, nil, nil, nil)
+	require.Empty(t, empty.Items())
+	require.Empty(t, empty.NextPageToken())
+	require.Empty(t, empty.PrevPageToken())
+}
+
+// Follows the next page tokens from the query to the end of the list.
+func collect(t *testing.T, paginator *pagination.Paginator, items []ulid.ULID, query *api.PageQuery, filter any) (pages []*pagination.Page[ulid.ULID]) {
+	for {
+		current := page(t, paginator, items, query, filter)
+		pages = append(pages, current)
+
+		if query.NextPageToken = current.NextPageToken(); query.NextPageToken == "" {
+			return pages
+		}
+	}
+}
+
+func page(t *testing.T, paginator *pagination.Paginator, items []ulid.ULID, query *api.PageQuery, filter any) *pagination.Page[ulid.ULID] {
+	page, err := pagination.NewPage[ulid.ULID](paginator, "items", query, filter)
+	require.NoError(t, err)
+
+	for _, item := range items {
+		if !page.Add(item, pagination.Key{ID: item}) {
+			break
+		}
+	}
+	return page
+}
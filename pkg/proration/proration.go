@@ -0,0 +1,249 @@
+/*
+Package proration computes the credits and charges that result from a customer changing
+their subscription plan part way through a billing cycle. Amounts are prorated to the
+second and are always expressed in the minor units of the currency (e.g. cents) so that
+they can be passed directly to Adyen without conversion.
+*/
+package proration
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownBehavior  = errors.New("unknown proration behavior")
+	ErrInvalidPeriod    = errors.New("billing period end must be after the period start")
+	ErrChangeOutOfRange = errors.New("plan change must occur within the billing period")
+	ErrCurrencyMismatch = errors.New("cannot prorate between plans with different currencies")
+	ErrNegativeAmount   = errors.New("plan amount cannot be negative")
+)
+
+//===========================================================================
+// Proration Behavior
+//===========================================================================
+
+// Behavior determines how prorations are handled when a plan changes mid-cycle.
+type Behavior uint8
+
+const (
+	// CreateProrations computes the proration line items so that they can be added to
+	// the next invoice for the subscription.
+	CreateProrations Behavior = iota
+
+	// AlwaysInvoice computes the proration line items and indicates that they should
+	// be invoiced immediately rather than waiting for the end of the billing cycle.
+	AlwaysInvoice
+
+	// None disables prorations; the new plan is charged at the start of the next cycle.
+	None
+)
+
+var behaviorNames = [3]string{"create_prorations", "always_invoice", "none"}
+
+// ParseBehavior parses a behavior from its string representation (case-insensitive).
+// An empty string is parsed as the default CreateProrations behavior.
+func ParseBehavior(s string) (Behavior, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(strings.ToLower(s)), "-", "_")
+	if s == "" {
+		return CreateProrations, nil
+	}
+
+	for i, name := range behaviorNames {
+		if s == name {
+			return Behavior(i), nil
+		}
+	}
+	return None, fmt.Errorf("%w %q", ErrUnknownBehavior, s)
+}
+
+func (b Behavior) String() string {
+	if int(b) < len(behaviorNames) {
+		return behaviorNames[b]
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler for JSON and form serialization.
+func (b Behavior) MarshalText() ([]byte, error) {
+	if int(b) >= len(behaviorNames) {
+		return nil, ErrUnknownBehavior
+	}
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler for JSON and form serialization.
+func (b *Behavior) UnmarshalText(text []byte) (err error) {
+	*b, err = ParseBehavior(string(text))
+	return err
+}
+
+//===========================================================================
+// Proration Calculation
+//===========================================================================
+
+// Plan describes the price of a subscription plan for a single billing period.
+type Plan struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// Change describes a customer switching from one plan to another during the billing
+// period [PeriodStart, PeriodEnd). The period is assumed to have already been paid for
+// at the price of the From plan.
+type Change struct {
+	From        Plan      `json:"from"`
+	To          Plan      `json:"to"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	ChangedAt   time.Time `json:"changed_at"`
+	Behavior    Behavior  `json:"behavior"`
+}
+
+// LineItem is a single invoice line produced by a proration. Credits for unused time
+// have a negative amount and charges for remaining time have a positive amount. The
+// Description is suitable for display on an invoice and the Calculation shows exactly
+// how the amount was derived so that ops can verify it without re-doing the math.
+type LineItem struct {
+	PlanID        string    `json:"plan_id"`
+	Description   string    `json:"description"`
+	Calculation   string    `json:"calculation"`
+	Amount        int64     `json:"amount"`
+	Currency      string    `json:"currency"`
+	PeriodStart   time.Time `json:"period_start"`
+	PeriodEnd     time.Time `json:"period_end"`
+	Seconds       int64     `json:"seconds"`
+	PeriodSeconds int64     `json:"period_seconds"`
+}
+
+// Result contains the line items produced by a proration along with the net total. If
+// Invoice is true the line items should be billed immediately, otherwise they should
+// be added to the next invoice for the subscription.
+type Result struct {
+	Behavior Behavior   `json:"behavior"`
+	Items    []LineItem `json:"items"`
+	Total    int64      `json:"total"`
+	Currency string     `json:"currency"`
+	Invoice  bool       `json:"invoice"`
+}
+
+// Calculate the proration for the specified plan change. Time is truncated to the
+// second and amounts are rounded half away from zero to the nearest minor unit, so the
+// credit and the charge are each individually rounded before the total is computed.
+func Calculate(change Change) (_ *Result, err error) {
+	if err = change.Validate(); err != nil {
+		return nil, err
+	}
+
+	out := &Result{
+		Behavior: change.Behavior,
+		Currency: change.To.Currency,
+		Invoice:  change.Behavior == AlwaysInvoice,
+	}
+
+	if change.Behavior == None {
+		out.Items = make([]LineItem, 0)
+		return out, nil
+	}
+
+	start := change.PeriodStart.Truncate(time.Second)
+	end := change.PeriodEnd.Truncate(time.Second)
+	changed := change.ChangedAt.Truncate(time.Second)
+
+	period := int64(end.Sub(start) / time.Second)
+	remaining := int64(end.Sub(changed) / time.Second)
+
+	out.Items = []LineItem{
+		prorate(change.From, -1, remaining, period, changed, end),
+		prorate(change.To, 1, remaining, period, changed, end),
+	}
+
+	for _, item := range out.Items {
+		out.Total += item.Amount
+	}
+	return out, nil
+}
+
+func prorate(plan Plan, sign, remaining, period int64, start, end time.Time) LineItem {
+	item := LineItem{
+		PlanID:        plan.ID,
+		Amount:        sign * divRound(plan.Amount, remaining, period),
+		Currency:      plan.Currency,
+		PeriodStart:   start,
+		PeriodEnd:     end,
+		Seconds:       remaining,
+		PeriodSeconds: period,
+	}
+
+	name := plan.Name
+	if name == "" {
+		name = plan.ID
+	}
+
+	span := fmt.Sprintf("%s to %s", start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	if sign < 0 {
+		item.Description = fmt.Sprintf("Unused time on %s from %s", name, span)
+	} else {
+		item.Description = fmt.Sprintf("Remaining time on %s from %s", name, span)
+	}
+
+	item.Calculation = fmt.Sprintf(
+		"%d %s × %d of %d seconds = %d %s",
+		sign*plan.Amount, plan.Currency, remaining, period, item.Amount, plan.Currency,
+	)
+	return item
+}
+
+// Computes amount * num / den rounded half away from zero. Uses big integers to avoid
+// overflow when large amounts are multiplied by long periods in seconds.
+func divRound(amount, num, den int64) int64 {
+	if den == 0 {
+		return 0
+	}
+
+	n := new(big.Int).Mul(big.NewInt(amount), big.NewInt(num))
+	d := big.NewInt(den)
+
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if r.Sign() != 0 {
+		// Round half away from zero: compare 2*|r| against |d|
+		r2 := new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2))
+		if r2.Cmp(new(big.Int).Abs(d)) >= 0 {
+			if n.Sign() < 0 {
+				q.Sub(q, big.NewInt(1))
+			} else {
+				q.Add(q, big.NewInt(1))
+			}
+		}
+	}
+	return q.Int64()
+}
+
+// Validate the change is computable before calculating the proration.
+func (c Change) Validate() error {
+	if int(c.Behavior) >= len(behaviorNames) {
+		return ErrUnknownBehavior
+	}
+
+	if !c.PeriodEnd.Truncate(time.Second).After(c.PeriodStart.Truncate(time.Second)) {
+		return ErrInvalidPeriod
+	}
+
+	if c.ChangedAt.Before(c.PeriodStart) || c.ChangedAt.After(c.PeriodEnd) {
+		return ErrChangeOutOfRange
+	}
+
+	if !strings.EqualFold(c.From.Currency, c.To.Currency) {
+		return ErrCurrencyMismatch
+	}
+
+	if c.From.Amount < 0 || c.To.Amount < 0 {
+		return ErrNegativeAmount
+	}
+	return nil
+}
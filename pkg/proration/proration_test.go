@@ -0,0 +1,143 @@
+package proration_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/proration"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	basic = proration.Plan{ID: "basic", Name: "Basic", Amount: 1000, Currency: "USD"}
+	pro   = proration.Plan{ID: "pro", Name: "Pro", Amount: 3000, Currency: "USD"}
+	start = time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	end   = time.Date(2026, 10, 31, 0, 0, 0, 0, time.UTC)
+)
+
+func TestCalculate(t *testing.T) {
+	t.Run("Upgrade", func(t *testing.T) {
+		// Halfway through a 30 day period
+		out, err := proration.Calculate(proration.Change{
+			From:        basic,
+			To:          pro,
+			PeriodStart: start,
+			PeriodEnd:   end,
+			ChangedAt:   start.Add(15 * 24 * time.Hour),
+		})
+		require.NoError(t, err)
+		require.False(t, out.Invoice)
+		require.Len(t, out.Items, 2)
+
+		require.Equal(t, "basic", out.Items[0].PlanID)
+		require.Equal(t, int64(-500), out.Items[0].Amount)
+		require.Equal(t, int64(1296000), out.Items[0].Seconds)
+		require.Equal(t, int64(2592000), out.Items[0].PeriodSeconds)
+		require.Equal(t, "Unused time on Basic from 2026-10-16T00:00:00Z to 2026-10-31T00:00:00Z", out.Items[0].Description)
+		require.Equal(t, "-1000 USD × 1296000 of 2592000 seconds = -500 USD", out.Items[0].Calculation)
+
+		require.Equal(t, "pro", out.Items[1].PlanID)
+		require.Equal(t, int64(1500), out.Items[1].Amount)
+		require.Equal(t, "Remaining time on Pro from 2026-10-16T00:00:00Z to 2026-10-31T00:00:00Z", out.Items[1].Description)
+
+		require.Equal(t, int64(1000), out.Total)
+		require.Equal(t, "USD", out.Currency)
+	})
+
+	t.Run("Downgrade", func(t *testing.T) {
+		out, err := proration.Calculate(proration.Change{
+			From:        pro,
+			To:          basic,
+			PeriodStart: start,
+			PeriodEnd:   end,
+			ChangedAt:   start.Add(10 * 24 * time.Hour),
+			Behavior:    proration.AlwaysInvoice,
+		})
+		require.NoError(t, err)
+		require.True(t, out.Invoice)
+		require.Equal(t, int64(-2000), out.Items[0].Amount)
+		require.Equal(t, int64(667), out.Items[1].Amount, "expected charge to round half away from zero")
+		require.Equal(t, int64(-1333), out.Total)
+	})
+
+	t.Run("Seconds", func(t *testing.T) {
+		// Sub-second precision is truncated so the partial second is included.
+		out, err := proration.Calculate(proration.Change{
+			From:        basic,
+			To:          pro,
+			PeriodStart: start,
+			PeriodEnd:   end,
+			ChangedAt:   end.Add(-1500 * time.Millisecond),
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(2), out.Items[0].Seconds)
+		require.Equal(t, int64(0), out.Items[0].Amount)
+		require.Equal(t, int64(0), out.Items[1].Amount)
+	})
+
+	t.Run("None", func(t *testing.T) {
+		out, err := proration.Calculate(proration.Change{
+			From:        basic,
+			To:          pro,
+			PeriodStart: start,
+			PeriodEnd:   end,
+			ChangedAt:   start.Add(time.Hour),
+			Behavior:    proration.None,
+		})
+		require.NoError(t, err)
+		require.Empty(t, out.Items)
+		require.Zero(t, out.Total)
+		require.False(t, out.Invoice)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		testCases := []struct {
+			change proration.Change
+			err    error
+		}{
+			{proration.Change{From: basic, To: pro, PeriodStart: end, PeriodEnd: start, ChangedAt: start}, proration.ErrInvalidPeriod},
+			{proration.Change{From: basic, To: pro, PeriodStart: start, PeriodEnd: end, ChangedAt: end.Add(time.Hour)}, proration.ErrChangeOutOfRange},
+			{proration.Change{From: basic, To: pro, PeriodStart: start, PeriodEnd: end, ChangedAt: start.Add(-time.Hour)}, proration.ErrChangeOutOfRange},
+			{proration.Change{From: basic, To: proration.Plan{Amount: 10, Currency: "EUR"}, PeriodStart: start, PeriodEnd: end, ChangedAt: start}, proration.ErrCurrencyMismatch},
+			{proration.Change{From: basic, To: proration.Plan{Amount: -10, Currency: "USD"}, PeriodStart: start, PeriodEnd: end, ChangedAt: start}, proration.ErrNegativeAmount},
+			{proration.Change{From: basic, To: pro, PeriodStart: start, PeriodEnd: end, ChangedAt: start, Behavior: 42}, proration.ErrUnknownBehavior},
+		}
+
+		for i, tc := range testCases {
+			_, err := proration.Calculate(tc.change)
+			require.ErrorIs(t, err, tc.err, "test case %d failed", i)
+		}
+	})
+}
+
+func TestBehavior(t *testing.T) {
+	testCases := []struct {
+		in       string
+		expected proration.Behavior
+	}{
+		{"", proration.CreateProrations},
+		{"create_prorations", proration.CreateProrations},
+		{"always_invoice", proration.AlwaysInvoice},
+		{"Always-Invoice", proration.AlwaysInvoice},
+		{"  none ", proration.None},
+	}
+
+	for i, tc := range testCases {
+		actual, err := proration.ParseBehavior(tc.in)
+		require.NoError(t, err, "test case %d failed", i)
+		require.Equal(t, tc.expected, actual, "test case %d failed", i)
+	}
+
+	_, err := proration.ParseBehavior("sometimes")
+	require.ErrorIs(t, err, proration.ErrUnknownBehavior)
+
+	// Test JSON serialization
+	data, err := json.Marshal(proration.AlwaysInvoice)
+	require.NoError(t, err)
+	require.Equal(t, `"always_invoice"`, string(data))
+
+	var b proration.Behavior
+	require.NoError(t, json.Unmarshal([]byte(`"none"`), &b))
+	require.Equal(t, proration.None, b)
+}
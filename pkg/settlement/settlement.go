@@ -0,0 +1,586 @@
+/*
+Package settlement parses the settlement detail reports that Adyen makes available after
+each settlement batch and reconciles the lines of a report against the payment records of
+Exchequer. Settled, refunded and chargeback lines must match a payment record with the
+same amount and fee lines must reference a known payment. Since a report only covers a
+single settlement batch, records that are not in a report are only flagged as missing if
+they belong to the merchant account of the report and were created in the batch window
+of the report more than the settlement delay before its latest line. Amounts are always
+expressed in the minor units of the currency (e.g. cents).
+*/
+package settlement
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingColumn = errors.New("settlement report is missing a required column")
+	ErrInvalidAmount = errors.New("could not parse amount in settlement report")
+	ErrInvalidDate   = errors.New("could not parse creation date in settlement report")
+	ErrUntrustedURL  = errors.New("report url is not an https url of an adyen.com host")
+)
+
+// Types of the lines in a settlement detail report that are reconciled; lines of other
+// types (e.g. MerchantPayout or Balancetransfer) are skipped.
+const (
+	TypeSettled    = "Settled"
+	TypeRefunded   = "Refunded"
+	TypeChargeback = "Chargeback"
+	TypeFee        = "Fee"
+)
+
+// Statuses of the entries of a reconciliation.
+const (
+	StatusMatched    = "matched"
+	StatusMismatched = "mismatched"
+	StatusMissing    = "missing"
+	StatusExtra      = "extra"
+	StatusSkipped    = "skipped"
+)
+
+// The file names of settlement detail reports start with this prefix followed by the
+// batch number, e.g. settlement_detail_report_batch_112.csv.
+const reportPrefix = "settlement_detail_report_batch_"
+
+// IsSettlementDetailReport returns true if the file name of a report that is available
+// from Adyen is a settlement detail report.
+func IsSettlementDetailReport(name string) bool {
+	return strings.HasPrefix(name, reportPrefix)
+}
+
+//===========================================================================
+// Settlement Detail Reports
+//===========================================================================
+
+// Line is a single line of a settlement detail report. Gross amounts are in the currency
+// of the payment and net amounts are in the settlement currency of the merchant account.
+type Line struct {
+	Row                   int       `json:"row"`
+	MerchantAccount       string    `json:"merchant_account,omitempty"`
+	PSPReference          string    `json:"psp_reference,omitempty"`
+	MerchantReference     string    `json:"merchant_reference,omitempty"`
+	PaymentMethod         string    `json:"payment_method,omitempty"`
+	Created               time.Time `json:"created"`
+	Type                  string    `json:"type"`
+	ModificationReference string    `json:"modification_reference,omitempty"`
+	GrossCurrency         string    `json:"gross_currency,omitempty"`
+	GrossDebit            int64     `json:"gross_debit,omitempty"`
+	GrossCredit           int64     `json:"gross_credit,omitempty"`
+	NetCurrency           string    `json:"net_currency,omitempty"`
+	NetDebit              int64     `json:"net_debit,omitempty"`
+	NetCredit             int64     `json:"net_credit,omitempty"`
+	BatchNumber           string    `json:"batch_number,omitempty"`
+}
+
+// Amount returns the gross amount of the line that is compared to the amount of the
+// payment record: the credit of settled payments and the debit of refunds and
+// chargebacks. Fees are only charged in the settlement currency so the net debit is
+// returned for fee lines.
+func (l *Line) Amount() (int64, string) {
+	switch l.Type {
+	case TypeSettled:
+		return l.GrossCredit, l.GrossCurrency
+	case TypeFee:
+		return l.NetDebit, l.NetCurrency
+	default:
+		return l.GrossDebit, l.GrossCurrency
+	}
+}
+
+// Columns of the settlement detail report; the report has more columns than these but
+// the remaining columns are not needed to reconcile the report.
+const (
+	colMerchantAccount       = "Merchant Account"
+	colPSPReference          = "Psp Reference"
+	colMerchantReference     = "Merchant Reference"
+	colPaymentMethod         = "Payment Method"
+	colCreationDate          = "Creation Date"
+	colTimeZone              = "TimeZone"
+	colType                  = "Type"
+	colModificationReference = "Modification Reference"
+	colGrossCurrency         = "Gross Currency"
+	colGrossDebit            = "Gross Debit (GC)"
+	colGrossCredit           = "Gross Credit (GC)"
+	colNetCurrency           = "Net Currency"
+	colNetDebit              = "Net Debit (NC)"
+	colNetCredit             = "Net Credit (NC)"
+	colBatchNumber           = "Batch Number"
+)
+
+var requiredColumns = []string{colPSPReference, colCreationDate, colType, colModificationReference, colGrossCurrency, colGrossDebit, colGrossCredit, colNetCurrency, colNetDebit, colNetCredit}
+
+// The layout of the creation date, which is in the time zone in the TimeZone column.
+const creationDateLayout = "2006-01-02 15:04:05"
+
+// Parse reads the lines of a settlement detail report in CSV format. Columns are found
+// by the header of the report so that the column order can be configured in Adyen.
+func Parse(r io.Reader) (lines []*Line, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	var header []string
+	if header, err = reader.Read(); err != nil {
+		return nil, fmt.Errorf("could not read settlement report header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+
+	for _, name := range requiredColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%w: %q", ErrMissingColumn, name)
+		}
+	}
+
+	for {
+		var record []string
+		if record, err = reader.Read(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return lines, nil
+			}
+			return nil, fmt.Errorf("could not read settlement report: %w", err)
+		}
+
+		// The row is the line number of the record in the report
+		row, _ := reader.FieldPos(0)
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		line := &Line{
+			Row:                   row,
+			MerchantAccount:       field(colMerchantAccount),
+			PSPReference:          field(colPSPReference),
+			MerchantReference:     field(colMerchantReference),
+			PaymentMethod:         field(colPaymentMethod),
+			Type:                  field(colType),
+			ModificationReference: field(colModificationReference),
+			GrossCurrency:         field(colGrossCurrency),
+			NetCurrency:           field(colNetCurrency),
+			BatchNumber:           field(colBatchNumber),
+		}
+
+		// Skip empty lines, e.g. at the end of the report
+		if line.Type == "" {
+			continue
+		}
+
+		if line.Created, err = parseCreationDate(field(colCreationDate), field(colTimeZone)); err != nil {
+			return nil, fmt.Errorf("row %d: %w", row, err)
+		}
+
+		amounts := []struct {
+			dst      *int64
+			column   string
+			currency string
+		}{
+			{&line.GrossDebit, colGrossDebit, line.GrossCurrency},
+			{&line.GrossCredit, colGrossCredit, line.GrossCurrency},
+			{&line.NetDebit, colNetDebit, line.NetCurrency},
+			{&line.NetCredit, colNetCredit, line.NetCurrency},
+		}
+
+		for _, amount := range amounts {
+			if *amount.dst, err = MinorUnits(field(amount.column), amount.currency); err != nil {
+				return nil, fmt.Errorf("row %d: %s: %w", row, amount.column, err)
+			}
+		}
+
+		lines = append(lines, line)
+	}
+}
+
+func parseCreationDate(date, zone string) (time.Time, error) {
+	if date == "" {
+		return time.Time{}, nil
+	}
+
+	// Adyen reports the time zone as an abbreviation that may not be a known location
+	loc, err := time.LoadLocation(zone)
+	if err != nil || zone == "" {
+		loc = time.UTC
+	}
+
+	created, err := time.ParseInLocation(creationDateLayout, date, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %q", ErrInvalidDate, date)
+	}
+	return created, nil
+}
+
+// Currencies whose minor unit is not 1/100 of the major unit (ISO 4217).
+var exponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// MinorUnits converts a decimal amount in the major units of the currency, as it is
+// formatted in Adyen reports (e.g. 11.30), to minor units (e.g. 1130). An empty amount
+// is zero.
+func MinorUnits(amount, currency string) (int64, error) {
+	if amount = strings.TrimSpace(amount); amount == "" {
+		return 0, nil
+	}
+
+	exp, ok := exponents[strings.ToUpper(currency)]
+	if !ok {
+		exp = 2
+	}
+
+	whole, frac, _ := strings.Cut(amount, ".")
+	if len(frac) > exp {
+		// Trailing zeros beyond the precision of the currency do not change the amount
+		if strings.Trim(frac[exp:], "0") != "" {
+			return 0, fmt.Errorf("%w: %q has more than %d decimals for %s", ErrInvalidAmount, amount, exp, currency)
+		}
+		frac = frac[:exp]
+	}
+
+	value, err := strconv.ParseInt(whole+frac+strings.Repeat("0", exp-len(frac)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, amount)
+	}
+	return value, nil
+}
+
+//===========================================================================
+// Reconciliation
+//===========================================================================
+
+// Record is a payment record of Exchequer that is expected to appear in a settlement
+// detail report as a line of the record type (e.g. a captured payment as Settled). If
+// the merchant account is empty the record is expected in reports of any account.
+type Record struct {
+	ID                string    `json:"id"`
+	Type              string    `json:"type"`
+	MerchantAccount   string    `json:"merchant_account,omitempty"`
+	PSPReference      string    `json:"psp_reference"`
+	OriginalReference string    `json:"original_reference,omitempty"`
+	Amount            int64     `json:"amount"`
+	Currency          string    `json:"currency"`
+	Created           time.Time `json:"created"`
+}
+
+// Entry is the outcome of reconciling a line of a report with the record it matched, if
+// any, or a record that is missing from the report; the reason describes why the entry
+// is not matched.
+type Entry struct {
+	Status string  `json:"status"`
+	Line   *Line   `json:"line,omitempty"`
+	Record *Record `json:"record,omitempty"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+// Reconciliation is the outcome of reconciling a settlement detail report. Entries are
+// in the order of the lines of the report followed by the missing records.
+type Reconciliation struct {
+	Report     string   `json:"report,omitempty"`
+	Matched    int      `json:"matched"`
+	Mismatched int      `json:"mismatched"`
+	Missing    int      `json:"missing"`
+	Extra      int      `json:"extra"`
+	Skipped    int      `json:"skipped"`
+	Entries    []*Entry `json:"entries"`
+}
+
+// Balanced returns true if there are no mismatched, missing or extra entries.
+func (r *Reconciliation) Balanced() bool {
+	return r.Mismatched == 0 && r.Missing == 0 && r.Extra == 0
+}
+
+// Discrepancies returns a copy of the reconciliation that only contains the entries that
+// are mismatched, missing or extra, e.g. to report them without the matched lines.
+func (r *Reconciliation) Discrepancies() *Reconciliation {
+	out := *r
+	out.Entries = make([]*Entry, 0, r.Mismatched+r.Missing+r.Extra)
+	for _, entry := range r.Entries {
+		switch entry.Status {
+		case StatusMismatched, StatusMissing, StatusExtra:
+			out.Entries = append(out.Entries, entry)
+		}
+	}
+	return &out
+}
+
+func (r *Reconciliation) add(entry *Entry) {
+	switch entry.Status {
+	case StatusMatched:
+		r.Matched++
+	case StatusMismatched:
+		r.Mismatched++
+	case StatusMissing:
+		r.Missing++
+	case StatusExtra:
+		r.Extra++
+	case StatusSkipped:
+		r.Skipped++
+	}
+	r.Entries = append(r.Entries, entry)
+}
+
+// Reconcile matches the lines of a settlement detail report to the payment records. A
+// line is matched to a record of the same type that has the modification reference of
+// the line as its PSP reference or that references the payment of the line; records
+// with the same amount and currency as the line are preferred.
+//
+// Records that are not matched are missing if they belong to a merchant account of the
+// report and were created in the batch window of the report, i.e. after its earliest
+// reconciled line, but more than the settlement delay before its latest reconciled line.
+// Records created later may still be settled in the next batch so they are not flagged.
+func Reconcile(lines []*Line, records []*Record, settlementDelay time.Duration) *Reconciliation {
+	out := &Reconciliation{Entries: make([]*Entry, 0, len(lines))}
+
+	// Index the records by both of their references
+	index := make(map[string][]*Record, len(records))
+	for _, record := range records {
+		index[record.PSPReference] = append(index[record.PSPReference], record)
+		if record.OriginalReference != "" && record.OriginalReference != record.PSPReference {
+			index[record.OriginalReference] = append(index[record.OriginalReference], record)
+		}
+	}
+
+	var (
+		start, end time.Time
+		accounts   = make(map[string]struct{})
+		matched    = make(map[*Record]struct{}, len(records))
+	)
+
+	for _, line := range lines {
+		entry := &Entry{Line: line}
+		switch line.Type {
+		case TypeSettled, TypeRefunded, TypeChargeback:
+			entry.Record = match(line, index, matched)
+			reconcileLine(entry)
+			if entry.Record != nil {
+				matched[entry.Record] = struct{}{}
+			}
+		case TypeFee:
+			switch {
+			case line.PSPReference == "":
+				entry.Status = StatusSkipped
+				entry.Reason = "fee does not reference a payment"
+			case len(index[line.PSPReference]) == 0:
+				entry.Status = StatusExtra
+				entry.Reason = "no payment record for the fee"
+			default:
+				entry.Status = StatusMatched
+			}
+		default:
+			entry.Status = StatusSkipped
+			entry.Reason = fmt.Sprintf("%s lines are not reconciled", line.Type)
+		}
+
+		if entry.Status != StatusSkipped {
+			accounts[line.MerchantAccount] = struct{}{}
+			if !line.Created.IsZero() {
+				if start.IsZero() || line.Created.Before(start) {
+					start = line.Created
+				}
+				if end.IsZero() || line.Created.After(end) {
+					end = line.Created
+				}
+			}
+		}
+
+		out.add(entry)
+	}
+
+	// Records created in the batch window should have been settled in the report
+	if start.IsZero() {
+		return out
+	}
+
+	cutoff := end.Add(-settlementDelay)
+	for _, record := range records {
+		if _, ok := matched[record]; ok || record.Created.Before(start) || record.Created.After(cutoff) {
+			continue
+		}
+
+		// Reports without a merchant account column are assumed to be of every account
+		if _, ok := accounts[record.MerchantAccount]; !ok && record.MerchantAccount != "" {
+			if _, unknown := accounts[""]; !unknown {
+				continue
+			}
+		}
+
+		out.add(&Entry{
+			Status: StatusMissing,
+			Record: record,
+			Reason: fmt.Sprintf("no %s line in the report for a record created more than %s before the end of the batch", record.Type, settlementDelay),
+		})
+	}
+
+	return out
+}
+
+// Returns the best unmatched record of the same type as the line or nil if there is no
+// record that references the line.
+func match(line *Line, index map[string][]*Record, matched map[*Record]struct{}) (best *Record) {
+	amount, currency := line.Amount()
+	candidates := make([]*Record, 0, len(index[line.ModificationReference])+len(index[line.PSPReference]))
+	if line.ModificationReference != "" {
+		candidates = append(candidates, index[line.ModificationReference]...)
+	}
+	candidates = append(candidates, index[line.PSPReference]...)
+
+	var bestScore int
+	for _, record := range candidates {
+		if _, ok := matched[record]; ok || record.Type != line.Type {
+			continue
+		}
+
+		var score int
+		switch {
+		case line.ModificationReference != "" && record.PSPReference == line.ModificationReference:
+			score = 4
+		case record.PSPReference == line.PSPReference || record.OriginalReference == line.PSPReference:
+			score = 2
+		default:
+			continue
+		}
+
+		if record.Amount == amount && record.Currency == currency {
+			score++
+		}
+
+		if score > bestScore {
+			best, bestScore = record, score
+		}
+	}
+	return best
+}
+
+func reconcileLine(entry *Entry) {
+	amount, currency := entry.Line.Amount()
+	switch {
+	case entry.Record == nil:
+		entry.Status = StatusExtra
+		entry.Reason = fmt.Sprintf("no payment record for the %s line", entry.Line.Type)
+	case entry.Record.Amount != amount || entry.Record.Currency != currency:
+		entry.Status = StatusMismatched
+		entry.Reason = fmt.Sprintf("report amount %d %s does not match recorded amount %d %s", amount, currency, entry.Record.Amount, entry.Record.Currency)
+	default:
+		entry.Status = StatusMatched
+	}
+}
+
+//===========================================================================
+// Report Downloads
+//===========================================================================
+
+// Downloader downloads a report that Adyen has made available at the URL. The caller
+// must close the returned reader.
+type Downloader interface {
+	Download(ctx context.Context, url string) (io.ReadCloser, error)
+}
+
+// HTTPDownloader downloads reports from Adyen with the credentials of a report user;
+// the API key is used if it is set, otherwise the username and password. Since the
+// credentials are sent with the request, reports are only downloaded from https URLs of
+// adyen.com hosts and redirects to any other host are refused.
+type HTTPDownloader struct {
+	Client   *http.Client
+	APIKey   string
+	Username string
+	Password string
+}
+
+var _ Downloader = &HTTPDownloader{}
+
+func (d *HTTPDownloader) Download(ctx context.Context, url string) (_ io.ReadCloser, err error) {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil); err != nil {
+		return nil, err
+	}
+
+	if err = ValidateReportURL(req.URL); err != nil {
+		return nil, err
+	}
+
+	if d.APIKey != "" {
+		req.Header.Set("X-API-Key", d.APIKey)
+	} else {
+		req.SetBasicAuth(d.Username, d.Password)
+	}
+
+	// Copy the client so that redirects are checked even if a client is configured
+	client := &http.Client{}
+	if d.Client != nil {
+		*client = *d.Client
+	}
+	client.CheckRedirect = checkRedirect
+
+	var rep *http.Response
+	if rep, err = client.Do(req); err != nil {
+		return nil, err
+	}
+
+	if rep.StatusCode != http.StatusOK {
+		rep.Body.Close()
+		return nil, fmt.Errorf("could not download report: %s", rep.Status)
+	}
+	return rep.Body, nil
+}
+
+// The X-API-Key header is sent again when a request is redirected so the redirect must
+// be to a host that is trusted with the credentials of the report user.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return ValidateReportURL(req.URL)
+}
+
+// ValidateReportURL returns ErrUntrustedURL unless the URL is an https URL of adyen.com
+// or one of its subdomains. The download URL of a report is not covered by the HMAC
+// signature of a notification so it must be validated before it is downloaded.
+func ValidateReportURL(u *url.URL) error {
+	if u.Scheme != "https" || u.User != nil {
+		return fmt.Errorf("%w: %q", ErrUntrustedURL, u.Redacted())
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host != "adyen.com" && !strings.HasSuffix(host, ".adyen.com") {
+		return fmt.Errorf("%w: %q", ErrUntrustedURL, u.Redacted())
+	}
+	return nil
+}
+
+// FileDownloader opens reports from a local directory by the file name at the end of
+// the report URL, e.g. to reconcile reports that were downloaded manually or fixtures.
+type FileDownloader string
+
+var _ Downloader = FileDownloader("")
+
+func (d FileDownloader) Download(_ context.Context, reportURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(reportURL)
+	if err != nil {
+		return nil, err
+	}
+
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return nil, fmt.Errorf("could not determine report file name from %q", reportURL)
+	}
+	return os.Open(filepath.Join(string(d), name))
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+)
+
+const (
+	nsAPIKeys   = "apikeys"
+	nsClientIDs = "clientids"
+)
+
+var ErrDuplicateClientID = errors.New("an api key with that client id already exists")
+
+// APIKey is a credential that services use to access the API without a JWT flow. The
+// secret is stored as an argon2 derived key and is never stored in plain text.
+type APIKey struct {
+	ID          ulid.ULID `json:"id"`
+	ClientID    string    `json:"client_id"`
+	Secret      string    `json:"secret"`
+	Description string    `json:"description,omitempty"`
+	Scopes      []string  `json:"scopes"`
+	Revoked     time.Time `json:"revoked,omitempty"`
+	Created     time.Time `json:"created"`
+	Modified    time.Time `json:"modified"`
+}
+
+// IsRevoked returns true if the key can no longer be used to authenticate.
+func (k *APIKey) IsRevoked() bool {
+	return !k.Revoked.IsZero()
+}
+
+// ListAPIKeys returns all API keys, including revoked keys, ordered by creation.
+func (s *Store) ListAPIKeys() (out []*APIKey, err error) {
+	out = make([]*APIKey, 0)
+	err = s.each(prefix(nsAPIKeys), func(value []byte) error {
+		key := &APIKey{}
+		if err := json.Unmarshal(value, key); err != nil {
+			return err
+		}
+		out = append(out, key)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CreateAPIKey saves a new API key, assigning it an ID, and indexes it by client ID.
+func (s *Store) CreateAPIKey(apikey *APIKey) (err error) {
+	if apikey.ClientID == "" || apikey.Secret == "" {
+		return ErrInvalidReference
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var exists bool
+	if exists, err = s.db.Has(key(nsClientIDs, apikey.ClientID), nil); err != nil {
+		return err
+	}
+
+	if exists {
+		return ErrDuplicateClientID
+	}
+
+	apikey.ID = ulids.New()
+	apikey.Created = time.Now()
+	apikey.Modified = apikey.Created
+
+	if err = s.put(key(nsAPIKeys, apikey.ID.String()), apikey); err != nil {
+		return err
+	}
+	return s.put(key(nsClientIDs, apikey.ClientID), apikey.ID)
+}
+
+// RetrieveAPIKey returns the API key with the specified ID.
+func (s *Store) RetrieveAPIKey(id ulid.ULID) (apikey *APIKey, err error) {
+	apikey = &APIKey{}
+	if err = s.get(key(nsAPIKeys, id.String()), apikey); err != nil {
+		return nil, err
+	}
+	return apikey, nil
+}
+
+// RetrieveAPIKeyByClientID returns the API key with the specified client ID.
+func (s *Store) RetrieveAPIKeyByClientID(clientID string) (_ *APIKey, err error) {
+	var id ulid.ULID
+	if err = s.get(key(nsClientIDs, clientID), &id); err != nil {
+		return nil, err
+	}
+	return s.RetrieveAPIKey(id)
+}
+
+// RevokeAPIKey marks the API key as revoked so that it can no longer be used. The key
+// is retained so that its use can be audited; revoking a revoked key is a no-op.
+func (s *Store) RevokeAPIKey(id ulid.ULID) (apikey *APIKey, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if apikey, err = s.RetrieveAPIKey(id); err != nil {
+		return nil, err
+	}
+
+	if apikey.IsRevoked() {
+		return apikey, nil
+	}
+
+	apikey.Revoked = time.Now()
+	apikey.Modified = apikey.Revoked
+	if err = s.put(key(nsAPIKeys, apikey.ID.String()), apikey); err != nil {
+		return nil, err
+	}
+	return apikey, nil
+}
@@ -0,0 +1,57 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeys(t *testing.T) {
+	db := openStore(t)
+
+	// Client ID and secret are required
+	require.ErrorIs(t, db.CreateAPIKey(&store.APIKey{Secret: "dk"}), store.ErrInvalidReference)
+	require.ErrorIs(t, db.CreateAPIKey(&store.APIKey{ClientID: "alpha"}), store.ErrInvalidReference)
+
+	alpha := &store.APIKey{ClientID: "alpha", Secret: "dk", Scopes: []string{"invoices:read"}}
+	require.NoError(t, db.CreateAPIKey(alpha))
+	require.False(t, ulids.IsZero(alpha.ID))
+	require.False(t, alpha.Created.IsZero())
+
+	// Client IDs must be unique
+	require.ErrorIs(t, db.CreateAPIKey(&store.APIKey{ClientID: "alpha", Secret: "dk"}), store.ErrDuplicateClientID)
+
+	bravo := &store.APIKey{ClientID: "bravo", Secret: "dk", Scopes: []string{"payments:refund"}}
+	require.NoError(t, db.CreateAPIKey(bravo))
+
+	keys, err := db.ListAPIKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, alpha.ID, keys[0].ID)
+
+	key, err := db.RetrieveAPIKeyByClientID("bravo")
+	require.NoError(t, err)
+	require.Equal(t, bravo.ID, key.ID)
+	require.Equal(t, []string{"payments:refund"}, key.Scopes)
+
+	_, err = db.RetrieveAPIKeyByClientID("charlie")
+	require.ErrorIs(t, err, store.ErrNotFound)
+
+	// Revoked keys are retained and revoking is idempotent
+	key, err = db.RevokeAPIKey(alpha.ID)
+	require.NoError(t, err)
+	require.True(t, key.IsRevoked())
+
+	again, err := db.RevokeAPIKey(alpha.ID)
+	require.NoError(t, err)
+	require.True(t, again.Revoked.Equal(key.Revoked))
+
+	key, err = db.RetrieveAPIKeyByClientID("alpha")
+	require.NoError(t, err)
+	require.True(t, key.IsRevoked())
+
+	_, err = db.RevokeAPIKey(ulids.New())
+	require.ErrorIs(t, err, store.ErrNotFound)
+}
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+)
+
+const nsAuditLog = "audit"
+
+var ErrAuditChainBroken = errors.New("audit log hash chain is broken")
+
+// AuditEntry records an action taken by an operator, a service or the system itself.
+// Entries are append-only and hash-chained: the hash of each entry covers its contents
+// and the hash of the previous entry, so modifying or removing an entry is detectable.
+type AuditEntry struct {
+	ID        ulid.ULID       `json:"id"`
+	Sequence  uint64          `json:"sequence"`
+	Actor     string          `json:"actor"`
+	ActorType string          `json:"actor_type"`
+	Action    string          `json:"action"`
+	Resource  string          `json:"resource"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Changes   []*AuditChange  `json:"changes,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	ClientIP  string          `json:"client_ip,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	PrevHash  []byte          `json:"prev_hash,omitempty"`
+	Hash      []byte          `json:"hash"`
+}
+
+// AuditChange is a top-level field of the resource that differs before and after the
+// action; a nil value means the field was not present.
+type AuditChange struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// AppendAuditEntry assigns the entry an ID and sequence number, computes the changes
+// between the before and after states and chains the entry to the end of the log.
+func (s *Store) AppendAuditEntry(entry *AuditEntry) (err error) {
+	if entry.Action == "" || entry.Resource == "" {
+		return ErrInvalidReference
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var last *AuditEntry
+	if last, err = s.lastAuditEntry(); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	entry.ID = ulids.New()
+	entry.Sequence = 1
+	entry.PrevHash = nil
+	if last != nil {
+		entry.Sequence = last.Sequence + 1
+		entry.PrevHash = last.Hash
+	}
+
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+	entry.Timestamp = entry.Timestamp.UTC()
+
+	if entry.Changes, err = auditChanges(entry.Before, entry.After); err != nil {
+		return err
+	}
+
+	if entry.Hash, err = entry.ComputeHash(); err != nil {
+		return err
+	}
+	return s.put(auditKey(entry.Sequence), entry)
+}
+
+// EachAuditEntry iterates over the audit log in the order the entries were appended.
+func (s *Store) EachAuditEntry(fn func(*AuditEntry) error) error {
+	return s.each(prefix(nsAuditLog), func(value []byte) error {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(value, entry); err != nil {
+			return err
+		}
+		return fn(entry)
+	})
+}
+
+// VerifyAuditLog walks the audit log and checks that every entry's hash matches its
+// contents and is chained to the previous entry, returning the number of entries that
+// were verified. An error wrapping ErrAuditChainBroken is returned at the first entry
+// that fails verification.
+func (s *Store) VerifyAuditLog() (verified uint64, err error) {
+	var prev []byte
+	err = s.EachAuditEntry(func(entry *AuditEntry) error {
+		if entry.Sequence != verified+1 {
+			return fmt.Errorf("%w: expected sequence %d but found %d", ErrAuditChainBroken, verified+1, entry.Sequence)
+		}
+
+		if !bytes.Equal(entry.PrevHash, prev) {
+			return fmt.Errorf("%w: entry %d is not chained to the previous entry", ErrAuditChainBroken, entry.Sequence)
+		}
+
+		hash, err := entry.ComputeHash()
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(hash, entry.Hash) {
+			return fmt.Errorf("%w: entry %d has been modified", ErrAuditChainBroken, entry.Sequence)
+		}
+
+		prev = entry.Hash
+		verified++
+		return nil
+	})
+	return verified, err
+}
+
+// ComputeHash returns the SHA-256 hash of the entry's JSON encoding without its hash,
+// which includes the hash of the previous entry in the chain.
+func (e *AuditEntry) ComputeHash() (_ []byte, err error) {
+	entry := *e
+	entry.Hash = nil
+
+	var data []byte
+	if data, err = json.Marshal(&entry); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+func (s *Store) lastAuditEntry() (_ *AuditEntry, err error) {
+	iter := s.db.NewIterator(prefix(nsAuditLog), nil)
+	defer iter.Release()
+
+	if !iter.Last() {
+		if err = iter.Error(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+
+	entry := &AuditEntry{}
+	if err = json.Unmarshal(iter.Value(), entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Audit entries are keyed by their zero-padded sequence so they are stored in order.
+func auditKey(seq uint64) []byte {
+	return key(nsAuditLog, fmt.Sprintf("%020d", seq))
+}
+
+// Computes the top-level fields that changed between two JSON objects. If either state
+// is not a JSON object, the states are compared as a whole.
+func auditChanges(before, after json.RawMessage) (_ []*AuditChange, err error) {
+	if len(before) == 0 && len(after) == 0 {
+		return nil, nil
+	}
+
+	var prev, next map[string]json.RawMessage
+	if err = unmarshalState(before, &prev); err != nil {
+		return nil, err
+	}
+
+	if err = unmarshalState(after, &next); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]struct{}, len(prev)+len(next))
+	for field := range prev {
+		fields[field] = struct{}{}
+	}
+	for field := range next {
+		fields[field] = struct{}{}
+	}
+
+	changes := make([]*AuditChange, 0, len(fields))
+	for field := range fields {
+		if !bytes.Equal(compact(prev[field]), compact(next[field])) {
+			changes = append(changes, &AuditChange{Field: field, Before: prev[field], After: next[field]})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+func unmarshalState(state json.RawMessage, obj *map[string]json.RawMessage) error {
+	if len(state) == 0 || bytes.Equal(state, []byte("null")) {
+		return nil
+	}
+	if err := json.Unmarshal(state, obj); err != nil {
+		*obj = map[string]json.RawMessage{"": state}
+	}
+	return nil
+}
+
+func compact(data json.RawMessage) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, data); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,89 @@
+package store_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db, err := store.Open("leveldb://" + path)
+	require.NoError(t, err)
+
+	// An empty audit log is valid
+	verified, err := db.VerifyAuditLog()
+	require.NoError(t, err)
+	require.Zero(t, verified)
+
+	// Action and resource are required
+	require.ErrorIs(t, db.AppendAuditEntry(&store.AuditEntry{Action: "apikey.create"}), store.ErrInvalidReference)
+
+	first := &store.AuditEntry{
+		Actor:     "alice",
+		ActorType: "user",
+		Action:    "webhook.create",
+		Resource:  "webhooks/01J9ZJ4HQKX3GTEPJ6N0HFSW3M",
+		After:     json.RawMessage(`{"url":"https://example.com/hook","active":true}`),
+		RequestID: "01J9ZJ7Z4Q0GZ6V8C1B0K2M3N4",
+		ClientIP:  "192.168.1.1",
+	}
+	require.NoError(t, db.AppendAuditEntry(first))
+	require.Equal(t, uint64(1), first.Sequence)
+	require.Nil(t, first.PrevHash)
+	require.Len(t, first.Hash, 32)
+	require.Len(t, first.Changes, 2)
+
+	second := &store.AuditEntry{
+		Actor:     "bob",
+		ActorType: "user",
+		Action:    "webhook.update",
+		Resource:  "webhooks/01J9ZJ4HQKX3GTEPJ6N0HFSW3M",
+		Before:    json.RawMessage(`{"url":"https://example.com/hook","active":true}`),
+		After:     json.RawMessage(`{"url": "https://example.com/hook", "active": false}`),
+	}
+	require.NoError(t, db.AppendAuditEntry(second))
+	require.Equal(t, uint64(2), second.Sequence)
+	require.Equal(t, first.Hash, second.PrevHash)
+	require.Len(t, second.Changes, 1, "only fields whose values changed should be recorded")
+	require.Equal(t, "active", second.Changes[0].Field)
+
+	third := &store.AuditEntry{Actor: "adyen", ActorType: "system", Action: "adyen.notification", Resource: "payments/7914073381342284"}
+	require.NoError(t, db.AppendAuditEntry(third))
+
+	var entries []*store.AuditEntry
+	require.NoError(t, db.EachAuditEntry(func(entry *store.AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	}))
+	require.Len(t, entries, 3)
+	require.Equal(t, "bob", entries[1].Actor)
+
+	verified, err = db.VerifyAuditLog()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), verified)
+
+	// Tamper with the second entry directly in the database
+	require.NoError(t, db.Close())
+	ldb, err := leveldb.OpenFile(path, nil)
+	require.NoError(t, err)
+
+	tampered := *entries[1]
+	tampered.Actor = "mallory"
+	data, err := json.Marshal(&tampered)
+	require.NoError(t, err)
+	require.NoError(t, ldb.Put([]byte("audit::00000000000000000002"), data, nil))
+	require.NoError(t, ldb.Close())
+
+	db, err = store.Open("leveldb://" + path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	verified, err = db.VerifyAuditLog()
+	require.ErrorIs(t, err, store.ErrAuditChainBroken)
+	require.Equal(t, uint64(1), verified)
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+)
+
+const nsEvents = "events"
+
+// Event is an append-only record of a billing event that occurred in Exchequer. Events
+// are keyed by a ULID so the event log is ordered by the time the event was created.
+type Event struct {
+	ID      ulid.ULID       `json:"id"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+	Created time.Time       `json:"created"`
+}
+
+// CreateEvent appends the event to the event log, assigning it a new ID.
+func (s *Store) CreateEvent(event *Event) error {
+	event.ID = ulids.New()
+	event.Created = ulid.Time(event.ID.Time())
+	return s.put(key(nsEvents, event.ID.String()), event)
+}
+
+// RetrieveEvent returns the event with the specified ID from the event log.
+func (s *Store) RetrieveEvent(id ulid.ULID) (event *Event, err error) {
+	event = &Event{}
+	if err = s.get(key(nsEvents, id.String()), event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// EachEvent iterates over the event log in order, starting with the first event after
+// the specified ID. If the ID is the zero-valued ULID, iteration begins at the start
+// of the event log.
+func (s *Store) EachEvent(after ulid.ULID, fn func(*Event) error) error {
+	rng := prefix(nsEvents)
+	if !ulids.IsZero(after) {
+		// Keys are ordered by ULID so the range starts just after the specified event.
+		rng.Start = append(key(nsEvents, after.String()), 0x00)
+	}
+
+	return s.each(rng, func(value []byte) error {
+		event := &Event{}
+		if err := json.Unmarshal(value, event); err != nil {
+			return err
+		}
+		return fn(event)
+	})
+}
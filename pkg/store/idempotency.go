@@ -0,0 +1,105 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const nsIdempotency = "idempotency"
+
+// IdempotencyRecord stores the response to a mutating request that was sent with an
+// Idempotency-Key header so that retries of the request are answered with the original
+// response instead of being executed again. Keys are scoped to the actor that made the
+// request. The record is stored without a status while the request is in flight.
+type IdempotencyRecord struct {
+	Key         string    `json:"key"`
+	Actor       string    `json:"actor"`
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Completed returns true if the response to the request has been stored.
+func (r *IdempotencyRecord) Completed() bool {
+	return r.Status != 0
+}
+
+// Expired returns true if the record no longer reserves its key.
+func (r *IdempotencyRecord) Expired(now time.Time) bool {
+	return !now.Before(r.Expires)
+}
+
+// ReserveIdempotencyKey saves the record if there is no unexpired record for its actor
+// and key. Otherwise the existing record is returned and the new record is not saved so
+// that the caller can decide how to respond to the retry.
+func (s *Store) ReserveIdempotencyKey(record *IdempotencyRecord) (existing *IdempotencyRecord, err error) {
+	if record.Actor == "" || record.Key == "" {
+		return nil, ErrInvalidReference
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	existing = &IdempotencyRecord{}
+	if err = s.get(key(nsIdempotency, record.Actor, record.Key), existing); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	if err == nil && !existing.Expired(time.Now()) {
+		return existing, nil
+	}
+
+	if err = s.put(key(nsIdempotency, record.Actor, record.Key), record); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// SaveIdempotencyRecord stores the record, e.g. to save the response to the request.
+func (s *Store) SaveIdempotencyRecord(record *IdempotencyRecord) error {
+	if record.Actor == "" || record.Key == "" {
+		return ErrInvalidReference
+	}
+	return s.put(key(nsIdempotency, record.Actor, record.Key), record)
+}
+
+// DeleteIdempotencyRecord releases the key so that the request can be made again.
+func (s *Store) DeleteIdempotencyRecord(actor, idempotencyKey string) error {
+	return s.delete(key(nsIdempotency, actor, idempotencyKey))
+}
+
+// DeleteExpiredIdempotencyRecords removes records that expired before now, returning the
+// number of records that were deleted.
+func (s *Store) DeleteExpiredIdempotencyRecords(now time.Time) (deleted int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var expired [][]byte
+	err = s.each(prefix(nsIdempotency), func(value []byte) error {
+		record := &IdempotencyRecord{}
+		if err := json.Unmarshal(value, record); err != nil {
+			return err
+		}
+
+		if record.Expired(now) {
+			expired = append(expired, key(nsIdempotency, record.Actor, record.Key))
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range expired {
+		if err = s.delete(key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
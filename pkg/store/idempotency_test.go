@@ -0,0 +1,66 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyRecords(t *testing.T) {
+	db := openStore(t)
+
+	// Actor and key are required
+	_, err := db.ReserveIdempotencyKey(&store.IdempotencyRecord{Key: "alpha"})
+	require.ErrorIs(t, err, store.ErrInvalidReference)
+
+	now := time.Now()
+	record := &store.IdempotencyRecord{Key: "alpha", Actor: "testing", Fingerprint: "abc", Created: now, Expires: now.Add(time.Minute)}
+	existing, err := db.ReserveIdempotencyKey(record)
+	require.NoError(t, err)
+	require.Nil(t, existing, "expected key to be reserved")
+
+	// The key cannot be reserved again while the request is in flight
+	existing, err = db.ReserveIdempotencyKey(&store.IdempotencyRecord{Key: "alpha", Actor: "testing", Fingerprint: "def", Created: now, Expires: now.Add(time.Minute)})
+	require.NoError(t, err)
+	require.NotNil(t, existing)
+	require.False(t, existing.Completed())
+	require.Equal(t, "abc", existing.Fingerprint)
+
+	// Keys are scoped to the actor
+	existing, err = db.ReserveIdempotencyKey(&store.IdempotencyRecord{Key: "alpha", Actor: "other", Created: now, Expires: now.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Nil(t, existing)
+
+	// The stored response is returned for retries
+	record.Status = 201
+	record.ContentType = "application/json"
+	record.Body = []byte(`{"id":"01J9ZJ4HQKX3GTEPJ6N0HFSW3M"}`)
+	record.Expires = now.Add(24 * time.Hour)
+	require.NoError(t, db.SaveIdempotencyRecord(record))
+
+	existing, err = db.ReserveIdempotencyKey(&store.IdempotencyRecord{Key: "alpha", Actor: "testing", Created: now, Expires: now.Add(time.Minute)})
+	require.NoError(t, err)
+	require.True(t, existing.Completed())
+	require.Equal(t, record.Body, existing.Body)
+
+	// Released keys can be reserved again
+	require.NoError(t, db.DeleteIdempotencyRecord("other", "alpha"))
+	existing, err = db.ReserveIdempotencyKey(&store.IdempotencyRecord{Key: "alpha", Actor: "other", Created: now, Expires: now.Add(-time.Second)})
+	require.NoError(t, err)
+	require.Nil(t, existing)
+
+	// Expired records do not reserve the key and are deleted
+	existing, err = db.ReserveIdempotencyKey(&store.IdempotencyRecord{Key: "alpha", Actor: "other", Created: now, Expires: now.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Nil(t, existing, "expected expired record to be replaced")
+
+	deleted, err := db.DeleteExpiredIdempotencyRecords(now.Add(2 * time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+
+	existing, err = db.ReserveIdempotencyKey(&store.IdempotencyRecord{Key: "alpha", Actor: "testing", Created: now, Expires: now.Add(time.Minute)})
+	require.NoError(t, err)
+	require.NotNil(t, existing, "expected unexpired record to be retained")
+}
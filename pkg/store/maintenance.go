@@ -0,0 +1,38 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+const nsMaintenance = "maintenance"
+
+// The key of the maintenance mode of the server, which is a single record.
+var maintenanceKey = key(nsMaintenance, "server")
+
+// MaintenanceMode is stored so that maintenance mode set at runtime is not lost when the
+// server restarts. The time maintenance started is preserved while the mode is updated.
+type MaintenanceMode struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	ETA     *time.Time `json:"eta,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+// RetrieveMaintenanceMode returns the stored maintenance mode; if maintenance mode has
+// never been set, maintenance mode is disabled.
+func (s *Store) RetrieveMaintenanceMode() (mode *MaintenanceMode, err error) {
+	mode = &MaintenanceMode{}
+	if err = s.get(maintenanceKey, mode); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return &MaintenanceMode{}, nil
+		}
+		return nil, err
+	}
+	return mode, nil
+}
+
+// SaveMaintenanceMode stores the maintenance mode, replacing the previous mode.
+func (s *Store) SaveMaintenanceMode(mode *MaintenanceMode) error {
+	return s.put(maintenanceKey, mode)
+}
@@ -0,0 +1,43 @@
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	dsn := "leveldb:///" + filepath.Join(t.TempDir(), "db")
+	db, err := store.Open(dsn)
+	require.NoError(t, err)
+
+	// Maintenance mode is disabled until it is set
+	mode, err := db.RetrieveMaintenanceMode()
+	require.NoError(t, err)
+	require.False(t, mode.Enabled)
+
+	since := time.Now().UTC().Truncate(time.Second)
+	eta := since.Add(time.Hour)
+	require.NoError(t, db.SaveMaintenanceMode(&store.MaintenanceMode{Enabled: true, Message: "upgrading", ETA: &eta, Since: &since}))
+
+	// The maintenance mode is preserved when the database is reopened
+	require.NoError(t, db.Close())
+	db, err = store.Open(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	mode, err = db.RetrieveMaintenanceMode()
+	require.NoError(t, err)
+	require.True(t, mode.Enabled)
+	require.Equal(t, "upgrading", mode.Message)
+	require.True(t, eta.Equal(*mode.ETA))
+	require.True(t, since.Equal(*mode.Since))
+
+	require.NoError(t, db.SaveMaintenanceMode(&store.MaintenanceMode{}))
+	mode, err = db.RetrieveMaintenanceMode()
+	require.NoError(t, err)
+	require.Equal(t, &store.MaintenanceMode{}, mode)
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+)
+
+const (
+	nsNotifications    = "notifications"
+	nsNotificationRefs = "notification_refs"
+)
+
+// Processing statuses of notifications received from Adyen. Notifications that could not
+// be processed are dead-lettered until they are processed by a retry or a replay.
+const (
+	NotificationReceived  = "received"
+	NotificationProcessed = "processed"
+	NotificationFailed    = "failed"
+)
+
+// Notification is a notification received from Adyen along with the outcome of
+// processing it so that notifications can be replayed, e.g. after a processing bug is
+// fixed. The item is the notification request item exactly as it was received.
+type Notification struct {
+	ID                ulid.ULID       `json:"id"`
+	EventCode         string          `json:"event_code"`
+	PSPReference      string          `json:"psp_reference"`
+	OriginalReference string          `json:"original_reference,omitempty"`
+	MerchantReference string          `json:"merchant_reference,omitempty"`
+	Success           bool            `json:"success"`
+	Live              bool            `json:"live"`
+	Item              json.RawMessage `json:"item"`
+	Status            string          `json:"status"`
+	Error             string          `json:"error,omitempty"`
+	Attempts          int             `json:"attempts"`
+	Replays           int             `json:"replays,omitempty"`
+	EventIDs          []ulid.ULID     `json:"event_ids,omitempty"`
+	Received          time.Time       `json:"received"`
+	Processed         time.Time       `json:"processed,omitempty"`
+	Modified          time.Time       `json:"modified"`
+}
+
+// DeadLettered returns true if the notification could not be processed.
+func (n *Notification) DeadLettered() bool {
+	return n.Status == NotificationFailed
+}
+
+// RecordNotification saves a notification that was received from Adyen. Adyen retries
+// notifications that are not accepted and identifies a notification by its PSP reference,
+// event code and success, so a retry updates the stored notification instead of
+// creating a new one. The notification is updated with the stored ID and attempts. A
+// retry of a notification that has already been processed only counts the attempt; the
+// notification is updated with the stored notification so that the caller can see that
+// it was processed and acknowledge it without processing it again.
+func (s *Store) RecordNotification(n *Notification) (err error) {
+	if n.PSPReference == "" || n.EventCode == "" {
+		return ErrInvalidReference
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	ref := notificationRef(n)
+	existing := &Notification{}
+
+	var id string
+	if err = s.get(ref, &id); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if err == nil {
+		var existingID ulid.ULID
+		if existingID, err = ulid.Parse(id); err != nil {
+			return err
+		}
+
+		if err = s.get(key(nsNotifications, existingID.String()), existing); err != nil {
+			return err
+		}
+
+		if existing.Status == NotificationProcessed {
+			*n = *existing
+			n.Attempts++
+			n.Modified = time.Now()
+			return s.put(key(nsNotifications, n.ID.String()), n)
+		}
+
+		n.ID = existing.ID
+		n.Attempts = existing.Attempts + 1
+		n.Replays = existing.Replays
+		n.EventIDs = existing.EventIDs
+		n.Received = existing.Received
+	} else {
+		n.ID = ulids.New()
+		n.Attempts = 1
+		n.Received = time.Now()
+	}
+
+	n.Status = NotificationReceived
+	n.Error = ""
+	n.Modified = time.Now()
+
+	if err = s.put(key(nsNotifications, n.ID.String()), n); err != nil {
+		return err
+	}
+	return s.put(ref, n.ID.String())
+}
+
+// RetrieveNotification returns the stored notification with the specified ID.
+func (s *Store) RetrieveNotification(id ulid.ULID) (n *Notification, err error) {
+	n = &Notification{}
+	if err = s.get(key(nsNotifications, id.String()), n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// UpdateNotification saves the processing status of a stored notification.
+func (s *Store) UpdateNotification(n *Notification) error {
+	if ulids.IsZero(n.ID) {
+		return ErrInvalidReference
+	}
+
+	n.Modified = time.Now()
+	return s.put(key(nsNotifications, n.ID.String()), n)
+}
+
+// EachNotification iterates over the stored notifications in the order that they were
+// first received.
+func (s *Store) EachNotification(fn func(*Notification) error) error {
+	return s.each(prefix(nsNotifications), func(value []byte) error {
+		n := &Notification{}
+		if err := json.Unmarshal(value, n); err != nil {
+			return err
+		}
+		return fn(n)
+	})
+}
+
+func notificationRef(n *Notification) []byte {
+	return key(nsNotificationRefs, n.PSPReference, n.EventCode, strconv.FormatBool(n.Success))
+}
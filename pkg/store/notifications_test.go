@@ -0,0 +1,82 @@
+package store_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifications(t *testing.T) {
+	db := openStore(t)
+
+	// PSP reference and event code are required
+	err := db.RecordNotification(&store.Notification{EventCode: "AUTHORISATION"})
+	require.ErrorIs(t, err, store.ErrInvalidReference)
+
+	first := &store.Notification{EventCode: "AUTHORISATION", PSPReference: "7914073381342284", Success: true, Item: json.RawMessage(`{}`)}
+	require.NoError(t, db.RecordNotification(first))
+	require.False(t, ulids.IsZero(first.ID))
+	require.Equal(t, 1, first.Attempts)
+	require.Equal(t, store.NotificationReceived, first.Status)
+
+	first.Status = store.NotificationFailed
+	first.Error = "could not publish event"
+	require.NoError(t, db.UpdateNotification(first))
+
+	stored, err := db.RetrieveNotification(first.ID)
+	require.NoError(t, err)
+	require.True(t, stored.DeadLettered())
+
+	// A retry of the notification updates the stored notification
+	retry := &store.Notification{EventCode: "AUTHORISATION", PSPReference: "7914073381342284", Success: true, Item: json.RawMessage(`{}`)}
+	require.NoError(t, db.RecordNotification(retry))
+	require.Equal(t, first.ID, retry.ID)
+	require.Equal(t, 2, retry.Attempts)
+	require.Equal(t, first.Received.UnixNano(), retry.Received.UnixNano())
+	require.Equal(t, store.NotificationReceived, retry.Status)
+	require.Empty(t, retry.Error)
+
+	// A retry of a processed notification does not reset its status or item
+	retry.Status = store.NotificationProcessed
+	retry.Processed = time.Now()
+	require.NoError(t, db.UpdateNotification(retry))
+
+	redelivery := &store.Notification{EventCode: "AUTHORISATION", PSPReference: "7914073381342284", Success: true, Item: json.RawMessage(`{"reason": "redelivered"}`)}
+	require.NoError(t, db.RecordNotification(redelivery))
+	require.Equal(t, first.ID, redelivery.ID)
+	require.Equal(t, 3, redelivery.Attempts)
+	require.Equal(t, store.NotificationProcessed, redelivery.Status)
+	require.Equal(t, json.RawMessage(`{}`), redelivery.Item)
+	require.Equal(t, retry.Processed.UnixNano(), redelivery.Processed.UnixNano())
+
+	stored, err = db.RetrieveNotification(first.ID)
+	require.NoError(t, err)
+	require.Equal(t, store.NotificationProcessed, stored.Status)
+	require.Equal(t, 3, stored.Attempts)
+
+	// Notifications with a different event code or success are different notifications
+	capture := &store.Notification{EventCode: "CAPTURE", PSPReference: "7914073381342284", Success: true, Item: json.RawMessage(`{}`)}
+	require.NoError(t, db.RecordNotification(capture))
+	require.NotEqual(t, first.ID, capture.ID)
+
+	refused := &store.Notification{EventCode: "AUTHORISATION", PSPReference: "7914073381342284", Success: false, Item: json.RawMessage(`{}`)}
+	require.NoError(t, db.RecordNotification(refused))
+	require.NotEqual(t, first.ID, refused.ID)
+
+	// Notifications are iterated over in the order they were first received
+	var ids []string
+	require.NoError(t, db.EachNotification(func(n *store.Notification) error {
+		ids = append(ids, n.ID.String())
+		return nil
+	}))
+	require.Equal(t, []string{first.ID.String(), capture.ID.String(), refused.ID.String()}, ids)
+
+	_, err = db.RetrieveNotification(ulids.New())
+	require.ErrorIs(t, err, store.ErrNotFound)
+
+	require.ErrorIs(t, db.UpdateNotification(&store.Notification{}), store.ErrInvalidReference)
+}
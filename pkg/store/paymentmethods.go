@@ -0,0 +1,179 @@
+package store
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const nsPaymentMethods = "paymentmethods"
+
+// PaymentMethod is a stored payment method (a recurring token) that Adyen has created
+// for a customer. The ID is Adyen's storedPaymentMethodId (also referred to as the
+// recurringDetailReference) and the CustomerID is the Adyen shopperReference. The card
+// details are never stored, only the summary information returned by Adyen.
+type PaymentMethod struct {
+	ID         string    `json:"id"`
+	CustomerID string    `json:"customer_id"`
+	Type       string    `json:"type,omitempty"`
+	Summary    string    `json:"summary,omitempty"`
+	Expiry     string    `json:"expiry,omitempty"`
+	Default    bool      `json:"default"`
+	Disabled   bool      `json:"disabled"`
+	Created    time.Time `json:"created"`
+	Modified   time.Time `json:"modified"`
+}
+
+// ListPaymentMethods returns all of the stored payment methods for the customer,
+// including disabled payment methods.
+func (s *Store) ListPaymentMethods(customerID string) (out []*PaymentMethod, err error) {
+	if err = validReference(customerID); err != nil {
+		return nil, err
+	}
+
+	out = make([]*PaymentMethod, 0)
+	err = s.each(prefix(nsPaymentMethods, customerID), func(value []byte) error {
+		pm := &PaymentMethod{}
+		if err := json.Unmarshal(value, pm); err != nil {
+			return err
+		}
+		out = append(out, pm)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RetrievePaymentMethod returns the stored payment method for the customer by ID.
+func (s *Store) RetrievePaymentMethod(customerID, id string) (pm *PaymentMethod, err error) {
+	if err = validReference(customerID, id); err != nil {
+		return nil, err
+	}
+
+	pm = &PaymentMethod{}
+	if err = s.get(key(nsPaymentMethods, customerID, id), pm); err != nil {
+		return nil, err
+	}
+	return pm, nil
+}
+
+// SavePaymentMethod creates or updates the stored payment method. If the payment method
+// already exists its created timestamp, default and disabled status are preserved. The
+// default flag is managed by the store: a new payment method only becomes the default if
+// the customer has no other active default; use SetDefaultPaymentMethod to change it.
+func (s *Store) SavePaymentMethod(pm *PaymentMethod) (err error) {
+	if err = validReference(pm.CustomerID, pm.ID); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var methods []*PaymentMethod
+	if methods, err = s.ListPaymentMethods(pm.CustomerID); err != nil {
+		return err
+	}
+
+	pm.Modified = time.Now()
+	pm.Created = pm.Modified
+	pm.Default = false
+	hasDefault := false
+
+	for _, existing := range methods {
+		if existing.ID == pm.ID {
+			pm.Created = existing.Created
+			pm.Default = existing.Default
+			pm.Disabled = pm.Disabled || existing.Disabled
+			continue
+		}
+
+		if existing.Default && !existing.Disabled {
+			hasDefault = true
+		}
+	}
+
+	switch {
+	case pm.Disabled:
+		pm.Default = false
+	case !hasDefault:
+		pm.Default = true
+	}
+
+	return s.put(key(nsPaymentMethods, pm.CustomerID, pm.ID), pm)
+}
+
+// SetDefaultPaymentMethod makes the specified payment method the default for the
+// customer and clears the default flag from all of the customer's other methods.
+func (s *Store) SetDefaultPaymentMethod(customerID, id string) (pm *PaymentMethod, err error) {
+	if err = validReference(customerID, id); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var methods []*PaymentMethod
+	if methods, err = s.ListPaymentMethods(customerID); err != nil {
+		return nil, err
+	}
+
+	for _, method := range methods {
+		if method.ID == id {
+			pm = method
+			break
+		}
+	}
+
+	if pm == nil || pm.Disabled {
+		return nil, ErrNotFound
+	}
+
+	now := time.Now()
+	for _, method := range methods {
+		isDefault := method.ID == id
+		if method.Default == isDefault {
+			continue
+		}
+
+		method.Default = isDefault
+		method.Modified = now
+		if err = s.put(key(nsPaymentMethods, customerID, method.ID), method); err != nil {
+			return nil, err
+		}
+	}
+	return pm, nil
+}
+
+// DisablePaymentMethod marks the payment method as disabled so that it can no longer be
+// used or set as the default. The record is kept for historical purposes.
+func (s *Store) DisablePaymentMethod(customerID, id string) (pm *PaymentMethod, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if pm, err = s.RetrievePaymentMethod(customerID, id); err != nil {
+		return nil, err
+	}
+
+	pm.Disabled = true
+	pm.Default = false
+	pm.Modified = time.Now()
+
+	if err = s.put(key(nsPaymentMethods, customerID, id), pm); err != nil {
+		return nil, err
+	}
+	return pm, nil
+}
+
+// References are used to construct keys so they must be non-empty and cannot contain
+// the key separator.
+func validReference(refs ...string) error {
+	for _, ref := range refs {
+		if ref == "" || strings.Contains(ref, sep) {
+			return ErrInvalidReference
+		}
+	}
+	return nil
+}
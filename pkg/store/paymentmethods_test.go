@@ -0,0 +1,76 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentMethods(t *testing.T) {
+	db := openStore(t)
+
+	// The first payment method saved becomes the default
+	alpha := &store.PaymentMethod{ID: "8415718415172200", CustomerID: "cus_alpha", Type: "visa", Summary: "1111"}
+	require.NoError(t, db.SavePaymentMethod(alpha))
+	require.True(t, alpha.Default)
+	require.False(t, alpha.Created.IsZero())
+
+	// Subsequent payment methods are not the default
+	bravo := &store.PaymentMethod{ID: "8415718415172201", CustomerID: "cus_alpha", Type: "mc", Summary: "4444"}
+	require.NoError(t, db.SavePaymentMethod(bravo))
+	require.False(t, bravo.Default)
+
+	// Another customer's payment methods are separate
+	other := &store.PaymentMethod{ID: "8415718415172202", CustomerID: "cus_bravo", Type: "visa"}
+	require.NoError(t, db.SavePaymentMethod(other))
+	require.True(t, other.Default)
+
+	methods, err := db.ListPaymentMethods("cus_alpha")
+	require.NoError(t, err)
+	require.Len(t, methods, 2)
+
+	// Saving an existing payment method preserves the created timestamp and default
+	update := &store.PaymentMethod{ID: alpha.ID, CustomerID: alpha.CustomerID, Expiry: "03/2030"}
+	require.NoError(t, db.SavePaymentMethod(update))
+	require.True(t, update.Default)
+	require.True(t, update.Created.Equal(alpha.Created))
+
+	// Change the default payment method
+	pm, err := db.SetDefaultPaymentMethod("cus_alpha", bravo.ID)
+	require.NoError(t, err)
+	require.True(t, pm.Default)
+
+	pm, err = db.RetrievePaymentMethod("cus_alpha", alpha.ID)
+	require.NoError(t, err)
+	require.False(t, pm.Default)
+	require.Equal(t, "03/2030", pm.Expiry)
+
+	// Disabling a payment method clears its default and prevents it being the default
+	pm, err = db.DisablePaymentMethod("cus_alpha", bravo.ID)
+	require.NoError(t, err)
+	require.True(t, pm.Disabled)
+	require.False(t, pm.Default)
+
+	_, err = db.SetDefaultPaymentMethod("cus_alpha", bravo.ID)
+	require.ErrorIs(t, err, store.ErrNotFound)
+
+	// Saving a disabled payment method again does not re-enable it
+	require.NoError(t, db.SavePaymentMethod(&store.PaymentMethod{ID: bravo.ID, CustomerID: "cus_alpha"}))
+	pm, err = db.RetrievePaymentMethod("cus_alpha", bravo.ID)
+	require.NoError(t, err)
+	require.True(t, pm.Disabled)
+
+	// Not found and invalid references
+	_, err = db.RetrievePaymentMethod("cus_alpha", "unknown")
+	require.ErrorIs(t, err, store.ErrNotFound)
+
+	_, err = db.DisablePaymentMethod("cus_alpha", "unknown")
+	require.ErrorIs(t, err, store.ErrNotFound)
+
+	_, err = db.ListPaymentMethods("")
+	require.ErrorIs(t, err, store.ErrInvalidReference)
+
+	err = db.SavePaymentMethod(&store.PaymentMethod{ID: "foo::bar", CustomerID: "cus_alpha"})
+	require.ErrorIs(t, err, store.ErrInvalidReference)
+}
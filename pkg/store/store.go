@@ -0,0 +1,149 @@
+/*
+Package store provides durable storage for the billing records that Exchequer manages
+locally (Adyen remains the source of truth for payments). Records are JSON encoded and
+stored in a leveldb database, namespaced by a key prefix for each record type.
+*/
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Database URL schemes supported by Open.
+const (
+	SchemeLevelDB = "leveldb"
+	SchemeMemory  = "memory"
+)
+
+var (
+	ErrNotFound         = errors.New("record not found")
+	ErrInvalidDSN       = errors.New("could not parse database url")
+	ErrUnknownScheme    = errors.New("unhandled database scheme")
+	ErrInvalidReference = errors.New("missing or invalid record reference")
+)
+
+// Store wraps a leveldb database and implements the data access methods for records.
+// The mutex serializes read-modify-write operations that span multiple keys.
+type Store struct {
+	sync.Mutex
+	db *leveldb.DB
+}
+
+// Open a store from a database URL. Use leveldb:///path/to/db to open an on-disk
+// database (relative paths are specified as leveldb://path/to/db) or memory:// to open
+// an in-memory database that is useful for testing and local development.
+func Open(databaseURL string) (s *Store, err error) {
+	var scheme, path string
+	if scheme, path, err = parseDSN(databaseURL); err != nil {
+		return nil, err
+	}
+
+	s = &Store{}
+	switch scheme {
+	case SchemeLevelDB:
+		if s.db, err = leveldb.OpenFile(path, &opt.Options{}); err != nil {
+			return nil, fmt.Errorf("could not open leveldb at %q: %w", path, err)
+		}
+	case SchemeMemory:
+		if s.db, err = leveldb.Open(storage.NewMemStorage(), &opt.Options{}); err != nil {
+			return nil, fmt.Errorf("could not open in-memory leveldb: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownScheme, scheme)
+	}
+
+	return s, nil
+}
+
+// Close the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks that the database is open and can be read from.
+func (s *Store) Ping() error {
+	if _, err := s.db.Get([]byte(pingKey), nil); err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// A key that is never written, used to check that reads succeed.
+const pingKey = "health" + sep + "ping"
+
+func parseDSN(dsn string) (scheme, path string, err error) {
+	var ok bool
+	if scheme, path, ok = strings.Cut(dsn, "://"); !ok || scheme == "" {
+		return "", "", ErrInvalidDSN
+	}
+
+	scheme = strings.ToLower(scheme)
+	if scheme == SchemeLevelDB && path == "" {
+		return "", "", ErrInvalidDSN
+	}
+	return scheme, path, nil
+}
+
+//===========================================================================
+// Key/Value Helpers
+//===========================================================================
+
+// Keys are constructed from a namespace prefix and one or more parts separated by ::
+const sep = "::"
+
+func key(namespace string, parts ...string) []byte {
+	return []byte(namespace + sep + strings.Join(parts, sep))
+}
+
+func prefix(namespace string, parts ...string) *util.Range {
+	pfx := namespace + sep
+	for _, part := range parts {
+		pfx += part + sep
+	}
+	return util.BytesPrefix([]byte(pfx))
+}
+
+func (s *Store) get(key []byte, obj any) (err error) {
+	var data []byte
+	if data, err = s.db.Get(key, nil); err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return json.Unmarshal(data, obj)
+}
+
+func (s *Store) put(key []byte, obj any) (err error) {
+	var data []byte
+	if data, err = json.Marshal(obj); err != nil {
+		return err
+	}
+	return s.db.Put(key, data, &opt.WriteOptions{Sync: true})
+}
+
+// Iterates over all of the values in the specified range in key order.
+func (s *Store) each(rng *util.Range, fn func(value []byte) error) (err error) {
+	iter := s.db.NewIterator(rng, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if err = fn(iter.Value()); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+func (s *Store) delete(key []byte) error {
+	return s.db.Delete(key, &opt.WriteOptions{Sync: true})
+}
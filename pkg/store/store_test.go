@@ -0,0 +1,52 @@
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rotationalio/exchequer/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		db, err := store.Open("memory://")
+		require.NoError(t, err, "could not open in-memory store")
+		require.NoError(t, db.Ping())
+		require.NoError(t, db.Close())
+		require.Error(t, db.Ping(), "expected ping to fail after the store is closed")
+	})
+
+	t.Run("LevelDB", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "db")
+		db, err := store.Open("leveldb://" + path)
+		require.NoError(t, err, "could not open leveldb store")
+		require.DirExists(t, path)
+		require.NoError(t, db.Close())
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		testCases := []struct {
+			dsn string
+			err error
+		}{
+			{"", store.ErrInvalidDSN},
+			{"/data/db", store.ErrInvalidDSN},
+			{"leveldb://", store.ErrInvalidDSN},
+			{"sqlite3:///data/db", store.ErrUnknownScheme},
+		}
+
+		for i, tc := range testCases {
+			_, err := store.Open(tc.dsn)
+			require.ErrorIs(t, err, tc.err, "test case %d failed", i)
+		}
+	})
+}
+
+// Creates a new in-memory store for testing that is closed when the test completes.
+func openStore(t *testing.T) *store.Store {
+	db, err := store.Open("memory://")
+	require.NoError(t, err, "could not open in-memory store")
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/rotationalio/exchequer/pkg/ulids"
+)
+
+const (
+	nsWebhookEndpoints  = "webhooks"
+	nsWebhookDeliveries = "deliveries"
+)
+
+// Delivery statuses for outbound webhooks.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookEndpoint is an internal service that has registered to receive billing events.
+// The secret is used to sign the payloads delivered to the endpoint.
+type WebhookEndpoint struct {
+	ID          ulid.ULID `json:"id"`
+	URL         string    `json:"url"`
+	Description string    `json:"description,omitempty"`
+	EventTypes  []string  `json:"event_types"`
+	Secret      string    `json:"secret"`
+	Active      bool      `json:"active"`
+	Created     time.Time `json:"created"`
+	Modified    time.Time `json:"modified"`
+}
+
+// WebhookDelivery tracks the delivery of a single event to a webhook endpoint, including
+// every attempt that was made, forming the delivery log for the endpoint.
+type WebhookDelivery struct {
+	ID          ulid.ULID          `json:"id"`
+	EndpointID  ulid.ULID          `json:"endpoint_id"`
+	EventID     ulid.ULID          `json:"event_id"`
+	EventType   string             `json:"event_type"`
+	Status      string             `json:"status"`
+	Attempts    []*DeliveryAttempt `json:"attempts"`
+	NextAttempt time.Time          `json:"next_attempt,omitempty"`
+	Created     time.Time          `json:"created"`
+	Modified    time.Time          `json:"modified"`
+}
+
+// DeliveryAttempt records the outcome of a single HTTP request to a webhook endpoint.
+type DeliveryAttempt struct {
+	Attempted  time.Time     `json:"attempted"`
+	Duration   time.Duration `json:"duration"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Replay     bool          `json:"replay,omitempty"`
+}
+
+//===========================================================================
+// Webhook Endpoints
+//===========================================================================
+
+// ListWebhookEndpoints returns all registered webhook endpoints ordered by creation.
+func (s *Store) ListWebhookEndpoints() (out []*WebhookEndpoint, err error) {
+	out = make([]*WebhookEndpoint, 0)
+	err = s.each(prefix(nsWebhookEndpoints), func(value []byte) error {
+		endpoint := &WebhookEndpoint{}
+		if err := json.Unmarshal(value, endpoint); err != nil {
+			return err
+		}
+		out = append(out, endpoint)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CreateWebhookEndpoint registers a new webhook endpoint, assigning it an ID.
+func (s *Store) CreateWebhookEndpoint(endpoint *WebhookEndpoint) error {
+	endpoint.ID = ulids.New()
+	endpoint.Created = time.Now()
+	endpoint.Modified = endpoint.Created
+	return s.put(key(nsWebhookEndpoints, endpoint.ID.String()), endpoint)
+}
+
+// RetrieveWebhookEndpoint returns the webhook endpoint with the specified ID.
+func (s *Store) RetrieveWebhookEndpoint(id ulid.ULID) (endpoint *WebhookEndpoint, err error) {
+	endpoint = &WebhookEndpoint{}
+	if err = s.get(key(nsWebhookEndpoints, id.String()), endpoint); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+// UpdateWebhookEndpoint saves changes to an existing webhook endpoint.
+func (s *Store) UpdateWebhookEndpoint(endpoint *WebhookEndpoint) (err error) {
+	var existing *WebhookEndpoint
+	if existing, err = s.RetrieveWebhookEndpoint(endpoint.ID); err != nil {
+		return err
+	}
+
+	endpoint.Created = existing.Created
+	endpoint.Modified = time.Now()
+	return s.put(key(nsWebhookEndpoints, endpoint.ID.String()), endpoint)
+}
+
+// DeleteWebhookEndpoint removes the webhook endpoint; its delivery log is retained.
+func (s *Store) DeleteWebhookEndpoint(id ulid.ULID) (err error) {
+	k := key(nsWebhookEndpoints, id.String())
+
+	var exists bool
+	if exists, err = s.db.Has(k, nil); err != nil {
+		return err
+	}
+
+	if !exists {
+		return ErrNotFound
+	}
+	return s.delete(k)
+}
+
+//===========================================================================
+// Webhook Deliveries
+//===========================================================================
+
+// ListWebhookDeliveries returns the delivery log for the endpoint ordered by creation.
+func (s *Store) ListWebhookDeliveries(endpointID ulid.ULID) (out []*WebhookDelivery, err error) {
+	out = make([]*WebhookDelivery, 0)
+	err = s.EachWebhookDelivery(endpointID, func(delivery *WebhookDelivery) error {
+		out = append(out, delivery)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// EachWebhookDelivery iterates over the deliveries for the endpoint ordered by creation.
+// If the endpoint ID is the zero-valued ULID, then deliveries for all endpoints are
+// iterated over, ordered by endpoint.
+func (s *Store) EachWebhookDelivery(endpointID ulid.ULID, fn func(*WebhookDelivery) error) error {
+	rng := prefix(nsWebhookDeliveries)
+	if !ulids.IsZero(endpointID) {
+		rng = prefix(nsWebhookDeliveries, endpointID.String())
+	}
+
+	return s.each(rng, func(value []byte) error {
+		delivery := &WebhookDelivery{}
+		if err := json.Unmarshal(value, delivery); err != nil {
+			return err
+		}
+		return fn(delivery)
+	})
+}
+
+// CreateWebhookDelivery adds a new delivery to the endpoint's delivery log.
+func (s *Store) CreateWebhookDelivery(delivery *WebhookDelivery) error {
+	if ulids.IsZero(delivery.EndpointID) {
+		return ErrInvalidReference
+	}
+
+	delivery.ID = ulids.New()
+	delivery.Created = time.Now()
+	delivery.Modified = delivery.Created
+	return s.put(key(nsWebhookDeliveries, delivery.EndpointID.String(), delivery.ID.String()), delivery)
+}
+
+// RetrieveWebhookDelivery returns the delivery for the endpoint by ID.
+func (s *Store) RetrieveWebhookDelivery(endpointID, id ulid.ULID) (delivery *WebhookDelivery, err error) {
+	delivery = &WebhookDelivery{}
+	if err = s.get(key(nsWebhookDeliveries, endpointID.String(), id.String()), delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// UpdateWebhookDelivery saves the delivery's status and attempts.
+func (s *Store) UpdateWebhookDelivery(delivery *WebhookDelivery) error {
+	if ulids.IsZero(delivery.EndpointID) || ulids.IsZero(delivery.ID) {
+		return ErrInvalidReference
+	}
+
+	delivery.Modified = time.Now()
+	return s.put(key(nsWebhookDeliveries, delivery.EndpointID.String(), delivery.ID.String()), delivery)
+}
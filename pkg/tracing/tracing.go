@@ -0,0 +1,137 @@
+/*
+Package tracing configures the global OpenTelemetry tracer provider that records spans
+for API requests, Adyen webhook notifications, and calls to the Adyen API. Spans are
+exported to an OTLP collector over http or, for tests, to an in-memory exporter. The W3C
+trace context propagator is always installed so that inbound trace context is
+propagated to outbound requests even if tracing is disabled.
+*/
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/rotationalio/exchequer/pkg"
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/logger"
+)
+
+// The instrumentation name of the tracers used by exchequer packages.
+const TracerName = "github.com/rotationalio/exchequer"
+
+var (
+	mu       sync.Mutex
+	provider *sdktrace.TracerProvider
+	memory   *tracetest.InMemoryExporter
+)
+
+// Setup configures the global tracer provider from the configuration, replacing (and
+// shutting down) any tracer provider previously configured by Setup. If tracing is not
+// enabled a no-op tracer provider is used.
+// NOTE: tracer providers are captured when instrumented handlers and clients are
+// created, so Setup must be called before they are.
+func Setup(conf config.TracingConfig) (err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err = shutdown(context.Background()); err != nil {
+		return err
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	logger.SetGCPProject(conf.GCPProject)
+
+	if !conf.Enabled {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		return nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	switch conf.Exporter {
+	case "otlp":
+		opts := make([]otlptracehttp.Option, 0, 2)
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		if exporter, err = otlptracehttp.New(context.Background(), opts...); err != nil {
+			return fmt.Errorf("could not create otlp span exporter: %w", err)
+		}
+	case "memory":
+		memory = tracetest.NewInMemoryExporter()
+		exporter = memory
+	default:
+		return fmt.Errorf("unknown span exporter %q", conf.Exporter)
+	}
+
+	var res *resource.Resource
+	if res, err = resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(conf.ServiceName),
+		semconv.ServiceVersion(pkg.Version()),
+	)); err != nil {
+		return fmt.Errorf("could not create tracing resource: %w", err)
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	}
+
+	// Spans are exported synchronously to the in-memory exporter so tests can inspect
+	// them as soon as they are ended.
+	if memory != nil {
+		opts = append(opts, sdktrace.WithSyncer(exporter))
+	} else {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	provider = sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	return nil
+}
+
+// Shutdown flushes any spans that have not been exported and stops the tracer provider.
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return shutdown(ctx)
+}
+
+func shutdown(ctx context.Context) (err error) {
+	if provider != nil {
+		err = provider.Shutdown(ctx)
+		provider = nil
+	}
+	memory = nil
+	return err
+}
+
+// Tracer returns the tracer used to create spans in exchequer packages from the global
+// tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName, trace.WithInstrumentationVersion(pkg.Version()))
+}
+
+// Memory returns the in-memory exporter if it is configured so that tests can inspect
+// the spans that have been recorded; otherwise it returns nil.
+func Memory() *tracetest.InMemoryExporter {
+	mu.Lock()
+	defer mu.Unlock()
+	return memory
+}
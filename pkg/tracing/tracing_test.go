@@ -0,0 +1,56 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rotationalio/exchequer/pkg/config"
+	"github.com/rotationalio/exchequer/pkg/tracing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetup(t *testing.T) {
+	t.Cleanup(func() { tracing.Setup(config.TracingConfig{}) })
+
+	// When tracing is disabled spans are not recorded
+	require.NoError(t, tracing.Setup(config.TracingConfig{Enabled: false}))
+	require.Nil(t, tracing.Memory())
+
+	_, span := tracing.Tracer().Start(context.Background(), "disabled")
+	require.False(t, span.IsRecording())
+	span.End()
+
+	// Spans are recorded by the in-memory exporter
+	require.NoError(t, tracing.Setup(config.TracingConfig{Enabled: true, Exporter: "memory", SampleRatio: 1, ServiceName: "testing"}))
+	exporter := tracing.Memory()
+	require.NotNil(t, exporter)
+
+	ctx, parent := tracing.Tracer().Start(context.Background(), "parent")
+	_, child := tracing.Tracer().Start(ctx, "child")
+	child.End()
+	parent.End()
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	require.Equal(t, "child", spans[0].Name)
+	require.Equal(t, "parent", spans[1].Name)
+	require.Equal(t, spans[1].SpanContext.SpanID(), spans[0].Parent.SpanID())
+
+	// Setting up tracing again replaces the previous exporter
+	require.NoError(t, tracing.Setup(config.TracingConfig{Enabled: true, Exporter: "memory", SampleRatio: 1}))
+	require.NotSame(t, exporter, tracing.Memory())
+	require.Empty(t, tracing.Memory().GetSpans())
+
+	// Unsampled traces are not recorded
+	require.NoError(t, tracing.Setup(config.TracingConfig{Enabled: true, Exporter: "memory", SampleRatio: 0}))
+	_, span = tracing.Tracer().Start(context.Background(), "unsampled")
+	require.False(t, span.IsRecording())
+	span.End()
+	require.Empty(t, tracing.Memory().GetSpans())
+
+	// Unknown exporters cannot be configured
+	require.Error(t, tracing.Setup(config.TracingConfig{Enabled: true, Exporter: "jaeger"}))
+
+	require.NoError(t, tracing.Shutdown(context.Background()))
+	require.Nil(t, tracing.Memory())
+}